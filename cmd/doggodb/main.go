@@ -0,0 +1,182 @@
+// Command doggodb runs a doggodb database server.
+//
+//	doggodb serve --pg :5432 --http :8080
+//	doggodb dump --http localhost:8080 > backup.sql
+//	doggodb serve --restore backup.sql
+//	doggodb serve --restore backup.sql --read-only
+//	doggodb serve --archive wal/
+//	doggodb serve --recover backup.sql --wal wal/ --until-lsn 1200 --archive wal2/
+//
+// The database lives in memory for as long as the server runs; a dump
+// keeps it as a SQL script.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/httpapi"
+	"github.com/H3199/doggodb/internal/pgwire"
+)
+
+const usage = `usage: doggodb serve [flags]
+       doggodb dump [--http addr] [--out file]
+
+serve flags:
+  --pg addr         serve the PostgreSQL wire protocol on addr
+  --http addr       serve the HTTP/JSON API on addr
+  --timeout dur     limit HTTP queries to dur, 0 for no limit (default 30s)
+  --file-dir dir    let clients COPY and BACKUP files in dir on the server;
+                    without it they may only COPY FROM STDIN and TO STDOUT
+  --restore file    load a dump or backup before serving
+  --read-only       refuse changes to the restored database, for checking
+                    a backup
+  --archive dir     archive the WAL to dir, for recovery from a backup
+  --recover file    load a backup taken while archiving, then replay the
+                    WAL archived in --wal dir
+  --until-lsn n     stop recovery after WAL position n
+  --until-time t    stop recovery at the last change committed by time t,
+                    in RFC 3339 format
+
+Without --pg or --http the PostgreSQL protocol is served on ":5432".
+
+dump writes the database of a server as a SQL script, fetched from its
+HTTP API at addr (default "localhost:8080"), to file or standard output.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2:])
+	case "dump":
+		dump(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	pgAddr := flags.String("pg", "", "")
+	httpAddr := flags.String("http", "", "")
+	timeout := flags.Duration("timeout", httpapi.DefaultTimeout, "")
+	fileDir := flags.String("file-dir", "", "")
+	restore := flags.String("restore", "", "")
+	readOnly := flags.Bool("read-only", false, "")
+	archive := flags.String("archive", "", "")
+	recoverFrom := flags.String("recover", "", "")
+	wal := flags.String("wal", "", "")
+	untilLSN := flags.Int64("until-lsn", 0, "")
+	untilTime := flags.String("until-time", "", "")
+	flags.Parse(args)
+	if *pgAddr == "" && *httpAddr == "" {
+		*pgAddr = ":5432"
+	}
+	if *readOnly && *restore == "" {
+		log.Fatal("--read-only needs --restore")
+	}
+	if *recoverFrom != "" && (*wal == "" || *restore != "") {
+		log.Fatal("--recover needs --wal and cannot be used with --restore")
+	}
+	if *recoverFrom == "" && (*wal != "" || *untilLSN != 0 || *untilTime != "") {
+		log.Fatal("--wal, --until-lsn and --until-time need --recover")
+	}
+	target := engine.RecoveryTarget{LSN: *untilLSN}
+	if *untilTime != "" {
+		var err error
+		if target.Time, err = time.Parse(time.RFC3339, *untilTime); err != nil {
+			log.Fatalf("invalid --until-time: %v", err)
+		}
+	}
+
+	db := engine.NewDatabase()
+	if *recoverFrom != "" {
+		var err error
+		if db, err = engine.Recover(context.Background(), *recoverFrom, *wal, target); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("recovered %s to WAL position %d", *recoverFrom, db.LSN())
+	} else if *readOnly {
+		var err error
+		if db, err = engine.OpenBackup(context.Background(), *restore); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("opened %s read-only", *restore)
+	} else if *restore != "" {
+		f, err := os.Open(*restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = db.Restore(context.Background(), f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("restored %s", *restore)
+	}
+	if *archive != "" {
+		if err := db.EnableArchive(*archive); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("archiving the WAL to %s", *archive)
+	}
+
+	errs := make(chan error, 2)
+	if *pgAddr != "" {
+		server := pgwire.NewServer(db)
+		server.SetFileDir(*fileDir)
+		log.Printf("serving PostgreSQL clients on %s", *pgAddr)
+		go func() { errs <- server.ListenAndServe(*pgAddr) }()
+	}
+	if *httpAddr != "" {
+		handler := httpapi.NewHandler(db, *timeout)
+		handler.SetFileDir(*fileDir)
+		log.Printf("serving HTTP clients on %s", *httpAddr)
+		go func() { errs <- http.ListenAndServe(*httpAddr, handler) }()
+	}
+	log.Fatal(<-errs)
+}
+
+func dump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	httpAddr := flags.String("http", "localhost:8080", "")
+	out := flags.String("out", "", "")
+	flags.Parse(args)
+
+	resp, err := http.Get("http://" + *httpAddr + "/dump")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("dump failed: %s: %s", resp.Status, body)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package driver registers doggodb with database/sql under the name
+// "doggodb", for embedding the database in a Go program:
+//
+//	import _ "github.com/H3199/doggodb/driver"
+//
+//	db, err := sql.Open("doggodb", "inventory")
+//
+// The data source name names an in-memory database. Every sql.DB opened
+// with the same non-empty name in a process shares its tables; an empty
+// name gives each sql.DB a database of its own. A named database is
+// dropped when the last sql.DB open on it is closed, so opening the name
+// again starts empty.
+//
+// The database has a single writer. A transaction holds the database until
+// it ends, so statements on other connections, including those a sql.DB
+// runs outside the transaction, wait for it. A goroutine that queries the
+// sql.DB while its own transaction is open waits for itself; give such
+// statements a context with a deadline, or run them on the sql.Tx. Waits
+// end when the context is done.
+//
+// Arguments are Go integers, floats, strings, byte slices, bools and nil.
+// There is no time type: time.Time arguments are refused rather than
+// stored as text that would not scan back into a time.Time.
+package driver
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/H3199/doggodb/internal/data"
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+func init() {
+	sql.Register("doggodb", &Driver{})
+}
+
+// Driver is the database/sql driver of doggodb.
+type Driver struct{}
+
+var (
+	databasesMu sync.Mutex
+	databases   = make(map[string]*namedDatabase)
+)
+
+// namedDatabase is a database shared under a data source name, with the
+// number of connectors and connections using it.
+type namedDatabase struct {
+	db   *engine.Database
+	refs int
+}
+
+// acquireDatabase returns the database of a data source name, creating it
+// on first use. Each call must be paired with releaseDatabase.
+func acquireDatabase(name string) *engine.Database {
+	if name == "" {
+		return engine.NewDatabase()
+	}
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+	named, ok := databases[name]
+	if !ok {
+		named = &namedDatabase{db: engine.NewDatabase()}
+		databases[name] = named
+	}
+	named.refs++
+	return named.db
+}
+
+// releaseDatabase drops a named database once nothing uses it.
+func releaseDatabase(name string) {
+	if name == "" {
+		return
+	}
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+	if named, ok := databases[name]; ok {
+		if named.refs--; named.refs == 0 {
+			delete(databases, name)
+		}
+	}
+}
+
+// Open opens a connection to the named database. The connection holds on
+// to the database until it is closed.
+func (d *Driver) Open(name string) (sqldriver.Conn, error) {
+	return &conn{session: acquireDatabase(name).Session(), release: func() { releaseDatabase(name) }}, nil
+}
+
+// OpenConnector returns a connector whose connections all share one
+// database, even when the name is empty. database/sql closes the
+// connector when the sql.DB is closed.
+func (d *Driver) OpenConnector(name string) (sqldriver.Connector, error) {
+	return &connector{driver: d, name: name, db: acquireDatabase(name)}, nil
+}
+
+type connector struct {
+	driver *Driver
+	name   string
+	db     *engine.Database
+	once   sync.Once
+}
+
+func (c *connector) Connect(context.Context) (sqldriver.Conn, error) {
+	return &conn{session: c.db.Session()}, nil
+}
+
+func (c *connector) Driver() sqldriver.Driver {
+	return c.driver
+}
+
+// Close releases the database of the connector.
+func (c *connector) Close() error {
+	c.once.Do(func() { releaseDatabase(c.name) })
+	return nil
+}
+
+// conn is a connection to a database.
+type conn struct {
+	session *engine.Session
+	tx      *tx    // The open transaction, if any
+	release func() // Releases the database of a connection made by Open
+	closed  bool
+}
+
+func (c *conn) Prepare(sql string) (sqldriver.Stmt, error) {
+	return c.PrepareContext(context.Background(), sql)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, sql string) (sqldriver.Stmt, error) {
+	if c.closed {
+		return nil, sqldriver.ErrBadConn
+	}
+	prepared, err := c.session.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, prepared: prepared}, nil
+}
+
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.session.Close()
+	c.tx = nil
+	c.closed = true
+	if c.release != nil {
+		c.release()
+	}
+	return nil
+}
+
+func (c *conn) Begin() (sqldriver.Tx, error) {
+	return c.BeginTx(context.Background(), sqldriver.TxOptions{})
+}
+
+// BeginTx starts a transaction. Transactions are serializable: the
+// connection holds the database to itself until the transaction ends, and
+// statements on other connections wait until then. Beginning copies the
+// tables, so that rolling back can restore them as they were. BeginTx
+// waits for the transactions of other connections until ctx is done.
+func (c *conn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if c.closed {
+		return nil, sqldriver.ErrBadConn
+	}
+	if err := c.session.Begin(ctx, opts.ReadOnly); err != nil {
+		return nil, fmt.Errorf("doggodb: %w", err)
+	}
+	c.tx = &tx{conn: c}
+	return c.tx, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, sql string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	s, err := c.PrepareContext(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	return s.(*stmt).ExecContext(ctx, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, sql string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	s, err := c.PrepareContext(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	return s.(*stmt).QueryContext(ctx, args)
+}
+
+// run executes a statement with its arguments.
+func (c *conn) run(ctx context.Context, prepared *query.PreparedStatement, args []sqldriver.NamedValue) (*query.ResultSet, error) {
+	if c.closed {
+		return nil, sqldriver.ErrBadConn
+	}
+	values := make([]interface{}, len(args))
+	for _, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("doggodb: named parameter %s is not supported", arg.Name)
+		}
+		values[arg.Ordinal-1] = arg.Value
+	}
+	rs, err := c.session.Run(ctx, prepared, values...)
+	if err == engine.ErrReadOnly {
+		return nil, fmt.Errorf("doggodb: %v", err)
+	}
+	return rs, err
+}
+
+// tx is a transaction of a connection.
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	return t.end(false)
+}
+
+func (t *tx) Rollback() error {
+	return t.end(true)
+}
+
+func (t *tx) end(rollback bool) error {
+	if t.conn.tx != t {
+		return sql.ErrTxDone
+	}
+	t.conn.tx = nil
+	if rollback {
+		return t.conn.session.Rollback()
+	}
+	return t.conn.session.Commit()
+}
+
+// stmt is a prepared statement of a connection.
+type stmt struct {
+	conn     *conn
+	prepared *query.PreparedStatement
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput returns the number of placeholders, ? or $n, of the statement.
+func (s *stmt) NumInput() int {
+	return s.prepared.NumParams()
+}
+
+func (s *stmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	rs, err := s.conn.run(ctx, s.prepared, args)
+	if err != nil {
+		return nil, err
+	}
+	return result{rs}, nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	rs, err := s.conn.run(ctx, s.prepared, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{rs: rs}, nil
+}
+
+func namedValues(args []sqldriver.Value) []sqldriver.NamedValue {
+	named := make([]sqldriver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = sqldriver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// result reports the effect of a statement run with Exec.
+type result struct {
+	rs *query.ResultSet
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.rs.LastInsertID(), nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rs.RowsAffected(), nil
+}
+
+// rows reads a result set. Results are computed in full before the first
+// row is returned.
+type rows struct {
+	rs *query.ResultSet
+}
+
+func (r *rows) Columns() []string {
+	names := make([]string, len(r.rs.Columns()))
+	for i, col := range r.rs.Columns() {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// ColumnTypeDatabaseTypeName returns the type of a column, such as INT,
+// or "" if it is not known.
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if t := r.rs.Columns()[index].Type; t != data.TypeAny {
+		return string(t)
+	}
+	return ""
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []sqldriver.Value) error {
+	if !r.rs.Next() {
+		return io.EOF
+	}
+	for i, value := range r.rs.Values() {
+		dest[i] = value
+	}
+	return nil
+}
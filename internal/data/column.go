@@ -0,0 +1,115 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type is the declared type of a table column.
+type Type string
+
+const (
+	TypeAny   Type = "ANY" // Untyped column, values are stored as given.
+	TypeInt   Type = "INT"
+	TypeFloat Type = "FLOAT"
+	TypeText  Type = "TEXT"
+	TypeBool  Type = "BOOL"
+)
+
+// Column describes a single column in a table schema.
+type Column struct {
+	Name    string
+	Type    Type
+	NotNull bool
+}
+
+// ParseType maps a SQL type name (e.g. INTEGER, VARCHAR) to a column Type.
+func ParseType(name string) (Type, error) {
+	switch strings.ToUpper(name) {
+	case "INT", "INTEGER", "BIGINT", "SMALLINT":
+		return TypeInt, nil
+	case "FLOAT", "REAL", "DOUBLE", "NUMERIC", "DECIMAL":
+		return TypeFloat, nil
+	case "TEXT", "VARCHAR", "CHAR", "STRING":
+		return TypeText, nil
+	case "BOOL", "BOOLEAN":
+		return TypeBool, nil
+	case "ANY":
+		return TypeAny, nil
+	default:
+		return "", fmt.Errorf("unknown column type '%s'", name)
+	}
+}
+
+// ConvertValue converts a value to the given column type. NULL (nil) is
+// accepted for every type.
+func ConvertValue(value interface{}, t Type) (interface{}, error) {
+	if value == nil || t == TypeAny {
+		return value, nil
+	}
+
+	switch t {
+	case TypeInt:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case int:
+			return int64(v), nil
+		case float64:
+			if v != float64(int64(v)) {
+				return nil, fmt.Errorf("cannot convert %v to %s without losing precision", v, t)
+			}
+			return int64(v), nil
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert '%s' to %s", v, t)
+			}
+			return n, nil
+		}
+	case TypeFloat:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		case int:
+			return float64(v), nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert '%s' to %s", v, t)
+			}
+			return f, nil
+		}
+	case TypeText:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		default:
+			return fmt.Sprintf("%v", v), nil
+		}
+	case TypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case int:
+			return v != 0, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert '%s' to %s", v, t)
+			}
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %v (%T) to %s", value, value, t)
+}
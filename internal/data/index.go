@@ -0,0 +1,105 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Index is a hash index over one or more columns of a table. Unique
+// indexes back PRIMARY KEY and UNIQUE constraints.
+type Index struct {
+	Name    string
+	Columns []string
+	Unique  bool
+	Primary bool
+	entries map[string][]*Row
+}
+
+func newIndex(name string, columns []string, unique bool) *Index {
+	return &Index{
+		Name:    name,
+		Columns: columns,
+		Unique:  unique,
+		entries: make(map[string][]*Row),
+	}
+}
+
+// key builds the lookup key for a row. It returns false if any indexed
+// column is NULL, as NULLs never collide with each other.
+func (idx *Index) key(row *Row) (string, bool) {
+	values := make([]interface{}, len(idx.Columns))
+	for i, col := range idx.Columns {
+		values[i] = row.Columns[col]
+	}
+	return indexKey(values)
+}
+
+func indexKey(values []interface{}) (string, bool) {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		if value == nil {
+			return "", false
+		}
+		parts[i] = fmt.Sprintf("%v", value)
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+func (idx *Index) add(row *Row) {
+	if key, ok := idx.key(row); ok {
+		idx.entries[key] = append(idx.entries[key], row)
+	}
+}
+
+func (idx *Index) remove(row *Row) {
+	key, ok := idx.key(row)
+	if !ok {
+		return
+	}
+	bucket := idx.entries[key]
+	for i, r := range bucket {
+		if r == row {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(idx.entries, key)
+	} else {
+		idx.entries[key] = bucket
+	}
+}
+
+// Lookup returns the rows whose indexed columns equal the given values.
+func (idx *Index) Lookup(values ...interface{}) []*Row {
+	key, ok := indexKey(values)
+	if !ok {
+		return nil
+	}
+	return idx.entries[key]
+}
+
+// Covers reports whether the index is defined on exactly the given set of
+// columns, in any order.
+func (idx *Index) Covers(columns []string) bool {
+	if len(columns) != len(idx.Columns) {
+		return false
+	}
+	for _, col := range columns {
+		found := false
+		for _, indexed := range idx.Columns {
+			if col == indexed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *Index) violation() error {
+	return fmt.Errorf("duplicate key value violates unique constraint \"%s\"", idx.Name)
+}
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"context"
 	"fmt"
+	"sort"
 )
 
 // InMemoryStorage implements the Storage interface for in-memory tables.
@@ -16,17 +18,27 @@ func NewInMemoryStorage() *InMemoryStorage {
 	}
 }
 
-// CreateTable creates a new table with the specified name.
-func (s *InMemoryStorage) CreateTable(tableName string) (*Table, error) {
+// CreateTable creates a new table with the specified name and optional schema.
+func (s *InMemoryStorage) CreateTable(tableName string, columns ...Column) (*Table, error) {
 	if _, exists := s.tables[tableName]; exists {
 		return nil, fmt.Errorf("table %s already exists", tableName)
 	}
 
-	table := NewTable(tableName)
+	table := NewTable(tableName, columns...)
 	s.tables[tableName] = table
 	return table, nil
 }
 
+// AddTable adds a table made with NewTable, such as one filled with rows
+// before others may see it.
+func (s *InMemoryStorage) AddTable(table *Table) error {
+	if _, exists := s.tables[table.Name]; exists {
+		return fmt.Errorf("table %s already exists", table.Name)
+	}
+	s.tables[table.Name] = table
+	return nil
+}
+
 // GetTable retrieves a table by its name.
 func (s *InMemoryStorage) GetTable(tableName string) (*Table, error) {
 	table, exists := s.tables[tableName]
@@ -36,14 +48,44 @@ func (s *InMemoryStorage) GetTable(tableName string) (*Table, error) {
 	return table, nil
 }
 
+// TableNames returns the names of all tables in alphabetical order.
+func (s *InMemoryStorage) TableNames() []string {
+	names := make([]string, 0, len(s.tables))
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Snapshot returns a deep copy of all tables, which Restore can later
+// bring back.
+func (s *InMemoryStorage) Snapshot() *InMemoryStorage {
+	snapshot := NewInMemoryStorage()
+	for name, table := range s.tables {
+		snapshot.tables[name] = table.Clone()
+	}
+	return snapshot
+}
+
+// Restore replaces all tables with those of a snapshot. Copies of the
+// storage value share its tables, so they see the restored tables too.
+func (s *InMemoryStorage) Restore(snapshot *InMemoryStorage) {
+	for name := range s.tables {
+		delete(s.tables, name)
+	}
+	for name, table := range snapshot.tables {
+		s.tables[name] = table
+	}
+}
+
 // Insert inserts a row into the specified table.
 func (s *InMemoryStorage) Insert(tableName string, row *Row) error {
 	table, err := s.GetTable(tableName)
 	if err != nil {
 		return err
 	}
-	table.Insert(row)
-	return nil
+	return table.Insert(row)
 }
 
 // Query performs a SELECT query on the specified table and returns the result set.
@@ -55,6 +97,16 @@ func (s *InMemoryStorage) Query(tableName string, condition func(*Row) bool) ([]
 	return table.Query(condition), nil
 }
 
+// QueryContext is like Query, but stops with the context's error once it is
+// canceled.
+func (s *InMemoryStorage) QueryContext(ctx context.Context, tableName string, condition func(*Row) bool) ([]*Row, error) {
+	table, err := s.GetTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	return table.QueryContext(ctx, condition)
+}
+
 // Update updates rows in the specified table based on the given condition and assignments.
 func (s *InMemoryStorage) Update(tableName string, assignments map[string]interface{}, condition func(*Row) bool) error {
 	table, err := s.GetTable(tableName)
@@ -2,11 +2,13 @@ package data
 
 import (
 	"fmt"
+	"sort"
 )
 
 // Row represents a row in a table, holding values for each column.
 type Row struct {
 	Columns map[string]interface{} // Mapping of column names to values
+	Order   []string               // Column names in result order; nil for stored rows
 }
 
 // CreateRow creates a new Row with the specified column values.
@@ -16,6 +18,40 @@ func CreateRow(columns map[string]interface{}) *Row {
 	}
 }
 
+// CreateOrderedRow creates a Row for a query result, remembering the order
+// of its columns.
+func CreateOrderedRow(names []string, values []interface{}) *Row {
+	columns := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		columns[name] = values[i]
+	}
+	return &Row{Columns: columns, Order: names}
+}
+
+// ColumnNames returns the names of the row's columns in result order, or
+// sorted by name if the row has no order.
+func (r *Row) ColumnNames() []string {
+	if r.Order != nil {
+		return r.Order
+	}
+	names := make([]string, 0, len(r.Columns))
+	for name := range r.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Values returns the row's values in the order of ColumnNames.
+func (r *Row) Values() []interface{} {
+	names := r.ColumnNames()
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		values[i] = r.Columns[name]
+	}
+	return values
+}
+
 // GetValue retrieves a column value by its name.
 func (r *Row) GetValue(columnName string) (interface{}, error) {
 	value, exists := r.Columns[columnName]
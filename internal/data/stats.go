@@ -0,0 +1,154 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// HistogramBuckets is the number of buckets ANALYZE builds per column.
+const HistogramBuckets = 10
+
+// TableStats holds the statistics gathered by ANALYZE for one table. The
+// planner uses them to estimate how many rows conditions and joins produce.
+type TableStats struct {
+	RowCount   int
+	Columns    map[string]*ColumnStats
+	AnalyzedAt time.Time
+}
+
+// ColumnStats describes the values of one column.
+type ColumnStats struct {
+	Distinct     int     // Number of distinct non-NULL values
+	NullFraction float64 // Fraction of rows where the column is NULL
+	// Histogram holds the bounds of equi-depth buckets over the non-NULL
+	// values: each bucket holds about as many rows as the others, the first
+	// bound is the smallest value and the last bound the largest.
+	Histogram []interface{}
+}
+
+// Analyze gathers statistics over the current rows of the table and stores
+// them with the table, replacing earlier statistics.
+func (t *Table) Analyze() *TableStats {
+	rows := t.Snapshot()
+
+	names := t.ColumnNames()
+	if len(t.Schema) == 0 {
+		seen := make(map[string]bool)
+		for _, row := range rows {
+			for name := range row {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	stats := &TableStats{
+		RowCount:   len(rows),
+		Columns:    make(map[string]*ColumnStats),
+		AnalyzedAt: time.Now(),
+	}
+	for _, name := range names {
+		stats.Columns[name] = analyzeColumn(rows, name)
+	}
+
+	t.mutex.Lock()
+	t.stats = stats
+	t.mutex.Unlock()
+	return stats
+}
+
+// Stats returns the statistics of the last ANALYZE, or nil if the table
+// has never been analyzed.
+func (t *Table) Stats() *TableStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stats
+}
+
+func analyzeColumn(rows []map[string]interface{}, name string) *ColumnStats {
+	var values []interface{}
+	distinct := make(map[string]bool)
+	for _, row := range rows {
+		value := row[name]
+		if value == nil {
+			continue
+		}
+		values = append(values, value)
+		distinct[fmt.Sprintf("%T:%v", value, value)] = true
+	}
+
+	stats := &ColumnStats{Distinct: len(distinct)}
+	if len(rows) > 0 {
+		stats.NullFraction = float64(len(rows)-len(values)) / float64(len(rows))
+	}
+	if len(values) == 0 {
+		return stats
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return CompareValues(values[i], values[j]) < 0
+	})
+	buckets := HistogramBuckets
+	if len(values) < buckets {
+		buckets = len(values)
+	}
+	for i := 0; i <= buckets; i++ {
+		pos := i * (len(values) - 1) / buckets
+		stats.Histogram = append(stats.Histogram, values[pos])
+	}
+	return stats
+}
+
+// CompareValues orders two non-NULL column values: numbers, including
+// numeric text, by value, booleans false before true, anything else as text.
+func CompareValues(a, b interface{}) int {
+	if x, ok := numericValue(a); ok {
+		if y, ok := numericValue(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	}
+	x, y := fmt.Sprintf("%v", a), fmt.Sprintf("%v", b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
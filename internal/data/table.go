@@ -1,30 +1,464 @@
 package data
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 )
 
 // Table represents a table in the database, which contains rows.
 type Table struct {
-	Name  string
-	Rows  []*Row
-	mutex sync.Mutex
+	Name    string
+	Schema  []Column // Column definitions; empty for schemaless tables
+	Rows    []*Row
+	Indexes []*Index
+	stats   *TableStats // Gathered by Analyze, nil until then
+	mutex   sync.Mutex
 }
 
-// NewTable creates a new empty table with the given name.
-func NewTable(name string) *Table {
+// NewTable creates a new empty table with the given name and optional schema.
+func NewTable(name string, columns ...Column) *Table {
 	return &Table{
-		Name: name,
-		Rows: []*Row{},
+		Name:   name,
+		Schema: columns,
+		Rows:   []*Row{},
 	}
 }
 
+// Clone returns a deep copy of the table: its schema, rows, indexes and
+// statistics.
+func (t *Table) Clone() *Table {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	clone := &Table{
+		Name:   t.Name,
+		Schema: append([]Column(nil), t.Schema...),
+		Rows:   make([]*Row, len(t.Rows)),
+		stats:  t.stats,
+	}
+	for i, row := range t.Rows {
+		columns := make(map[string]interface{}, len(row.Columns))
+		for name, value := range row.Columns {
+			columns[name] = value
+		}
+		clone.Rows[i] = CreateRow(columns)
+	}
+	for _, idx := range t.Indexes {
+		copied := newIndex(idx.Name, idx.Columns, idx.Unique)
+		copied.Primary = idx.Primary
+		for _, row := range clone.Rows {
+			copied.add(row)
+		}
+		clone.Indexes = append(clone.Indexes, copied)
+	}
+	return clone
+}
+
+// ColumnNames returns the column names of the schema in declaration order.
+func (t *Table) ColumnNames() []string {
+	names := make([]string, len(t.Schema))
+	for i, col := range t.Schema {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// Column looks up a column definition by name.
+func (t *Table) Column(name string) (Column, bool) {
+	for _, col := range t.Schema {
+		if col.Name == name {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+// CreateIndex builds a new index over the given columns from the rows
+// already in the table. A unique index fails if existing rows collide.
+func (t *Table) CreateIndex(name string, columns []string, unique bool) (*Index, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.createIndex(name, columns, unique)
+}
+
+func (t *Table) createIndex(name string, columns []string, unique bool) (*Index, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("an index needs at least one column")
+	}
+	for _, idx := range t.Indexes {
+		if idx.Name == name {
+			return nil, fmt.Errorf("index %s already exists", name)
+		}
+	}
+	if len(t.Schema) > 0 {
+		for _, col := range columns {
+			if _, ok := t.Column(col); !ok {
+				return nil, fmt.Errorf("column '%s' not found in table %s", col, t.Name)
+			}
+		}
+	}
+
+	idx := newIndex(name, columns, unique)
+	for _, row := range t.Rows {
+		if key, ok := idx.key(row); ok && unique && len(idx.entries[key]) > 0 {
+			return nil, fmt.Errorf("could not create unique index \"%s\": key is duplicated", name)
+		}
+		idx.add(row)
+	}
+	t.Indexes = append(t.Indexes, idx)
+	return idx, nil
+}
+
+// SetPrimaryKey declares the primary key of the table. The key columns
+// become NOT NULL and are backed by a unique index named <table>_pkey.
+func (t *Table) SetPrimaryKey(columns []string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.PrimaryKey() != nil {
+		return fmt.Errorf("multiple primary keys for table %s are not allowed", t.Name)
+	}
+	for _, row := range t.Rows {
+		for _, col := range columns {
+			if row.Columns[col] == nil {
+				return fmt.Errorf("column '%s' contains null values", col)
+			}
+		}
+	}
+
+	idx, err := t.createIndex(t.Name+"_pkey", columns, true)
+	if err != nil {
+		return err
+	}
+	idx.Primary = true
+	for i := range t.Schema {
+		for _, col := range columns {
+			if t.Schema[i].Name == col {
+				t.Schema[i].NotNull = true
+			}
+		}
+	}
+	return nil
+}
+
+// PrimaryKey returns the primary key columns, or nil if there is none.
+func (t *Table) PrimaryKey() []string {
+	for _, idx := range t.Indexes {
+		if idx.Primary {
+			return idx.Columns
+		}
+	}
+	return nil
+}
+
+// uniqueIndexOn returns the unique index defined on exactly the given
+// columns, if any.
+func (t *Table) uniqueIndexOn(columns []string) *Index {
+	for _, idx := range t.Indexes {
+		if idx.Unique && idx.Covers(columns) {
+			return idx
+		}
+	}
+	return nil
+}
+
+// checkUnique verifies that the candidate rows collide neither with each
+// other nor with existing rows on any unique index. Existing rows listed in
+// replaced are about to be overwritten by the candidates and are ignored.
+func (t *Table) checkUnique(candidates []*Row, replaced map[*Row]bool) error {
+	for _, idx := range t.Indexes {
+		if !idx.Unique {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, row := range candidates {
+			key, ok := idx.key(row)
+			if !ok {
+				continue
+			}
+			if seen[key] {
+				return idx.violation()
+			}
+			seen[key] = true
+			for _, existing := range idx.entries[key] {
+				if !replaced[existing] {
+					return idx.violation()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Table) indexRow(row *Row) {
+	for _, idx := range t.Indexes {
+		idx.add(row)
+	}
+}
+
+func (t *Table) unindexRow(row *Row) {
+	for _, idx := range t.Indexes {
+		idx.remove(row)
+	}
+}
+
+// replaceColumns swaps in new values for an existing row, keeping the
+// indexes in sync.
+func (t *Table) replaceColumns(row *Row, columns map[string]interface{}) {
+	t.unindexRow(row)
+	row.Columns = columns
+	t.indexRow(row)
+}
+
+func (t *Table) rebuildIndexes() {
+	for _, idx := range t.Indexes {
+		idx.entries = make(map[string][]*Row)
+		for _, row := range t.Rows {
+			idx.add(row)
+		}
+	}
+}
+
+// applyAssignments returns a normalized copy of the row with the given
+// column values changed. The row itself is left untouched.
+func (t *Table) applyAssignments(row *Row, assignments map[string]interface{}) (*Row, error) {
+	columns := make(map[string]interface{}, len(row.Columns))
+	for column, value := range row.Columns {
+		columns[column] = value
+	}
+	updated := CreateRow(columns)
+	for column, value := range assignments {
+		if err := updated.SetValue(column, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.normalize(updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// normalize checks a row against the schema, converting values to the
+// declared column types and filling in missing columns with NULL.
+// Schemaless tables accept any row unchanged.
+func (t *Table) normalize(row *Row) error {
+	if len(t.Schema) == 0 {
+		return nil
+	}
+
+	for name := range row.Columns {
+		if _, ok := t.Column(name); !ok {
+			return fmt.Errorf("column '%s' not found in table %s", name, t.Name)
+		}
+	}
+
+	columns := make(map[string]interface{}, len(t.Schema))
+	for _, col := range t.Schema {
+		value, err := ConvertValue(row.Columns[col.Name], col.Type)
+		if err != nil {
+			return fmt.Errorf("column '%s': %v", col.Name, err)
+		}
+		if value == nil && col.NotNull {
+			return fmt.Errorf("null value in column '%s' violates not-null constraint", col.Name)
+		}
+		columns[col.Name] = value
+	}
+	row.Columns = columns
+	return nil
+}
+
 // Insert adds a row to the table.
-func (t *Table) Insert(row *Row) {
+func (t *Table) Insert(row *Row) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+
+	if err := t.normalize(row); err != nil {
+		return err
+	}
+	if err := t.checkUnique([]*Row{row}, nil); err != nil {
+		return err
+	}
 	t.Rows = append(t.Rows, row)
+	t.indexRow(row)
+	return nil
+}
+
+// InsertMany adds several rows to the table. Either all rows are inserted
+// or, if any of them is invalid, none are.
+func (t *Table) InsertMany(rows []*Row) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, row := range rows {
+		if err := t.normalize(row); err != nil {
+			return err
+		}
+	}
+	if err := t.checkUnique(rows, nil); err != nil {
+		return err
+	}
+	t.Rows = append(t.Rows, rows...)
+	for _, row := range rows {
+		t.indexRow(row)
+	}
+	return nil
+}
+
+// Load inserts rows in bulk, as COPY does. A row that does not fit the
+// schema or collides on a unique index is passed to reject with its
+// position; if reject returns an error, Load inserts nothing and returns
+// it, otherwise the row is left out. It returns the number of rows
+// inserted.
+func (t *Table) Load(rows []*Row, reject func(i int, err error) error) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var unique []*Index
+	for _, idx := range t.Indexes {
+		if idx.Unique {
+			unique = append(unique, idx)
+		}
+	}
+	seen := make([]map[string]bool, len(unique))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+	check := func(row *Row) error {
+		if err := t.normalize(row); err != nil {
+			return err
+		}
+		keys := make(map[int]string, len(unique))
+		for i, idx := range unique {
+			key, ok := idx.key(row)
+			if !ok {
+				continue // NULLs never collide
+			}
+			if seen[i][key] || len(idx.entries[key]) > 0 {
+				return idx.violation()
+			}
+			keys[i] = key
+		}
+		for i, key := range keys {
+			seen[i][key] = true
+		}
+		return nil
+	}
+
+	accepted := make([]*Row, 0, len(rows))
+	for i, row := range rows {
+		if err := check(row); err != nil {
+			if err := reject(i, err); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		accepted = append(accepted, row)
+	}
+	t.Rows = append(t.Rows, accepted...)
+	for _, row := range accepted {
+		t.indexRow(row)
+	}
+	return len(accepted), nil
+}
+
+// Upsert inserts rows, resolving collisions on the unique index defined on
+// the conflict columns, or on any unique index when no columns are given.
+// For a row that collides with an existing one, resolve is called with the
+// existing row and the proposed (excluded) row and returns the assignments
+// to apply to the existing row, or nil to leave it untouched. As in
+// Postgres, a row may be inserted or updated only once: updating a row
+// that an earlier one of the rows inserted or updated is an error. The
+// whole operation holds the table lock and is undone if any row fails. It
+// returns the rows that were inserted or updated.
+func (t *Table) Upsert(rows []*Row, conflictColumns []string, resolve func(existing, excluded *Row) (map[string]interface{}, error)) ([]*Row, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var arbiters []*Index
+	if len(conflictColumns) > 0 {
+		idx := t.uniqueIndexOn(conflictColumns)
+		if idx == nil {
+			return nil, errors.New("there is no unique constraint matching the ON CONFLICT specification")
+		}
+		arbiters = append(arbiters, idx)
+	} else {
+		for _, idx := range t.Indexes {
+			if idx.Unique {
+				arbiters = append(arbiters, idx)
+			}
+		}
+	}
+
+	// Remember the previous state so a failure part way through can be undone.
+	rowCount := len(t.Rows)
+	previous := make(map[*Row]map[string]interface{})
+	rollback := func() {
+		for row, columns := range previous {
+			row.Columns = columns
+		}
+		t.Rows = t.Rows[:rowCount]
+		t.rebuildIndexes()
+	}
+
+	var affected []*Row
+	touched := make(map[*Row]bool)
+	for _, row := range rows {
+		if err := t.normalize(row); err != nil {
+			rollback()
+			return nil, err
+		}
+
+		var existing *Row
+		for _, idx := range arbiters {
+			if key, ok := idx.key(row); ok && len(idx.entries[key]) > 0 {
+				existing = idx.entries[key][0]
+				break
+			}
+		}
+
+		if existing == nil {
+			if err := t.checkUnique([]*Row{row}, nil); err != nil {
+				rollback()
+				return nil, err
+			}
+			t.Rows = append(t.Rows, row)
+			t.indexRow(row)
+			touched[row] = true
+			affected = append(affected, row)
+			continue
+		}
+
+		assignments, err := resolve(existing, row)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if assignments == nil {
+			continue // DO NOTHING
+		}
+		if touched[existing] {
+			rollback()
+			return nil, errors.New("ON CONFLICT DO UPDATE command cannot affect row a second time")
+		}
+		updated, err := t.applyAssignments(existing, assignments)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if err := t.checkUnique([]*Row{updated}, map[*Row]bool{existing: true}); err != nil {
+			rollback()
+			return nil, err
+		}
+		if _, saved := previous[existing]; !saved {
+			previous[existing] = existing.Columns
+		}
+		t.replaceColumns(existing, updated.Columns)
+		touched[existing] = true
+		affected = append(affected, existing)
+	}
+	return affected, nil
 }
 
 // Delete removes a row by its index.
@@ -36,37 +470,162 @@ func (t *Table) Delete(index int) error {
 		return errors.New("index out of bounds")
 	}
 
+	t.unindexRow(t.Rows[index])
 	t.Rows = append(t.Rows[:index], t.Rows[index+1:]...)
 	return nil
 }
 
+// DeleteWhere removes all rows that satisfy the condition and returns them.
+// If the condition fails for any row, nothing is deleted.
+func (t *Table) DeleteWhere(condition func(*Row) (bool, error)) ([]*Row, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	matches := make([]bool, len(t.Rows))
+	for i, row := range t.Rows {
+		match, err := condition(row)
+		if err != nil {
+			return nil, err
+		}
+		matches[i] = match
+	}
+
+	var deleted []*Row
+	kept := t.Rows[:0]
+	for i, row := range t.Rows {
+		if matches[i] {
+			deleted = append(deleted, row)
+			t.unindexRow(row)
+		} else {
+			kept = append(kept, row)
+		}
+	}
+	t.Rows = kept
+	return deleted, nil
+}
+
+// Snapshot returns the column values of every row as of now. Writers
+// replace a row's value map instead of modifying it, so the snapshot can be
+// read without holding the table lock while writes go on.
+func (t *Table) Snapshot() []map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	snapshot := make([]map[string]interface{}, len(t.Rows))
+	for i, row := range t.Rows {
+		snapshot[i] = row.Columns
+	}
+	return snapshot
+}
+
+// SnapshotRows is like Snapshot, but also returns the rows the values
+// belong to, so callers can pick rows to change later.
+func (t *Table) SnapshotRows() ([]*Row, []map[string]interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rows := append([]*Row{}, t.Rows...)
+	snapshot := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		snapshot[i] = row.Columns
+	}
+	return rows, snapshot
+}
+
+// RowCount returns the number of rows in the table.
+func (t *Table) RowCount() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.Rows)
+}
+
+// LookupIndex returns the column values of the rows whose indexed columns
+// equal the given values, like Snapshot does for the whole table.
+func (t *Table) LookupIndex(idx *Index, values ...interface{}) []map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rows := idx.Lookup(values...)
+	result := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		result[i] = row.Columns
+	}
+	return result
+}
+
 // Query retrieves rows that satisfy a condition function.
 func (t *Table) Query(condition func(*Row) bool) []*Row {
+	result, _ := t.QueryContext(context.Background(), condition)
+	return result
+}
+
+// QueryContext is like Query, but stops with the context's error once it is
+// canceled.
+func (t *Table) QueryContext(ctx context.Context, condition func(*Row) bool) ([]*Row, error) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
 	var result []*Row
 	for _, row := range t.Rows {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
 		if condition(row) {
 			result = append(result, row)
 		}
 	}
-	return result
+	return result, nil
 }
 
 // Update modifies rows that satisfy the given condition and apply column assignments.
 func (t *Table) Update(assignments map[string]interface{}, condition func(*Row) bool) error {
+	_, err := t.UpdateWhere(func(row *Row) (bool, error) {
+		return condition(row), nil
+	}, func(*Row) (map[string]interface{}, error) {
+		return assignments, nil
+	})
+	return err
+}
+
+// UpdateWhere computes new column values for every row that satisfies the
+// condition and applies them. The assign callback sees the row as it was
+// before the update. Nothing is changed if the condition or any assignment
+// fails or breaks a constraint; otherwise the updated rows are returned.
+func (t *Table) UpdateWhere(condition func(*Row) (bool, error), assign func(*Row) (map[string]interface{}, error)) ([]*Row, error) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
+	var targets []*Row
+	var updates []*Row
+	replaced := make(map[*Row]bool)
 	for _, row := range t.Rows {
-		if condition(row) {
-			for column, value := range assignments {
-				if err := row.SetValue(column, value); err != nil {
-					return err
-				}
-			}
+		match, err := condition(row)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
 		}
+		assignments, err := assign(row)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := t.applyAssignments(row, assignments)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, row)
+		updates = append(updates, updated)
+		replaced[row] = true
 	}
-	return nil
+
+	if err := t.checkUnique(updates, replaced); err != nil {
+		return nil, err
+	}
+	for i, row := range targets {
+		t.replaceColumns(row, updates[i].Columns)
+	}
+	return targets, nil
 }
@@ -0,0 +1,482 @@
+// Package engine shares an in-memory database between sessions, such as
+// database/sql connections or network clients. Queries run concurrently;
+// other statements and transactions run one at a time.
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/H3199/doggodb/internal/data"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+var (
+	// ErrNoTransaction is returned when committing or rolling back outside
+	// a transaction.
+	ErrNoTransaction = errors.New("there is no transaction in progress")
+	// ErrInTransaction is returned when beginning a transaction inside one.
+	ErrInTransaction = errors.New("there is already a transaction in progress")
+	// ErrReadOnly is returned for statements that change data in a
+	// read-only transaction.
+	ErrReadOnly = errors.New("cannot change data in a read-only transaction")
+	// ErrReadOnlyDatabase is returned for statements that change data in a
+	// database opened read-only.
+	ErrReadOnlyDatabase = errors.New("cannot change data in a read-only database")
+)
+
+// Database is an in-memory database with its executor.
+type Database struct {
+	storage  *data.InMemoryStorage
+	executor *query.Executor
+	mu       rwLock
+	readOnly bool        // Opened with OpenBackup
+	archive  *walArchive // Set by EnableArchive
+	lsn      int64       // WAL position of the last archived change
+}
+
+// NewDatabase creates an empty database.
+func NewDatabase() *Database {
+	storage := data.NewInMemoryStorage()
+	return &Database{storage: storage, executor: query.NewExecutor(*storage)}
+}
+
+// Executor returns the executor of the database, for registering
+// functions and the like.
+func (db *Database) Executor() *query.Executor {
+	return db.executor
+}
+
+// TableNames returns the names of all tables in alphabetical order.
+func (db *Database) TableNames() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.storage.TableNames()
+}
+
+// TableInfo describes a table.
+type TableInfo struct {
+	Name       string
+	Columns    []data.Column // Empty for schemaless tables
+	PrimaryKey []string
+	Indexes    []IndexInfo
+	Rows       int
+}
+
+// IndexInfo describes an index of a table.
+type IndexInfo struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+
+// DescribeTable describes the named table.
+func (db *Database) DescribeTable(name string) (*TableInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	table, err := db.storage.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &TableInfo{
+		Name:       table.Name,
+		Columns:    append([]data.Column(nil), table.Schema...),
+		PrimaryKey: table.PrimaryKey(),
+		Rows:       table.RowCount(),
+	}
+	for _, idx := range table.Indexes {
+		info.Indexes = append(info.Indexes, IndexInfo{Name: idx.Name, Columns: append([]string(nil), idx.Columns...), Unique: idx.Unique})
+	}
+	return info, nil
+}
+
+// Dump writes the database to w as a SQL script, see query.Executor.Dump.
+// Writers wait until it is done, so the dump is consistent.
+func (db *Database) Dump(w io.Writer) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.executor.Dump(w)
+}
+
+// Restore replays a script, such as one written by Dump, in a single
+// transaction: if a statement fails the database is left as it was.
+func (db *Database) Restore(ctx context.Context, r io.Reader) error {
+	text, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to restore: %v", err)
+	}
+	s := db.Session()
+	defer s.Close()
+	if err := s.Begin(ctx, false); err != nil {
+		return err
+	}
+	if err := db.executor.ExecScript(ctx, string(text)); err != nil {
+		return fmt.Errorf("failed to restore: %v", err)
+	}
+	if db.archive != nil {
+		s.tx.wal = append(s.tx.wal, walEntry{SQL: string(text), Script: true})
+	}
+	return s.Commit()
+}
+
+// Backup writes a consistent copy of the database to a file, in the
+// format of Dump, with the WAL position it was taken at for Recover.
+// Writers only wait while the tables are copied in memory, not while the
+// file is written.
+func (db *Database) Backup(path string) error {
+	db.mu.RLock()
+	snapshot, lsn := db.storage.Snapshot(), db.lsn
+	db.mu.RUnlock()
+	return query.WriteBackup(snapshot, path, lsn)
+}
+
+// OpenBackup loads a backup file into a new database that only allows
+// reading, for checking the backup.
+func OpenBackup(ctx context.Context, path string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db := NewDatabase()
+	if err := db.Restore(ctx, f); err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	return db, nil
+}
+
+// ReadOnly reports whether the database only allows reading.
+func (db *Database) ReadOnly() bool {
+	return db.readOnly
+}
+
+// Session returns a new session on the database.
+func (db *Database) Session() *Session {
+	return &Session{db: db}
+}
+
+// Session runs statements for one client and holds its transaction. A
+// session is not safe for concurrent use.
+type Session struct {
+	db         *Database
+	tx         *transaction  // The open transaction, if any
+	timeout    time.Duration // SET statement_timeout, 0 for none
+	restricted bool          // Server files are limited to fileDir, see RestrictFiles
+	fileDir    string
+}
+
+// transaction is the state of an open transaction. Transactions are
+// serializable: the session holds the database to itself until the
+// transaction ends, and rolling back restores the tables as they were
+// when it began.
+type transaction struct {
+	readOnly bool
+	snapshot *data.InMemoryStorage // Tables as they were at BEGIN, nil if read-only
+	wal      []walEntry            // Changes to archive at COMMIT
+}
+
+// Prepare parses a query, using the executor's statement cache.
+func (s *Session) Prepare(text string) (*query.PreparedStatement, error) {
+	return s.db.executor.Prepare(text)
+}
+
+// Begin starts a transaction.
+func (s *Session) Begin(ctx context.Context, readOnly bool) error {
+	if s.tx != nil {
+		return ErrInTransaction
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.db.readOnly && !readOnly {
+		return ErrReadOnlyDatabase
+	}
+	if err := s.db.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	s.tx = &transaction{readOnly: readOnly}
+	if !readOnly {
+		s.tx.snapshot = s.db.storage.Snapshot()
+	}
+	return nil
+}
+
+// Commit ends the transaction, keeping its changes.
+func (s *Session) Commit() error {
+	return s.end(false)
+}
+
+// Rollback ends the transaction, undoing its changes.
+func (s *Session) Rollback() error {
+	return s.end(true)
+}
+
+func (s *Session) end(rollback bool) error {
+	if s.tx == nil {
+		return ErrNoTransaction
+	}
+	var err error
+	if !rollback && len(s.tx.wal) > 0 {
+		// Changes that cannot be archived are undone.
+		err = s.db.log(s.tx.wal)
+		rollback = err != nil
+	}
+	if rollback && s.tx.snapshot != nil {
+		s.db.storage.Restore(s.tx.snapshot)
+	}
+	s.tx = nil
+	s.db.mu.Unlock()
+	return err
+}
+
+// InTransaction reports whether a transaction is open.
+func (s *Session) InTransaction() bool {
+	return s.tx != nil
+}
+
+// Close rolls back the open transaction, if any.
+func (s *Session) Close() {
+	if s.tx != nil {
+		s.Rollback()
+	}
+}
+
+// Run runs a prepared statement with values for its placeholders, locking
+// the database unless the session's transaction already holds it. The
+// statement is canceled with a *query.CanceledError when the context is
+// done or the session's statement timeout passes.
+func (s *Session) Run(ctx context.Context, p *query.PreparedStatement, args ...interface{}) (*query.ResultSet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &query.CanceledError{Err: err}
+	}
+	if set, ok := p.Statement().(*query.SetStatement); ok && set.Name == "statement_timeout" {
+		// The setting belongs to the session, not the shared executor.
+		timeout, err := query.ParseTimeout(set.Value)
+		if err != nil {
+			return nil, err
+		}
+		s.timeout = timeout
+		return &query.ResultSet{}, nil
+	}
+	switch stmt := p.Statement().(type) {
+	case *query.BackupStatement:
+		if err := s.checkFile(stmt.Path); err != nil {
+			return nil, err
+		}
+		return s.backup(stmt.Path)
+	case *query.CopyStatement:
+		if !stmt.Stdio {
+			if err := s.checkFile(stmt.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	readOnly := isReadOnly(p.Statement())
+	var entry *walEntry
+	if !readOnly {
+		var err error
+		if entry, err = newWALEntry(p.String(), args); err != nil {
+			return nil, err
+		}
+	}
+	return s.exec(ctx, readOnly, entry, func(ctx context.Context) (*query.ResultSet, error) {
+		stmt, ok := p.Statement().(*query.CopyStatement)
+		if !ok || !stmt.From || stmt.Stdio || s.db.archive == nil {
+			return p.ExecContext(ctx, args...)
+		}
+		// The archive keeps what was read, as the file may change.
+		text, err := os.ReadFile(stmt.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute COPY: %v", err)
+		}
+		entry.Copy, entry.Data = true, text
+		return s.db.executor.RunContext(ctx, stmt.WithReader(bytes.NewReader(text)))
+	})
+}
+
+// Stream runs a prepared statement like Run, but passes the rows of a
+// SELECT to fn as they are produced; see
+// query.PreparedStatement.StreamContext. The database stays locked for
+// reading until fn returns, so writers wait for it.
+func (s *Session) Stream(ctx context.Context, p *query.PreparedStatement, fn func(*query.Rows) error, args ...interface{}) (*query.ResultSet, error) {
+	if _, ok := p.Statement().(*query.SelectStatement); !ok {
+		return s.Run(ctx, p, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &query.CanceledError{Err: err}
+	}
+	return s.exec(ctx, true, nil, func(ctx context.Context) (*query.ResultSet, error) {
+		return p.StreamContext(ctx, fn, args...)
+	})
+}
+
+// backup runs BACKUP TO. Outside a transaction writers need not wait for
+// the file to be written. In a transaction that may write, the backup
+// holds the tables as they were at BEGIN, without uncommitted changes.
+func (s *Session) backup(path string) (*query.ResultSet, error) {
+	if s.tx == nil {
+		if err := s.db.Backup(path); err != nil {
+			return nil, err
+		}
+		return &query.ResultSet{}, nil
+	}
+	snapshot := s.tx.snapshot
+	if snapshot == nil {
+		snapshot = s.db.storage.Snapshot()
+	}
+	if err := query.WriteBackup(snapshot, path, s.db.lsn); err != nil {
+		return nil, err
+	}
+	return &query.ResultSet{}, nil
+}
+
+// CopyFrom loads rows read from r into a table, as COPY FROM does with a
+// file; see query.Executor.CopyFrom.
+func (s *Session) CopyFrom(ctx context.Context, table string, r io.Reader, options query.CopyOptions) (*query.ResultSet, error) {
+	stmt, err := query.NewCopyFrom(table, r, options)
+	if err != nil {
+		return nil, err
+	}
+	return s.copyFrom(ctx, stmt, r)
+}
+
+// RunCopy runs a prepared COPY FROM STDIN, reading the data from r, or
+// COPY TO STDOUT, writing the data to w.
+func (s *Session) RunCopy(ctx context.Context, p *query.PreparedStatement, r io.Reader, w io.Writer) (*query.ResultSet, error) {
+	stmt, ok := p.Statement().(*query.CopyStatement)
+	if !ok || !stmt.Stdio {
+		return nil, errors.New("expected COPY FROM STDIN or COPY TO STDOUT")
+	}
+	if p.NumParams() > 0 {
+		return nil, errors.New("COPY does not take parameters")
+	}
+	if stmt.From {
+		return s.copyFrom(ctx, stmt, r)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &query.CanceledError{Err: err}
+	}
+	return s.exec(ctx, true, nil, func(ctx context.Context) (*query.ResultSet, error) {
+		return s.db.executor.RunContext(ctx, stmt.WithWriter(w))
+	})
+}
+
+// copyFrom runs a COPY FROM STDIN that reads r.
+func (s *Session) copyFrom(ctx context.Context, stmt *query.CopyStatement, r io.Reader) (*query.ResultSet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &query.CanceledError{Err: err}
+	}
+	stmt = stmt.WithReader(r)
+	entry := &walEntry{SQL: stmt.String(), Copy: true}
+	return s.exec(ctx, false, entry, func(ctx context.Context) (*query.ResultSet, error) {
+		if s.db.archive != nil {
+			text, err := io.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to execute COPY: %v", err)
+			}
+			entry.Data = text
+			stmt = stmt.WithReader(bytes.NewReader(text))
+		}
+		return s.db.executor.RunContext(ctx, stmt)
+	})
+}
+
+// exec runs fn with the session's statement timeout, holding the database
+// for reading or writing unless the session's transaction already does.
+// Waiting for the database ends with a *query.CanceledError once the
+// context is done or the statement timeout passes. When the WAL is
+// archived, the entry for a change is archived once fn succeeds, or at
+// COMMIT in a transaction.
+func (s *Session) exec(ctx context.Context, readOnly bool, entry *walEntry, fn func(context.Context) (*query.ResultSet, error)) (*query.ResultSet, error) {
+	if s.db.readOnly && !readOnly {
+		return nil, ErrReadOnlyDatabase
+	}
+	if s.timeout == 0 {
+		return s.execLocked(ctx, readOnly, entry, fn)
+	}
+	timed, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	rs, err := s.execLocked(timed, readOnly, entry, fn)
+	var canceled *query.CanceledError
+	if errors.As(err, &canceled) && ctx.Err() == nil {
+		// The caller's context is live, so the statement timeout passed.
+		canceled.Timeout = true
+	}
+	return rs, err
+}
+
+func (s *Session) execLocked(ctx context.Context, readOnly bool, entry *walEntry, fn func(context.Context) (*query.ResultSet, error)) (*query.ResultSet, error) {
+	switch {
+	case s.tx != nil:
+		if s.tx.readOnly && !readOnly {
+			return nil, ErrReadOnly
+		}
+	case readOnly:
+		if err := s.db.mu.RLockContext(ctx); err != nil {
+			return nil, &query.CanceledError{Err: err}
+		}
+		defer s.db.mu.RUnlock()
+	default:
+		if err := s.db.mu.LockContext(ctx); err != nil {
+			return nil, &query.CanceledError{Err: err}
+		}
+		defer s.db.mu.Unlock()
+	}
+	if entry == nil || s.db.archive == nil {
+		return fn(ctx)
+	}
+	if err := s.db.archive.err; err != nil {
+		return nil, err
+	}
+	if s.tx != nil {
+		rs, err := fn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.tx.wal = append(s.tx.wal, *entry)
+		return rs, nil
+	}
+	// As when a transaction commits, a change that cannot be archived is
+	// undone, so that recovery does not lose a write the client saw fail.
+	snapshot := s.db.storage.Snapshot()
+	rs, err := fn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.log([]walEntry{*entry}); err != nil {
+		s.db.storage.Restore(snapshot)
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Describe returns the placeholder types and result columns of a prepared
+// statement, as PreparedStatement.Describe does.
+func (s *Session) Describe(p *query.PreparedStatement) ([]data.Type, []query.Column, error) {
+	if s.tx == nil {
+		s.db.mu.RLock()
+		defer s.db.mu.RUnlock()
+	}
+	return p.Describe()
+}
+
+// isReadOnly reports whether a statement only reads data.
+func isReadOnly(stmt query.Statement) bool {
+	switch s := stmt.(type) {
+	case *query.SelectStatement:
+		return true
+	case *query.ExplainStatement:
+		return !s.Analyze
+	case *query.CopyStatement:
+		return !s.From
+	case *query.BackupStatement:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrFileAccess is returned when a session may not use a file on the
+// server for COPY or BACKUP.
+var ErrFileAccess = errors.New("permission denied for files on the server")
+
+// RestrictFiles limits the files on the server that COPY and BACKUP may
+// read and write in the session to those in dir, or to none if dir is
+// empty. Network servers restrict their sessions, since their clients are
+// not trusted with the server's files; COPY FROM STDIN and TO STDOUT are
+// still available.
+func (s *Session) RestrictFiles(dir string) {
+	s.restricted, s.fileDir = true, dir
+}
+
+// checkFile reports whether the session may use the file at path. Paths
+// are resolved as COPY and BACKUP resolve them, relative to the working
+// directory, and must lead into the session's directory without following
+// symbolic links out of it.
+func (s *Session) checkFile(path string) error {
+	if !s.restricted {
+		return nil
+	}
+	if s.fileDir == "" {
+		return fmt.Errorf("%w; use COPY FROM STDIN or TO STDOUT", ErrFileAccess)
+	}
+	denied := fmt.Errorf("%w: %s is outside the directory for server files", ErrFileAccess, path)
+	root, err := filepath.EvalSymlinks(s.fileDir)
+	if err == nil {
+		root, err = filepath.Abs(root)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFileAccess, err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return denied
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return denied
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return denied
+	}
+	if info, err := os.Lstat(filepath.Join(dir, filepath.Base(abs))); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return denied
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"sync"
+)
+
+// rwLock is a readers-writer lock whose waits end when a context is done,
+// so a statement waiting on another session's transaction can be canceled
+// or time out. Like sync.RWMutex, readers wait while a writer is waiting,
+// so writers are not starved.
+type rwLock struct {
+	mu       sync.Mutex
+	readers  int
+	writer   bool
+	waiting  int           // Writers waiting for the lock
+	released chan struct{} // Closed when the lock is released
+}
+
+// Lock takes the lock for writing, waiting as long as it takes.
+func (l *rwLock) Lock() {
+	l.acquire(context.Background(), true)
+}
+
+// RLock takes the lock for reading, waiting as long as it takes.
+func (l *rwLock) RLock() {
+	l.acquire(context.Background(), false)
+}
+
+// LockContext takes the lock for writing, or returns the error of the
+// context if it is done first.
+func (l *rwLock) LockContext(ctx context.Context) error {
+	return l.acquire(ctx, true)
+}
+
+// RLockContext takes the lock for reading, or returns the error of the
+// context if it is done first.
+func (l *rwLock) RLockContext(ctx context.Context) error {
+	return l.acquire(ctx, false)
+}
+
+func (l *rwLock) Unlock() {
+	l.mu.Lock()
+	l.writer = false
+	l.release()
+	l.mu.Unlock()
+}
+
+func (l *rwLock) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	l.release()
+	l.mu.Unlock()
+}
+
+func (l *rwLock) acquire(ctx context.Context, write bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if write {
+		l.waiting++
+		defer func() { l.waiting-- }()
+	}
+	for {
+		if !l.writer && (write && l.readers == 0 || !write && l.waiting == 0) {
+			if write {
+				l.writer = true
+			} else {
+				l.readers++
+			}
+			return nil
+		}
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+			l.mu.Lock()
+		case <-ctx.Done():
+			l.mu.Lock()
+			if write {
+				// Readers held back by this writer may go ahead.
+				l.release()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// release wakes the waiters to try again. The caller holds l.mu.
+func (l *rwLock) release() {
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
@@ -0,0 +1,352 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/H3199/doggodb/internal/query"
+)
+
+// walSegmentRecords is how many records an archive segment holds before
+// the next segment is started.
+const walSegmentRecords = 1024
+
+// walRecord is a committed transaction in the WAL archive, with the
+// statements that made its changes in the order they ran. Records are
+// numbered from 1 by their log sequence number (LSN).
+type walRecord struct {
+	LSN     int64      `json:"lsn"`
+	Time    time.Time  `json:"time"`
+	Entries []walEntry `json:"entries"`
+}
+
+// walEntry is a statement that changed data.
+type walEntry struct {
+	SQL    string     `json:"sql"`
+	Args   []walValue `json:"args,omitempty"`
+	Copy   bool       `json:"copy,omitempty"`   // SQL is a COPY FROM reading Data
+	Data   []byte     `json:"data,omitempty"`   // What the COPY FROM read
+	Script bool       `json:"script,omitempty"` // SQL is a script run by Restore
+}
+
+// newWALEntry returns the entry for a statement run with values for its
+// placeholders.
+func newWALEntry(sql string, args []interface{}) (*walEntry, error) {
+	entry := &walEntry{SQL: sql}
+	for i, arg := range args {
+		value, err := query.BindValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for parameter $%d: %v", i+1, err)
+		}
+		entry.Args = append(entry.Args, walValue{value})
+	}
+	return entry, nil
+}
+
+// walValue is a placeholder value, as query.BindValue gives it. JSON does
+// not tell floats from integers, so floats are written as {"float": "1.5"}.
+type walValue struct {
+	value interface{}
+}
+
+func (v walValue) MarshalJSON() ([]byte, error) {
+	if f, ok := v.value.(float64); ok {
+		return json.Marshal(map[string]string{"float": strconv.FormatFloat(f, 'g', -1, 64)})
+	}
+	return json.Marshal(v.value)
+}
+
+func (v *walValue) UnmarshalJSON(text []byte) error {
+	if bytes.HasPrefix(text, []byte("{")) {
+		var float struct {
+			Float *string `json:"float"`
+		}
+		if err := json.Unmarshal(text, &float); err != nil || float.Float == nil {
+			return fmt.Errorf("invalid value %s", text)
+		}
+		f, err := strconv.ParseFloat(*float.Float, 64)
+		v.value = f
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v.value); err != nil {
+		return err
+	}
+	if n, ok := v.value.(json.Number); ok {
+		i, err := n.Int64()
+		v.value = i
+		return err
+	}
+	return nil
+}
+
+// walArchive appends WAL records to segment files in a directory, a JSON
+// object per line. Segments are named by the LSN of their first record.
+type walArchive struct {
+	dir     string
+	segment *os.File // The segment being written, nil before the first record
+	records int      // Records in the segment
+	err     error    // The write that failed; nothing is archived after it
+}
+
+// write appends a record and syncs it to disk. Once a write fails, the
+// archive misses a change and later ones fail too.
+func (a *walArchive) write(record walRecord) error {
+	if a.err != nil {
+		return a.err
+	}
+	line, err := json.Marshal(record)
+	if err == nil {
+		err = a.append(record.LSN, append(line, '\n'))
+	}
+	if err != nil {
+		a.err = fmt.Errorf("failed to archive WAL: %v", err)
+		return a.err
+	}
+	return nil
+}
+
+func (a *walArchive) append(lsn int64, line []byte) error {
+	if a.segment == nil || a.records == walSegmentRecords {
+		if a.segment != nil {
+			a.segment.Close()
+		}
+		name := filepath.Join(a.dir, fmt.Sprintf("%016d.wal", lsn))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		a.segment, a.records = f, 0
+	}
+	if _, err := a.segment.Write(line); err != nil {
+		return err
+	}
+	a.records++
+	return a.segment.Sync()
+}
+
+// archiveSegments returns the names of the segments in a directory, in
+// order.
+func archiveSegments(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".wal") {
+			segments = append(segments, file.Name())
+		}
+	}
+	return segments, nil
+}
+
+// readArchive reads the records of the segments in a directory, in order.
+// The last record of the last segment may be cut short by a crash while
+// it was written; it is left out.
+func readArchive(dir string) ([]walRecord, error) {
+	segments, err := archiveSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var records []walRecord
+	for i, name := range segments {
+		text, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range bytes.SplitAfter(text, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var record walRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				if i == len(segments)-1 && !bytes.HasSuffix(line, []byte("\n")) {
+					break
+				}
+				return nil, fmt.Errorf("corrupt WAL segment %s: %v", name, err)
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// repairArchive cuts a record that a crash left half written off the end
+// of the last segment in a directory. Records archived after it then go to
+// a segment that is no longer the last, where only whole ones may be.
+func repairArchive(dir string) error {
+	segments, err := archiveSegments(dir)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	name := filepath.Join(dir, segments[len(segments)-1])
+	text, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	end := bytes.LastIndexByte(text, '\n') + 1
+	switch {
+	case end == len(text):
+		return nil
+	case end == 0:
+		// The segment is named by the record it lacks, which the next
+		// segment will be named by.
+		return os.Remove(name)
+	}
+	return os.Truncate(name, int64(end))
+}
+
+// EnableArchive starts archiving the WAL to a directory, creating it if
+// needed: every committed change is appended there as a record that
+// Recover can replay on top of a backup. Changes made before archiving
+// starts are not archived, so take a backup after enabling it. A record
+// that a crash left half written at the end of the archive is removed.
+//
+// Only changes made through sessions are archived, not those made with
+// the executor directly. Statements are archived as they were written, so
+// functions registered on the executor must give the same results when
+// the archive is replayed.
+func (db *Database) EnableArchive(dir string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.archive != nil {
+		return errors.New("WAL archiving is already enabled")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to archive WAL: %v", err)
+	}
+	records, err := readArchive(dir)
+	if err != nil {
+		return fmt.Errorf("failed to archive WAL: %v", err)
+	}
+	if n := len(records); n > 0 && records[n-1].LSN > db.lsn {
+		return fmt.Errorf("failed to archive WAL: %s already holds changes past position %d", dir, db.lsn)
+	}
+	if err := repairArchive(dir); err != nil {
+		return fmt.Errorf("failed to archive WAL: %v", err)
+	}
+	db.archive = &walArchive{dir: dir}
+	return nil
+}
+
+// LSN returns the WAL position of the last archived change, 0 if there is
+// none.
+func (db *Database) LSN() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lsn
+}
+
+// log archives the changes of a transaction as the next WAL record. The
+// caller holds the database for writing.
+func (db *Database) log(entries []walEntry) error {
+	record := walRecord{LSN: db.lsn + 1, Time: time.Now().UTC(), Entries: entries}
+	if err := db.archive.write(record); err != nil {
+		return err
+	}
+	db.lsn = record.LSN
+	return nil
+}
+
+// RecoveryTarget is where Recover stops replaying the WAL archive. Fields
+// left zero set no limit.
+type RecoveryTarget struct {
+	LSN  int64     // Last record to replay
+	Time time.Time // Replay the records committed up to this time
+}
+
+// Recover loads a backup written while the WAL was archived into a new
+// database, then replays the archived changes made after the backup up to
+// the target. Archive to a new directory after recovering to an earlier
+// point, since the old one holds the changes that were not replayed.
+func Recover(ctx context.Context, backupPath, archiveDir string, target RecoveryTarget) (*Database, error) {
+	backup, err := os.ReadFile(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover: %v", err)
+	}
+	base, err := query.BackupPosition(string(backup))
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover: %s: %v", backupPath, err)
+	}
+	if target.LSN > 0 && target.LSN < base {
+		return nil, fmt.Errorf("failed to recover: backup %s was taken at position %d, past the target", backupPath, base)
+	}
+	records, err := readArchive(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover: %v", err)
+	}
+
+	db := NewDatabase()
+	if err := db.Restore(ctx, bytes.NewReader(backup)); err != nil {
+		return nil, err
+	}
+	db.lsn = base
+	for _, record := range records {
+		if record.LSN <= db.lsn {
+			continue
+		}
+		if target.LSN > 0 && record.LSN > target.LSN || !target.Time.IsZero() && record.Time.After(target.Time) {
+			break
+		}
+		if record.LSN != db.lsn+1 {
+			return nil, fmt.Errorf("failed to recover: WAL record %d is missing", db.lsn+1)
+		}
+		if err := db.replay(ctx, record); err != nil {
+			return nil, fmt.Errorf("failed to recover: WAL record %d: %v", record.LSN, err)
+		}
+		db.lsn = record.LSN
+	}
+	if target.LSN > db.lsn {
+		return nil, fmt.Errorf("failed to recover: WAL record %d is missing", db.lsn+1)
+	}
+	return db, nil
+}
+
+// replay applies the changes of a record in a transaction.
+func (db *Database) replay(ctx context.Context, record walRecord) error {
+	s := db.Session()
+	defer s.Close()
+	if err := s.Begin(ctx, false); err != nil {
+		return err
+	}
+	for _, entry := range record.Entries {
+		if err := db.apply(ctx, entry); err != nil {
+			return err
+		}
+	}
+	return s.Commit()
+}
+
+func (db *Database) apply(ctx context.Context, entry walEntry) error {
+	if entry.Script {
+		return db.executor.ExecScript(ctx, entry.SQL)
+	}
+	p, err := db.executor.Prepare(entry.SQL)
+	if err != nil {
+		return err
+	}
+	if entry.Copy {
+		stmt, ok := p.Statement().(*query.CopyStatement)
+		if !ok || !stmt.From {
+			return fmt.Errorf("%q is not a COPY FROM", entry.SQL)
+		}
+		_, err = db.executor.RunContext(ctx, stmt.WithReader(bytes.NewReader(entry.Data)))
+		return err
+	}
+	args := make([]interface{}, len(entry.Args))
+	for i, arg := range entry.Args {
+		args[i] = arg.value
+	}
+	_, err = p.ExecContext(ctx, args...)
+	return err
+}
@@ -0,0 +1,367 @@
+// Package httpapi serves a database over HTTP with JSON, for quick
+// integrations and browser tooling:
+//
+//	POST /query                 run a statement
+//	GET  /tables                list the tables
+//	GET  /tables/{name}/schema  describe a table
+//	GET  /dump                  dump the database as a SQL script
+//
+// A query request is a JSON object with the SQL text, values for its
+// placeholders and an optional timeout:
+//
+//	{"sql": "SELECT * FROM pets WHERE id = ?", "params": [1], "timeout": "2s"}
+//
+// The response holds the result columns, the rows and the number of rows
+// changed. Clients that accept application/x-ndjson, or ask for
+// ?format=ndjson, get the result streamed as newline-delimited JSON: the
+// columns first, then one line per row and a summary line at the end. The
+// rows of a SELECT are written as the query produces them, without
+// holding the whole result in memory; the database stays locked for
+// reading until they are written.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+// DefaultTimeout is the usual limit on how long a query may run.
+const DefaultTimeout = 30 * time.Second
+
+// maxRequestSize bounds the body of a query request.
+const maxRequestSize = 1 << 20
+
+// flushInterval is how many NDJSON rows are written between flushes.
+const flushInterval = 256
+
+// Handler is the http.Handler of the API.
+type Handler struct {
+	db      *engine.Database
+	timeout time.Duration
+	fileDir string // See SetFileDir
+}
+
+// NewHandler creates the API for a database. Each query runs for at most
+// timeout, or without a limit if it is 0; requests may ask for less.
+func NewHandler(db *engine.Database, timeout time.Duration) *Handler {
+	return &Handler{db: db, timeout: timeout}
+}
+
+// SetFileDir lets queries COPY and BACKUP files in dir on the server. By
+// default they may use no files, as anyone who can reach the API could
+// otherwise read and write the files of the server's user.
+func (h *Handler) SetFileDir(dir string) {
+	h.fileDir = dir
+}
+
+type queryRequest struct {
+	SQL     string        `json:"sql"`
+	Params  []interface{} `json:"params"`
+	Timeout string        `json:"timeout"` // Such as "500ms"
+}
+
+type columnJSON struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type queryResponse struct {
+	Columns      []columnJSON    `json:"columns"`
+	Rows         [][]interface{} `json:"rows"`
+	RowsAffected int64           `json:"rows_affected"`
+	LastInsertID int64           `json:"last_insert_id,omitempty"`
+	Notices      []string        `json:"notices,omitempty"`
+}
+
+// summaryJSON is the last line of an NDJSON result.
+type summaryJSON struct {
+	RowCount     int      `json:"row_count"`
+	RowsAffected int64    `json:"rows_affected"`
+	LastInsertID int64    `json:"last_insert_id,omitempty"`
+	Notices      []string `json:"notices,omitempty"`
+}
+
+type tableJSON struct {
+	Name       string       `json:"name"`
+	Columns    []columnJSON `json:"columns"`
+	PrimaryKey []string     `json:"primary_key"`
+	Indexes    []indexJSON  `json:"indexes"`
+	Rows       int          `json:"rows"`
+}
+
+type indexJSON struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP routes a request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/query":
+		if allow(w, r, http.MethodPost) {
+			h.query(w, r)
+		}
+	case path == "/tables":
+		if allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, map[string][]string{"tables": h.db.TableNames()})
+		}
+	case path == "/dump":
+		if allow(w, r, http.MethodGet) {
+			h.dump(w)
+		}
+	case strings.HasPrefix(path, "/tables/"):
+		name, ok := strings.CutSuffix(strings.TrimPrefix(path, "/tables/"), "/schema")
+		if !ok || name == "" || strings.Contains(name, "/") {
+			writeError(w, http.StatusNotFound, "not found")
+		} else if allow(w, r, http.MethodGet) {
+			h.schema(w, name)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// allow answers requests with another method with 405.
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method))
+	return false
+}
+
+func (h *Handler) query(w http.ResponseWriter, r *http.Request) {
+	var req queryRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.SQL) == "" {
+		writeError(w, http.StatusBadRequest, "invalid request: sql is required")
+		return
+	}
+	args := make([]interface{}, len(req.Params))
+	for i, param := range req.Params {
+		value, err := paramValue(param)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid value for parameter $%d: %v", i+1, err))
+			return
+		}
+		args[i] = value
+	}
+
+	timeout := h.timeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid timeout %q", req.Timeout))
+			return
+		}
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	session := h.db.Session()
+	defer session.Close()
+	session.RestrictFiles(h.fileDir)
+	p, err := session.Prepare(req.SQL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if wantsNDJSON(r) {
+		streamQuery(ctx, w, session, p, args)
+		return
+	}
+	rs, err := session.Run(ctx, p, args...)
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	resp := queryResponse{
+		Columns:      columnsJSON(rs.Columns()),
+		Rows:         make([][]interface{}, 0, rs.Len()),
+		RowsAffected: rs.RowsAffected(),
+		LastInsertID: rs.LastInsertID(),
+		Notices:      rs.Notices(),
+	}
+	for rs.Next() {
+		resp.Rows = append(resp.Rows, rs.Values())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// errorStatus returns the HTTP status for a failed statement.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, engine.ErrFileAccess):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// streamQuery runs a statement for an NDJSON response, writing the rows
+// of a SELECT as they are produced and flushing as it goes. Once rows have
+// been sent the status can no longer change, so a failure ends the stream
+// with an error line instead of the summary.
+func streamQuery(ctx context.Context, w http.ResponseWriter, session *engine.Session, p *query.PreparedStatement, args []interface{}) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	started := false
+	start := func(columns []query.Column) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		encoder.Encode(map[string][]columnJSON{"columns": columnsJSON(columns)})
+		started = true
+	}
+	count := 0
+	write := func(values []interface{}) error {
+		if err := encoder.Encode(values); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%flushInterval == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	rs, err := session.Stream(ctx, p, func(rows *query.Rows) error {
+		start(rows.Columns())
+		for rows.Next() {
+			if err := write(rows.Values()); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}, args...)
+	if err != nil {
+		if !started {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		encoder.Encode(errorJSON{Error: err.Error()})
+		return
+	}
+	if !started {
+		// Statements other than SELECT, such as those with RETURNING,
+		// have their rows collected.
+		start(rs.Columns())
+		for rs.Next() {
+			if err := write(rs.Values()); err != nil {
+				return
+			}
+		}
+	}
+	encoder.Encode(summaryJSON{RowCount: count, RowsAffected: rs.RowsAffected(), LastInsertID: rs.LastInsertID(), Notices: rs.Notices()})
+}
+
+func (h *Handler) schema(w http.ResponseWriter, name string) {
+	info, err := h.db.DescribeTable(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	table := tableJSON{
+		Name:       info.Name,
+		Columns:    []columnJSON{},
+		PrimaryKey: info.PrimaryKey,
+		Indexes:    []indexJSON{},
+		Rows:       info.Rows,
+	}
+	if table.PrimaryKey == nil {
+		table.PrimaryKey = []string{}
+	}
+	for _, col := range info.Columns {
+		table.Columns = append(table.Columns, columnJSON{Name: col.Name, Type: string(col.Type)})
+	}
+	for _, idx := range info.Indexes {
+		table.Indexes = append(table.Indexes, indexJSON{Name: idx.Name, Columns: idx.Columns, Unique: idx.Unique})
+	}
+	writeJSON(w, http.StatusOK, table)
+}
+
+// dump writes the dump of the database once it is complete, so that a
+// failure can still be reported.
+func (h *Handler) dump(w http.ResponseWriter) {
+	var buf bytes.Buffer
+	if err := h.db.Dump(&buf); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/sql; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// wantsNDJSON reports whether the client asked for a streamed result.
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// paramValue converts a decoded JSON value to a parameter value. Numbers
+// without a fraction or exponent are integers.
+func paramValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	}
+	return nil, fmt.Errorf("arrays and objects are not supported")
+}
+
+func columnsJSON(columns []query.Column) []columnJSON {
+	result := make([]columnJSON, len(columns))
+	for i, col := range columns {
+		result[i] = columnJSON{Name: col.Name, Type: string(col.Type)}
+	}
+	return result
+}
+
+// writeJSON writes a JSON response. The value is encoded first so that an
+// encoding failure, such as a NaN, still gets a proper error response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		status = http.StatusInternalServerError
+		buf.Reset()
+		json.NewEncoder(&buf).Encode(errorJSON{Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorJSON{Error: message})
+}
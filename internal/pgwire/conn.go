@@ -0,0 +1,888 @@
+package pgwire
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+// conn serves one client.
+type conn struct {
+	server     *Server
+	nc         net.Conn
+	r          *bufio.Reader
+	w          *writer
+	pid        int32
+	secret     int32
+	session    *engine.Session
+	statements map[string]*statement // Created by Parse; "" is the unnamed statement
+	portals    map[string]*portal    // Created by Bind; "" is the unnamed portal
+	failed     bool                  // An error aborted the transaction block
+
+	mu     sync.Mutex         // Guards cancel, which CancelRequest calls from another connection
+	cancel context.CancelFunc // Cancels the running statement, if any
+}
+
+// statement is a statement prepared with Parse or sent as a simple query.
+// Empty statements have neither a command nor a prepared statement.
+type statement struct {
+	command    *command                 // Set for statements the server handles itself
+	prepared   *query.PreparedStatement // Set for all other statements
+	paramTypes []uint32                 // Declared by the client or inferred; 0 if not known yet
+	columns    []query.Column
+	described  bool
+}
+
+// portal is a statement bound to parameter values, ready to run.
+type portal struct {
+	stmt    *statement
+	args    []interface{}
+	formats []int16          // Result column format codes
+	result  *query.ResultSet // Set once the portal has run
+	sent    int              // Rows sent so far
+}
+
+// command is a statement the server handles itself: transaction control
+// and session settings, which are accepted and ignored.
+type command struct {
+	tag      string // BEGIN, COMMIT, ROLLBACK or SET
+	readOnly bool   // BEGIN READ ONLY
+}
+
+// SQLSTATE codes of the errors the server reports.
+const (
+	codeSyntaxError           = "42601"
+	codeUndefinedTable        = "42P01"
+	codeSuccessful            = "00000"
+	codeUndefinedColumn       = "42703"
+	codeUndefinedFunction     = "42883"
+	codeDuplicateTable        = "42P07"
+	codeDuplicateStatement    = "42P05"
+	codeUndefinedStatement    = "26000"
+	codeUndefinedCursor       = "34000"
+	codeUniqueViolation       = "23505"
+	codeNotNullViolation      = "23502"
+	codeDivisionByZero        = "22012"
+	codeInvalidText           = "22P02"
+	codeReadOnlyTransaction   = "25006"
+	codeInsufficientPrivilege = "42501"
+	codeQueryCanceled         = "57014"
+	codeAbortedTransaction    = "25P02"
+	codeProtocolViolation     = "08P01"
+	codeFeatureNotSupported   = "0A000"
+	codeInternalError         = "XX000"
+)
+
+// pgError is an error with its SQLSTATE code.
+type pgError struct {
+	code    string
+	message string
+}
+
+func (e *pgError) Error() string {
+	return e.message
+}
+
+func newError(code, format string, args ...interface{}) error {
+	return &pgError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+var errAborted = newError(codeAbortedTransaction, "current transaction is aborted, commands ignored until end of transaction block")
+
+// serve runs the startup phase and then handles messages until the client
+// terminates or the connection fails.
+func (c *conn) serve(ctx context.Context) {
+	if !c.startup() {
+		return
+	}
+
+	// After an error in the extended query protocol, messages are
+	// discarded until the next Sync.
+	skipping := false
+	for {
+		msg, err := readMessage(c.r)
+		if err != nil {
+			return
+		}
+		if skipping && msg.kind != 'S' && msg.kind != 'X' {
+			continue
+		}
+
+		switch msg.kind {
+		case 'Q':
+			c.simpleQuery(ctx, msg)
+			c.readyForQuery()
+			err = c.w.flush()
+		case 'P':
+			err = c.parse(msg)
+		case 'B':
+			err = c.bind(msg)
+		case 'D':
+			err = c.describe(msg)
+		case 'E':
+			err = c.execute(ctx, msg)
+		case 'C':
+			err = c.close(msg)
+		case 'S':
+			skipping = false
+			c.readyForQuery()
+			err = c.w.flush()
+		case 'H':
+			err = c.w.flush()
+		case 'X':
+			return
+		default:
+			err = newError(codeProtocolViolation, "invalid frontend message type %q", msg.kind)
+		}
+		if err == nil {
+			continue
+		}
+		var pgErr *pgError
+		if !errors.As(err, &pgErr) {
+			return // Writing to the client failed
+		}
+		c.sendError(err)
+		skipping = true
+	}
+}
+
+// startup answers SSL requests, reads the startup message and greets the
+// client. It reports whether the client may go on.
+func (c *conn) startup() bool {
+	var params map[string]string
+	for params == nil {
+		msg, err := readStartup(c.r)
+		if err != nil {
+			return false
+		}
+		code, _ := msg.int32()
+		switch {
+		case code == sslRequestCode || code == gssRequestCode:
+			// Encryption is not supported; the client goes on in the clear.
+			c.w.w.WriteByte('N')
+			if c.w.flush() != nil {
+				return false
+			}
+			continue
+		case code == cancelCode:
+			pid, err1 := msg.int32()
+			secret, err2 := msg.int32()
+			if err1 == nil && err2 == nil {
+				c.server.cancel(pid, secret)
+			}
+			return false
+		case code>>16 != protocolVersion>>16:
+			c.sendFatal(newError(codeFeatureNotSupported, "unsupported frontend protocol %d.%d", code>>16, code&0xffff))
+			return false
+		}
+		params = make(map[string]string)
+		for {
+			key, err := msg.string()
+			if err != nil || key == "" {
+				break
+			}
+			if params[key], err = msg.string(); err != nil {
+				break
+			}
+		}
+	}
+
+	c.w.start('R')
+	c.w.int32(0) // AuthenticationOk
+	c.w.send()
+	for _, status := range [][2]string{
+		{"server_version", "14.0"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+		{"application_name", params["application_name"]},
+	} {
+		c.w.start('S')
+		c.w.string(status[0])
+		c.w.string(status[1])
+		c.w.send()
+	}
+	// The secret is all that keeps other clients from canceling the
+	// session's statements, so it must not be guessable.
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		c.sendFatal(newError(codeInternalError, "could not generate a cancel key: %v", err))
+		return false
+	}
+	c.secret = int32(binary.BigEndian.Uint32(key[:]))
+	c.w.start('K')
+	c.w.int32(c.pid)
+	c.w.int32(c.secret)
+	c.w.send()
+	c.server.started(c)
+	c.readyForQuery()
+	return c.w.flush() == nil
+}
+
+// simpleQuery runs the statements of a Query message, stopping at the
+// first error.
+func (c *conn) simpleQuery(ctx context.Context, msg *message) {
+	text, err := msg.string()
+	if err != nil {
+		c.sendError(newError(codeProtocolViolation, "invalid Query message"))
+		return
+	}
+	queries := query.SplitStatements(text)
+	if len(queries) == 0 {
+		c.w.start('I') // EmptyQueryResponse
+		c.w.send()
+		return
+	}
+	for _, text := range queries {
+		st, err := c.prepare(text)
+		if err == nil {
+			err = c.run(ctx, &portal{stmt: st}, 0, true)
+		}
+		if err != nil {
+			c.sendError(err)
+			return
+		}
+	}
+}
+
+// parse handles a Parse message: name, query and declared parameter types.
+func (c *conn) parse(msg *message) error {
+	name, err := msg.string()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Parse message")
+	}
+	text, err := msg.string()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Parse message")
+	}
+	n, err := msg.count(4)
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Parse message")
+	}
+	declared := make([]uint32, n)
+	for i := range declared {
+		oid, err := msg.int32()
+		if err != nil {
+			return newError(codeProtocolViolation, "invalid Parse message")
+		}
+		declared[i] = uint32(oid)
+	}
+
+	if _, exists := c.statements[name]; exists && name != "" {
+		return newError(codeDuplicateStatement, "prepared statement \"%s\" already exists", name)
+	}
+	queries := query.SplitStatements(text)
+	if len(queries) > 1 {
+		return newError(codeSyntaxError, "cannot insert multiple commands into a prepared statement")
+	}
+	st := &statement{}
+	if len(queries) == 1 {
+		if st, err = c.prepare(queries[0]); err != nil {
+			return err
+		}
+	}
+	if st.prepared != nil {
+		st.paramTypes = make([]uint32, st.prepared.NumParams())
+	}
+	copy(st.paramTypes, declared)
+	c.statements[name] = st
+
+	c.w.start('1') // ParseComplete
+	return c.w.send()
+}
+
+// bind handles a Bind message, creating a portal from a statement and
+// parameter values.
+func (c *conn) bind(msg *message) error {
+	invalid := newError(codeProtocolViolation, "invalid Bind message")
+	portalName, err := msg.string()
+	if err != nil {
+		return invalid
+	}
+	stmtName, err := msg.string()
+	if err != nil {
+		return invalid
+	}
+	paramFormats, err := msg.int16s()
+	if err != nil {
+		return invalid
+	}
+	n, err := msg.count(4)
+	if err != nil {
+		return invalid
+	}
+	raw := make([][]byte, n)
+	for i := range raw {
+		size, err := msg.int32()
+		if err != nil {
+			return invalid
+		}
+		if size < 0 {
+			continue // NULL
+		}
+		if raw[i], err = msg.bytes(int(size)); err != nil {
+			return invalid
+		}
+	}
+	resultFormats, err := msg.int16s()
+	if err != nil {
+		return invalid
+	}
+
+	st, ok := c.statements[stmtName]
+	if !ok {
+		return newError(codeUndefinedStatement, "prepared statement \"%s\" does not exist", stmtName)
+	}
+	if n != len(st.paramTypes) {
+		return newError(codeProtocolViolation, "bind message supplies %d parameters, but prepared statement \"%s\" requires %d", n, stmtName, len(st.paramTypes))
+	}
+	if !validFormats(paramFormats, n) {
+		return newError(codeProtocolViolation, "bind message has %d parameter formats but %d parameters", len(paramFormats), n)
+	}
+	if len(resultFormats) > 1 {
+		if err := c.describeStatement(st); err != nil {
+			return err
+		}
+		if !validFormats(resultFormats, len(st.columns)) {
+			return newError(codeProtocolViolation, "bind message has %d result formats but query has %d columns", len(resultFormats), len(st.columns))
+		}
+	}
+	for _, oid := range st.paramTypes {
+		if oid == oidUnknown {
+			if err := c.describeStatement(st); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	args := make([]interface{}, n)
+	for i := range raw {
+		if args[i], err = decodeParam(raw[i], st.paramTypes[i], formatFor(paramFormats, i)); err != nil {
+			return newError(codeInvalidText, "invalid value for parameter $%d: %v", i+1, err)
+		}
+	}
+	c.portals[portalName] = &portal{stmt: st, args: args, formats: resultFormats}
+
+	c.w.start('2') // BindComplete
+	return c.w.send()
+}
+
+// describe handles a Describe message for a statement or a portal.
+func (c *conn) describe(msg *message) error {
+	kind, err := msg.byte1()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Describe message")
+	}
+	name, err := msg.string()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Describe message")
+	}
+
+	switch kind {
+	case 'S':
+		st, ok := c.statements[name]
+		if !ok {
+			return newError(codeUndefinedStatement, "prepared statement \"%s\" does not exist", name)
+		}
+		if err := c.describeStatement(st); err != nil {
+			return err
+		}
+		c.w.start('t') // ParameterDescription
+		c.w.int16(int16(len(st.paramTypes)))
+		for _, oid := range st.paramTypes {
+			c.w.int32(int32(oid))
+		}
+		c.w.send()
+		return c.rowDescription(st.columns, nil, st.prepared == nil)
+	case 'P':
+		p, ok := c.portals[name]
+		if !ok {
+			return newError(codeUndefinedCursor, "portal \"%s\" does not exist", name)
+		}
+		if err := c.describeStatement(p.stmt); err != nil {
+			return err
+		}
+		return c.rowDescription(p.stmt.columns, p.formats, p.stmt.prepared == nil)
+	}
+	return newError(codeProtocolViolation, "invalid Describe message")
+}
+
+// execute handles an Execute message, running a portal and sending at
+// most maxRows rows of its result, or all of them if maxRows is 0.
+func (c *conn) execute(ctx context.Context, msg *message) error {
+	name, err := msg.string()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Execute message")
+	}
+	maxRows, err := msg.int32()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Execute message")
+	}
+	p, ok := c.portals[name]
+	if !ok {
+		return newError(codeUndefinedCursor, "portal \"%s\" does not exist", name)
+	}
+	return c.run(ctx, p, int(maxRows), false)
+}
+
+// close handles a Close message for a statement or a portal.
+func (c *conn) close(msg *message) error {
+	kind, err := msg.byte1()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Close message")
+	}
+	name, err := msg.string()
+	if err != nil {
+		return newError(codeProtocolViolation, "invalid Close message")
+	}
+	switch kind {
+	case 'S':
+		delete(c.statements, name)
+	case 'P':
+		delete(c.portals, name)
+	default:
+		return newError(codeProtocolViolation, "invalid Close message")
+	}
+	c.w.start('3') // CloseComplete
+	return c.w.send()
+}
+
+// prepare turns the text of one statement into a statement.
+func (c *conn) prepare(text string) (*statement, error) {
+	if cmd := parseCommand(text); cmd != nil {
+		return &statement{command: cmd}, nil
+	}
+	p, err := c.session.Prepare(text)
+	if err != nil {
+		return nil, &pgError{code: codeSyntaxError, message: err.Error()}
+	}
+	return &statement{prepared: p}, nil
+}
+
+// describeStatement finds the result columns of a statement and the
+// types of the parameters the client did not declare.
+func (c *conn) describeStatement(st *statement) error {
+	if st.described || st.prepared == nil {
+		return nil
+	}
+	types, columns, err := c.session.Describe(st.prepared)
+	if err != nil {
+		return errorWithCode(err)
+	}
+	for i, t := range types {
+		if st.paramTypes[i] == oidUnknown {
+			st.paramTypes[i] = typeOID(t)
+		}
+	}
+	st.columns = columns
+	st.described = true
+	return nil
+}
+
+// run runs a portal, or continues one that was suspended, and sends its
+// rows and command tag. The simple query protocol also wants the row
+// description.
+func (c *conn) run(ctx context.Context, p *portal, maxRows int, describe bool) error {
+	st := p.stmt
+	if st.command != nil {
+		return c.runCommand(ctx, st.command)
+	}
+	if st.prepared == nil {
+		c.w.start('I') // EmptyQueryResponse
+		return c.w.send()
+	}
+	if c.failed {
+		return errAborted
+	}
+
+	if p.result == nil {
+		var rs *query.ResultSet
+		var err error
+		if stmt, ok := st.prepared.Statement().(*query.CopyStatement); ok && stmt.Stdio {
+			rs, err = c.runCopy(ctx, st.prepared, stmt)
+		} else {
+			rs, err = c.runStatement(ctx, func(ctx context.Context) (*query.ResultSet, error) {
+				return c.session.Run(ctx, st.prepared, p.args...)
+			})
+		}
+		if err != nil {
+			if c.session.InTransaction() {
+				c.failed = true
+			}
+			return errorWithCode(err)
+		}
+		p.result = rs
+		for _, notice := range rs.Notices() {
+			c.sendNotice('N', "NOTICE", newError(codeSuccessful, "%s", notice))
+		}
+		if describe {
+			if err := c.rowDescription(rs.Columns(), nil, !rs.HasRows()); err != nil {
+				return err
+			}
+		}
+	}
+
+	rs := p.result
+	if rs.HasRows() {
+		// Values are encoded as the row description announced.
+		columns := rs.Columns()
+		if st.described && len(st.columns) == len(columns) {
+			columns = st.columns
+		}
+		// The table may have changed since Bind checked the formats.
+		if !validFormats(p.formats, len(columns)) {
+			return newError(codeProtocolViolation, "bind message has %d result formats but query has %d columns", len(p.formats), len(columns))
+		}
+		sent := 0
+		for maxRows <= 0 || sent < maxRows {
+			if !rs.Next() {
+				break
+			}
+			if err := c.dataRow(rs.Values(), columns, p.formats); err != nil {
+				return err
+			}
+			sent++
+		}
+		p.sent += sent
+		if p.sent < rs.Len() {
+			c.w.start('s') // PortalSuspended
+			return c.w.send()
+		}
+		if _, ok := st.prepared.Statement().(*query.SelectStatement); ok {
+			return c.commandComplete(fmt.Sprintf("SELECT %d", sent))
+		}
+	}
+	return c.commandComplete(commandTag(st.prepared.Statement(), rs))
+}
+
+// runStatement runs a statement in the session with fn. A CancelRequest
+// stops it while it runs.
+func (c *conn) runStatement(ctx context.Context, fn func(context.Context) (*query.ResultSet, error)) (*query.ResultSet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.cancel = nil
+		c.mu.Unlock()
+	}()
+	return fn(ctx)
+}
+
+// runCopy runs COPY FROM STDIN or COPY TO STDOUT with the copy protocol.
+// The data is read from CopyData messages up to CopyDone before the
+// statement runs, or sent in CopyData messages once it has run, so the
+// database is not held while the client sends or receives. The column
+// count announced is that of the statement's column list.
+func (c *conn) runCopy(ctx context.Context, p *query.PreparedStatement, stmt *query.CopyStatement) (*query.ResultSet, error) {
+	if stmt.From {
+		text, err := c.copyIn(len(stmt.Columns))
+		if err != nil {
+			return nil, err
+		}
+		return c.runStatement(ctx, func(ctx context.Context) (*query.ResultSet, error) {
+			return c.session.RunCopy(ctx, p, bytes.NewReader(text), nil)
+		})
+	}
+
+	var out bytes.Buffer
+	rs, err := c.runStatement(ctx, func(ctx context.Context) (*query.ResultSet, error) {
+		return c.session.RunCopy(ctx, p, nil, &out)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.copyResponse('H', len(stmt.Columns)) // CopyOutResponse
+	for _, line := range bytes.SplitAfter(out.Bytes(), []byte("\n")) {
+		if len(line) > 0 {
+			c.w.start('d') // CopyData
+			c.w.bytes(line)
+			c.w.send()
+		}
+	}
+	c.w.start('c') // CopyDone
+	return rs, c.w.send()
+}
+
+// copyIn asks the client for the data of a COPY FROM STDIN and reads it
+// up to CopyDone.
+func (c *conn) copyIn(columns int) ([]byte, error) {
+	c.copyResponse('G', columns) // CopyInResponse
+	if err := c.w.flush(); err != nil {
+		return nil, err
+	}
+	var text bytes.Buffer
+	for {
+		msg, err := readMessage(c.r)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.kind {
+		case 'd': // CopyData
+			text.Write(msg.body)
+		case 'c': // CopyDone
+			return text.Bytes(), nil
+		case 'f': // CopyFail
+			reason, _ := msg.string()
+			return nil, newError(codeQueryCanceled, "COPY from stdin failed: %s", reason)
+		case 'H', 'S':
+			// Flush and Sync mean nothing during a copy.
+		default:
+			return nil, newError(codeProtocolViolation, "unexpected message type %q during COPY from stdin", msg.kind)
+		}
+	}
+}
+
+// copyResponse starts a copy in the text format.
+func (c *conn) copyResponse(kind byte, columns int) {
+	c.w.start(kind)
+	c.w.byte1(0)
+	c.w.int16(int16(columns))
+	for i := 0; i < columns; i++ {
+		c.w.int16(0)
+	}
+	c.w.send()
+}
+
+// cancelStatement cancels the running statement, if any.
+func (c *conn) cancelStatement() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// runCommand runs transaction control and SET statements.
+func (c *conn) runCommand(ctx context.Context, cmd *command) error {
+	tag := cmd.tag
+	switch cmd.tag {
+	case "BEGIN":
+		if c.failed {
+			return errAborted
+		}
+		if !c.session.InTransaction() {
+			if err := c.session.Begin(ctx, cmd.readOnly); err != nil {
+				return errorWithCode(err)
+			}
+		}
+	case "COMMIT", "ROLLBACK":
+		if c.failed {
+			tag = "ROLLBACK"
+		}
+		if c.session.InTransaction() {
+			if tag == "ROLLBACK" {
+				c.session.Rollback()
+			} else {
+				c.session.Commit()
+			}
+		}
+		c.failed = false
+	case "SET":
+		if c.failed {
+			return errAborted
+		}
+	}
+	return c.commandComplete(tag)
+}
+
+// rowDescription sends a RowDescription for result columns, or NoData for
+// statements without rows.
+func (c *conn) rowDescription(columns []query.Column, formats []int16, noData bool) error {
+	if noData || columns == nil {
+		c.w.start('n') // NoData
+		return c.w.send()
+	}
+	c.w.start('T')
+	c.w.int16(int16(len(columns)))
+	for i, col := range columns {
+		oid := typeOID(col.Type)
+		c.w.string(col.Name)
+		c.w.int32(0) // Table OID
+		c.w.int16(0) // Column number
+		c.w.int32(int32(oid))
+		c.w.int16(typeSize(oid))
+		c.w.int32(-1) // Type modifier
+		c.w.int16(formatFor(formats, i))
+	}
+	return c.w.send()
+}
+
+func (c *conn) dataRow(values []interface{}, columns []query.Column, formats []int16) error {
+	c.w.start('D')
+	c.w.int16(int16(len(values)))
+	for i, value := range values {
+		if value == nil {
+			c.w.int32(-1)
+			continue
+		}
+		encoded, err := encodeValue(value, typeOID(columns[i].Type), formatFor(formats, i))
+		if err != nil {
+			return newError(codeInvalidText, "column %s: %v", columns[i].Name, err)
+		}
+		c.w.int32(int32(len(encoded)))
+		c.w.bytes(encoded)
+	}
+	return c.w.send()
+}
+
+func (c *conn) commandComplete(tag string) error {
+	c.w.start('C')
+	c.w.string(tag)
+	return c.w.send()
+}
+
+// readyForQuery tells the client the server is idle, in a transaction
+// block or in a failed one.
+func (c *conn) readyForQuery() {
+	status := byte('I')
+	switch {
+	case c.failed:
+		status = 'E'
+	case c.session.InTransaction():
+		status = 'T'
+	}
+	c.w.start('Z')
+	c.w.byte1(status)
+	c.w.send()
+}
+
+func (c *conn) sendError(err error) {
+	c.sendNotice('E', "ERROR", err)
+}
+
+// sendFatal reports an error that ends the connection.
+func (c *conn) sendFatal(err error) {
+	c.sendNotice('E', "FATAL", err)
+	c.w.flush()
+}
+
+func (c *conn) sendNotice(kind byte, severity string, err error) {
+	code := codeInternalError
+	var pgErr *pgError
+	if errors.As(errorWithCode(err), &pgErr) {
+		code = pgErr.code
+	}
+	c.w.start(kind)
+	c.w.byte1('S')
+	c.w.string(severity)
+	c.w.byte1('V')
+	c.w.string(severity)
+	c.w.byte1('C')
+	c.w.string(code)
+	c.w.byte1('M')
+	c.w.string(err.Error())
+	c.w.byte1(0)
+	c.w.send()
+}
+
+// errorWithCode gives an error of the engine its SQLSTATE code, found from
+// its message.
+func errorWithCode(err error) error {
+	var pgErr *pgError
+	if errors.As(err, &pgErr) {
+		return err
+	}
+	message := err.Error()
+	code := codeInternalError
+	var canceled *query.CanceledError
+	switch {
+	case errors.As(err, &canceled):
+		code = codeQueryCanceled
+	case err == engine.ErrReadOnly, err == engine.ErrReadOnlyDatabase:
+		code = codeReadOnlyTransaction
+	case errors.Is(err, engine.ErrFileAccess):
+		code = codeInsufficientPrivilege
+	case strings.Contains(message, "duplicate key value"):
+		code = codeUniqueViolation
+	case strings.Contains(message, "violates not-null constraint"):
+		code = codeNotNullViolation
+	case strings.Contains(message, "division by zero"):
+		code = codeDivisionByZero
+	case strings.Contains(message, "cannot convert"):
+		code = codeInvalidText
+	case strings.Contains(message, "function") && strings.Contains(message, "does not exist"):
+		code = codeUndefinedFunction
+	case strings.Contains(message, "column") && (strings.Contains(message, "does not exist") || strings.Contains(message, "not found")):
+		code = codeUndefinedColumn
+	case strings.Contains(message, "table") && strings.Contains(message, "not found"):
+		code = codeUndefinedTable
+	case strings.Contains(message, "already exists"):
+		code = codeDuplicateTable
+	}
+	return &pgError{code: code, message: message}
+}
+
+// commandTag is the tag of CommandComplete for a statement.
+func commandTag(stmt query.Statement, rs *query.ResultSet) string {
+	switch stmt.(type) {
+	case *query.SelectStatement:
+		return fmt.Sprintf("SELECT %d", rs.Len())
+	case *query.InsertStatement:
+		return fmt.Sprintf("INSERT 0 %d", rs.RowsAffected())
+	case *query.UpdateStatement:
+		return fmt.Sprintf("UPDATE %d", rs.RowsAffected())
+	case *query.DeleteStatement:
+		return fmt.Sprintf("DELETE %d", rs.RowsAffected())
+	case *query.CreateTableStatement:
+		return "CREATE TABLE"
+	case *query.CreateIndexStatement:
+		return "CREATE INDEX"
+	case *query.ExplainStatement:
+		return "EXPLAIN"
+	case *query.AnalyzeStatement:
+		return "ANALYZE"
+	case *query.SetStatement:
+		return "SET"
+	case *query.CopyStatement:
+		return fmt.Sprintf("COPY %d", rs.RowsAffected())
+	case *query.BackupStatement:
+		return "BACKUP"
+	}
+	return "OK"
+}
+
+// parseCommand recognizes the statements the server handles itself.
+func parseCommand(text string) *command {
+	words := strings.Fields(strings.ToUpper(text))
+	if len(words) == 0 {
+		return nil
+	}
+	switch words[0] {
+	case "BEGIN":
+		return &command{tag: "BEGIN", readOnly: strings.Contains(strings.Join(words, " "), "READ ONLY")}
+	case "START":
+		if len(words) > 1 && words[1] == "TRANSACTION" {
+			return &command{tag: "BEGIN", readOnly: strings.Contains(strings.Join(words, " "), "READ ONLY")}
+		}
+	case "COMMIT", "END":
+		return &command{tag: "COMMIT"}
+	case "ROLLBACK", "ABORT":
+		if len(words) == 1 || words[1] == "TRANSACTION" || words[1] == "WORK" {
+			return &command{tag: "ROLLBACK"}
+		}
+	case "SET":
+		// Clients change settings such as client_encoding when they
+		// connect; the server ignores them. statement_timeout is run by
+		// the session.
+		if len(words) < 2 || words[1] != "STATEMENT_TIMEOUT" {
+			return &command{tag: "SET"}
+		}
+	}
+	return nil
+}
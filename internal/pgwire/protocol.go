@@ -0,0 +1,366 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// Protocol codes sent in place of a protocol version in startup packets.
+const (
+	protocolVersion = 3 << 16
+	sslRequestCode  = 80877103
+	gssRequestCode  = 80877104
+	cancelCode      = 80877102
+)
+
+// maxMessageSize bounds the length of a client message.
+const maxMessageSize = 1 << 26
+
+// Type OIDs of the PostgreSQL types that doggodb types map to.
+const (
+	oidUnknown = 0
+	oidBool    = 16
+	oidInt8    = 20
+	oidInt2    = 21
+	oidInt4    = 23
+	oidText    = 25
+	oidFloat4  = 700
+	oidFloat8  = 701
+	oidVarchar = 1043
+	oidNumeric = 1700
+)
+
+// Format codes of parameters and result columns.
+const (
+	formatText   = 0
+	formatBinary = 1
+)
+
+// typeOID returns the PostgreSQL type of a column type. Untyped columns
+// are sent as text.
+func typeOID(t data.Type) uint32 {
+	switch t {
+	case data.TypeInt:
+		return oidInt8
+	case data.TypeFloat:
+		return oidFloat8
+	case data.TypeBool:
+		return oidBool
+	}
+	return oidText
+}
+
+// typeSize is the size of a type for RowDescription, -1 if it varies.
+func typeSize(oid uint32) int16 {
+	switch oid {
+	case oidInt8, oidFloat8:
+		return 8
+	case oidBool:
+		return 1
+	}
+	return -1
+}
+
+// message is a message read from the client.
+type message struct {
+	kind byte
+	body []byte
+	pos  int
+}
+
+// readStartup reads an untyped startup-phase packet: a length followed by
+// a protocol code and the rest of the packet.
+func readStartup(r *bufio.Reader) (*message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < 8 || size > maxMessageSize {
+		return nil, fmt.Errorf("invalid startup packet length %d", size)
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &message{body: body}, nil
+}
+
+// readMessage reads a typed message.
+func readMessage(r *bufio.Reader) (*message, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < 4 || size > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", size)
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &message{kind: kind, body: body}, nil
+}
+
+var (
+	errShortMessage  = errors.New("message is too short")
+	errInvalidLength = errors.New("invalid list length")
+)
+
+func (m *message) byte1() (byte, error) {
+	if m.pos+1 > len(m.body) {
+		return 0, errShortMessage
+	}
+	m.pos++
+	return m.body[m.pos-1], nil
+}
+
+func (m *message) int16() (int16, error) {
+	if m.pos+2 > len(m.body) {
+		return 0, errShortMessage
+	}
+	m.pos += 2
+	return int16(binary.BigEndian.Uint16(m.body[m.pos-2:])), nil
+}
+
+func (m *message) int32() (int32, error) {
+	if m.pos+4 > len(m.body) {
+		return 0, errShortMessage
+	}
+	m.pos += 4
+	return int32(binary.BigEndian.Uint32(m.body[m.pos-4:])), nil
+}
+
+// string reads a null-terminated string.
+func (m *message) string() (string, error) {
+	end := m.pos
+	for end < len(m.body) && m.body[end] != 0 {
+		end++
+	}
+	if end >= len(m.body) {
+		return "", errShortMessage
+	}
+	s := string(m.body[m.pos:end])
+	m.pos = end + 1
+	return s, nil
+}
+
+func (m *message) bytes(n int) ([]byte, error) {
+	if n < 0 || m.pos+n > len(m.body) {
+		return nil, errShortMessage
+	}
+	m.pos += n
+	return m.body[m.pos-n : m.pos], nil
+}
+
+// count reads the length of a list whose items take at least size bytes
+// each. It is checked against the rest of the message before anything is
+// allocated for the list.
+func (m *message) count(size int) (int, error) {
+	n, err := m.int16()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || int(n)*size > len(m.body)-m.pos {
+		return 0, errInvalidLength
+	}
+	return int(n), nil
+}
+
+// int16s reads a count followed by that many 16-bit integers, as used for
+// format codes.
+func (m *message) int16s() ([]int16, error) {
+	n, err := m.count(2)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]int16, n)
+	for i := range values {
+		if values[i], err = m.int16(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// writer builds server messages.
+type writer struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// start begins a message of the given kind.
+func (w *writer) start(kind byte) {
+	w.buf = append(w.buf[:0], kind, 0, 0, 0, 0)
+}
+
+func (w *writer) byte1(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *writer) int16(n int16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(n))
+}
+
+func (w *writer) int32(n int32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+}
+
+func (w *writer) string(s string) {
+	w.buf = append(append(w.buf, s...), 0)
+}
+
+func (w *writer) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// send completes the message and buffers it for the client.
+func (w *writer) send() error {
+	binary.BigEndian.PutUint32(w.buf[1:], uint32(len(w.buf)-1))
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
+
+// encodeValue encodes a result value for a column of the given type, in
+// text or binary format. The value is converted to the column type first,
+// so untyped values still match their RowDescription.
+func encodeValue(value interface{}, oid uint32, format int16) ([]byte, error) {
+	if format == formatText {
+		return []byte(textValue(value)), nil
+	}
+	switch oid {
+	case oidInt8:
+		n, err := data.ConvertValue(value, data.TypeInt)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(n.(int64))), nil
+	case oidFloat8:
+		f, err := data.ConvertValue(value, data.TypeFloat)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f.(float64))), nil
+	case oidBool:
+		b, err := data.ConvertValue(value, data.TypeBool)
+		if err != nil {
+			return nil, err
+		}
+		if b.(bool) {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	}
+	return []byte(textValue(value)), nil
+}
+
+// textValue is the text format of a value.
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+// decodeParam decodes a parameter value sent by the client for a
+// placeholder of the given type. Text values of untyped placeholders stay
+// strings, which the executor converts where a column type calls for it.
+func decodeParam(raw []byte, oid uint32, format int16) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if format == formatBinary {
+		switch oid {
+		case oidInt2:
+			if len(raw) == 2 {
+				return int64(int16(binary.BigEndian.Uint16(raw))), nil
+			}
+		case oidInt4:
+			if len(raw) == 4 {
+				return int64(int32(binary.BigEndian.Uint32(raw))), nil
+			}
+		case oidInt8:
+			if len(raw) == 8 {
+				return int64(binary.BigEndian.Uint64(raw)), nil
+			}
+		case oidFloat4:
+			if len(raw) == 4 {
+				return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+			}
+		case oidFloat8:
+			if len(raw) == 8 {
+				return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+			}
+		case oidBool:
+			if len(raw) == 1 {
+				return raw[0] != 0, nil
+			}
+		case oidText, oidVarchar, oidUnknown:
+			return string(raw), nil
+		default:
+			return nil, fmt.Errorf("binary format is not supported for type %d", oid)
+		}
+		return nil, fmt.Errorf("invalid binary value for type %d", oid)
+	}
+
+	text := string(raw)
+	switch oid {
+	case oidInt2, oidInt4, oidInt8:
+		return data.ConvertValue(text, data.TypeInt)
+	case oidFloat4, oidFloat8, oidNumeric:
+		return data.ConvertValue(text, data.TypeFloat)
+	case oidBool:
+		switch strings.ToLower(text) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("invalid input syntax for type boolean: %q", text)
+	}
+	return text, nil
+}
+
+// formatFor returns the format of column i from the format codes of a
+// Bind message: none means text, one applies to all columns. Otherwise
+// there is one per column, as validFormats makes sure.
+func formatFor(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return formatText
+	case 1:
+		return formats[0]
+	}
+	return formats[i]
+}
+
+// validFormats reports whether a Bind message has no format codes, one
+// for all, or one for each of n parameters or columns.
+func validFormats(formats []int16, n int) bool {
+	return len(formats) <= 1 || len(formats) == n
+}
@@ -0,0 +1,177 @@
+// Package pgwire serves a database over version 3 of the PostgreSQL
+// frontend/backend protocol, so that psql and PostgreSQL client libraries
+// can connect to doggodb. It supports the simple query protocol, the
+// extended query protocol (Parse, Bind, Describe, Execute) and transaction
+// blocks, and COPY FROM STDIN and TO STDOUT. Clients are not authenticated
+// and SSL is declined, so clients may not use files on the server unless
+// SetFileDir allows a directory.
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/H3199/doggodb/internal/engine"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("pgwire: server closed")
+
+// Server accepts PostgreSQL clients for a database.
+type Server struct {
+	db      *engine.Database
+	fileDir string // See SetFileDir
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	clients   map[int32]*conn // Started clients by process ID, for CancelRequest
+	nextPID   int32
+	closed    bool
+}
+
+// NewServer creates a server for a database.
+func NewServer(db *engine.Database) *Server {
+	return &Server{
+		db:        db,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		clients:   make(map[int32]*conn),
+	}
+}
+
+// SetFileDir lets clients COPY and BACKUP files in dir on the server. By
+// default they may use no files, as anyone who can connect could otherwise
+// read and write the files of the server's user. Call it before serving.
+func (s *Server) SetFileDir(dir string) {
+	s.fileDir = dir
+}
+
+// ListenAndServe listens on a TCP address, such as ":5432", and serves
+// clients until the server is closed.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts clients on a listener, serving each on its own goroutine,
+// until the server is closed. The listener is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(nc) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(nc)
+	}
+}
+
+// Close stops the listeners and disconnects every client. Open
+// transactions are rolled back.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for nc := range s.conns {
+		nc.Close()
+	}
+	return nil
+}
+
+// track registers a client connection, unless the server is closed.
+func (s *Server) track(nc net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[nc] = struct{}{}
+	return true
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	s.mu.Lock()
+	s.nextPID++
+	pid := s.nextPID
+	s.mu.Unlock()
+
+	c := &conn{
+		server:     s,
+		nc:         nc,
+		r:          bufio.NewReader(nc),
+		w:          &writer{w: bufio.NewWriter(nc)},
+		pid:        pid,
+		session:    s.db.Session(),
+		statements: make(map[string]*statement),
+		portals:    make(map[string]*portal),
+	}
+	c.session.RestrictFiles(s.fileDir)
+	defer func() {
+		c.session.Close()
+		nc.Close()
+		s.mu.Lock()
+		delete(s.conns, nc)
+		delete(s.clients, pid)
+		s.mu.Unlock()
+	}()
+	// A bug that one client triggers ends its connection, not the server.
+	defer func() {
+		if r := recover(); r != nil {
+			c.sendFatal(newError(codeInternalError, "internal error: %v", r))
+		}
+	}()
+	c.serve(context.Background())
+}
+
+// started registers a client that completed its startup, so that cancel
+// requests can find it.
+func (s *Server) started(c *conn) {
+	s.mu.Lock()
+	s.clients[c.pid] = c
+	s.mu.Unlock()
+}
+
+// cancel handles a CancelRequest, canceling the running statement of the
+// client with the process ID if the secret key matches.
+func (s *Server) cancel(pid, secret int32) {
+	s.mu.Lock()
+	c := s.clients[pid]
+	s.mu.Unlock()
+	if c != nil && c.secret == secret {
+		c.cancelStatement()
+	}
+}
@@ -1,6 +1,11 @@
 package query
 
-import "strings"
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 // Node is the interface that all AST nodes implement.
 type Node interface {
@@ -13,40 +18,269 @@ type Statement interface {
 	statementNode()
 }
 
-// SelectStatement represents a SELECT query in the AST.
+// SelectStatement represents a SELECT query in the AST. Expressions (select
+// list items, conditions, keys) are kept as query text. The parser also
+// keeps their parsed trees, which the planner uses instead of parsing the
+// text again; statements built by hand have their text parsed when they
+// are planned. The text of a parsed statement should not be changed.
 type SelectStatement struct {
+	With       []CommonTableExpr // Named queries of a WITH clause
+	Recursive  bool              // WITH RECURSIVE
 	Table      string
-	Columns    []string
-	Conditions string // Optional WHERE clause
+	Subquery   *SelectStatement // Derived table read instead of Table
+	Alias      string           // Optional alias of Table, required for Subquery
+	Distinct   bool             // SELECT DISTINCT
+	Columns    []string         // Select list; "*" or "t.*" selects every column of the FROM clause or of t
+	Aliases    []string         // Output names given with AS, parallel to Columns; nil if there are none
+	Joins      []JoinClause     // Further tables joined to Table
+	Conditions string           // Optional WHERE clause
+	GroupBy    []string
+	Having     string
+	Compound   []SetOperation // Further SELECTs combined with this one
+	OrderBy    []OrderItem    // Sorts the whole result of a compound SELECT
+	Limit      string         // Optional LIMIT expression
+	Offset     string         // Optional OFFSET expression
+
+	// Parsed expressions, nil unless set by the parser.
+	items         []Expr // Parallel to Columns, nil for * and t.*
+	where, having Expr
+	groupBy       []Expr
+	limit, offset Expr
+}
+
+// SetOperation combines the result so far with another SELECT. Op is
+// UNION, INTERSECT or EXCEPT; All keeps duplicate rows.
+type SetOperation struct {
+	Op     string
+	All    bool
+	Select *SelectStatement
+}
+
+// JoinClause is one JOIN of a SELECT. Type is INNER, LEFT or CROSS.
+type JoinClause struct {
+	Type       string
+	Table      string
+	Subquery   *SelectStatement // Derived table joined instead of Table
+	Alias      string
+	Conditions string // ON condition, empty for CROSS joins
+	on         Expr   // Parsed Conditions
+}
+
+// CommonTableExpr is one named query of a WITH clause. A recursive one has
+// a second query, joined with UNION [ALL], that reads the rows produced so
+// far under the name.
+type CommonTableExpr struct {
+	Name      string
+	Columns   []string // Optional column names
+	Select    *SelectStatement
+	Recursive *SelectStatement // Recursive term, nil for plain queries
+	UnionAll  bool
+}
+
+// String returns a string representation of the CommonTableExpr.
+func (c *CommonTableExpr) String() string {
+	sql := c.Name
+	if len(c.Columns) > 0 {
+		sql += " (" + strings.Join(c.Columns, ", ") + ")"
+	}
+	body := c.Select.String()
+	if c.Recursive != nil {
+		union := " UNION "
+		if c.UnionAll {
+			union = " UNION ALL "
+		}
+		body += union + c.Recursive.String()
+	}
+	return sql + " AS (" + body + ")"
+}
+
+// OrderItem is one ORDER BY key.
+type OrderItem struct {
+	Expr   string
+	Desc   bool
+	parsed Expr
 }
 
 func (s *SelectStatement) statementNode() {}
 
 // String returns a string representation of the SelectStatement.
 func (s *SelectStatement) String() string {
-	return "SELECT * FROM " + s.Table
+	columns := "*"
+	if len(s.Columns) > 0 {
+		items := make([]string, len(s.Columns))
+		for i, column := range s.Columns {
+			items[i] = column
+			if i < len(s.Aliases) && s.Aliases[i] != "" {
+				items[i] += " AS " + s.Aliases[i]
+			}
+		}
+		columns = strings.Join(items, ", ")
+	}
+	if s.Distinct {
+		columns = "DISTINCT " + columns
+	}
+	sql := "SELECT " + columns
+	if len(s.With) > 0 {
+		ctes := make([]string, len(s.With))
+		for i := range s.With {
+			ctes[i] = s.With[i].String()
+		}
+		with := "WITH "
+		if s.Recursive {
+			with = "WITH RECURSIVE "
+		}
+		sql = with + strings.Join(ctes, ", ") + " " + sql
+	}
+	if s.Table != "" || s.Subquery != nil {
+		sql += " FROM " + sourceString(s.Table, s.Subquery, s.Alias)
+	}
+	for _, join := range s.Joins {
+		sql += " " + join.Type + " JOIN " + sourceString(join.Table, join.Subquery, join.Alias)
+		if join.Conditions != "" {
+			sql += " ON " + join.Conditions
+		}
+	}
+	if s.Conditions != "" {
+		sql += " WHERE " + s.Conditions
+	}
+	if len(s.GroupBy) > 0 {
+		sql += " GROUP BY " + strings.Join(s.GroupBy, ", ")
+	}
+	if s.Having != "" {
+		sql += " HAVING " + s.Having
+	}
+	for _, op := range s.Compound {
+		sql += " " + op.Op
+		if op.All {
+			sql += " ALL"
+		}
+		operand := op.Select.String()
+		if len(op.Select.Compound) > 0 || len(op.Select.OrderBy) > 0 || op.Select.Limit != "" || op.Select.Offset != "" || len(op.Select.With) > 0 {
+			operand = "(" + operand + ")"
+		}
+		sql += " " + operand
+	}
+	if len(s.OrderBy) > 0 {
+		keys := []string{}
+		for _, item := range s.OrderBy {
+			key := item.Expr
+			if item.Desc {
+				key += " DESC"
+			}
+			keys = append(keys, key)
+		}
+		sql += " ORDER BY " + strings.Join(keys, ", ")
+	}
+	if s.Limit != "" {
+		sql += " LIMIT " + s.Limit
+	}
+	if s.Offset != "" {
+		sql += " OFFSET " + s.Offset
+	}
+	return sql
+}
+
+// HasFrom reports whether the query reads from a table or derived table.
+func (s *SelectStatement) HasFrom() bool {
+	return s.Table != "" || s.Subquery != nil
+}
+
+// sourceString renders a FROM item: a table or a derived table.
+func sourceString(table string, subquery *SelectStatement, alias string) string {
+	if subquery != nil {
+		table = "(" + subquery.String() + ")"
+	}
+	return tableString(table, alias)
+}
+
+func tableString(table, alias string) string {
+	if alias != "" {
+		return table + " AS " + alias
+	}
+	return table
 }
 
 // InsertStatement represents an INSERT query in the AST.
 type InsertStatement struct {
-	Table   string   // The name of the table being inserted into.
-	Columns []string // The list of column names.
-	Values  []string // The corresponding list of values.
+	Table      string            // The name of the table being inserted into.
+	Columns    []string          // The list of column names, empty for schema order.
+	Values     []string          // The corresponding list of values.
+	MoreValues [][]string        // Further VALUES tuples of a multi-row insert.
+	Select     *SelectStatement  // Source query for INSERT ... SELECT.
+	OnConflict *OnConflictClause // Upsert behaviour, if any.
+	Returning  []string          // Columns of the RETURNING clause, if any.
+
+	// Parsed Tuples, nil unless set by the parser. Without them, as in a
+	// statement built by hand, the values are literals: quoted strings,
+	// NULL, placeholders, or text that the table's schema converts.
+	values [][]Expr
+}
+
+// OnConflictClause is the ON CONFLICT part of an INSERT, turning it into an
+// upsert.
+type OnConflictClause struct {
+	Columns     []string          // Conflict target; empty matches any unique constraint.
+	DoNothing   bool              // DO NOTHING rather than DO UPDATE.
+	Assignments map[string]string // DO UPDATE SET values; excluded.<col> is the proposed row.
+	values      map[string]Expr   // Parsed Assignments
+}
+
+// String returns a string representation of the OnConflictClause.
+func (o *OnConflictClause) String() string {
+	sql := "ON CONFLICT"
+	if len(o.Columns) > 0 {
+		sql += " (" + strings.Join(o.Columns, ", ") + ")"
+	}
+	if o.DoNothing {
+		return sql + " DO NOTHING"
+	}
+	assignments := []string{}
+	for col, val := range o.Assignments {
+		assignments = append(assignments, col+" = "+val)
+	}
+	sort.Strings(assignments)
+	return sql + " DO UPDATE SET " + strings.Join(assignments, ", ")
 }
 
 func (i *InsertStatement) statementNode() {}
 
+// Tuples returns every VALUES tuple of the statement in order.
+func (i *InsertStatement) Tuples() [][]string {
+	if i.Values == nil {
+		return nil
+	}
+	return append([][]string{i.Values}, i.MoreValues...)
+}
+
 // String returns a string representation of the InsertStatement.
 func (i *InsertStatement) String() string {
-	columns := strings.Join(i.Columns, ", ")
-	values := strings.Join(i.Values, ", ")
-	return "INSERT INTO " + i.Table + " (" + columns + ") VALUES (" + values + ")"
+	sql := "INSERT INTO " + i.Table
+	if len(i.Columns) > 0 {
+		sql += " (" + strings.Join(i.Columns, ", ") + ")"
+	}
+	if i.Select != nil {
+		sql += " " + i.Select.String()
+	} else {
+		tuples := []string{}
+		for _, values := range i.Tuples() {
+			tuples = append(tuples, "("+strings.Join(values, ", ")+")")
+		}
+		sql += " VALUES " + strings.Join(tuples, ", ")
+	}
+	if i.OnConflict != nil {
+		sql += " " + i.OnConflict.String()
+	}
+	return sql + returningString(i.Returning)
 }
 
 type UpdateStatement struct {
 	Table       string            // The table to update
 	Assignments map[string]string // Column-value pairs to update
 	Conditions  string            // WHERE clause (string for now, could be more structured later)
+	Returning   []string          // Columns of the RETURNING clause, if any.
+
+	values map[string]Expr // Parsed Assignments, as for SelectStatement
+	where  Expr            // Parsed Conditions
 }
 
 func (i *UpdateStatement) statementNode() {} // I have no idea why this is needed.
@@ -64,5 +298,230 @@ func (u *UpdateStatement) String() string {
 		whereClause = " WHERE " + u.Conditions
 	}
 
-	return "UPDATE " + u.Table + " SET " + assignmentStr + whereClause
+	return "UPDATE " + u.Table + " SET " + assignmentStr + whereClause + returningString(u.Returning)
+}
+
+// DeleteStatement represents a DELETE query in the AST.
+type DeleteStatement struct {
+	Table      string   // The table to delete from
+	Conditions string   // Optional WHERE clause
+	Returning  []string // Columns of the RETURNING clause, if any.
+
+	where Expr // Parsed Conditions, as for SelectStatement
+}
+
+func (d *DeleteStatement) statementNode() {}
+
+// String returns a string representation of the DeleteStatement.
+func (d *DeleteStatement) String() string {
+	sql := "DELETE FROM " + d.Table
+	if d.Conditions != "" {
+		sql += " WHERE " + d.Conditions
+	}
+	return sql + returningString(d.Returning)
+}
+
+// ColumnDefinition is a single column in a CREATE TABLE statement.
+type ColumnDefinition struct {
+	Name    string
+	Type    string
+	NotNull bool
+}
+
+// CreateTableStatement represents a CREATE TABLE query in the AST. Column
+// level PRIMARY KEY and UNIQUE constraints are folded into PrimaryKey and
+// Unique. A table without columns is schemaless.
+type CreateTableStatement struct {
+	Table      string
+	Columns    []ColumnDefinition
+	PrimaryKey []string   // Primary key columns, if any.
+	Unique     [][]string // Column sets of UNIQUE constraints.
+}
+
+func (c *CreateTableStatement) statementNode() {}
+
+// String returns a string representation of the CreateTableStatement.
+func (c *CreateTableStatement) String() string {
+	definitions := []string{}
+	for _, col := range c.Columns {
+		definition := col.Name + " " + col.Type
+		if col.NotNull {
+			definition += " NOT NULL"
+		}
+		definitions = append(definitions, definition)
+	}
+	if len(c.PrimaryKey) > 0 {
+		definitions = append(definitions, "PRIMARY KEY ("+strings.Join(c.PrimaryKey, ", ")+")")
+	}
+	for _, columns := range c.Unique {
+		definitions = append(definitions, "UNIQUE ("+strings.Join(columns, ", ")+")")
+	}
+	return "CREATE TABLE " + c.Table + " (" + strings.Join(definitions, ", ") + ")"
+}
+
+// CreateIndexStatement represents a CREATE [UNIQUE] INDEX query in the AST.
+type CreateIndexStatement struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+}
+
+func (c *CreateIndexStatement) statementNode() {}
+
+// String returns a string representation of the CreateIndexStatement.
+func (c *CreateIndexStatement) String() string {
+	sql := "CREATE INDEX "
+	if c.Unique {
+		sql = "CREATE UNIQUE INDEX "
+	}
+	return sql + c.Name + " ON " + c.Table + " (" + strings.Join(c.Columns, ", ") + ")"
+}
+
+// ExplainStatement represents an EXPLAIN [ANALYZE] query in the AST.
+type ExplainStatement struct {
+	Statement Statement
+	Analyze   bool // Run the statement and report actual row counts and times
+}
+
+func (e *ExplainStatement) statementNode() {}
+
+// String returns a string representation of the ExplainStatement.
+func (e *ExplainStatement) String() string {
+	if e.Analyze {
+		return "EXPLAIN ANALYZE " + e.Statement.String()
+	}
+	return "EXPLAIN " + e.Statement.String()
+}
+
+// AnalyzeStatement represents an ANALYZE [table] query in the AST.
+type AnalyzeStatement struct {
+	Table string // Empty to analyze every table
+}
+
+func (a *AnalyzeStatement) statementNode() {}
+
+// String returns a string representation of the AnalyzeStatement.
+func (a *AnalyzeStatement) String() string {
+	if a.Table == "" {
+		return "ANALYZE"
+	}
+	return "ANALYZE " + a.Table
+}
+
+// SetStatement represents a SET name = value query in the AST.
+type SetStatement struct {
+	Name  string // The setting, in lower case
+	Value string // The value as written, such as '5s' or DEFAULT
+}
+
+func (s *SetStatement) statementNode() {}
+
+// String returns a string representation of the SetStatement.
+func (s *SetStatement) String() string {
+	return "SET " + s.Name + " = " + s.Value
+}
+
+// CopyStatement represents a COPY query in the AST, which moves rows
+// between a table or query and a file:
+//
+//	COPY table [(columns)] FROM 'file' [WITH (options)]
+//	COPY table [(columns)] TO 'file' [WITH (options)]
+//	COPY (query) TO 'file' [WITH (options)]
+type CopyStatement struct {
+	Table   string
+	Columns []string         // Columns in file order; empty for all of them
+	Query   *SelectStatement // Query to export instead of Table
+	From    bool             // Read the file into the table, rather than write it
+	Path    string           // Name of the file
+	Stdio   bool             // FROM STDIN or TO STDOUT: the client sends or takes the data
+	Options CopyOptions
+
+	reader io.Reader // Read by FROM STDIN, see WithReader
+	writer io.Writer // Written by TO STDOUT, see WithWriter
+}
+
+func (c *CopyStatement) statementNode() {}
+
+// String returns a string representation of the CopyStatement.
+func (c *CopyStatement) String() string {
+	sql := "COPY " + c.Table
+	if c.Query != nil {
+		sql = "COPY (" + c.Query.String() + ")"
+	} else if len(c.Columns) > 0 {
+		sql += " (" + strings.Join(c.Columns, ", ") + ")"
+	}
+	switch {
+	case c.From && c.Stdio:
+		sql += " FROM STDIN"
+	case c.From:
+		sql += " FROM " + formatLiteral(c.Path)
+	case c.Stdio:
+		sql += " TO STDOUT"
+	default:
+		sql += " TO " + formatLiteral(c.Path)
+	}
+	return sql + " WITH (" + c.Options.String() + ")"
+}
+
+// CopyOptions are the options of a COPY statement.
+//
+// The csv format has a line per row. The json format is an array of
+// objects and ndjson has an object per line; object keys name the columns.
+// Header, Delimiter, Null and Quote only apply to csv.
+type CopyOptions struct {
+	Format      string // "csv", "json" or "ndjson"
+	Header      bool   // The first line of the file names the columns
+	Delimiter   rune   // Separates the fields of a line
+	Null        string // Stands for NULL when unquoted
+	Quote       rune   // Encloses fields holding delimiters, quotes or line breaks
+	SkipErrors  bool   // ON_ERROR skip: leave out rows that fail instead of failing
+	CreateTable bool   // Create a missing table with columns inferred from the file
+	Sample      int    // Objects CreateTable infers the columns from, 0 for all
+}
+
+// DefaultCopyOptions returns the options of a COPY without a WITH clause:
+// CSV without a header, separated by commas, with empty fields for NULL.
+func DefaultCopyOptions() CopyOptions {
+	return CopyOptions{Format: "csv", Delimiter: ',', Quote: '"', Sample: 1000}
+}
+
+// String returns the options as they appear in a WITH clause.
+func (o CopyOptions) String() string {
+	options := []string{"FORMAT " + o.Format}
+	if o.Format == "csv" {
+		if o.Header {
+			options = append(options, "HEADER")
+		}
+		options = append(options,
+			"DELIMITER "+formatLiteral(string(o.Delimiter)),
+			"NULL "+formatLiteral(o.Null),
+			"QUOTE "+formatLiteral(string(o.Quote)))
+	}
+	if o.SkipErrors {
+		options = append(options, "ON_ERROR skip")
+	}
+	if o.CreateTable {
+		options = append(options, "CREATE_TABLE", "SAMPLE "+strconv.Itoa(o.Sample))
+	}
+	return strings.Join(options, ", ")
+}
+
+// BackupStatement represents a BACKUP TO 'file' query in the AST.
+type BackupStatement struct {
+	Path string // Name of the backup file
+}
+
+func (b *BackupStatement) statementNode() {}
+
+// String returns a string representation of the BackupStatement.
+func (b *BackupStatement) String() string {
+	return "BACKUP TO " + formatLiteral(b.Path)
+}
+
+func returningString(columns []string) string {
+	if len(columns) == 0 {
+		return ""
+	}
+	return " RETURNING " + strings.Join(columns, ", ")
 }
@@ -0,0 +1,223 @@
+package query
+
+import "fmt"
+
+// aggregator accumulates the values of one aggregate call over a group.
+type aggregator interface {
+	Step(value interface{}) error
+	Result() (interface{}, error)
+}
+
+// isAggregate reports whether a function name is a built-in aggregate
+// function.
+func isAggregate(name string) bool {
+	switch name {
+	case "COUNT", "SUM", "AVG", "MIN", "MAX":
+		return true
+	}
+	return false
+}
+
+// isAggregate reports whether a call is of an aggregate function, built-in
+// or registered.
+func (f *FuncCall) isAggregate() bool {
+	if f.user != nil {
+		return f.user.aggregate != nil
+	}
+	return isAggregate(f.Name)
+}
+
+// compileAggregateArg compiles the argument of an aggregate call. A
+// registered aggregate with several arguments gets them as one []Value.
+func compileAggregateArg(call *FuncCall, columns []PlanColumn) (evalFunc, error) {
+	if call.Star {
+		return func(Tuple) (interface{}, error) { return nil, nil }, nil
+	}
+	if call.user == nil || len(call.Args) == 1 {
+		return compileExpr(call.Args[0], columns)
+	}
+	args, err := compileExprs(call.Args, columns)
+	if err != nil {
+		return nil, err
+	}
+	return func(t Tuple) (interface{}, error) {
+		var err error
+		values := make([]Value, len(args))
+		for i, arg := range args {
+			if values[i], err = arg(t); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}, nil
+}
+
+// newAggregator returns a fresh accumulator for an aggregate call.
+func newAggregator(call *FuncCall) (aggregator, error) {
+	agg, err := newBaseAggregator(call)
+	if err != nil || !call.Distinct {
+		return agg, err
+	}
+	return &distinctAggregator{aggregator: agg, seen: make(map[string]bool)}, nil
+}
+
+func newBaseAggregator(call *FuncCall) (aggregator, error) {
+	if f := call.user; f != nil {
+		if f.aggregate == nil {
+			return nil, fmt.Errorf("function %s is not an aggregate", call.Name)
+		}
+		if err := f.checkArgs(call); err != nil {
+			return nil, err
+		}
+		a := &userAggregator{f: f}
+		if f.aggregate.Init != nil {
+			a.state = f.aggregate.Init()
+		}
+		return a, nil
+	}
+	if !call.Star && len(call.Args) != 1 {
+		return nil, fmt.Errorf("%s takes exactly one argument", call.Name)
+	}
+	if call.Star && call.Name != "COUNT" {
+		return nil, fmt.Errorf("%s(*) is not allowed", call.Name)
+	}
+
+	switch call.Name {
+	case "COUNT":
+		return &countAggregator{star: call.Star}, nil
+	case "SUM":
+		return &sumAggregator{}, nil
+	case "AVG":
+		return &avgAggregator{}, nil
+	case "MIN":
+		return &extremeAggregator{want: -1}, nil
+	case "MAX":
+		return &extremeAggregator{want: 1}, nil
+	}
+	return nil, fmt.Errorf("function %s is not an aggregate", call.Name)
+}
+
+// containsAggregate reports whether an expression calls an aggregate.
+func containsAggregate(expr Expr) bool {
+	found := false
+	walkExpr(expr, func(e Expr) {
+		if call, ok := e.(*FuncCall); ok && call.isAggregate() {
+			found = true
+		}
+	})
+	return found
+}
+
+// collectAggregates appends the distinct aggregate calls of an expression.
+func collectAggregates(expr Expr, calls []*FuncCall) []*FuncCall {
+	walkExpr(expr, func(e Expr) {
+		call, ok := e.(*FuncCall)
+		if !ok || !call.isAggregate() {
+			return
+		}
+		for _, existing := range calls {
+			if existing.String() == call.String() {
+				return
+			}
+		}
+		calls = append(calls, call)
+	})
+	return calls
+}
+
+// distinctAggregator passes each distinct argument value to an aggregate
+// once, as in COUNT(DISTINCT x).
+type distinctAggregator struct {
+	aggregator
+	seen map[string]bool
+}
+
+func (a *distinctAggregator) Step(value interface{}) error {
+	key := valueKey(value)
+	if args, ok := value.([]Value); ok {
+		key = rowKey(args)
+	}
+	if a.seen[key] {
+		return nil
+	}
+	a.seen[key] = true
+	return a.aggregator.Step(value)
+}
+
+type countAggregator struct {
+	star  bool
+	count int64
+}
+
+func (a *countAggregator) Step(value interface{}) error {
+	if a.star || value != nil {
+		a.count++
+	}
+	return nil
+}
+
+func (a *countAggregator) Result() (interface{}, error) { return a.count, nil }
+
+type sumAggregator struct {
+	sum interface{}
+}
+
+func (a *sumAggregator) Step(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if a.sum == nil {
+		a.sum = int64(0)
+	}
+	sum, err := arithmetic("+", a.sum, value)
+	if err != nil {
+		return fmt.Errorf("SUM: %v", err)
+	}
+	a.sum = sum
+	return nil
+}
+
+func (a *sumAggregator) Result() (interface{}, error) { return a.sum, nil }
+
+type avgAggregator struct {
+	sum   float64
+	count int64
+}
+
+func (a *avgAggregator) Step(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	n, ok := toNumber(value)
+	if !ok {
+		return fmt.Errorf("AVG: %v is not a number", value)
+	}
+	a.sum += toFloat(n)
+	a.count++
+	return nil
+}
+
+func (a *avgAggregator) Result() (interface{}, error) {
+	if a.count == 0 {
+		return nil, nil
+	}
+	return a.sum / float64(a.count), nil
+}
+
+// extremeAggregator implements MIN (want -1) and MAX (want 1).
+type extremeAggregator struct {
+	want  int
+	value interface{}
+}
+
+func (a *extremeAggregator) Step(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if a.value == nil || compareValues(value, a.value) == a.want {
+		a.value = value
+	}
+	return nil
+}
+
+func (a *extremeAggregator) Result() (interface{}, error) { return a.value, nil }
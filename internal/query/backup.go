@@ -0,0 +1,63 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// executeBackup handles BACKUP statements, writing a copy of the tables as
+// they are now to a file that Restore can load.
+func (e *Executor) executeBackup(stmt *BackupStatement) (*ResultSet, error) {
+	if err := WriteBackup(e.storage.Snapshot(), stmt.Path, 0); err != nil {
+		return nil, err
+	}
+	return &ResultSet{}, nil
+}
+
+// backupHeader starts a backup file, giving the WAL position of the last
+// change the backup holds.
+const backupHeader = "-- doggodb backup at WAL position %d\n"
+
+// WriteBackup writes the tables of a storage, such as a snapshot, to a
+// backup file in the format of Dump. lsn is the WAL position of the last
+// change the tables hold, or 0 if the WAL is not archived. The file is
+// written under a temporary name and renamed once complete, so the path
+// never holds part of a backup.
+func WriteBackup(storage *data.InMemoryStorage, path string, lsn int64) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to execute BACKUP: %v", err)
+	}
+	_, err = fmt.Fprintf(f, backupHeader, lsn)
+	if err == nil {
+		err = NewExecutor(*storage).Dump(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to execute BACKUP: %v", err)
+	}
+	return nil
+}
+
+// BackupPosition returns the WAL position a backup file was taken at, as
+// WriteBackup records it.
+func BackupPosition(backup string) (int64, error) {
+	var lsn int64
+	if _, err := fmt.Sscanf(backup, backupHeader, &lsn); err != nil {
+		return 0, errors.New("not a doggodb backup")
+	}
+	return lsn, nil
+}
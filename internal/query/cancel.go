@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// CanceledError is returned for a statement stopped because its context
+// was canceled or its deadline, such as the statement timeout, passed.
+type CanceledError struct {
+	Err     error // context.Canceled or context.DeadlineExceeded
+	Timeout bool  // The statement timeout passed, rather than the caller's deadline
+}
+
+func (e *CanceledError) Error() string {
+	switch {
+	case e.Timeout:
+		return "canceling statement due to statement timeout"
+	case errors.Is(e.Err, context.DeadlineExceeded):
+		return "canceling statement due to deadline"
+	}
+	return "canceling statement due to user request"
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// checkCanceled returns the error of a canceled context. It is cheap enough
+// to call for every row.
+func checkCanceled(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// cancelableCondition makes a row condition fail once the context is
+// canceled, stopping the table scan of an UPDATE or DELETE.
+func cancelableCondition(ctx context.Context, condition func(*data.Row) (bool, error)) func(*data.Row) (bool, error) {
+	if ctx.Done() == nil {
+		return condition
+	}
+	return func(row *data.Row) (bool, error) {
+		if err := checkCanceled(ctx); err != nil {
+			return false, err
+		}
+		return condition(row)
+	}
+}
+
+// SetStatementTimeout limits how long a statement may run before it is
+// canceled. Zero or less means no limit, the default.
+func (e *Executor) SetStatementTimeout(timeout time.Duration) {
+	e.statementTimeout = timeout
+}
+
+// executeSet handles SET statements. statement_timeout is the only
+// setting.
+func (e *Executor) executeSet(stmt *SetStatement) (*ResultSet, error) {
+	if stmt.Name != "statement_timeout" {
+		return nil, fmt.Errorf("unrecognized configuration parameter %q", stmt.Name)
+	}
+	timeout, err := ParseTimeout(stmt.Value)
+	if err != nil {
+		return nil, err
+	}
+	e.SetStatementTimeout(timeout)
+	return &ResultSet{}, nil
+}
+
+// ParseTimeout parses the value of statement_timeout: a duration such as
+// '5s' or '250ms', a number of milliseconds, or DEFAULT. Zero turns the
+// timeout off.
+func ParseTimeout(value string) (time.Duration, error) {
+	text, _ := literalValue(value).(string)
+	text = strings.TrimSpace(text)
+	if strings.EqualFold(text, "DEFAULT") {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(text, 10, 64); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	timeout, err := time.ParseDuration(strings.ReplaceAll(text, "min", "m"))
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid value for parameter \"statement_timeout\": %s", value)
+	}
+	return timeout, nil
+}
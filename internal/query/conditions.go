@@ -0,0 +1,455 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// LikeExpr is x [NOT] LIKE pattern [ESCAPE e], or ILIKE, which ignores
+// case. In patterns, % matches any sequence of characters and _ any one
+// character.
+type LikeExpr struct {
+	Expr       Expr
+	Pattern    Expr
+	Escape     Expr // nil for the default escape character, a backslash
+	Not        bool
+	IgnoreCase bool // ILIKE
+}
+
+func (l *LikeExpr) exprNode() {}
+
+// String returns the expression.
+func (l *LikeExpr) String() string {
+	op := "LIKE"
+	if l.IgnoreCase {
+		op = "ILIKE"
+	}
+	if l.Not {
+		op = "NOT " + op
+	}
+	s := operandString(l.Expr) + " " + op + " " + operandString(l.Pattern)
+	if l.Escape != nil {
+		s += " ESCAPE " + operandString(l.Escape)
+	}
+	return s
+}
+
+// BetweenExpr is x [NOT] BETWEEN low AND high.
+type BetweenExpr struct {
+	Expr Expr
+	Low  Expr
+	High Expr
+	Not  bool
+}
+
+func (b *BetweenExpr) exprNode() {}
+
+// String returns the expression.
+func (b *BetweenExpr) String() string {
+	op := " BETWEEN "
+	if b.Not {
+		op = " NOT BETWEEN "
+	}
+	return operandString(b.Expr) + op + operandString(b.Low) + " AND " + operandString(b.High)
+}
+
+// IsNullExpr is x IS [NOT] NULL.
+type IsNullExpr struct {
+	Expr Expr
+	Not  bool
+}
+
+func (n *IsNullExpr) exprNode() {}
+
+// String returns the expression.
+func (n *IsNullExpr) String() string {
+	if n.Not {
+		return operandString(n.Expr) + " IS NOT NULL"
+	}
+	return operandString(n.Expr) + " IS NULL"
+}
+
+// CaseExpr is CASE [operand] WHEN ... THEN ... [ELSE ...] END. With an
+// operand, each WHEN value is compared with it; without one, each WHEN is
+// a condition.
+type CaseExpr struct {
+	Operand Expr // nil for a searched CASE
+	Whens   []WhenClause
+	Else    Expr // nil for ELSE NULL
+}
+
+// WhenClause is one WHEN ... THEN ... branch of a CASE expression.
+type WhenClause struct {
+	When Expr
+	Then Expr
+}
+
+func (c *CaseExpr) exprNode() {}
+
+// String returns the expression.
+func (c *CaseExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString("CASE")
+	if c.Operand != nil {
+		sb.WriteString(" " + c.Operand.String())
+	}
+	for _, w := range c.Whens {
+		sb.WriteString(" WHEN " + w.When.String() + " THEN " + w.Then.String())
+	}
+	if c.Else != nil {
+		sb.WriteString(" ELSE " + c.Else.String())
+	}
+	sb.WriteString(" END")
+	return sb.String()
+}
+
+// operandString returns an operand of a comparison-level operator,
+// parenthesized unless it binds tighter than comparisons.
+func operandString(expr Expr) string {
+	if exprPrecedence(expr) <= 4 {
+		return "(" + expr.String() + ")"
+	}
+	return expr.String()
+}
+
+// parsePostfixCondition parses the [NOT] IN, LIKE, ILIKE, BETWEEN or IS
+// [NOT] NULL following the operand left at tokens[i]. It reports false if
+// none follows.
+func parsePostfixCondition(tokens []Token, i int, left Expr) (Expr, int, bool, error) {
+	if i >= len(tokens) {
+		return nil, i, false, nil
+	}
+	if tokens[i].Type == IS {
+		not := i+1 < len(tokens) && tokens[i+1].Type == NOT
+		if not {
+			i++
+		}
+		if i+1 >= len(tokens) || tokens[i+1].Type != NULL {
+			return nil, i, true, errors.New("expected NULL after IS")
+		}
+		return &IsNullExpr{Expr: left, Not: not}, i + 2, true, nil
+	}
+
+	not := tokens[i].Type == NOT && i+1 < len(tokens)
+	if not {
+		i++
+	}
+	var expr Expr
+	var err error
+	switch tokens[i].Type {
+	case IN:
+		expr, i, err = parseIn(tokens, i+1, &InExpr{Expr: left, Not: not})
+	case LIKE, ILIKE:
+		like := &LikeExpr{Expr: left, Not: not, IgnoreCase: tokens[i].Type == ILIKE}
+		if like.Pattern, i, err = parseAdditive(tokens, i+1); err != nil {
+			return nil, i, true, err
+		}
+		if i < len(tokens) && tokens[i].Type == ESCAPE {
+			like.Escape, i, err = parseAdditive(tokens, i+1)
+		}
+		expr = like
+	case BETWEEN:
+		between := &BetweenExpr{Expr: left, Not: not}
+		if between.Low, i, err = parseAdditive(tokens, i+1); err != nil {
+			return nil, i, true, err
+		}
+		if i >= len(tokens) || tokens[i].Type != AND {
+			return nil, i, true, errors.New("expected AND in BETWEEN")
+		}
+		between.High, i, err = parseAdditive(tokens, i+1)
+		expr = between
+	default:
+		if not {
+			i--
+		}
+		return nil, i, false, nil
+	}
+	if err != nil {
+		return nil, i, true, err
+	}
+	return expr, i, true, nil
+}
+
+// parseIn parses the parenthesized subquery or value list of an IN
+// starting at tokens[i].
+func parseIn(tokens []Token, i int, in *InExpr) (Expr, int, error) {
+	if i+1 < len(tokens) && tokens[i].Type == LEFT_PAREN && (tokens[i+1].Type == SELECT || tokens[i+1].Type == WITH) {
+		sub, next, err := parseSubquery(tokens, i)
+		if err != nil {
+			return nil, next, err
+		}
+		in.Select = sub
+		return in, next, nil
+	}
+	if i >= len(tokens) || tokens[i].Type != LEFT_PAREN {
+		return nil, i, errors.New("expected '(' after IN")
+	}
+	i++
+	for {
+		item, next, err := parseExpr(tokens, i)
+		if err != nil {
+			return nil, next, err
+		}
+		in.List = append(in.List, item)
+		if next < len(tokens) && tokens[next].Type == COMMA {
+			i = next + 1
+			continue
+		}
+		if next >= len(tokens) || tokens[next].Type != RIGHT_PAREN {
+			return nil, next, errors.New("expected ')' after IN list")
+		}
+		return in, next + 1, nil
+	}
+}
+
+// parseCase parses a CASE expression starting at the CASE token.
+func parseCase(tokens []Token, i int) (Expr, int, error) {
+	c := &CaseExpr{}
+	i++
+	var err error
+	if i < len(tokens) && tokens[i].Type != WHEN {
+		if c.Operand, i, err = parseExpr(tokens, i); err != nil {
+			return nil, i, err
+		}
+	}
+	for i < len(tokens) && tokens[i].Type == WHEN {
+		var w WhenClause
+		if w.When, i, err = parseExpr(tokens, i+1); err != nil {
+			return nil, i, err
+		}
+		if i >= len(tokens) || tokens[i].Type != THEN {
+			return nil, i, errors.New("expected THEN in CASE")
+		}
+		if w.Then, i, err = parseExpr(tokens, i+1); err != nil {
+			return nil, i, err
+		}
+		c.Whens = append(c.Whens, w)
+	}
+	if len(c.Whens) == 0 {
+		return nil, i, errors.New("expected WHEN in CASE")
+	}
+	if i < len(tokens) && tokens[i].Type == ELSE {
+		if c.Else, i, err = parseExpr(tokens, i+1); err != nil {
+			return nil, i, err
+		}
+	}
+	if i >= len(tokens) || tokens[i].Type != END {
+		return nil, i, errors.New("expected END after CASE")
+	}
+	return c, i + 1, nil
+}
+
+// negate applies NOT to the result of a condition, keeping NULL.
+func negate(eval evalFunc) evalFunc {
+	return func(t Tuple) (interface{}, error) {
+		v, err := eval(t)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		b, err := toBool(v)
+		return !b, err
+	}
+}
+
+func compileLike(e *LikeExpr, columns []PlanColumn) (evalFunc, error) {
+	exprs := []Expr{e.Expr, e.Pattern}
+	if e.Escape != nil {
+		exprs = append(exprs, e.Escape)
+	}
+	args, err := compileExprs(exprs, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	// Patterns are usually constant, so the last one is kept compiled.
+	var lastPattern string
+	var lastEscape interface{}
+	var compiled []likeElem
+	eval := func(t Tuple) (interface{}, error) {
+		var err error
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			if values[i], err = arg(t); err != nil {
+				return nil, err
+			}
+			if values[i] == nil {
+				return nil, nil
+			}
+		}
+		s, pattern := textValue(values[0]), textValue(values[1])
+		escape := interface{}('\\')
+		if len(values) > 2 {
+			escape = values[2]
+		}
+		if compiled == nil || pattern != lastPattern || escape != lastEscape {
+			var escapeRune rune
+			escapeRune, err = likeEscape(escape)
+			if err != nil {
+				return nil, err
+			}
+			if e.IgnoreCase {
+				pattern = strings.ToLower(pattern)
+			}
+			if compiled, err = compileLikePattern(pattern, escapeRune); err != nil {
+				return nil, err
+			}
+			lastPattern, lastEscape = textValue(values[1]), escape
+		}
+		if e.IgnoreCase {
+			s = strings.ToLower(s)
+		}
+		return likeMatch([]rune(s), compiled), nil
+	}
+	if e.Not {
+		return negate(eval), nil
+	}
+	return eval, nil
+}
+
+// likeEscape returns the escape character given with ESCAPE, or -1 for
+// none.
+func likeEscape(value interface{}) (rune, error) {
+	if r, ok := value.(rune); ok {
+		return r, nil
+	}
+	s := textValue(value)
+	switch utf8.RuneCountInString(s) {
+	case 0:
+		return -1, nil
+	case 1:
+		r, _ := utf8.DecodeRuneInString(s)
+		return r, nil
+	}
+	return 0, fmt.Errorf("invalid escape string %s: must be one character", formatLiteral(s))
+}
+
+// likeElem is one element of a compiled LIKE pattern: a literal
+// character, or the wildcard _ or %.
+type likeElem struct {
+	r        rune
+	wildcard rune // 0 for a literal
+}
+
+func compileLikePattern(pattern string, escape rune) ([]likeElem, error) {
+	var elems []likeElem
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == escape:
+			if i+1 >= len(runes) {
+				return nil, errors.New("LIKE pattern must not end with escape character")
+			}
+			i++
+			elems = append(elems, likeElem{r: runes[i]})
+		case r == '%' || r == '_':
+			elems = append(elems, likeElem{wildcard: r})
+		default:
+			elems = append(elems, likeElem{r: r})
+		}
+	}
+	return elems, nil
+}
+
+// likeMatch matches a string against a compiled pattern, backtracking to
+// the last % on a mismatch.
+func likeMatch(s []rune, pattern []likeElem) bool {
+	si, pi := 0, 0
+	star, mark := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(pattern) && pattern[pi].wildcard == '%':
+			star, mark = pi, si
+			pi++
+		case pi < len(pattern) && (pattern[pi].wildcard == '_' || (pattern[pi].wildcard == 0 && pattern[pi].r == s[si])):
+			si++
+			pi++
+		case star >= 0:
+			mark++
+			pi, si = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi].wildcard == '%' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
+// compileBetween compiles x BETWEEN low AND high as x >= low AND x <= high.
+func compileBetween(e *BetweenExpr, columns []PlanColumn) (evalFunc, error) {
+	args, err := compileExprs([]Expr{e.Expr, e.Low, e.High}, columns)
+	if err != nil {
+		return nil, err
+	}
+	eval := compileBinary("AND", compileBinary(">=", args[0], args[1]), compileBinary("<=", args[0], args[2]))
+	if e.Not {
+		return negate(eval), nil
+	}
+	return eval, nil
+}
+
+func compileIsNull(e *IsNullExpr, columns []PlanColumn) (evalFunc, error) {
+	operand, err := compileExpr(e.Expr, columns)
+	if err != nil {
+		return nil, err
+	}
+	return func(t Tuple) (interface{}, error) {
+		v, err := operand(t)
+		if err != nil {
+			return nil, err
+		}
+		return (v == nil) != e.Not, nil
+	}, nil
+}
+
+// compileCase compiles a CASE expression. Branches are evaluated lazily,
+// so a branch that is not taken cannot fail.
+func compileCase(e *CaseExpr, columns []PlanColumn) (evalFunc, error) {
+	var operand evalFunc
+	if e.Operand != nil {
+		var err error
+		if operand, err = compileExpr(e.Operand, columns); err != nil {
+			return nil, err
+		}
+	}
+	conds := make([]evalFunc, len(e.Whens))
+	results := make([]evalFunc, len(e.Whens))
+	for i, w := range e.Whens {
+		when, err := compileExpr(w.When, columns)
+		if err != nil {
+			return nil, err
+		}
+		if operand != nil {
+			when = compileBinary("=", operand, when)
+		}
+		conds[i] = when
+		if results[i], err = compileExpr(w.Then, columns); err != nil {
+			return nil, err
+		}
+	}
+	otherwise := func(Tuple) (interface{}, error) { return nil, nil }
+	if e.Else != nil {
+		var err error
+		if otherwise, err = compileExpr(e.Else, columns); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(t Tuple) (interface{}, error) {
+		for i, cond := range conds {
+			v, err := cond(t)
+			if err != nil {
+				return nil, err
+			}
+			if ok, err := isTrue(v); err != nil {
+				return nil, err
+			} else if ok {
+				return results[i](t)
+			}
+		}
+		return otherwise(t)
+	}, nil
+}
@@ -0,0 +1,447 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// CopyFrom loads rows read from r into a table, as COPY FROM does with a
+// file. Options left zero take their default values.
+func (e *Executor) CopyFrom(ctx context.Context, table string, r io.Reader, options CopyOptions) (*ResultSet, error) {
+	stmt, err := NewCopyFrom(table, r, options)
+	if err != nil {
+		return nil, err
+	}
+	return e.RunContext(ctx, stmt)
+}
+
+// NewCopyFrom returns a COPY FROM STDIN statement that loads rows read
+// from r into a table. Options left zero take their default values.
+func NewCopyFrom(table string, r io.Reader, options CopyOptions) (*CopyStatement, error) {
+	defaults := DefaultCopyOptions()
+	if options.Format == "" {
+		options.Format = defaults.Format
+	}
+	if options.Delimiter == 0 {
+		options.Delimiter = defaults.Delimiter
+	}
+	if options.Quote == 0 {
+		options.Quote = defaults.Quote
+	}
+	if err := options.check(true); err != nil {
+		return nil, err
+	}
+	return &CopyStatement{Table: table, From: true, Stdio: true, Options: options, reader: r}, nil
+}
+
+// WithReader returns a copy of a COPY FROM statement that reads r instead
+// of standard input or its file.
+func (c *CopyStatement) WithReader(r io.Reader) *CopyStatement {
+	stmt := *c
+	stmt.reader = r
+	return &stmt
+}
+
+// WithWriter returns a copy of a COPY TO STDOUT statement that writes its
+// output to w.
+func (c *CopyStatement) WithWriter(w io.Writer) *CopyStatement {
+	stmt := *c
+	stmt.writer = w
+	return &stmt
+}
+
+// check reports options that do not apply to the format or direction.
+func (o CopyOptions) check(from bool) error {
+	if o.Format != "csv" && (o.Header || o.Delimiter != ',' || o.Quote != '"' || o.Null != "") {
+		return errors.New("COPY HEADER, DELIMITER, QUOTE and NULL are only available in CSV mode")
+	}
+	if o.CreateTable && (!from || o.Format == "csv") {
+		return errors.New("COPY CREATE_TABLE is only available in COPY FROM with FORMAT json or ndjson")
+	}
+	return nil
+}
+
+// executeCopy handles COPY statements. The file is read or written by the
+// process running the executor, relative to its working directory. STDIN
+// and STDOUT are the reader and writer the statement was given.
+func (e *Executor) executeCopy(stmt *CopyStatement) (*ResultSet, error) {
+	if stmt.From {
+		return e.copyFrom(stmt)
+	}
+	return e.copyTo(stmt)
+}
+
+// copyFrom loads a file into a table. Unless ON_ERROR skip is given, the
+// first bad row fails the COPY and nothing is inserted. Skipped rows are
+// reported as notices.
+func (e *Executor) copyFrom(stmt *CopyStatement) (*ResultSet, error) {
+	r := stmt.reader
+	if r == nil && stmt.Stdio {
+		return nil, errors.New("failed to execute COPY: there is no client to send the data for STDIN")
+	}
+	if r == nil {
+		f, err := os.Open(stmt.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute COPY: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	load := &copyLoad{skip: stmt.Options.SkipErrors}
+	if stmt.Options.Format == "csv" {
+		return e.copyFromCSV(stmt, r, load)
+	}
+	return e.copyFromJSON(stmt, r, load)
+}
+
+// copyLoad collects the rows of a COPY FROM with where each comes from in
+// the file, such as "line 3", and the notices about the rows it skips.
+type copyLoad struct {
+	skip    bool
+	rows    []*data.Row
+	where   []string
+	notices []string
+}
+
+func (l *copyLoad) add(row *data.Row, where string) {
+	l.rows = append(l.rows, row)
+	l.where = append(l.where, where)
+}
+
+// reject fails the COPY because of a bad row, or skips the row if errors
+// are skipped.
+func (l *copyLoad) reject(where string, err error) error {
+	if !l.skip {
+		return fmt.Errorf("failed to execute COPY: %s: %v", where, err)
+	}
+	l.notices = append(l.notices, fmt.Sprintf("skipped %s: %v", where, err))
+	return nil
+}
+
+// into inserts the rows into the table.
+func (l *copyLoad) into(table *data.Table) (*ResultSet, error) {
+	inserted, err := table.Load(l.rows, func(i int, err error) error {
+		return l.reject(l.where[i], err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if skipped := len(l.notices); skipped > 0 {
+		l.notices = append(l.notices, fmt.Sprintf("%d rows were skipped", skipped))
+	}
+	return &ResultSet{rowsAffected: int64(inserted), notices: l.notices}, nil
+}
+
+// copyFromCSV reads CSV records into a table, converting the fields to
+// the column types.
+func (e *Executor) copyFromCSV(stmt *CopyStatement, r io.Reader, load *copyLoad) (*ResultSet, error) {
+	table, err := e.storage.GetTable(stmt.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute COPY: %v", err)
+	}
+	reader := newCSVReader(r, stmt.Options)
+
+	columns := stmt.Columns
+	if stmt.Options.Header {
+		header, err := reader.read()
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to execute COPY: %v", err)
+		}
+		if len(columns) == 0 && len(table.Schema) == 0 && header != nil {
+			columns = header.fields
+		}
+	}
+	if len(columns) == 0 {
+		if len(table.Schema) == 0 {
+			return nil, fmt.Errorf("failed to execute COPY: table %s has no schema; give a column list or use HEADER", table.Name)
+		}
+		columns = table.ColumnNames()
+	}
+	types, err := copyColumnTypes(table, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	for n := 0; ; n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := checkCanceled(e.context()); err != nil {
+				return nil, err
+			}
+		}
+		record, err := reader.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute COPY: %v", err)
+		}
+		where := fmt.Sprintf("line %d", record.line)
+		row, err := copyRow(record, columns, types, stmt.Options.Null)
+		if err != nil {
+			if err := load.reject(where, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		load.add(row, where)
+	}
+	return load.into(table)
+}
+
+// copyColumnTypes returns the types of the named columns, TypeAny for all
+// of them if the table has no schema.
+func copyColumnTypes(table *data.Table, columns []string) ([]data.Type, error) {
+	types := make([]data.Type, len(columns))
+	for i, name := range columns {
+		types[i] = data.TypeAny
+		if len(table.Schema) == 0 {
+			continue
+		}
+		col, ok := table.Column(name)
+		if !ok {
+			return nil, fmt.Errorf("failed to execute COPY: column '%s' not found in table %s", name, table.Name)
+		}
+		types[i] = col.Type
+	}
+	return types, nil
+}
+
+// cancelCheckInterval is how many records COPY reads between checks for
+// cancellation.
+const cancelCheckInterval = 1024
+
+// copyRow turns the fields of a record into a row.
+func copyRow(record *csvRecord, columns []string, types []data.Type, null string) (*data.Row, error) {
+	if len(record.fields) != len(columns) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(columns), len(record.fields))
+	}
+	values := make(map[string]interface{}, len(columns))
+	for i, field := range record.fields {
+		if field == null && !record.quoted[i] {
+			values[columns[i]] = nil
+			continue
+		}
+		value, err := data.ConvertValue(field, types[i])
+		if err != nil {
+			return nil, fmt.Errorf("column '%s': %v", columns[i], err)
+		}
+		values[columns[i]] = value
+	}
+	return data.CreateRow(values), nil
+}
+
+// copyTo writes the rows of a table or query to a file.
+func (e *Executor) copyTo(stmt *CopyStatement) (*ResultSet, error) {
+	query := stmt.Query
+	if query == nil {
+		query = &SelectStatement{Table: stmt.Table, Columns: stmt.Columns}
+		if len(stmt.Columns) == 0 {
+			query.Columns = []string{"*"}
+		}
+	}
+	plan, err := e.planSelect(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute COPY: %v", err)
+	}
+	tuples, err := runPlan(e.context(), plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute COPY: %v", err)
+	}
+
+	names := resultNames(plan.Columns())
+	if stmt.Stdio {
+		if stmt.writer == nil {
+			return nil, errors.New("failed to execute COPY: there is no client to take the data for STDOUT")
+		}
+		err = writeCopy(stmt.writer, names, tuples, stmt.Options)
+	} else {
+		var f *os.File
+		if f, err = os.Create(stmt.Path); err != nil {
+			return nil, fmt.Errorf("failed to execute COPY: %v", err)
+		}
+		err = writeCopy(f, names, tuples, stmt.Options)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute COPY: %v", err)
+	}
+	return &ResultSet{rowsAffected: int64(len(tuples))}, nil
+}
+
+// writeCopy writes tuples in the format of a COPY.
+func writeCopy(w io.Writer, names []string, tuples []Tuple, options CopyOptions) error {
+	if options.Format == "csv" {
+		return writeCSV(w, names, tuples, options)
+	}
+	rows := make([][]interface{}, len(tuples))
+	for i, t := range tuples {
+		rows[i] = t
+	}
+	return writeJSONRows(w, names, rows, options.Format == "json")
+}
+
+// writeCSV writes tuples as CSV, after a header line if one is asked for.
+func writeCSV(w io.Writer, names []string, tuples []Tuple, options CopyOptions) error {
+	c := newCSVWriter(w, options)
+	if options.Header {
+		header := make([]interface{}, len(names))
+		for i, name := range names {
+			header[i] = name
+		}
+		c.write(header)
+	}
+	for _, t := range tuples {
+		c.write(t)
+	}
+	return c.flush()
+}
+
+// csvRecord is one record of a CSV file. Quoted fields are never NULL.
+type csvRecord struct {
+	fields []string
+	quoted []bool
+	line   int // Line the record starts on
+}
+
+// csvReader reads CSV records. Unlike encoding/csv it remembers which
+// fields were quoted, so that an empty quoted field is an empty string
+// while an empty unquoted one can stand for NULL.
+type csvReader struct {
+	r         *bufio.Reader
+	delimiter rune
+	quote     rune
+	line      int
+}
+
+func newCSVReader(r io.Reader, options CopyOptions) *csvReader {
+	return &csvReader{r: bufio.NewReader(r), delimiter: options.Delimiter, quote: options.Quote}
+}
+
+// read returns the next record, or io.EOF at the end of the input. Blank
+// lines are skipped.
+func (c *csvReader) read() (*csvRecord, error) {
+	for {
+		record, err := c.readRecord()
+		if err != nil || len(record.fields) != 1 || record.fields[0] != "" || record.quoted[0] {
+			return record, err
+		}
+	}
+}
+
+func (c *csvReader) readRecord() (*csvRecord, error) {
+	c.line++
+	record := &csvRecord{line: c.line}
+	var field strings.Builder
+	quoted, inQuotes, atStart := false, false, true
+	end := func() {
+		record.fields = append(record.fields, field.String())
+		record.quoted = append(record.quoted, quoted)
+		field.Reset()
+		quoted, atStart = false, true
+	}
+
+	for {
+		r, _, err := c.r.ReadRune()
+		if err == io.EOF {
+			switch {
+			case inQuotes:
+				return nil, fmt.Errorf("line %d: unterminated quoted field", record.line)
+			case atStart && len(record.fields) == 0:
+				return nil, io.EOF
+			}
+			end()
+			return record, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case inQuotes:
+			if r != c.quote {
+				if r == '\n' {
+					c.line++
+				}
+				field.WriteRune(r)
+				continue
+			}
+			// A doubled quote is a quote; a single one ends the field.
+			if next, _, err := c.r.ReadRune(); err == nil && next == c.quote {
+				field.WriteRune(r)
+				continue
+			} else if err == nil {
+				c.r.UnreadRune()
+			}
+			inQuotes = false
+		case r == c.quote && atStart:
+			inQuotes, quoted, atStart = true, true, false
+		case r == c.delimiter:
+			end()
+		case r == '\n':
+			end()
+			return record, nil
+		case r == '\r':
+			// Dropped before a line feed.
+			if next, _, err := c.r.ReadRune(); err == nil && next != '\n' {
+				c.r.UnreadRune()
+				field.WriteRune(r)
+				atStart = false
+			} else if err == nil {
+				c.r.UnreadRune()
+			}
+		case quoted:
+			return nil, fmt.Errorf("line %d: unexpected %q after quoted field", c.line, r)
+		default:
+			field.WriteRune(r)
+			atStart = false
+		}
+	}
+}
+
+// csvWriter writes CSV records. NULL is written as the NULL marker, and
+// any value that could be mistaken for it or holds special characters is
+// quoted.
+type csvWriter struct {
+	w       *bufio.Writer
+	options CopyOptions
+	special string
+}
+
+func newCSVWriter(w io.Writer, options CopyOptions) *csvWriter {
+	special := string(options.Delimiter) + string(options.Quote) + "\r\n"
+	return &csvWriter{w: bufio.NewWriter(w), options: options, special: special}
+}
+
+func (c *csvWriter) write(values []interface{}) {
+	for i, value := range values {
+		if i > 0 {
+			c.w.WriteRune(c.options.Delimiter)
+		}
+		if value == nil {
+			c.w.WriteString(c.options.Null)
+			continue
+		}
+		text, _ := data.ConvertValue(value, data.TypeText)
+		field := text.(string)
+		if field != c.options.Null && !strings.ContainsAny(field, c.special) {
+			c.w.WriteString(field)
+			continue
+		}
+		quote := string(c.options.Quote)
+		c.w.WriteString(quote + strings.ReplaceAll(field, quote, quote+quote) + quote)
+	}
+	c.w.WriteByte('\n')
+}
+
+func (c *csvWriter) flush() error {
+	return c.w.Flush()
+}
@@ -0,0 +1,374 @@
+package query
+
+import (
+	"math"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// Selectivities used when a column has no statistics, as before ANALYZE.
+const (
+	equalitySelectivity = 0.1
+	rangeSelectivity    = 1.0 / 3
+	defaultSelectivity  = 0.5
+)
+
+// indexLookupCost is the cost of fetching one row through an index,
+// relative to reading one row in a sequential scan.
+const indexLookupCost = 2.0
+
+// columnStats returns the ANALYZE statistics of the table column an
+// expression refers to, or nil if there are none.
+func columnStats(expr Expr, columns []PlanColumn) *data.ColumnStats {
+	ref, ok := expr.(*ColumnRef)
+	if !ok {
+		return nil
+	}
+	slot, err := resolveColumn(columns, ref)
+	if err != nil {
+		return nil
+	}
+	return sourceStats(columns[slot])
+}
+
+func sourceStats(col PlanColumn) *data.ColumnStats {
+	if col.source == nil {
+		return nil
+	}
+	stats := col.source.Stats()
+	if stats == nil {
+		return nil
+	}
+	return stats.Columns[col.Name]
+}
+
+// selectivity estimates the fraction of rows a condition lets through,
+// using column statistics where the condition compares a column with a
+// constant.
+func selectivity(expr Expr, columns []PlanColumn) float64 {
+	switch e := expr.(type) {
+	case *Literal:
+		if ok, err := isTrue(e.Value); err == nil && ok {
+			return 1
+		}
+		return 0
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return 1 - selectivity(e.Operand, columns)
+		}
+	case *BinaryExpr:
+		switch e.Op {
+		case "AND":
+			return selectivity(e.Left, columns) * selectivity(e.Right, columns)
+		case "OR":
+			l, r := selectivity(e.Left, columns), selectivity(e.Right, columns)
+			return l + r - l*r
+		case "=":
+			return equalSelectivity(e, columns)
+		case "<>":
+			return 1 - equalSelectivity(e, columns)
+		case "<", "<=", ">", ">=":
+			return rangeSelectivityOf(e, columns)
+		}
+	case *IsNullExpr:
+		if stats := columnStats(e.Expr, columns); stats != nil {
+			if e.Not {
+				return 1 - stats.NullFraction
+			}
+			return stats.NullFraction
+		}
+	case *InExpr:
+		if e.Select == nil && len(e.List) > 0 {
+			s := math.Min(1, float64(len(e.List))*equalSelectivity(&BinaryExpr{Op: "=", Left: e.Expr, Right: e.List[0]}, columns))
+			if e.Not {
+				return 1 - s
+			}
+			return s
+		}
+	}
+	return defaultSelectivity
+}
+
+// equalSelectivity estimates column = constant as one distinct value's
+// share of the non-NULL rows, and column = column by the larger distinct
+// count of the two.
+func equalSelectivity(e *BinaryExpr, columns []PlanColumn) float64 {
+	l, r := columnStats(e.Left, columns), columnStats(e.Right, columns)
+	switch {
+	case l != nil && r != nil:
+		return (1 - l.NullFraction) * (1 - r.NullFraction) / math.Max(1, math.Max(float64(l.Distinct), float64(r.Distinct)))
+	case l != nil:
+		return (1 - l.NullFraction) / math.Max(1, float64(l.Distinct))
+	case r != nil:
+		return (1 - r.NullFraction) / math.Max(1, float64(r.Distinct))
+	}
+	return equalitySelectivity
+}
+
+// rangeSelectivityOf estimates a comparison of a column with a constant
+// from the column's histogram.
+func rangeSelectivityOf(e *BinaryExpr, columns []PlanColumn) float64 {
+	op, column, constant := e.Op, e.Left, e.Right
+	if _, ok := column.(*Literal); ok {
+		// Turn 5 < x into x > 5.
+		column, constant = e.Right, e.Left
+		op = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]
+	}
+	lit, ok := constant.(*Literal)
+	stats := columnStats(column, columns)
+	if !ok || lit.Value == nil || stats == nil || len(stats.Histogram) == 0 {
+		return rangeSelectivity
+	}
+
+	below := histogramFraction(stats.Histogram, lit.Value)
+	if op == ">" || op == ">=" {
+		below = 1 - below
+	}
+	return below * (1 - stats.NullFraction)
+}
+
+// histogramFraction estimates the fraction of values below a constant.
+// Within a bucket, numeric values are interpolated linearly.
+func histogramFraction(bounds []interface{}, value interface{}) float64 {
+	last := len(bounds) - 1
+	if data.CompareValues(value, bounds[0]) <= 0 {
+		return 0
+	}
+	if data.CompareValues(value, bounds[last]) >= 0 {
+		return 1
+	}
+	for i := 0; i < last; i++ {
+		if data.CompareValues(value, bounds[i+1]) >= 0 {
+			continue
+		}
+		within := 0.5
+		lo, loOK := toNumber(bounds[i])
+		hi, hiOK := toNumber(bounds[i+1])
+		v, vOK := toNumber(value)
+		if loOK && hiOK && vOK && toFloat(hi) > toFloat(lo) {
+			within = (toFloat(v) - toFloat(lo)) / (toFloat(hi) - toFloat(lo))
+		}
+		return (float64(i) + within) / float64(last)
+	}
+	return 1
+}
+
+// indexSelectivity estimates the fraction of rows an equality lookup on
+// every column of an index returns.
+func indexSelectivity(idx *data.Index, columns []PlanColumn) float64 {
+	sel := 1.0
+	for _, name := range idx.Columns {
+		colSel := equalitySelectivity
+		for _, col := range columns {
+			if col.Name != name {
+				continue
+			}
+			if stats := sourceStats(col); stats != nil {
+				colSel = (1 - stats.NullFraction) / math.Max(1, float64(stats.Distinct))
+			}
+		}
+		sel *= colSel
+	}
+	return sel
+}
+
+// indexRows estimates the rows an index lookup returns.
+func indexRows(table *data.Table, idx *data.Index, columns []PlanColumn) float64 {
+	if idx.Unique {
+		return 1
+	}
+	return float64(table.RowCount()) * indexSelectivity(idx, columns)
+}
+
+// joinRows estimates the size of a join. Equalities between the two sides
+// use the distinct counts of the columns if known, and otherwise assume
+// each row of the smaller input matches about one row of the larger.
+func joinRows(leftRows, rightRows float64, condition Expr, left, right []PlanColumn) float64 {
+	rows := leftRows * rightRows
+	columns := append(append([]PlanColumn{}, left...), right...)
+	for _, conjunct := range conjuncts(condition) {
+		if binary, ok := conjunct.(*BinaryExpr); ok && binary.Op == "=" && isEquiJoin(binary, left, right) {
+			if columnStats(binary.Left, columns) != nil && columnStats(binary.Right, columns) != nil {
+				rows *= equalSelectivity(binary, columns)
+			} else {
+				rows /= math.Max(1, math.Max(leftRows, rightRows))
+			}
+			continue
+		}
+		rows *= selectivity(conjunct, columns)
+	}
+	return rows
+}
+
+// isEquiJoin reports whether an equality compares one side of a join with
+// the other.
+func isEquiJoin(binary *BinaryExpr, left, right []PlanColumn) bool {
+	l, r := equiKeys(binary.Left, binary.Right, left, right)
+	if l == nil {
+		l, r = equiKeys(binary.Right, binary.Left, left, right)
+	}
+	return l != nil && r != nil
+}
+
+// groupRows estimates the number of groups: the product of the distinct
+// counts of the keys if known, at most one group per input row.
+func groupRows(inputRows float64, groupBy []Expr, columns []PlanColumn) float64 {
+	if len(groupBy) == 0 {
+		return 1
+	}
+	groups := 1.0
+	for _, key := range groupBy {
+		stats := columnStats(key, columns)
+		if stats == nil {
+			return math.Max(1, inputRows*equalitySelectivity)
+		}
+		groups *= math.Max(1, float64(stats.Distinct))
+	}
+	return math.Max(1, math.Min(inputRows, groups))
+}
+
+// estimatePlan estimates the number of rows a logical plan produces.
+func estimatePlan(plan LogicalPlan) float64 {
+	switch node := plan.(type) {
+	case *ScanNode:
+		return float64(node.Table.RowCount())
+	case *SingleRowNode:
+		return 1
+	case *EmptyNode:
+		return 0
+	case *RecursiveNode:
+		return estimatePlan(node.Anchor)
+	case *SetOpNode:
+		return setOpRows(node.Op, estimatePlan(node.Left), estimatePlan(node.Right))
+	case *FilterNode:
+		return estimatePlan(node.Input) * selectivity(node.Condition, node.Input.Columns())
+	case *JoinNode:
+		rows := joinRows(estimatePlan(node.Left), estimatePlan(node.Right), node.Condition, node.Left.Columns(), node.Right.Columns())
+		if node.Type == "LEFT" {
+			rows = math.Max(rows, estimatePlan(node.Left))
+		}
+		return rows
+	case *AggregateNode:
+		return groupRows(estimatePlan(node.Input), node.GroupBy, node.Input.Columns())
+	case *LimitNode:
+		return limitRows(estimatePlan(node.Input), node.Count, node.Offset)
+	}
+	if children := plan.Children(); len(children) == 1 {
+		return estimatePlan(children[0])
+	}
+	return 1
+}
+
+// setOpRows estimates a set operation at its largest possible result.
+func setOpRows(op string, left, right float64) float64 {
+	switch op {
+	case "UNION":
+		return left + right
+	case "INTERSECT":
+		return math.Min(left, right)
+	}
+	return left
+}
+
+func limitRows(rows float64, count, offset int64) float64 {
+	rows = math.Max(0, rows-float64(offset))
+	if count >= 0 {
+		rows = math.Min(rows, float64(count))
+	}
+	return rows
+}
+
+// orderJoins picks the order of a chain of inner and cross joins. It
+// starts with the pair of inputs whose join is estimated smallest and keeps
+// adding the input that keeps the intermediate result smallest, avoiding
+// cross products while a joining condition is available. Conditions are
+// attached to the first join that has all of their columns, and the
+// smaller input of each join becomes its right, hash table side.
+func orderJoins(inputs []LogicalPlan, conditions []Expr) LogicalPlan {
+	pending := append([]Expr{}, conditions...)
+	remaining := append([]LogicalPlan{}, inputs...)
+
+	// join combines two inputs with the pending conditions they can check.
+	join := func(left, right LogicalPlan, take bool) (*JoinNode, float64) {
+		if estimatePlan(left) < estimatePlan(right) {
+			left, right = right, left
+		}
+		node := &JoinNode{Left: left, Right: right, Type: "CROSS"}
+		var applied []Expr
+		var kept []Expr
+		for _, condition := range pending {
+			if _, err := compileExpr(condition, node.Columns()); err == nil {
+				applied = append(applied, condition)
+			} else {
+				kept = append(kept, condition)
+			}
+		}
+		if len(applied) > 0 {
+			node.Type = "INNER"
+			node.Condition = conjoin(applied)
+		}
+		if take {
+			pending = kept
+		}
+		return node, estimatePlan(node)
+	}
+
+	// better prefers joins with a condition, then smaller results.
+	better := func(node *JoinNode, rows float64, best *JoinNode, bestRows float64) bool {
+		if best == nil {
+			return true
+		}
+		if (node.Condition != nil) != (best.Condition != nil) {
+			return node.Condition != nil
+		}
+		return rows < bestRows
+	}
+
+	var current LogicalPlan
+	if len(remaining) > 1 {
+		var best *JoinNode
+		var bestRows float64
+		bestI, bestJ := 0, 1
+		for i := range remaining {
+			for j := i + 1; j < len(remaining); j++ {
+				node, rows := join(remaining[i], remaining[j], false)
+				if better(node, rows, best, bestRows) {
+					best, bestRows, bestI, bestJ = node, rows, i, j
+				}
+			}
+		}
+		current, _ = join(remaining[bestI], remaining[bestJ], true)
+		remaining = append(remaining[:bestJ], remaining[bestJ+1:]...)
+		remaining = append(remaining[:bestI], remaining[bestI+1:]...)
+	} else {
+		current, remaining = remaining[0], nil
+	}
+
+	for len(remaining) > 0 {
+		var best *JoinNode
+		var bestRows float64
+		bestI := 0
+		for i, input := range remaining {
+			node, rows := join(current, input, false)
+			if better(node, rows, best, bestRows) {
+				best, bestRows, bestI = node, rows, i
+			}
+		}
+		current, _ = join(current, remaining[bestI], true)
+		remaining = append(remaining[:bestI], remaining[bestI+1:]...)
+	}
+
+	if len(pending) > 0 {
+		current = &FilterNode{Input: current, Condition: conjoin(pending)}
+	}
+	return current
+}
+
+// conjoin combines conditions with AND.
+func conjoin(conditions []Expr) Expr {
+	result := conditions[0]
+	for _, condition := range conditions[1:] {
+		result = &BinaryExpr{Op: "AND", Left: result, Right: condition}
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxRecursionDepth is the number of times the recursive term of a
+// WITH RECURSIVE query may run before the query is aborted.
+const DefaultMaxRecursionDepth = 1000
+
+// SetMaxRecursionDepth sets how many times the recursive term of a WITH
+// RECURSIVE query may run, guarding against queries that never reach a
+// fixed point. Zero or less restores the default.
+func (e *Executor) SetMaxRecursionDepth(depth int) {
+	e.maxRecursionDepth = depth
+}
+
+func (e *Executor) recursionLimit() int {
+	if e.maxRecursionDepth <= 0 {
+		return DefaultMaxRecursionDepth
+	}
+	return e.maxRecursionDepth
+}
+
+// withScope holds the common table expressions of a WITH clause while the
+// query is planned. Nested queries see those of enclosing queries too.
+type withScope struct {
+	ctes   map[string]*cteDef
+	parent *withScope
+}
+
+// cteDef is a common table expression visible to a query.
+type cteDef struct {
+	cte       *CommonTableExpr
+	with      *withScope // WITH clause it belongs to
+	recursive bool
+	anchoring bool       // Set while the non-recursive term is planned
+	work      *workTable // Set while the recursive term is planned
+}
+
+// lookup finds a common table expression by name.
+func (w *withScope) lookup(name string) *cteDef {
+	for ; w != nil; w = w.parent {
+		if def, ok := w.ctes[strings.ToLower(name)]; ok {
+			return def
+		}
+	}
+	return nil
+}
+
+// planWith makes the common table expressions of a WITH clause visible to
+// the query and checks that each of them plans. Each reference plans its
+// query again, as a derived table of its own.
+func (e *Executor) planWith(stmt *SelectStatement, s *scope) error {
+	with := &withScope{ctes: make(map[string]*cteDef), parent: s.with}
+	s.with = with
+	for i := range stmt.With {
+		cte := &stmt.With[i]
+		key := strings.ToLower(cte.Name)
+		if _, exists := with.ctes[key]; exists {
+			return fmt.Errorf("WITH query name %s specified more than once", cte.Name)
+		}
+		def := &cteDef{cte: cte, with: with, recursive: stmt.Recursive && cte.Recursive != nil}
+		if def.recursive {
+			with.ctes[key] = def
+		}
+		if _, err := e.cteNode(def, cte.Name); err != nil {
+			return err
+		}
+		with.ctes[key] = def
+	}
+	return nil
+}
+
+// cteNode plans a reference to a common table expression. Inside the
+// recursive term of its own query, the reference reads the work table.
+func (e *Executor) cteNode(def *cteDef, alias string) (LogicalPlan, error) {
+	if def.anchoring {
+		return nil, fmt.Errorf("recursive reference to query %s must not appear within its non-recursive term", def.cte.Name)
+	}
+	if def.work != nil {
+		def.work.used = true
+		return &WorkTableNode{Name: def.cte.Name, work: def.work, columns: qualifyColumns(def.work.columns, alias)}, nil
+	}
+
+	def.anchoring = def.recursive
+	input, err := e.planQuery(def.cte.Select, &scope{with: def.with})
+	def.anchoring = false
+	if err != nil {
+		return nil, err
+	}
+	columns, err := cteColumns(def.cte, input.Columns())
+	if err != nil {
+		return nil, err
+	}
+
+	if def.recursive {
+		def.work = &workTable{columns: columns}
+		term, err := e.planQuery(def.cte.Recursive, &scope{with: def.with})
+		work := def.work
+		def.work = nil
+		if err != nil {
+			return nil, err
+		}
+		union, err := newSetOp("UNION", def.cte.UnionAll, input, term)
+		if err != nil {
+			return nil, err
+		}
+		// A term that does not read the query's rows so far runs once.
+		if !work.used {
+			return &DerivedNode{Input: union, Alias: alias, columns: qualifyColumns(columns, alias)}, nil
+		}
+		input = &RecursiveNode{
+			Name:      def.cte.Name,
+			Anchor:    input,
+			Recursive: term,
+			UnionAll:  def.cte.UnionAll,
+			MaxDepth:  e.recursionLimit(),
+			work:      work,
+			columns:   columns,
+		}
+	}
+
+	return &DerivedNode{Input: input, Alias: alias, columns: qualifyColumns(columns, alias)}, nil
+}
+
+// cteColumns names the columns of a common table expression after its
+// column list, or after the columns of its query.
+func cteColumns(cte *CommonTableExpr, input []PlanColumn) ([]PlanColumn, error) {
+	if len(cte.Columns) > len(input) {
+		return nil, fmt.Errorf("WITH query %s has %d columns available but %d columns specified", cte.Name, len(input), len(cte.Columns))
+	}
+	columns := make([]PlanColumn, len(input))
+	for i, col := range input {
+		columns[i] = PlanColumn{Table: cte.Name, Name: col.Name, Type: col.Type}
+		if i < len(cte.Columns) {
+			columns[i].Name = cte.Columns[i]
+		}
+	}
+	return columns, nil
+}
+
+// qualifyColumns copies columns under another table name.
+func qualifyColumns(columns []PlanColumn, table string) []PlanColumn {
+	qualified := make([]PlanColumn, len(columns))
+	for i, col := range columns {
+		qualified[i] = PlanColumn{Table: table, Name: col.Name, Type: col.Type}
+	}
+	return qualified
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// dumpBatchSize is how many rows a dump puts in one INSERT.
+const dumpBatchSize = 100
+
+// Dump writes the whole database to w as a SQL script that ExecScript can
+// replay: a CREATE TABLE for every table, then INSERT statements for the
+// rows, then CREATE INDEX for the indexes other than primary keys. Tables
+// are in alphabetical order and rows in table order, so dumps of the same
+// data are identical.
+//
+// The caller must keep the tables from changing while the dump runs for
+// it to be consistent.
+func (e *Executor) Dump(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	out.WriteString("-- doggodb dump\n")
+	var tables []*data.Table
+	for _, name := range e.storage.TableNames() {
+		table, err := e.storage.GetTable(name)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+
+	var creates, inserts, indexes []Statement
+	for _, table := range tables {
+		create := &CreateTableStatement{Table: table.Name, PrimaryKey: table.PrimaryKey()}
+		for _, col := range table.Schema {
+			create.Columns = append(create.Columns, ColumnDefinition{Name: col.Name, Type: string(col.Type), NotNull: col.NotNull})
+		}
+		creates = append(creates, create)
+		for _, insert := range dumpInserts(table) {
+			inserts = append(inserts, insert)
+		}
+		for _, idx := range table.Indexes {
+			if !idx.Primary {
+				indexes = append(indexes, &CreateIndexStatement{Name: idx.Name, Table: table.Name, Columns: idx.Columns, Unique: idx.Unique})
+			}
+		}
+	}
+	for _, section := range [][]Statement{creates, inserts, indexes} {
+		if len(section) > 0 {
+			out.WriteString("\n")
+		}
+		for _, stmt := range section {
+			out.WriteString(stmt.String() + ";\n")
+		}
+	}
+	return out.Flush()
+}
+
+// dumpInserts returns the INSERT statements that fill a table, in batches
+// of rows with the same columns. Rows of schemaless tables list the
+// columns they have.
+func dumpInserts(table *data.Table) []*InsertStatement {
+	var inserts []*InsertStatement
+	var insert *InsertStatement
+	for _, values := range table.Snapshot() {
+		columns := table.ColumnNames()
+		if len(table.Schema) == 0 {
+			columns = make([]string, 0, len(values))
+			for name := range values {
+				columns = append(columns, name)
+			}
+			sort.Strings(columns)
+		}
+		tuple := make([]string, len(columns))
+		for i, name := range columns {
+			tuple[i] = dumpLiteral(values[name])
+		}
+		if insert != nil && len(insert.MoreValues) < dumpBatchSize-1 && equalNames(insert.Columns, columns) {
+			insert.MoreValues = append(insert.MoreValues, tuple)
+			continue
+		}
+		insert = &InsertStatement{Table: table.Name, Columns: columns, Values: tuple}
+		inserts = append(inserts, insert)
+	}
+	return inserts
+}
+
+// dumpLiteral formats a value so that it reads back as the same value.
+// Whole floats keep a decimal point so that they are not read back as
+// integers.
+func dumpLiteral(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		text := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.ContainsAny(text, ".") {
+			text += ".0"
+		}
+		return text
+	}
+	return formatLiteral(value)
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,415 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tuple is a row flowing between physical operators. Its values line up
+// with the operator's Columns.
+type Tuple []interface{}
+
+// evalFunc evaluates a compiled expression against an input tuple.
+type evalFunc func(Tuple) (interface{}, error)
+
+// compileExpr binds the column references of an expression to positions in
+// the given input columns and returns a function that evaluates it.
+func compileExpr(expr Expr, columns []PlanColumn) (evalFunc, error) {
+	// Computed inputs, such as aggregate results or GROUP BY keys, are
+	// matched on their expression text.
+	key := expr.String()
+	for i, col := range columns {
+		if col.Expr != "" && col.Expr == key {
+			slot := i
+			return func(t Tuple) (interface{}, error) { return t[slot], nil }, nil
+		}
+	}
+
+	switch e := expr.(type) {
+	case *Literal:
+		value := e.Value
+		return func(Tuple) (interface{}, error) { return value, nil }, nil
+
+	case *Param:
+		return nil, fmt.Errorf("no value supplied for parameter %s", e)
+
+	case *ColumnRef:
+		slot, err := resolveColumn(columns, e)
+		if err != nil {
+			return nil, err
+		}
+		return func(t Tuple) (interface{}, error) { return t[slot], nil }, nil
+
+	case *UnaryExpr:
+		operand, err := compileExpr(e.Operand, columns)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "NOT" {
+			return func(t Tuple) (interface{}, error) {
+				v, err := operand(t)
+				if err != nil || v == nil {
+					return nil, err
+				}
+				b, err := toBool(v)
+				return !b, err
+			}, nil
+		}
+		return func(t Tuple) (interface{}, error) {
+			v, err := operand(t)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			return arithmetic("-", int64(0), v)
+		}, nil
+
+	case *BinaryExpr:
+		left, err := compileExpr(e.Left, columns)
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileExpr(e.Right, columns)
+		if err != nil {
+			return nil, err
+		}
+		return compileBinary(e.Op, left, right), nil
+
+	case *OuterRef:
+		return func(Tuple) (interface{}, error) { return e.value, nil }, nil
+
+	case *SubqueryExpr:
+		return compileScalarSubquery(e, columns)
+
+	case *ExistsExpr:
+		return compileExists(e, columns)
+
+	case *InExpr:
+		if e.Select == nil {
+			return compileInList(e, columns)
+		}
+		return compileIn(e, columns)
+
+	case *LikeExpr:
+		return compileLike(e, columns)
+
+	case *BetweenExpr:
+		return compileBetween(e, columns)
+
+	case *IsNullExpr:
+		return compileIsNull(e, columns)
+
+	case *CaseExpr:
+		return compileCase(e, columns)
+
+	case *CastExpr:
+		operand, err := compileExpr(e.Expr, columns)
+		if err != nil {
+			return nil, err
+		}
+		return func(t Tuple) (interface{}, error) {
+			v, err := operand(t)
+			if err != nil {
+				return nil, err
+			}
+			return castValue(v, e.Type)
+		}, nil
+
+	case *WindowExpr:
+		return nil, fmt.Errorf("window function %s is not allowed here", e.Func.Name)
+
+	case *FuncCall:
+		if e.isAggregate() {
+			return nil, fmt.Errorf("aggregate function %s is not allowed here", e.Name)
+		}
+		if isWindowFunction(e.Name) {
+			return nil, fmt.Errorf("window function %s requires an OVER clause", e.Name)
+		}
+		if e.Distinct {
+			return nil, fmt.Errorf("DISTINCT specified, but %s is not an aggregate function", e.Name)
+		}
+		if e.user != nil {
+			return compileUserCall(e, columns)
+		}
+		if f, ok := builtinFunctions[e.Name]; ok {
+			return compileFuncCall(e, f, columns)
+		}
+		return nil, fmt.Errorf("function %s does not exist", e.Name)
+	}
+
+	return nil, fmt.Errorf("unsupported expression %s", expr)
+}
+
+func compileBinary(op string, left, right evalFunc) evalFunc {
+	switch op {
+	case "AND", "OR":
+		// Three-valued logic: NULL is unknown rather than false.
+		return func(t Tuple) (interface{}, error) {
+			l, err := left(t)
+			if err != nil {
+				return nil, err
+			}
+			if l != nil {
+				lb, err := toBool(l)
+				if err != nil {
+					return nil, err
+				}
+				if op == "AND" && !lb {
+					return false, nil
+				}
+				if op == "OR" && lb {
+					return true, nil
+				}
+			}
+			r, err := right(t)
+			if err != nil {
+				return nil, err
+			}
+			if r == nil {
+				return nil, nil
+			}
+			rb, err := toBool(r)
+			if err != nil {
+				return nil, err
+			}
+			if l == nil {
+				if (op == "AND" && !rb) || (op == "OR" && rb) {
+					return rb, nil
+				}
+				return nil, nil
+			}
+			return rb, nil
+		}
+
+	case "=", "<>", "<", "<=", ">", ">=":
+		return func(t Tuple) (interface{}, error) {
+			l, err := left(t)
+			if err != nil {
+				return nil, err
+			}
+			r, err := right(t)
+			if err != nil {
+				return nil, err
+			}
+			if l == nil || r == nil {
+				return nil, nil
+			}
+			c := compareValues(l, r)
+			switch op {
+			case "=":
+				return c == 0, nil
+			case "<>":
+				return c != 0, nil
+			case "<":
+				return c < 0, nil
+			case "<=":
+				return c <= 0, nil
+			case ">":
+				return c > 0, nil
+			default:
+				return c >= 0, nil
+			}
+		}
+	}
+
+	return func(t Tuple) (interface{}, error) {
+		l, err := left(t)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(t)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		if op == "||" {
+			return textValue(l) + textValue(r), nil
+		}
+		return arithmetic(op, l, r)
+	}
+}
+
+// resolveColumn finds the position of a column reference among the input
+// columns.
+func resolveColumn(columns []PlanColumn, ref *ColumnRef) (int, error) {
+	found := -1
+	for i, col := range columns {
+		if col.Name == "" || !strings.EqualFold(col.Name, ref.Name) {
+			continue
+		}
+		if ref.Table != "" && !strings.EqualFold(col.Table, ref.Table) {
+			continue
+		}
+		if found >= 0 {
+			return -1, fmt.Errorf("column reference '%s' is ambiguous", ref)
+		}
+		found = i
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("column '%s' does not exist", ref)
+	}
+	return found, nil
+}
+
+// isTrue reports whether a condition result lets a row through. NULL does not.
+func isTrue(value interface{}) (bool, error) {
+	if value == nil {
+		return false, nil
+	}
+	return toBool(value)
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid boolean value '%s'", v)
+		}
+		return b, nil
+	}
+	return false, fmt.Errorf("invalid boolean value %v", value)
+}
+
+// toNumber returns a value as int64 or float64. Strings holding numbers,
+// as stored by schemaless tables, are converted.
+func toNumber(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return v, true
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// compareValues orders two non-NULL values. Numbers compare numerically,
+// also against strings that hold numbers; everything else compares as text.
+func compareValues(a, b interface{}) int {
+	_, aString := a.(string)
+	_, bString := b.(string)
+	if !aString || !bString {
+		if x, ok := toNumber(a); ok {
+			if y, ok := toNumber(b); ok {
+				xi, xInt := x.(int64)
+				yi, yInt := y.(int64)
+				if xInt && yInt {
+					return compareInts(xi, yi)
+				}
+				return compareFloats(toFloat(x), toFloat(y))
+			}
+		}
+	}
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			default:
+				return 1
+			}
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// arithmetic applies +, -, *, / or % to two non-NULL values.
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	x, ok := toNumber(a)
+	if !ok {
+		return nil, fmt.Errorf("operator %s does not accept %v", op, a)
+	}
+	y, ok := toNumber(b)
+	if !ok {
+		return nil, fmt.Errorf("operator %s does not accept %v", op, b)
+	}
+
+	xi, xInt := x.(int64)
+	yi, yInt := y.(int64)
+	if xInt && yInt {
+		switch op {
+		case "+":
+			return xi + yi, nil
+		case "-":
+			return xi - yi, nil
+		case "*":
+			return xi * yi, nil
+		case "/", "%":
+			if yi == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if op == "/" {
+				return xi / yi, nil
+			}
+			return xi % yi, nil
+		}
+	}
+
+	xf, yf := toFloat(x), toFloat(y)
+	switch op {
+	case "+":
+		return xf + yf, nil
+	case "-":
+		return xf - yf, nil
+	case "*":
+		return xf * yf, nil
+	case "/":
+		if yf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return xf / yf, nil
+	case "%":
+		return nil, errors.New("operator % requires integers")
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
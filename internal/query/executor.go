@@ -1,93 +1,619 @@
 package query
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/H3199/doggodb/internal/data"
 )
 
 // Executor handles the execution of SQL queries.
 type Executor struct {
-	storage data.InMemoryStorage
+	storage           data.InMemoryStorage
+	maxRecursionDepth int                      // See SetMaxRecursionDepth
+	functions         map[string]*userFunction // See RegisterFunc
+	statements        *statementCache          // See Prepare
+	params            []interface{}            // Values of the placeholders while running a prepared statement
+	paramTypes        []data.Type              // Placeholder types found while describing a statement
+	statementTimeout  time.Duration            // See SetStatementTimeout
+	ctx               context.Context          // Context of the running statement, see RunContext
 }
 
 // NewExecutor creates a new Executor with the provided storage.
 func NewExecutor(storage data.InMemoryStorage) *Executor {
-	return &Executor{storage: storage}
+	return &Executor{storage: storage, statements: newStatementCache()}
 }
 
-// Execute executes the given statement.
+// Execute executes the given statement. Queries and statements with a
+// RETURNING clause produce a []*data.Row; other statements return nil. Run
+// returns the full result instead.
 func (e *Executor) Execute(stmt Statement) (interface{}, error) {
+	return e.ExecuteContext(context.Background(), stmt)
+}
+
+// ExecuteContext is like Execute, but stops the statement with a
+// *CanceledError once the context is canceled.
+func (e *Executor) ExecuteContext(ctx context.Context, stmt Statement) (interface{}, error) {
+	result, err := e.RunContext(ctx, stmt)
+	if err != nil || !result.HasRows() {
+		return nil, err
+	}
+	return result.Rows(), nil
+}
+
+// Run executes the given statement and returns its result.
+func (e *Executor) Run(stmt Statement) (*ResultSet, error) {
+	return e.RunContext(context.Background(), stmt)
+}
+
+// RunContext is like Run, but stops the statement with a *CanceledError
+// once the context is canceled or the statement timeout passes. Scans
+// check the context as they go, so statements stop promptly; a statement
+// that fails to change a table leaves it as it was.
+func (e *Executor) RunContext(ctx context.Context, stmt Statement) (*ResultSet, error) {
+	// SET changes this executor, not the copy that runs the statement.
+	if set, ok := stmt.(*SetStatement); ok {
+		return e.executeSet(set)
+	}
+	return e.withContext(ctx, func(running *Executor) (*ResultSet, error) {
+		return running.run(stmt)
+	})
+}
+
+// withContext calls fn with a copy of the executor that runs statements
+// with the context and the statement timeout, as RunContext describes.
+func (e *Executor) withContext(ctx context.Context, fn func(running *Executor) (*ResultSet, error)) (*ResultSet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CanceledError{Err: err}
+	}
+	running := *e
+	running.ctx = ctx
+	if e.statementTimeout > 0 {
+		var cancel context.CancelFunc
+		running.ctx, cancel = context.WithTimeout(ctx, e.statementTimeout)
+		defer cancel()
+	}
+	result, err := fn(&running)
+	if err != nil && running.ctx.Err() != nil {
+		// With the caller's context live, the statement timeout passed.
+		return nil, &CanceledError{Err: running.ctx.Err(), Timeout: ctx.Err() == nil}
+	}
+	return result, err
+}
+
+// context returns the context of the running statement.
+func (e *Executor) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+func (e *Executor) run(stmt Statement) (*ResultSet, error) {
 	switch s := stmt.(type) {
 	case *InsertStatement:
 		return e.executeInsert(s)
 	case *SelectStatement:
 		return e.executeSelect(s)
+	case *UpdateStatement:
+		return e.executeUpdate(s)
+	case *DeleteStatement:
+		return e.executeDelete(s)
+	case *CreateTableStatement:
+		return e.executeCreateTable(s)
+	case *CreateIndexStatement:
+		return e.executeCreateIndex(s)
+	case *ExplainStatement:
+		return e.executeExplain(s)
+	case *AnalyzeStatement:
+		return e.executeAnalyze(s)
+	case *CopyStatement:
+		return e.executeCopy(s)
+	case *BackupStatement:
+		return e.executeBackup(s)
 	default:
 		return nil, fmt.Errorf("unsupported statement type")
 	}
 }
 
 // executeInsert handles INSERT statements.
-func (e *Executor) executeInsert(stmt *InsertStatement) (interface{}, error) {
-	// Prepare values as a map from column name to value.
-	values := make(map[string]interface{})
-	for i, col := range stmt.Columns {
-		values[col] = stmt.Values[i]
+func (e *Executor) executeInsert(stmt *InsertStatement) (*ResultSet, error) {
+	table, err := e.storage.GetTable(stmt.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute INSERT: %v", err)
+	}
+
+	// Without a column list the values follow the table's schema order.
+	columns := stmt.Columns
+	if len(columns) == 0 {
+		if len(table.Schema) == 0 {
+			return nil, fmt.Errorf("failed to execute INSERT: table %s has no schema, a column list is required", stmt.Table)
+		}
+		columns = table.ColumnNames()
 	}
 
-	// Create a row from the values.
-	row := data.CreateRow(values)
+	// Collect the tuples to insert, either from VALUES or from a query.
+	var tuples [][]interface{}
+	if stmt.Select != nil {
+		tuples, err = e.selectTuples(stmt.Select)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute INSERT: %v", err)
+		}
+	} else {
+		for n, values := range stmt.Tuples() {
+			tuple := make([]interface{}, len(values))
+			for i, value := range values {
+				if stmt.values != nil {
+					tuple[i], err = e.evalValue(stmt.values[n][i])
+				} else {
+					tuple[i], err = e.insertValue(value)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("failed to execute INSERT: %v", err)
+				}
+			}
+			tuples = append(tuples, tuple)
+		}
+	}
+
+	// Prepare each tuple as a row from column name to value.
+	rows := make([]*data.Row, 0, len(tuples))
+	for _, tuple := range tuples {
+		if len(tuple) != len(columns) {
+			return nil, fmt.Errorf("failed to execute INSERT: %d columns but %d values", len(columns), len(tuple))
+		}
+		values := make(map[string]interface{})
+		for i, col := range columns {
+			values[col] = tuple[i]
+		}
+		rows = append(rows, data.CreateRow(values))
+	}
 
-	// Insert the row into the storage.
-	if err := e.storage.Insert(stmt.Table, row); err != nil {
+	if stmt.OnConflict != nil {
+		resolve, err := e.conflictResolver(table, stmt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute INSERT: %v", err)
+		}
+		affected, err := table.Upsert(rows, stmt.OnConflict.Columns, resolve)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute INSERT: %v", err)
+		}
+		result := changeResult(table, affected, stmt.Returning)
+		result.lastInsertID = insertID(table, affected)
+		return result, nil
+	}
+
+	// Insert all rows in one go so a bad row leaves the table untouched.
+	if err := table.InsertMany(rows); err != nil {
 		return nil, fmt.Errorf("failed to execute INSERT: %v", err)
 	}
 
-	// Return success with no result.
-	return nil, nil
+	result := changeResult(table, rows, stmt.Returning)
+	result.lastInsertID = insertID(table, rows)
+	return result, nil
 }
 
-func (e *Executor) executeSelect(stmt *SelectStatement) (interface{}, error) {
-	// Retrieve the table.
-	table, err := e.storage.GetTable(stmt.Table)
+// executeSelect plans a query and runs it through the physical operators.
+func (e *Executor) executeSelect(stmt *SelectStatement) (*ResultSet, error) {
+	plan, err := e.planSelect(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute SELECT: %v", err)
+	}
+	tuples, err := runPlan(e.context(), plan)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute SELECT: %v", err)
 	}
 
-	// Parse the condition into a function.
-	var conditionFunc func(*data.Row) bool
-	if stmt.Conditions != "" {
-		conditionFunc, err = parseCondition(stmt.Conditions)
+	return planResult(plan.Columns(), tuples), nil
+}
+
+// selectTuples runs a query and returns its rows as tuples in select-list
+// order, as needed for INSERT ... SELECT.
+func (e *Executor) selectTuples(stmt *SelectStatement) ([][]interface{}, error) {
+	plan, err := e.planSelect(stmt)
+	if err != nil {
+		return nil, err
+	}
+	tuples, err := runPlan(e.context(), plan)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]interface{}, len(tuples))
+	for i, tuple := range tuples {
+		result[i] = tuple
+	}
+	return result, nil
+}
+
+// runPlan builds the operators for a plan and drains them.
+func runPlan(ctx context.Context, plan LogicalPlan) ([]Tuple, error) {
+	op, err := buildOperator(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+	return runOperator(op)
+}
+
+// runOperator opens an operator, reads all of its tuples and closes it.
+func runOperator(op Operator) ([]Tuple, error) {
+	if err := op.Open(); err != nil {
+		op.Close()
+		return nil, err
+	}
+
+	var tuples []Tuple
+	for {
+		t, err := op.Next()
 		if err != nil {
-			return nil, fmt.Errorf("invalid condition: %v", err)
+			op.Close()
+			return nil, err
+		}
+		if t == nil {
+			break
 		}
+		tuples = append(tuples, t)
 	}
+	return tuples, op.Close()
+}
 
-	// Query the table with the condition.
-	filteredRows := table.Query(func(row *data.Row) bool {
-		if conditionFunc == nil {
-			return true // No condition means include all rows.
+// resultNames names the result columns. Columns sharing a name, as in a
+// join of two tables with an id column, are qualified with their table.
+func resultNames(columns []PlanColumn) []string {
+	counts := make(map[string]int)
+	for _, col := range columns {
+		counts[col.Name]++
+	}
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+		if counts[col.Name] > 1 && col.Table != "" {
+			names[i] = col.Table + "." + col.Name
 		}
-		return conditionFunc(row)
-	})
+	}
+	return names
+}
 
-	// Prepare the result set.
-	var result []*data.Row
-	for _, row := range filteredRows {
-		if len(stmt.Columns) == 0 { // SELECT * case.
-			result = append(result, row)
-		} else { // Filter specific columns.
-			columns := make(map[string]interface{})
-			for _, col := range stmt.Columns {
-				if value, exists := row.Columns[col]; exists {
-					columns[col] = value
-				} else {
-					columns[col] = nil
-				}
+// executeUpdate handles UPDATE statements.
+func (e *Executor) executeUpdate(stmt *UpdateStatement) (*ResultSet, error) {
+	table, err := e.storage.GetTable(stmt.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+	}
+
+	where, err := parsedExpr(stmt.Conditions, stmt.where)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition: %v", err)
+	}
+	exprs := make(map[string]Expr)
+	for column, value := range stmt.Assignments {
+		if exprs[column], err = parsedExpr(value, stmt.values[column]); err != nil {
+			return nil, fmt.Errorf("invalid value for column '%s': %v", column, err)
+		}
+	}
+
+	refs := exprColumnRefs(where)
+	for _, expr := range exprs {
+		refs = append(refs, exprColumnRefs(expr)...)
+	}
+	columns := tableColumns(table, stmt.Table, refs, true)
+
+	s := &scope{columns: columns}
+	if where, err = e.prepareExpr(where, s); err != nil {
+		return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+	}
+	subqueries := hasSubquery(where)
+	for column, expr := range exprs {
+		if exprs[column], err = e.prepareExpr(expr, s); err != nil {
+			return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+		}
+		subqueries = subqueries || hasSubquery(expr)
+	}
+
+	condition, err := rowCondition(where, columns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+	}
+	condition = cancelableCondition(e.context(), condition)
+	values := make(map[string]evalFunc)
+	for column, expr := range exprs {
+		if values[column], err = compileExpr(expr, columns); err != nil {
+			return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+		}
+	}
+	assign := func(row *data.Row) (map[string]interface{}, error) {
+		return evalAssignments(values, rowTuple(row.Columns, columns))
+	}
+	if subqueries {
+		if condition, assign, err = precomputeRows(table, condition, assign); err != nil {
+			return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+		}
+	}
+
+	updated, err := table.UpdateWhere(condition, assign)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute UPDATE: %v", err)
+	}
+
+	return changeResult(table, updated, stmt.Returning), nil
+}
+
+// executeDelete handles DELETE statements.
+func (e *Executor) executeDelete(stmt *DeleteStatement) (*ResultSet, error) {
+	table, err := e.storage.GetTable(stmt.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute DELETE: %v", err)
+	}
+
+	where, err := parsedExpr(stmt.Conditions, stmt.where)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition: %v", err)
+	}
+	columns := tableColumns(table, stmt.Table, exprColumnRefs(where), true)
+	if where, err = e.prepareExpr(where, &scope{columns: columns}); err != nil {
+		return nil, fmt.Errorf("failed to execute DELETE: %v", err)
+	}
+	condition, err := rowCondition(where, columns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute DELETE: %v", err)
+	}
+	condition = cancelableCondition(e.context(), condition)
+	if hasSubquery(where) {
+		if condition, _, err = precomputeRows(table, condition, nil); err != nil {
+			return nil, fmt.Errorf("failed to execute DELETE: %v", err)
+		}
+	}
+
+	deleted, err := table.DeleteWhere(condition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute DELETE: %v", err)
+	}
+	return changeResult(table, deleted, stmt.Returning), nil
+}
+
+// executeCreateTable handles CREATE TABLE statements.
+func (e *Executor) executeCreateTable(stmt *CreateTableStatement) (*ResultSet, error) {
+	columns := make([]data.Column, len(stmt.Columns))
+	defined := make(map[string]bool)
+	for i, def := range stmt.Columns {
+		columnType, err := data.ParseType(def.Type)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute CREATE TABLE: %v", err)
+		}
+		columns[i] = data.Column{Name: def.Name, Type: columnType, NotNull: def.NotNull}
+		defined[def.Name] = true
+	}
+
+	// Check constraint columns up front so the table is only created when
+	// all of its indexes can be.
+	for _, constraint := range append([][]string{stmt.PrimaryKey}, stmt.Unique...) {
+		for _, col := range constraint {
+			if !defined[col] {
+				return nil, fmt.Errorf("failed to execute CREATE TABLE: column '%s' named in key does not exist", col)
 			}
-			result = append(result, data.CreateRow(columns))
 		}
 	}
-	return result, nil
+
+	table, err := e.storage.CreateTable(stmt.Table, columns...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute CREATE TABLE: %v", err)
+	}
+	if len(stmt.PrimaryKey) > 0 {
+		if err := table.SetPrimaryKey(stmt.PrimaryKey); err != nil {
+			return nil, fmt.Errorf("failed to execute CREATE TABLE: %v", err)
+		}
+	}
+	for _, unique := range stmt.Unique {
+		name := stmt.Table + "_" + strings.Join(unique, "_") + "_key"
+		if _, err := table.CreateIndex(name, unique, true); err != nil {
+			return nil, fmt.Errorf("failed to execute CREATE TABLE: %v", err)
+		}
+	}
+	return &ResultSet{}, nil
+}
+
+// executeCreateIndex handles CREATE INDEX statements.
+func (e *Executor) executeCreateIndex(stmt *CreateIndexStatement) (*ResultSet, error) {
+	table, err := e.storage.GetTable(stmt.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute CREATE INDEX: %v", err)
+	}
+	if _, err := table.CreateIndex(stmt.Name, stmt.Columns, stmt.Unique); err != nil {
+		return nil, fmt.Errorf("failed to execute CREATE INDEX: %v", err)
+	}
+	return &ResultSet{}, nil
+}
+
+// executeAnalyze handles ANALYZE statements, gathering the statistics the
+// planner uses for one table or for all of them.
+func (e *Executor) executeAnalyze(stmt *AnalyzeStatement) (*ResultSet, error) {
+	names := e.storage.TableNames()
+	if stmt.Table != "" {
+		names = []string{stmt.Table}
+	}
+	for _, name := range names {
+		table, err := e.storage.GetTable(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute ANALYZE: %v", err)
+		}
+		table.Analyze()
+	}
+	return &ResultSet{}, nil
+}
+
+// conflictResolver compiles the DO UPDATE SET clause of an upsert. Its
+// expressions see the existing row's columns, unqualified or qualified with
+// the table name, and the proposed row as excluded.<column>.
+func (e *Executor) conflictResolver(table *data.Table, stmt *InsertStatement) (func(existing, excluded *data.Row) (map[string]interface{}, error), error) {
+	if stmt.OnConflict.DoNothing {
+		return func(existing, excluded *data.Row) (map[string]interface{}, error) { return nil, nil }, nil
+	}
+
+	exprs := make(map[string]Expr)
+	var refs []*ColumnRef
+	for column, value := range stmt.OnConflict.Assignments {
+		expr, err := parsedExpr(value, stmt.OnConflict.values[column])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for column '%s': %v", column, err)
+		}
+		if expr, err = e.bindParams(e.bindFunctions(expr)); err != nil {
+			return nil, err
+		}
+		if hasSubquery(expr) {
+			return nil, fmt.Errorf("subqueries are not supported in ON CONFLICT DO UPDATE")
+		}
+		// Unqualified columns are those of the existing row. The parsed
+		// tree belongs to the statement, so they are qualified in a copy.
+		expr = transformExpr(expr, func(node Expr) Expr {
+			if ref, ok := node.(*ColumnRef); ok && ref.Table == "" {
+				return &ColumnRef{Table: stmt.Table, Name: ref.Name}
+			}
+			return node
+		})
+		for _, ref := range exprColumnRefs(expr) {
+			refs = append(refs, &ColumnRef{Name: ref.Name})
+		}
+		exprs[column] = expr
+	}
+
+	columns := tableColumns(table, stmt.Table, refs, true)
+	rowColumns := columns
+	for _, col := range rowColumns {
+		columns = append(columns, PlanColumn{Table: "excluded", Name: col.Name, Type: col.Type})
+	}
+
+	values := make(map[string]evalFunc)
+	for column, expr := range exprs {
+		eval, err := compileExpr(expr, columns)
+		if err != nil {
+			return nil, err
+		}
+		values[column] = eval
+	}
+
+	return func(existing, excluded *data.Row) (map[string]interface{}, error) {
+		t := append(rowTuple(existing.Columns, rowColumns), rowTuple(excluded.Columns, rowColumns)...)
+		return evalAssignments(values, t)
+	}, nil
+}
+
+// rowCondition compiles an optional WHERE clause into a predicate on
+// stored rows. A missing clause matches every row.
+func rowCondition(where Expr, columns []PlanColumn) (func(*data.Row) (bool, error), error) {
+	if where == nil {
+		return func(*data.Row) (bool, error) { return true, nil }, nil
+	}
+	if containsAggregate(where) {
+		return nil, fmt.Errorf("aggregate functions are not allowed in WHERE")
+	}
+	condition, err := compileExpr(where, columns)
+	if err != nil {
+		return nil, err
+	}
+	return func(row *data.Row) (bool, error) {
+		value, err := condition(rowTuple(row.Columns, columns))
+		if err != nil {
+			return false, err
+		}
+		return isTrue(value)
+	}, nil
+}
+
+// precomputeRows evaluates a condition, and assignments if given, for
+// every row ahead of a change. Subqueries may read the table being changed,
+// which they cannot do while the change holds the table's lock.
+func precomputeRows(table *data.Table, condition func(*data.Row) (bool, error), assign func(*data.Row) (map[string]interface{}, error)) (func(*data.Row) (bool, error), func(*data.Row) (map[string]interface{}, error), error) {
+	rows, values := table.SnapshotRows()
+	matched := make(map[*data.Row]bool)
+	assigned := make(map[*data.Row]map[string]interface{})
+	for i, row := range rows {
+		before := data.CreateRow(values[i])
+		match, err := condition(before)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !match {
+			continue
+		}
+		matched[row] = true
+		if assign != nil {
+			if assigned[row], err = assign(before); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return func(row *data.Row) (bool, error) { return matched[row], nil },
+		func(row *data.Row) (map[string]interface{}, error) { return assigned[row], nil },
+		nil
+}
+
+// evalAssignments computes the new column values of a SET clause.
+func evalAssignments(values map[string]evalFunc, t Tuple) (map[string]interface{}, error) {
+	assignments := make(map[string]interface{}, len(values))
+	for column, eval := range values {
+		value, err := eval(t)
+		if err != nil {
+			return nil, err
+		}
+		assignments[column] = value
+	}
+	return assignments, nil
+}
+
+// exprColumnRefs lists the column references of an expression.
+func exprColumnRefs(expr Expr) []*ColumnRef {
+	var refs []*ColumnRef
+	walkExpr(expr, func(e Expr) {
+		if ref, ok := e.(*ColumnRef); ok {
+			refs = append(refs, ref)
+		}
+	})
+	return refs
+}
+
+func isSelectAll(columns []string) bool {
+	return len(columns) == 0 || (len(columns) == 1 && columns[0] == "*")
+}
+
+// evalValue evaluates an item of a VALUES list. It may not read columns,
+// but may hold subqueries.
+func (e *Executor) evalValue(expr Expr) (interface{}, error) {
+	if lit, ok := expr.(*Literal); ok {
+		return lit.Value, nil
+	}
+	expr, err := e.prepareExpr(expr, &scope{})
+	if err != nil {
+		return nil, err
+	}
+	eval, err := compileExpr(expr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return eval(nil)
+}
+
+// insertValue returns the value of one item of a VALUES list built by
+// hand: a literal or a placeholder.
+func (e *Executor) insertValue(text string) (interface{}, error) {
+	if isParam(text) {
+		index, _ := strconv.Atoi(text[1:])
+		return e.param(index)
+	}
+	return literalValue(text), nil
+}
+
+// literalValue converts the text of a literal from the query into a value.
+// Quoted strings lose their quotes and NULL becomes nil; anything else is
+// kept as written and converted by the table's schema on insert.
+func literalValue(literal string) interface{} {
+	if strings.EqualFold(literal, "NULL") {
+		return nil
+	}
+	if len(literal) >= 2 && strings.HasPrefix(literal, "'") && strings.HasSuffix(literal, "'") {
+		return strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+	}
+	return literal
 }
@@ -0,0 +1,241 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// instrumentedOp wraps an operator for EXPLAIN ANALYZE, counting the rows
+// it returns, how often it is opened and the time spent in it, including
+// the time spent in its inputs.
+type instrumentedOp struct {
+	Operator
+	rows    int64
+	loops   int64
+	elapsed time.Duration
+}
+
+func (op *instrumentedOp) Open() error {
+	start := time.Now()
+	op.loops++
+	err := op.Operator.Open()
+	op.elapsed += time.Since(start)
+	return err
+}
+
+func (op *instrumentedOp) Next() (Tuple, error) {
+	start := time.Now()
+	t, err := op.Operator.Next()
+	op.elapsed += time.Since(start)
+	if t != nil {
+		op.rows++
+	}
+	return t, err
+}
+
+func (op *instrumentedOp) Close() error {
+	start := time.Now()
+	err := op.Operator.Close()
+	op.elapsed += time.Since(start)
+	return err
+}
+
+// executeExplain handles EXPLAIN and EXPLAIN ANALYZE. The plan comes back
+// as rows of a single "QUERY PLAN" column, one line per row.
+func (e *Executor) executeExplain(stmt *ExplainStatement) (*ResultSet, error) {
+	sel, ok := stmt.Statement.(*SelectStatement)
+	if !ok {
+		return nil, fmt.Errorf("failed to execute EXPLAIN: only SELECT statements can be explained")
+	}
+	plan, err := e.planSelect(sel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute EXPLAIN: %v", err)
+	}
+	op, err := (&operatorBuilder{ctx: e.context(), analyze: stmt.Analyze}).build(plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute EXPLAIN: %v", err)
+	}
+
+	var lines []string
+	if stmt.Analyze {
+		start := time.Now()
+		if _, err := runOperator(op); err != nil {
+			return nil, fmt.Errorf("failed to execute EXPLAIN: %v", err)
+		}
+		total := time.Since(start)
+		lines = explainLines(op, 0, lines)
+		lines = append(lines, "Execution Time: "+formatDuration(total))
+	} else {
+		lines = explainLines(op, 0, lines)
+	}
+
+	rows := make([][]interface{}, len(lines))
+	for i, line := range lines {
+		rows[i] = []interface{}{line}
+	}
+	return newResultSet([]Column{{Name: "QUERY PLAN", Type: data.TypeText}}, rows), nil
+}
+
+// explainLines renders an operator tree, one indented line per operator.
+func explainLines(op Operator, depth int, lines []string) []string {
+	line := describeOperator(op)
+	if depth > 0 {
+		line = strings.Repeat("  ", depth-1) + "-> " + line
+	}
+	line += fmt.Sprintf("  (rows=%.0f)", math.Max(1, math.Round(estimateRows(op))))
+	if stats, ok := op.(*instrumentedOp); ok {
+		line += fmt.Sprintf(" (actual rows=%d loops=%d time=%s)", stats.rows, stats.loops, formatDuration(stats.elapsed))
+	}
+	lines = append(lines, line)
+
+	for _, input := range operatorInputs(op) {
+		lines = explainLines(input, depth+1, lines)
+	}
+	return lines
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d.Nanoseconds())/1e6)
+}
+
+// unwrap returns the operator inside an instrumentedOp.
+func unwrap(op Operator) Operator {
+	if stats, ok := op.(*instrumentedOp); ok {
+		return stats.Operator
+	}
+	return op
+}
+
+// describeOperator says what an operator does: the scan type and index,
+// the join algorithm, and the expressions it evaluates.
+func describeOperator(op Operator) string {
+	switch o := unwrap(op).(type) {
+	case *seqScanOp:
+		return "Seq Scan on " + tableString(o.table.Name, o.alias)
+	case *indexScanOp:
+		conds := make([]string, len(o.values))
+		for i, col := range o.index.Columns {
+			conds[i] = fmt.Sprintf("%s = %s", col, formatLiteral(o.values[i]))
+		}
+		return fmt.Sprintf("Index Scan using %s on %s (%s)", o.index.Name, tableString(o.table.Name, o.alias), strings.Join(conds, " AND "))
+	case *derivedOp:
+		return "Subquery Scan on " + o.alias
+	case *recursiveOp:
+		if o.node.UnionAll {
+			return "Recursive Union All on " + o.node.Name
+		}
+		return "Recursive Union on " + o.node.Name
+	case *workTableScanOp:
+		return "WorkTable Scan on " + o.name
+	case *setOpOp:
+		return o.node.String()
+	case *windowOp:
+		return "Window: " + strings.TrimPrefix(o.node.String(), "Window ")
+	case *singleRowOp:
+		return "Result"
+	case *emptyOp:
+		return "Empty Result"
+	case *filterOp:
+		return "Filter: " + o.expr.String()
+	case *projectOp:
+		return "Project: " + strings.TrimPrefix(o.node.String(), "Project ")
+	case *hashJoinOp:
+		return joinDescription("Hash", o.node)
+	case *nestedLoopJoinOp:
+		return joinDescription("Nested Loop", o.node)
+	case *hashAggregateOp:
+		return "Hash " + o.node.String()
+	case *sortOp:
+		return o.node.String()
+	case *distinctOp:
+		return "Hash Distinct"
+	case *limitOp:
+		return (&LimitNode{Count: o.count, Offset: o.offset}).String()
+	}
+	return fmt.Sprintf("%T", op)
+}
+
+func joinDescription(algorithm string, node *JoinNode) string {
+	s := algorithm + " " + node.Type + " Join"
+	if node.Condition != nil {
+		s += " on " + node.Condition.String()
+	}
+	return s
+}
+
+// operatorInputs lists the inputs of an operator.
+func operatorInputs(op Operator) []Operator {
+	switch o := unwrap(op).(type) {
+	case *derivedOp:
+		return []Operator{o.input}
+	case *recursiveOp:
+		return []Operator{o.anchor, o.recursive}
+	case *setOpOp:
+		return []Operator{o.left, o.right}
+	case *windowOp:
+		return []Operator{o.input}
+	case *filterOp:
+		return []Operator{o.input}
+	case *projectOp:
+		return []Operator{o.input}
+	case *hashJoinOp:
+		return []Operator{o.left, o.right}
+	case *nestedLoopJoinOp:
+		return []Operator{o.left, o.right}
+	case *hashAggregateOp:
+		return []Operator{o.input}
+	case *sortOp:
+		return []Operator{o.input}
+	case *distinctOp:
+		return []Operator{o.input}
+	case *limitOp:
+		return []Operator{o.input}
+	}
+	return nil
+}
+
+// estimateRows estimates how many rows an operator returns, with the same
+// cost model the planner uses.
+func estimateRows(op Operator) float64 {
+	switch o := unwrap(op).(type) {
+	case *seqScanOp:
+		return float64(o.table.RowCount())
+	case *indexScanOp:
+		return indexRows(o.table, o.index, o.columns)
+	case *singleRowOp:
+		return 1
+	case *emptyOp:
+		return 0
+	case *recursiveOp:
+		return estimateRows(o.anchor)
+	case *setOpOp:
+		return setOpRows(o.node.Op, estimateRows(o.left), estimateRows(o.right))
+	case *filterOp:
+		return estimateRows(o.input) * selectivity(o.expr, o.input.Columns())
+	case *hashJoinOp:
+		return joinEstimate(&o.joinBase)
+	case *nestedLoopJoinOp:
+		return joinEstimate(&o.joinBase)
+	case *hashAggregateOp:
+		return groupRows(estimateRows(o.input), o.node.GroupBy, o.input.Columns())
+	case *limitOp:
+		return limitRows(estimateRows(o.input), o.count, o.offset)
+	}
+	if inputs := operatorInputs(op); len(inputs) == 1 {
+		return estimateRows(inputs[0])
+	}
+	return 1
+}
+
+func joinEstimate(j *joinBase) float64 {
+	left := estimateRows(j.left)
+	rows := joinRows(left, estimateRows(j.right), j.node.Condition, j.left.Columns(), j.right.Columns())
+	if j.outer {
+		rows = math.Max(rows, left)
+	}
+	return rows
+}
@@ -0,0 +1,735 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a node of a parsed SQL expression, as found in WHERE clauses,
+// select lists, ORDER BY keys and so on. The statements keep expressions as
+// text; they are parsed into Expr trees when a statement is planned.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Literal is a constant value: int64, float64, string, bool or nil (NULL).
+type Literal struct {
+	Value interface{}
+}
+
+func (l *Literal) exprNode() {}
+
+// String returns the SQL form of the literal.
+func (l *Literal) String() string {
+	return formatLiteral(l.Value)
+}
+
+// Param is a placeholder, $n, for a value supplied when the statement is
+// run. Index counts from 1.
+type Param struct {
+	Index int
+}
+
+func (p *Param) exprNode() {}
+
+// String returns the placeholder as $n.
+func (p *Param) String() string {
+	return "$" + strconv.Itoa(p.Index)
+}
+
+// ColumnRef is a reference to a column, optionally qualified by a table
+// name or alias.
+type ColumnRef struct {
+	Table string
+	Name  string
+}
+
+func (c *ColumnRef) exprNode() {}
+
+// String returns the (qualified) column name.
+func (c *ColumnRef) String() string {
+	if c.Table != "" {
+		return c.Table + "." + c.Name
+	}
+	return c.Name
+}
+
+// BinaryExpr is an infix operation such as a + b, a = b or a AND b.
+type BinaryExpr struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+func (b *BinaryExpr) exprNode() {}
+
+// String returns the expression, parenthesizing operands where needed.
+func (b *BinaryExpr) String() string {
+	prec := precedence(b.Op)
+	left := b.Left.String()
+	if p := exprPrecedence(b.Left); p < prec {
+		left = "(" + left + ")"
+	}
+	right := b.Right.String()
+	if p := exprPrecedence(b.Right); p <= prec {
+		right = "(" + right + ")"
+	}
+	return left + " " + b.Op + " " + right
+}
+
+// UnaryExpr is a prefix operation: NOT x or -x.
+type UnaryExpr struct {
+	Op      string
+	Operand Expr
+}
+
+func (u *UnaryExpr) exprNode() {}
+
+// String returns the expression.
+func (u *UnaryExpr) String() string {
+	operand := u.Operand.String()
+	if _, ok := u.Operand.(*BinaryExpr); ok {
+		operand = "(" + operand + ")"
+	}
+	if u.Op == "NOT" {
+		return "NOT " + operand
+	}
+	return u.Op + operand
+}
+
+// FuncCall is a function call such as COUNT(*) or SUM(price).
+type FuncCall struct {
+	Name     string // Upper case function name
+	Args     []Expr
+	Star     bool          // COUNT(*)
+	Distinct bool          // COUNT(DISTINCT x)
+	user     *userFunction // Set for registered functions when planned
+}
+
+func (f *FuncCall) exprNode() {}
+
+// String returns the call in canonical form, e.g. SUM(price).
+func (f *FuncCall) String() string {
+	if f.Star {
+		return f.Name + "(*)"
+	}
+	args := make([]string, len(f.Args))
+	for i, arg := range f.Args {
+		args[i] = arg.String()
+	}
+	if f.Distinct {
+		return f.Name + "(DISTINCT " + strings.Join(args, ", ") + ")"
+	}
+	return f.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// SubqueryExpr is a scalar subquery: a SELECT returning a single column and
+// at most one row, used as a value.
+type SubqueryExpr struct {
+	Select *SelectStatement
+	query  *subquery // Set when the enclosing statement is planned
+}
+
+func (s *SubqueryExpr) exprNode() {}
+
+// String returns the subquery in parentheses.
+func (s *SubqueryExpr) String() string {
+	return "(" + s.Select.String() + ")"
+}
+
+// ExistsExpr is EXISTS (subquery), true if the subquery returns any row.
+type ExistsExpr struct {
+	Select *SelectStatement
+	query  *subquery
+}
+
+func (e *ExistsExpr) exprNode() {}
+
+// String returns the expression.
+func (e *ExistsExpr) String() string {
+	return "EXISTS (" + e.Select.String() + ")"
+}
+
+// InExpr is x [NOT] IN (subquery).
+type InExpr struct {
+	Expr   Expr
+	Select *SelectStatement // nil for a value list
+	List   []Expr
+	Not    bool
+	query  *subquery
+}
+
+func (e *InExpr) exprNode() {}
+
+// String returns the expression.
+func (e *InExpr) String() string {
+	left := e.Expr.String()
+	if exprPrecedence(e.Expr) <= 4 {
+		left = "(" + left + ")"
+	}
+	op := " IN ("
+	if e.Not {
+		op = " NOT IN ("
+	}
+	if e.Select == nil {
+		items := make([]string, len(e.List))
+		for i, item := range e.List {
+			items[i] = item.String()
+		}
+		return left + op + strings.Join(items, ", ") + ")"
+	}
+	return left + op + e.Select.String() + ")"
+}
+
+// OuterRef is a column of an enclosing query referenced from a correlated
+// subquery. Its value is set from the current row of the enclosing query
+// each time the subquery runs.
+type OuterRef struct {
+	Ref    *ColumnRef
+	parent *OuterRef // Set if the column belongs to a query further out
+	value  interface{}
+}
+
+func (o *OuterRef) exprNode() {}
+
+// String returns the referenced column.
+func (o *OuterRef) String() string {
+	return o.Ref.String()
+}
+
+// precedence returns the binding strength of a binary operator.
+func precedence(op string) int {
+	switch op {
+	case "OR":
+		return 1
+	case "AND":
+		return 2
+	case "=", "<>", "<", "<=", ">", ">=":
+		return 4
+	case "+", "-", "||":
+		return 5
+	case "*", "/", "%":
+		return 6
+	}
+	return 0
+}
+
+func exprPrecedence(expr Expr) int {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		return precedence(e.Op)
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return 3
+		}
+	case *InExpr, *LikeExpr, *BetweenExpr, *IsNullExpr:
+		return 4
+	}
+	return 10
+}
+
+// formatLiteral renders a value as a SQL literal.
+func formatLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// ParseExpression parses the text of a single expression, such as a WHERE
+// clause kept in a statement.
+func ParseExpression(text string) (Expr, error) {
+	tokens, err := Tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	expr, i, err := parseExpr(tokens, 0)
+	if err != nil {
+		return nil, err
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in expression", tokens[i].Literal)
+	}
+	return expr, nil
+}
+
+// parseExprText parses an expression starting at tokens[i] and also returns
+// its source text. The AST keeps both: the text for String and the tree
+// for the planner, so a statement run many times is parsed once.
+func parseExprText(tokens []Token, i int) (string, Expr, int, error) {
+	expr, end, err := parseExpr(tokens, i)
+	if err != nil {
+		return "", nil, i, err
+	}
+	return joinTokens(tokens[i:end]), expr, end, nil
+}
+
+// parseExpr parses an expression starting at tokens[i] and returns it with
+// the index of the first token after it.
+func parseExpr(tokens []Token, i int) (Expr, int, error) {
+	return parseOr(tokens, i)
+}
+
+func parseOr(tokens []Token, i int) (Expr, int, error) {
+	left, i, err := parseAnd(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	for i < len(tokens) && tokens[i].Type == OR {
+		right, next, err := parseAnd(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		left, i = &BinaryExpr{Op: "OR", Left: left, Right: right}, next
+	}
+	return left, i, nil
+}
+
+func parseAnd(tokens []Token, i int) (Expr, int, error) {
+	left, i, err := parseNot(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	for i < len(tokens) && tokens[i].Type == AND {
+		right, next, err := parseNot(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		left, i = &BinaryExpr{Op: "AND", Left: left, Right: right}, next
+	}
+	return left, i, nil
+}
+
+func parseNot(tokens []Token, i int) (Expr, int, error) {
+	if i < len(tokens) && tokens[i].Type == NOT {
+		operand, next, err := parseNot(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		return &UnaryExpr{Op: "NOT", Operand: operand}, next, nil
+	}
+	return parseComparison(tokens, i)
+}
+
+var comparisonOperators = map[TokenType]string{
+	EQUALS:         "=",
+	NOT_EQUALS:     "<>",
+	LESS:           "<",
+	LESS_EQUALS:    "<=",
+	GREATER:        ">",
+	GREATER_EQUALS: ">=",
+}
+
+func parseComparison(tokens []Token, i int) (Expr, int, error) {
+	left, i, err := parseAdditive(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	if expr, next, ok, err := parsePostfixCondition(tokens, i, left); ok || err != nil {
+		return expr, next, err
+	}
+	if i < len(tokens) {
+		if op, ok := comparisonOperators[tokens[i].Type]; ok {
+			right, next, err := parseAdditive(tokens, i+1)
+			if err != nil {
+				return nil, next, err
+			}
+			return &BinaryExpr{Op: op, Left: left, Right: right}, next, nil
+		}
+	}
+	return left, i, nil
+}
+
+func parseAdditive(tokens []Token, i int) (Expr, int, error) {
+	left, i, err := parseMultiplicative(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	for i < len(tokens) && (tokens[i].Type == PLUS || tokens[i].Type == MINUS || tokens[i].Type == CONCAT) {
+		op := tokens[i].Literal
+		right, next, err := parseMultiplicative(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		left, i = &BinaryExpr{Op: op, Left: left, Right: right}, next
+	}
+	return left, i, nil
+}
+
+func parseMultiplicative(tokens []Token, i int) (Expr, int, error) {
+	left, i, err := parseUnary(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	for i < len(tokens) && (tokens[i].Type == ASTERISK || tokens[i].Type == SLASH || tokens[i].Type == PERCENT) {
+		op := tokens[i].Literal
+		right, next, err := parseUnary(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		left, i = &BinaryExpr{Op: op, Left: left, Right: right}, next
+	}
+	return left, i, nil
+}
+
+func parseUnary(tokens []Token, i int) (Expr, int, error) {
+	if i < len(tokens) && (tokens[i].Type == MINUS || tokens[i].Type == PLUS) {
+		op := tokens[i].Literal
+		operand, next, err := parseUnary(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		// Fold signs into numeric literals so -5 stays a constant. A
+		// negated number is read with its sign, so that the smallest INT
+		// does not overflow into a float.
+		if op == "-" && next == i+2 && tokens[i+1].Type == NUMBER {
+			value, err := numberValue("-" + tokens[i+1].Literal)
+			if err != nil {
+				return nil, next, err
+			}
+			return &Literal{Value: value}, next, nil
+		}
+		if lit, ok := operand.(*Literal); ok {
+			switch v := lit.Value.(type) {
+			case int64:
+				if op == "-" {
+					v = -v
+				}
+				return &Literal{Value: v}, next, nil
+			case float64:
+				if op == "-" {
+					v = -v
+				}
+				return &Literal{Value: v}, next, nil
+			}
+		}
+		if op == "+" {
+			return operand, next, nil
+		}
+		return &UnaryExpr{Op: "-", Operand: operand}, next, nil
+	}
+	return parseTypecast(tokens, i)
+}
+
+func parsePrimary(tokens []Token, i int) (Expr, int, error) {
+	if i >= len(tokens) {
+		return nil, i, errors.New("unexpected end of expression")
+	}
+
+	token := tokens[i]
+	switch token.Type {
+	case NUMBER:
+		value, err := numberValue(token.Literal)
+		if err != nil {
+			return nil, i, err
+		}
+		return &Literal{Value: value}, i + 1, nil
+
+	case STRING:
+		return &Literal{Value: literalValue(token.Literal)}, i + 1, nil
+
+	case PARAM:
+		index, err := strconv.Atoi(token.Literal[1:])
+		if err != nil {
+			return nil, i, fmt.Errorf("invalid parameter %s", token.Literal)
+		}
+		return &Param{Index: index}, i + 1, nil
+
+	case NULL:
+		return &Literal{Value: nil}, i + 1, nil
+
+	case TRUE, FALSE:
+		return &Literal{Value: token.Type == TRUE}, i + 1, nil
+
+	case CAST:
+		return parseCast(tokens, i)
+
+	case CASE:
+		return parseCase(tokens, i)
+
+	case EXISTS:
+		sub, next, err := parseSubquery(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		return &ExistsExpr{Select: sub}, next, nil
+
+	case LEFT_PAREN:
+		if i+1 < len(tokens) && (tokens[i+1].Type == SELECT || tokens[i+1].Type == WITH) {
+			sub, next, err := parseSubquery(tokens, i)
+			if err != nil {
+				return nil, next, err
+			}
+			return &SubqueryExpr{Select: sub}, next, nil
+		}
+		expr, next, err := parseExpr(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		if next >= len(tokens) || tokens[next].Type != RIGHT_PAREN {
+			return nil, next, errors.New("expected ')' in expression")
+		}
+		return expr, next + 1, nil
+
+	case IDENTIFIER:
+		if i+1 < len(tokens) && tokens[i+1].Type == LEFT_PAREN {
+			call, next, err := parseFuncCall(tokens, i)
+			if err == nil && next < len(tokens) && tokens[next].Type == OVER {
+				return parseOver(tokens, next, call)
+			}
+			return call, next, err
+		}
+		if dot := strings.LastIndex(token.Literal, "."); dot > 0 {
+			return &ColumnRef{Table: token.Literal[:dot], Name: token.Literal[dot+1:]}, i + 1, nil
+		}
+		return &ColumnRef{Name: token.Literal}, i + 1, nil
+	}
+
+	return nil, i, fmt.Errorf("unexpected token '%s' in expression", token.Literal)
+}
+
+// parseSubquery parses a parenthesized SELECT starting at tokens[i].
+func parseSubquery(tokens []Token, i int) (*SelectStatement, int, error) {
+	if i >= len(tokens) || tokens[i].Type != LEFT_PAREN {
+		return nil, i, errors.New("expected '(' before subquery")
+	}
+	sub, next, err := parseSelectAt(tokens, i+1)
+	if err != nil {
+		return nil, next, err
+	}
+	if next >= len(tokens) || tokens[next].Type != RIGHT_PAREN {
+		return nil, next, errors.New("expected ')' after subquery")
+	}
+	return sub, next + 1, nil
+}
+
+func parseFuncCall(tokens []Token, i int) (*FuncCall, int, error) {
+	call := &FuncCall{Name: strings.ToUpper(tokens[i].Literal)}
+	i += 2 // Skip name and '('
+
+	if i < len(tokens) && tokens[i].Type == DISTINCT {
+		call.Distinct = true
+		i++
+		if i >= len(tokens) || tokens[i].Type == RIGHT_PAREN || tokens[i].Type == ASTERISK {
+			return nil, i, fmt.Errorf("expected an argument after DISTINCT in %s", call.Name)
+		}
+	}
+	if i < len(tokens) && tokens[i].Type == ASTERISK {
+		call.Star = true
+		i++
+	} else {
+		for i < len(tokens) && tokens[i].Type != RIGHT_PAREN {
+			arg, next, err := parseExpr(tokens, i)
+			if err != nil {
+				return nil, next, err
+			}
+			call.Args = append(call.Args, arg)
+			i = next
+			if i < len(tokens) && tokens[i].Type == COMMA {
+				i++
+			} else {
+				break
+			}
+		}
+	}
+
+	if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+		return nil, i, fmt.Errorf("expected ')' after arguments of %s", call.Name)
+	}
+	return call, i + 1, nil
+}
+
+func numberValue(literal string) (interface{}, error) {
+	if n, err := strconv.ParseInt(literal, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number '%s'", literal)
+	}
+	return f, nil
+}
+
+// joinTokens turns a run of tokens back into query text that tokenizes to
+// the same tokens.
+func joinTokens(tokens []Token) string {
+	var sb strings.Builder
+	for i, token := range tokens {
+		if i > 0 {
+			prev := tokens[i-1]
+			space := true
+			switch {
+			case prev.Type == LEFT_PAREN:
+				space = false
+			case token.Type == RIGHT_PAREN || token.Type == COMMA:
+				space = false
+			case token.Type == LEFT_PAREN && prev.Type == IDENTIFIER:
+				space = false // Function call
+			case token.Type == DOUBLE_COLON || prev.Type == DOUBLE_COLON:
+				space = false
+			}
+			if space {
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString(token.Literal)
+	}
+	return sb.String()
+}
+
+// walkExpr calls fn for an expression and each of its subexpressions.
+func walkExpr(expr Expr, fn func(Expr)) {
+	if expr == nil {
+		return
+	}
+	fn(expr)
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		walkExpr(e.Left, fn)
+		walkExpr(e.Right, fn)
+	case *UnaryExpr:
+		walkExpr(e.Operand, fn)
+	case *CastExpr:
+		walkExpr(e.Expr, fn)
+	case *FuncCall:
+		for _, arg := range e.Args {
+			walkExpr(arg, fn)
+		}
+	case *InExpr:
+		walkExpr(e.Expr, fn)
+		for _, item := range e.List {
+			walkExpr(item, fn)
+		}
+		walkSubquery(e.query, fn)
+	case *LikeExpr:
+		walkExpr(e.Expr, fn)
+		walkExpr(e.Pattern, fn)
+		walkExpr(e.Escape, fn)
+	case *BetweenExpr:
+		walkExpr(e.Expr, fn)
+		walkExpr(e.Low, fn)
+		walkExpr(e.High, fn)
+	case *IsNullExpr:
+		walkExpr(e.Expr, fn)
+	case *CaseExpr:
+		walkExpr(e.Operand, fn)
+		for _, w := range e.Whens {
+			walkExpr(w.When, fn)
+			walkExpr(w.Then, fn)
+		}
+		walkExpr(e.Else, fn)
+	case *SubqueryExpr:
+		walkSubquery(e.query, fn)
+	case *ExistsExpr:
+		walkSubquery(e.query, fn)
+	case *WindowExpr:
+		// The function itself is computed by the window, not per row.
+		for _, arg := range e.Func.Args {
+			walkExpr(arg, fn)
+		}
+		for _, expr := range e.PartitionBy {
+			walkExpr(expr, fn)
+		}
+		for _, key := range e.OrderBy {
+			walkExpr(key.Expr, fn)
+		}
+	}
+}
+
+// walkSubquery visits the columns a planned subquery reads from the
+// enclosing query, as the enclosing query has to provide them.
+func walkSubquery(query *subquery, fn func(Expr)) {
+	if query == nil {
+		return
+	}
+	for _, outer := range query.outer {
+		if outer.parent == nil {
+			walkExpr(outer.Ref, fn)
+		}
+	}
+}
+
+// transformExpr rebuilds an expression bottom-up, replacing each node with
+// the result of fn.
+func transformExpr(expr Expr, fn func(Expr) Expr) Expr {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		expr = &BinaryExpr{Op: e.Op, Left: transformExpr(e.Left, fn), Right: transformExpr(e.Right, fn)}
+	case *UnaryExpr:
+		expr = &UnaryExpr{Op: e.Op, Operand: transformExpr(e.Operand, fn)}
+	case *CastExpr:
+		expr = &CastExpr{Expr: transformExpr(e.Expr, fn), Type: e.Type}
+	case *FuncCall:
+		call := *e
+		call.Args = make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			call.Args[i] = transformExpr(arg, fn)
+		}
+		expr = &call
+	case *InExpr:
+		in := *e
+		in.Expr = transformExpr(e.Expr, fn)
+		if e.List != nil {
+			in.List = make([]Expr, len(e.List))
+			for i, item := range e.List {
+				in.List[i] = transformExpr(item, fn)
+			}
+		}
+		expr = &in
+	case *LikeExpr:
+		like := *e
+		like.Expr, like.Pattern = transformExpr(e.Expr, fn), transformExpr(e.Pattern, fn)
+		if e.Escape != nil {
+			like.Escape = transformExpr(e.Escape, fn)
+		}
+		expr = &like
+	case *BetweenExpr:
+		expr = &BetweenExpr{Expr: transformExpr(e.Expr, fn), Low: transformExpr(e.Low, fn), High: transformExpr(e.High, fn), Not: e.Not}
+	case *IsNullExpr:
+		expr = &IsNullExpr{Expr: transformExpr(e.Expr, fn), Not: e.Not}
+	case *CaseExpr:
+		c := &CaseExpr{Whens: make([]WhenClause, len(e.Whens))}
+		if e.Operand != nil {
+			c.Operand = transformExpr(e.Operand, fn)
+		}
+		for i, w := range e.Whens {
+			c.Whens[i] = WhenClause{When: transformExpr(w.When, fn), Then: transformExpr(w.Then, fn)}
+		}
+		if e.Else != nil {
+			c.Else = transformExpr(e.Else, fn)
+		}
+		expr = c
+	case *WindowExpr:
+		w := *e
+		call := *e.Func
+		call.Args = make([]Expr, len(e.Func.Args))
+		for i, arg := range e.Func.Args {
+			call.Args[i] = transformExpr(arg, fn)
+		}
+		w.Func = &call
+		w.PartitionBy = make([]Expr, len(e.PartitionBy))
+		for i, part := range e.PartitionBy {
+			w.PartitionBy[i] = transformExpr(part, fn)
+		}
+		w.OrderBy = make([]SortKey, len(e.OrderBy))
+		for i, key := range e.OrderBy {
+			w.OrderBy[i] = SortKey{Expr: transformExpr(key.Expr, fn), Desc: key.Desc}
+		}
+		expr = &w
+	}
+	return fn(expr)
+}
@@ -0,0 +1,331 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// scalarFunction is a function that computes one value from the values of
+// its arguments.
+type scalarFunction struct {
+	minArgs, maxArgs int  // maxArgs is -1 for any number of arguments
+	strict           bool // NULL if any argument is NULL, without calling fn
+	returns          func(args []data.Type) data.Type
+	fn               func(args []interface{}) (interface{}, error)
+}
+
+// builtinFunctions maps upper-case function names to the built-in scalar
+// functions.
+var builtinFunctions = map[string]*scalarFunction{
+	// Strings.
+	"LOWER":   {minArgs: 1, maxArgs: 1, strict: true, returns: returnsType(data.TypeText), fn: textFunc(strings.ToLower)},
+	"UPPER":   {minArgs: 1, maxArgs: 1, strict: true, returns: returnsType(data.TypeText), fn: textFunc(strings.ToUpper)},
+	"LENGTH":  {minArgs: 1, maxArgs: 1, strict: true, returns: returnsType(data.TypeInt), fn: lengthFunc},
+	"SUBSTR":  {minArgs: 2, maxArgs: 3, strict: true, returns: returnsType(data.TypeText), fn: substrFunc},
+	"TRIM":    {minArgs: 1, maxArgs: 2, strict: true, returns: returnsType(data.TypeText), fn: trimFunc},
+	"REPLACE": {minArgs: 3, maxArgs: 3, strict: true, returns: returnsType(data.TypeText), fn: replaceFunc},
+
+	// Numbers.
+	"ABS":   {minArgs: 1, maxArgs: 1, strict: true, returns: returnsArg, fn: absFunc},
+	"ROUND": {minArgs: 1, maxArgs: 2, strict: true, returns: returnsArg, fn: roundFunc},
+	"FLOOR": {minArgs: 1, maxArgs: 1, strict: true, returns: returnsArg, fn: floatFunc(math.Floor)},
+	"CEIL":  {minArgs: 1, maxArgs: 1, strict: true, returns: returnsArg, fn: floatFunc(math.Ceil)},
+	"MOD":   {minArgs: 2, maxArgs: 2, strict: true, returns: returnsArg, fn: modFunc},
+
+	// NULL handling.
+	"COALESCE": {minArgs: 1, maxArgs: -1, returns: returnsArg, fn: coalesceFunc},
+	"IFNULL":   {minArgs: 2, maxArgs: 2, returns: returnsArg, fn: coalesceFunc},
+	"NULLIF":   {minArgs: 2, maxArgs: 2, returns: returnsArg, fn: nullifFunc},
+}
+
+func init() {
+	builtinFunctions["CEILING"] = builtinFunctions["CEIL"]
+	builtinFunctions["SUBSTRING"] = builtinFunctions["SUBSTR"]
+}
+
+// compileFuncCall compiles a call of a scalar function.
+func compileFuncCall(call *FuncCall, f *scalarFunction, columns []PlanColumn) (evalFunc, error) {
+	if call.Star {
+		return nil, fmt.Errorf("%s(*) is not allowed", call.Name)
+	}
+	if len(call.Args) < f.minArgs || (f.maxArgs >= 0 && len(call.Args) > f.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments for %s: %d", call.Name, len(call.Args))
+	}
+	args, err := compileExprs(call.Args, columns)
+	if err != nil {
+		return nil, err
+	}
+	return func(t Tuple) (interface{}, error) {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			value, err := arg(t)
+			if err != nil {
+				return nil, err
+			}
+			if value == nil && f.strict {
+				return nil, nil
+			}
+			values[i] = value
+		}
+		value, err := f.fn(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", call.Name, err)
+		}
+		return value, nil
+	}, nil
+}
+
+func returnsType(t data.Type) func([]data.Type) data.Type {
+	return func([]data.Type) data.Type { return t }
+}
+
+// returnsArg gives the type of the first argument, or of the first typed
+// one for functions such as COALESCE.
+func returnsArg(args []data.Type) data.Type {
+	for _, t := range args {
+		if t != data.TypeAny {
+			return t
+		}
+	}
+	return data.TypeAny
+}
+
+// textValue renders a value as text for string functions and ||.
+func textValue(value interface{}) string {
+	text, _ := data.ConvertValue(value, data.TypeText)
+	return text.(string)
+}
+
+func intArg(value interface{}, name string) (int64, error) {
+	n, ok := toNumber(value)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an integer, got %v", name, value)
+	}
+	if i, isInt := n.(int64); isInt {
+		return i, nil
+	}
+	f := toFloat(n)
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("%s must be an integer, got %v", name, value)
+	}
+	return int64(f), nil
+}
+
+func numberArg(value interface{}) (interface{}, error) {
+	n, ok := toNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a number", value)
+	}
+	return n, nil
+}
+
+func textFunc(fn func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		return fn(textValue(args[0])), nil
+	}
+}
+
+func lengthFunc(args []interface{}) (interface{}, error) {
+	return int64(utf8.RuneCountInString(textValue(args[0]))), nil
+}
+
+// substrFunc implements SUBSTR(s, start [, count]) with 1-based positions.
+// Positions before the start of the string count towards count.
+func substrFunc(args []interface{}) (interface{}, error) {
+	runes := []rune(textValue(args[0]))
+	start, err := intArg(args[1], "start position")
+	if err != nil {
+		return nil, err
+	}
+	end := int64(len(runes)) + 1
+	if len(args) > 2 {
+		count, err := intArg(args[2], "length")
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, errors.New("negative substring length not allowed")
+		}
+		end = start + count
+	}
+	if start < 1 {
+		start = 1
+	}
+	if end > int64(len(runes))+1 {
+		end = int64(len(runes)) + 1
+	}
+	if start >= end {
+		return "", nil
+	}
+	return string(runes[start-1 : end-1]), nil
+}
+
+// trimFunc implements TRIM(s [, characters]), removing spaces or the given
+// characters from both ends.
+func trimFunc(args []interface{}) (interface{}, error) {
+	cutset := " "
+	if len(args) > 1 {
+		cutset = textValue(args[1])
+	}
+	return strings.Trim(textValue(args[0]), cutset), nil
+}
+
+func replaceFunc(args []interface{}) (interface{}, error) {
+	return strings.ReplaceAll(textValue(args[0]), textValue(args[1]), textValue(args[2])), nil
+}
+
+func absFunc(args []interface{}) (interface{}, error) {
+	n, err := numberArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := n.(int64); ok {
+		if i < 0 {
+			return -i, nil
+		}
+		return i, nil
+	}
+	return math.Abs(toFloat(n)), nil
+}
+
+// roundFunc implements ROUND(n [, digits]), rounding halves away from zero.
+func roundFunc(args []interface{}) (interface{}, error) {
+	n, err := numberArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	digits := int64(0)
+	if len(args) > 1 {
+		if digits, err = intArg(args[1], "number of digits"); err != nil {
+			return nil, err
+		}
+	}
+	if i, ok := n.(int64); ok && digits >= 0 {
+		return i, nil
+	}
+	scale := math.Pow(10, float64(digits))
+	rounded := math.Round(toFloat(n)*scale) / scale
+	if _, ok := n.(int64); ok {
+		return int64(rounded), nil
+	}
+	return rounded, nil
+}
+
+func floatFunc(fn func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		n, err := numberArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := n.(int64); ok {
+			return i, nil
+		}
+		return fn(toFloat(n)), nil
+	}
+}
+
+func modFunc(args []interface{}) (interface{}, error) {
+	x, err := numberArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	y, err := numberArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := x.(int64); ok {
+		if _, ok := y.(int64); ok {
+			return arithmetic("%", x, y)
+		}
+	}
+	if toFloat(y) == 0 {
+		return nil, errors.New("division by zero")
+	}
+	return math.Mod(toFloat(x), toFloat(y)), nil
+}
+
+func coalesceFunc(args []interface{}) (interface{}, error) {
+	for _, value := range args {
+		if value != nil {
+			return value, nil
+		}
+	}
+	return nil, nil
+}
+
+func nullifFunc(args []interface{}) (interface{}, error) {
+	if args[0] != nil && args[1] != nil && compareValues(args[0], args[1]) == 0 {
+		return nil, nil
+	}
+	return args[0], nil
+}
+
+// CastExpr is CAST(x AS type).
+type CastExpr struct {
+	Expr Expr
+	Type data.Type
+}
+
+func (c *CastExpr) exprNode() {}
+
+// String returns the cast in SQL syntax.
+func (c *CastExpr) String() string {
+	return "CAST(" + c.Expr.String() + " AS " + string(c.Type) + ")"
+}
+
+// parseCast parses CAST(x AS type) starting at the CAST token.
+func parseCast(tokens []Token, i int) (Expr, int, error) {
+	if i+1 >= len(tokens) || tokens[i+1].Type != LEFT_PAREN {
+		return nil, i, errors.New("expected '(' after CAST")
+	}
+	expr, i, err := parseExpr(tokens, i+2)
+	if err != nil {
+		return nil, i, err
+	}
+	if i+1 >= len(tokens) || tokens[i].Type != AS || tokens[i+1].Type != IDENTIFIER {
+		return nil, i, errors.New("expected AS type in CAST")
+	}
+	t, err := data.ParseType(tokens[i+1].Literal)
+	if err != nil {
+		return nil, i, err
+	}
+	i += 2
+	if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+		return nil, i, errors.New("expected ')' after CAST")
+	}
+	return &CastExpr{Expr: expr, Type: t}, i + 1, nil
+}
+
+// parseTypecast parses a primary expression followed by any number of
+// x::type casts, which bind more tightly than every operator.
+func parseTypecast(tokens []Token, i int) (Expr, int, error) {
+	expr, i, err := parsePrimary(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	for i < len(tokens) && tokens[i].Type == DOUBLE_COLON {
+		if i+1 >= len(tokens) || tokens[i+1].Type != IDENTIFIER {
+			return nil, i, errors.New("expected a type after '::'")
+		}
+		t, err := data.ParseType(tokens[i+1].Literal)
+		if err != nil {
+			return nil, i, err
+		}
+		expr, i = &CastExpr{Expr: expr, Type: t}, i+2
+	}
+	return expr, i, nil
+}
+
+// castValue converts a value for CAST. Unlike storing a float in an
+// integer column, casting rounds it.
+func castValue(value interface{}, t data.Type) (interface{}, error) {
+	if f, ok := value.(float64); ok && t == data.TypeInt {
+		value = math.Round(f)
+	}
+	return data.ConvertValue(value, t)
+}
@@ -0,0 +1,373 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// copyFromJSON reads JSON objects into a table, their keys naming the
+// columns. With a column list only the listed keys are read; otherwise a
+// key the table does not have fails the row. With CREATE_TABLE a missing
+// table is created with the columns inferred from the first objects, in
+// the order their keys first appear.
+func (e *Executor) copyFromJSON(stmt *CopyStatement, r io.Reader, load *copyLoad) (*ResultSet, error) {
+	table, err := e.storage.GetTable(stmt.Table)
+	create := err != nil && stmt.Options.CreateTable
+	if err != nil && !create {
+		return nil, fmt.Errorf("failed to execute COPY: %v", err)
+	}
+	if !create && len(stmt.Columns) > 0 {
+		if _, err := copyColumnTypes(table, stmt.Columns); err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []map[string]interface{}
+	var keys [][]string
+	var where []string
+	err = readJSONObjects(e.context(), r, stmt.Options.Format == "ndjson", func(object map[string]interface{}, objectKeys []string, at string, err error) error {
+		if err != nil {
+			return load.reject(at, err)
+		}
+		objects = append(objects, object)
+		keys = append(keys, objectKeys)
+		where = append(where, at)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if create {
+		sample, sampleKeys := objects, keys
+		if n := stmt.Options.Sample; n > 0 && n < len(sample) {
+			sample, sampleKeys = sample[:n], sampleKeys[:n]
+		}
+		columns := inferColumns(sample, sampleKeys, stmt.Columns)
+		if len(columns) == 0 {
+			return nil, fmt.Errorf("failed to execute COPY: no columns to create table %s with", stmt.Table)
+		}
+		// The table is filled before it is added, so that a failed COPY
+		// leaves no table behind.
+		table = data.NewTable(stmt.Table, columns...)
+	}
+	for i, object := range objects {
+		load.add(jsonRow(object, stmt.Columns), where[i])
+	}
+	result, err := load.into(table)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		if err := e.storage.AddTable(table); err != nil {
+			return nil, fmt.Errorf("failed to execute COPY: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// readJSONObjects passes the objects of a JSON array, or of NDJSON lines,
+// to fn with their keys in order and where each is, such as "line 3". A
+// value that is not an
+// object, or an NDJSON line that is not valid JSON, is passed as an error
+// instead; an array that is not valid JSON fails the read.
+func readJSONObjects(ctx context.Context, r io.Reader, lines bool, fn func(map[string]interface{}, []string, string, error) error) error {
+	if lines {
+		return readNDJSON(ctx, r, fn)
+	}
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return errors.New("failed to execute COPY: expected a JSON array of objects")
+	}
+	for n := 1; decoder.More(); n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := checkCanceled(ctx); err != nil {
+				return err
+			}
+		}
+		where := fmt.Sprintf("element %d", n)
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return fmt.Errorf("failed to execute COPY: %s: %v", where, err)
+		}
+		object, keys, objectErr := jsonObject(raw)
+		if err := fn(object, keys, where, objectErr); err != nil {
+			return err
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("failed to execute COPY: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("failed to execute COPY: unexpected data after the JSON array")
+	}
+	return nil
+}
+
+// readNDJSON reads one JSON object per line, skipping blank lines.
+func readNDJSON(ctx context.Context, r io.Reader, fn func(map[string]interface{}, []string, string, error) error) error {
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := checkCanceled(ctx); err != nil {
+				return err
+			}
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to execute COPY: %v", err)
+		}
+		if text := strings.TrimSpace(line); text != "" {
+			where := fmt.Sprintf("line %d", n)
+			object, keys, parseErr := parseJSONObject(text)
+			if err := fn(object, keys, where, parseErr); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseJSONObject parses a line of NDJSON.
+func parseJSONObject(text string) (map[string]interface{}, []string, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, nil, errors.New("invalid JSON: unexpected data after the value")
+	}
+	return jsonObject(raw)
+}
+
+// jsonObject decodes a JSON value as an object and returns it with its keys
+// in the order they appear, or an error if it is not one. A map does not
+// keep the order, so the keys are read as tokens.
+func jsonObject(raw json.RawMessage) (map[string]interface{}, []string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		var value interface{}
+		decoder = json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return nil, nil, fmt.Errorf("expected a JSON object, got %s", jsonKind(value))
+	}
+	object := make(map[string]interface{})
+	var keys []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		key, _ := token.(string)
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		if _, ok := object[key]; !ok {
+			keys = append(keys, key)
+		}
+		object[key] = value
+	}
+	return object, keys, nil
+}
+
+// jsonRow turns an object into a row, reading only the given keys unless
+// there are none.
+func jsonRow(object map[string]interface{}, columns []string) *data.Row {
+	values := make(map[string]interface{}, len(object))
+	if len(columns) > 0 {
+		for _, name := range columns {
+			if value, ok := object[name]; ok {
+				values[name] = jsonValue(value)
+			}
+		}
+	} else {
+		for name, value := range object {
+			values[name] = jsonValue(value)
+		}
+	}
+	return data.CreateRow(values)
+}
+
+// jsonValue converts a decoded JSON value to a column value. Numbers are
+// integers unless they have a fraction or exponent, and nested objects and
+// arrays are kept as JSON text.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}, []interface{}:
+		text, _ := encodeJSON(v)
+		return string(text)
+	}
+	return value
+}
+
+// jsonKind names the kind of a decoded JSON value.
+func jsonKind(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "an integer"
+		}
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}
+
+// inferColumns infers the columns of a table from objects and their keys:
+// the given columns or else all keys in the order they first appear, each
+// with the narrowest type that holds all of its values. INT takes
+// integers, FLOAT any numbers and BOOL booleans; everything else, including
+// columns of mixed or only null values, is TEXT.
+func inferColumns(objects []map[string]interface{}, keys [][]string, names []string) []data.Column {
+	type kinds struct{ ints, floats, bools, others bool }
+	seen := make(map[string]*kinds)
+	for _, object := range objects {
+		for name, value := range object {
+			k := seen[name]
+			if k == nil {
+				k = &kinds{}
+				seen[name] = k
+			}
+			switch v := value.(type) {
+			case nil:
+			case bool:
+				k.bools = true
+			case json.Number:
+				if _, err := v.Int64(); err == nil {
+					k.ints = true
+				} else {
+					k.floats = true
+				}
+			default:
+				k.others = true
+			}
+		}
+	}
+	if len(names) == 0 {
+		listed := make(map[string]bool)
+		for _, objectKeys := range keys {
+			for _, name := range objectKeys {
+				if !listed[name] {
+					listed[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	columns := make([]data.Column, len(names))
+	for i, name := range names {
+		columns[i] = data.Column{Name: name, Type: data.TypeText}
+		k := seen[name]
+		switch {
+		case k == nil || k.others || (k.bools && (k.ints || k.floats)):
+		case k.floats:
+			columns[i].Type = data.TypeFloat
+		case k.ints:
+			columns[i].Type = data.TypeInt
+		case k.bools:
+			columns[i].Type = data.TypeBool
+		}
+	}
+	return columns
+}
+
+// WriteJSON writes all rows of the result to w as a JSON array of objects
+// keyed by column name, whatever the position of Next.
+func (r *ResultSet) WriteJSON(w io.Writer) error {
+	return writeJSONRows(w, r.columnNames(), r.rows, true)
+}
+
+// WriteNDJSON writes all rows of the result to w as newline-delimited
+// JSON, one object per row keyed by column name.
+func (r *ResultSet) WriteNDJSON(w io.Writer) error {
+	return writeJSONRows(w, r.columnNames(), r.rows, false)
+}
+
+// writeJSONRows writes rows as objects with the given keys, either in an
+// array with an object per line or as NDJSON. Keys keep the column order.
+func writeJSONRows(w io.Writer, names []string, rows [][]interface{}, array bool) error {
+	keys := make([][]byte, len(names))
+	for i, name := range names {
+		keys[i], _ = encodeJSON(name)
+	}
+	out := bufio.NewWriter(w)
+	if array {
+		out.WriteByte('[')
+	}
+	for i, row := range rows {
+		if array {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteByte('\n')
+		}
+		out.WriteByte('{')
+		for j, value := range row {
+			encoded, err := encodeJSON(value)
+			if err != nil {
+				return fmt.Errorf("column %s: %v", names[j], err)
+			}
+			if j > 0 {
+				out.WriteByte(',')
+			}
+			out.Write(keys[j])
+			out.WriteByte(':')
+			out.Write(encoded)
+		}
+		out.WriteByte('}')
+		if !array {
+			out.WriteByte('\n')
+		}
+	}
+	if array {
+		if len(rows) > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString("]\n")
+	}
+	return out.Flush()
+}
+
+// encodeJSON encodes a value without escaping HTML characters.
+func encodeJSON(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
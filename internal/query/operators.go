@@ -0,0 +1,1039 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// Operator is a physical operator of the Volcano iterator model. Open
+// prepares the operator, each call to Next returns the next tuple or nil
+// once the input is exhausted, and Close releases the operator's inputs.
+type Operator interface {
+	Open() error
+	Next() (Tuple, error)
+	Close() error
+	Columns() []PlanColumn
+}
+
+// buildOperator turns a logical plan into a tree of physical operators.
+// The scans stop with the context's error once it is canceled.
+func buildOperator(ctx context.Context, plan LogicalPlan) (Operator, error) {
+	return (&operatorBuilder{ctx: ctx}).build(plan)
+}
+
+// operatorBuilder builds physical operators. With analyze set, every
+// operator is wrapped to record its actual rows, loops and time.
+type operatorBuilder struct {
+	ctx     context.Context
+	analyze bool
+}
+
+func (b *operatorBuilder) build(plan LogicalPlan) (Operator, error) {
+	op, err := b.buildNode(plan)
+	if err != nil {
+		return nil, err
+	}
+	if b.analyze {
+		op = &instrumentedOp{Operator: op}
+	}
+	return op, nil
+}
+
+func (b *operatorBuilder) buildNode(plan LogicalPlan) (Operator, error) {
+	switch node := plan.(type) {
+	case *ScanNode:
+		return &seqScanOp{ctx: b.ctx, table: node.Table, alias: node.Alias, columns: node.Columns()}, nil
+
+	case *DerivedNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		return &derivedOp{input: input, alias: node.Alias, columns: node.Columns()}, nil
+
+	case *RecursiveNode:
+		anchor, err := b.build(node.Anchor)
+		if err != nil {
+			return nil, err
+		}
+		recursive, err := b.build(node.Recursive)
+		if err != nil {
+			return nil, err
+		}
+		return &recursiveOp{node: node, anchor: anchor, recursive: recursive}, nil
+
+	case *SetOpNode:
+		left, err := b.build(node.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.build(node.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &setOpOp{node: node, left: left, right: right}, nil
+
+	case *WorkTableNode:
+		return &workTableScanOp{ctx: b.ctx, name: node.Name, work: node.work, columns: node.Columns()}, nil
+
+	case *SingleRowNode:
+		return &singleRowOp{}, nil
+
+	case *EmptyNode:
+		return &emptyOp{columns: node.Columns()}, nil
+
+	case *FilterNode:
+		input, err := b.filterInput(node)
+		if err != nil {
+			return nil, err
+		}
+		condition, err := compileExpr(node.Condition, node.Columns())
+		if err != nil {
+			return nil, err
+		}
+		return &filterOp{input: input, expr: node.Condition, condition: condition}, nil
+
+	case *ProjectNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		exprs, err := compileExprs(node.Exprs, node.Input.Columns())
+		if err != nil {
+			return nil, err
+		}
+		return &projectOp{input: input, node: node, exprs: exprs, columns: node.Columns()}, nil
+
+	case *JoinNode:
+		return b.buildJoin(node)
+
+	case *AggregateNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		groupBy, err := compileExprs(node.GroupBy, node.Input.Columns())
+		if err != nil {
+			return nil, err
+		}
+		op := &hashAggregateOp{input: input, node: node, groupBy: groupBy, calls: node.Aggregates, columns: node.Columns()}
+		for _, call := range node.Aggregates {
+			arg, err := compileAggregateArg(call, node.Input.Columns())
+			if err != nil {
+				return nil, err
+			}
+			op.args = append(op.args, arg)
+		}
+		return op, nil
+
+	case *WindowNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		return newWindowOp(input, node)
+
+	case *SortNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		op := &sortOp{input: input, node: node}
+		for _, key := range node.Keys {
+			eval, err := compileExpr(key.Expr, node.Input.Columns())
+			if err != nil {
+				return nil, err
+			}
+			op.keys = append(op.keys, eval)
+			op.desc = append(op.desc, key.Desc)
+		}
+		return op, nil
+
+	case *DistinctNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		return &distinctOp{input: input}, nil
+
+	case *LimitNode:
+		input, err := b.build(node.Input)
+		if err != nil {
+			return nil, err
+		}
+		return &limitOp{input: input, count: node.Count, offset: node.Offset}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported plan node %s", plan)
+}
+
+func compileExprs(exprs []Expr, columns []PlanColumn) ([]evalFunc, error) {
+	evals := make([]evalFunc, len(exprs))
+	for i, expr := range exprs {
+		eval, err := compileExpr(expr, columns)
+		if err != nil {
+			return nil, err
+		}
+		evals[i] = eval
+	}
+	return evals, nil
+}
+
+// filterInput builds the input of a filter. A filter directly over a scan
+// whose equality conditions cover an index reads the table through that
+// index instead of scanning it; the filter still checks every condition.
+func (b *operatorBuilder) filterInput(node *FilterNode) (Operator, error) {
+	scan, ok := node.Input.(*ScanNode)
+	if !ok {
+		return b.build(node.Input)
+	}
+	if idx, values := chooseIndex(scan, node.Condition); idx != nil {
+		var op Operator = &indexScanOp{ctx: b.ctx, table: scan.Table, alias: scan.Alias, index: idx, values: values, columns: scan.Columns()}
+		if b.analyze {
+			op = &instrumentedOp{Operator: op}
+		}
+		return op, nil
+	}
+	return b.build(scan)
+}
+
+// chooseIndex looks for an index whose columns are all compared with a
+// constant in the condition, and returns the cheapest one if it beats a
+// sequential scan according to the cost model.
+func chooseIndex(scan *ScanNode, condition Expr) (*data.Index, []interface{}) {
+	constants := make(map[string]interface{})
+	for _, conjunct := range conjuncts(condition) {
+		binary, ok := conjunct.(*BinaryExpr)
+		if !ok || binary.Op != "=" {
+			continue
+		}
+		ref, lit := columnAndLiteral(binary.Left, binary.Right)
+		if ref == nil {
+			ref, lit = columnAndLiteral(binary.Right, binary.Left)
+		}
+		if ref == nil || lit.Value == nil {
+			continue
+		}
+		slot, err := resolveColumn(scan.Columns(), ref)
+		if err != nil {
+			continue
+		}
+		constants[scan.Columns()[slot].Name] = lit.Value
+	}
+	if len(constants) == 0 {
+		return nil, nil
+	}
+
+	var best *data.Index
+	var bestValues []interface{}
+	bestCost := float64(scan.Table.RowCount())
+	for _, idx := range scan.Table.Indexes {
+		values, ok := indexValues(scan.Table, idx, constants)
+		if !ok {
+			continue
+		}
+		cost := indexLookupCost * indexRows(scan.Table, idx, scan.Columns())
+		if cost < bestCost {
+			best, bestValues, bestCost = idx, values, cost
+		}
+	}
+	return best, bestValues
+}
+
+// indexValues converts the constants for an index's columns to the
+// column types, as they are stored in the index.
+func indexValues(table *data.Table, idx *data.Index, constants map[string]interface{}) ([]interface{}, bool) {
+	values := make([]interface{}, len(idx.Columns))
+	for i, name := range idx.Columns {
+		value, ok := constants[name]
+		if !ok {
+			return nil, false
+		}
+		if col, ok := table.Column(name); ok {
+			converted, err := data.ConvertValue(value, col.Type)
+			if err != nil {
+				return nil, false
+			}
+			value = converted
+		} else {
+			value = fmt.Sprintf("%v", value) // schemaless tables store text
+		}
+		values[i] = value
+	}
+	return values, true
+}
+
+func columnAndLiteral(a, b Expr) (*ColumnRef, *Literal) {
+	ref, ok := a.(*ColumnRef)
+	if !ok {
+		return nil, nil
+	}
+	lit, ok := b.(*Literal)
+	if !ok {
+		return nil, nil
+	}
+	return ref, lit
+}
+
+// conjuncts splits a condition on its top-level ANDs.
+func conjuncts(expr Expr) []Expr {
+	if binary, ok := expr.(*BinaryExpr); ok && binary.Op == "AND" {
+		return append(conjuncts(binary.Left), conjuncts(binary.Right)...)
+	}
+	if expr == nil {
+		return nil
+	}
+	return []Expr{expr}
+}
+
+// buildJoin picks a hash join when the condition has equalities between
+// the two sides, and a nested loop join otherwise.
+func (b *operatorBuilder) buildJoin(node *JoinNode) (Operator, error) {
+	left, err := b.build(node.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := b.build(node.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	var condition evalFunc
+	if node.Condition != nil {
+		if condition, err = compileExpr(node.Condition, node.Columns()); err != nil {
+			return nil, err
+		}
+	}
+	base := joinBase{ctx: b.ctx, node: node, left: left, right: right, condition: condition, outer: node.Type == "LEFT", columns: node.Columns()}
+
+	var leftKeys, rightKeys []evalFunc
+	for _, conjunct := range conjuncts(node.Condition) {
+		binary, ok := conjunct.(*BinaryExpr)
+		if !ok || binary.Op != "=" {
+			continue
+		}
+		l, r := equiKeys(binary.Left, binary.Right, node.Left.Columns(), node.Right.Columns())
+		if l == nil {
+			l, r = equiKeys(binary.Right, binary.Left, node.Left.Columns(), node.Right.Columns())
+		}
+		if l != nil && r != nil {
+			leftKeys = append(leftKeys, l)
+			rightKeys = append(rightKeys, r)
+		}
+	}
+	if len(leftKeys) > 0 {
+		return &hashJoinOp{joinBase: base, leftKeys: leftKeys, rightKeys: rightKeys}, nil
+	}
+	return &nestedLoopJoinOp{joinBase: base}, nil
+}
+
+// equiKeys compiles the two sides of an equality against the left and right
+// inputs of a join, returning nils unless each side belongs to one input.
+func equiKeys(a, b Expr, left, right []PlanColumn) (evalFunc, evalFunc) {
+	l, err := compileExpr(a, left)
+	if err != nil {
+		return nil, nil
+	}
+	r, err := compileExpr(b, right)
+	if err != nil {
+		return nil, nil
+	}
+	return l, r
+}
+
+// valueKey encodes a value for hashing so that values which compare equal
+// share a key: numbers, including numeric text, by their numeric value.
+func valueKey(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	if b, ok := value.(bool); ok {
+		return "b:" + strconv.FormatBool(b)
+	}
+	if n, ok := toNumber(value); ok {
+		return "n:" + strconv.FormatFloat(toFloat(n), 'g', -1, 64)
+	}
+	return "s:" + fmt.Sprintf("%v", value)
+}
+
+func tupleKey(t Tuple, exprs []evalFunc) (string, bool, error) {
+	parts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		value, err := expr(t)
+		if err != nil {
+			return "", false, err
+		}
+		if value == nil {
+			return "", false, nil
+		}
+		parts[i] = valueKey(value)
+	}
+	return strings.Join(parts, "\x00"), true, nil
+}
+
+// rowKey encodes a whole tuple so that duplicate rows share a key. Unlike
+// tupleKey, NULLs count as equal, as they do for UNION and DISTINCT.
+func rowKey(t Tuple) string {
+	parts := make([]string, len(t))
+	for i, value := range t {
+		parts[i] = valueKey(value)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// seqScanOp reads the rows of a table. It works on a snapshot taken at
+// Open, so concurrent writes do not affect a running scan.
+type seqScanOp struct {
+	ctx     context.Context
+	table   *data.Table
+	alias   string
+	columns []PlanColumn
+	rows    []map[string]interface{}
+	pos     int
+}
+
+func (op *seqScanOp) Open() error {
+	op.rows, op.pos = op.table.Snapshot(), 0
+	return nil
+}
+
+func (op *seqScanOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	if err := checkCanceled(op.ctx); err != nil {
+		return nil, err
+	}
+	op.pos++
+	return rowTuple(op.rows[op.pos-1], op.columns), nil
+}
+
+func (op *seqScanOp) Close() error          { op.rows = nil; return nil }
+func (op *seqScanOp) Columns() []PlanColumn { return op.columns }
+
+// indexScanOp reads the rows of a table matching an index lookup.
+type indexScanOp struct {
+	ctx     context.Context
+	table   *data.Table
+	alias   string
+	index   *data.Index
+	values  []interface{}
+	columns []PlanColumn
+	rows    []map[string]interface{}
+	pos     int
+}
+
+func (op *indexScanOp) Open() error {
+	op.rows, op.pos = op.table.LookupIndex(op.index, op.values...), 0
+	return nil
+}
+
+func (op *indexScanOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	if err := checkCanceled(op.ctx); err != nil {
+		return nil, err
+	}
+	op.pos++
+	return rowTuple(op.rows[op.pos-1], op.columns), nil
+}
+
+func (op *indexScanOp) Close() error          { op.rows = nil; return nil }
+func (op *indexScanOp) Columns() []PlanColumn { return op.columns }
+
+// rowTuple lays out the values of a stored row in column order.
+func rowTuple(row map[string]interface{}, columns []PlanColumn) Tuple {
+	t := make(Tuple, len(columns))
+	for i, col := range columns {
+		t[i] = row[col.Name]
+	}
+	return t
+}
+
+// derivedOp passes on the tuples of a subquery in FROM under the columns
+// of the derived table.
+type derivedOp struct {
+	input   Operator
+	alias   string
+	columns []PlanColumn
+}
+
+func (op *derivedOp) Open() error           { return op.input.Open() }
+func (op *derivedOp) Next() (Tuple, error)  { return op.input.Next() }
+func (op *derivedOp) Close() error          { return op.input.Close() }
+func (op *derivedOp) Columns() []PlanColumn { return op.columns }
+
+// recursiveOp computes a recursive query when opened and then returns its
+// rows.
+type recursiveOp struct {
+	node      *RecursiveNode
+	anchor    Operator
+	recursive Operator
+	rows      []Tuple
+	pos       int
+}
+
+func (op *recursiveOp) Open() error {
+	seen := make(map[string]bool)
+	// fresh drops the rows seen before, unless duplicates are kept.
+	fresh := func(rows []Tuple) []Tuple {
+		if op.node.UnionAll {
+			return rows
+		}
+		var kept []Tuple
+		for _, row := range rows {
+			key := rowKey(row)
+			if !seen[key] {
+				seen[key] = true
+				kept = append(kept, row)
+			}
+		}
+		return kept
+	}
+
+	rows, err := runOperator(op.anchor)
+	if err != nil {
+		return err
+	}
+	added := fresh(rows)
+	op.rows, op.pos = added, 0
+	for depth := 0; len(added) > 0; depth++ {
+		if depth == op.node.MaxDepth {
+			return fmt.Errorf("recursive query %s exceeded the maximum recursion depth of %d", op.node.Name, op.node.MaxDepth)
+		}
+		op.node.work.rows = added
+		rows, err := runOperator(op.recursive)
+		if err != nil {
+			return err
+		}
+		added = fresh(rows)
+		op.rows = append(op.rows, added...)
+	}
+	op.node.work.rows = nil
+	return nil
+}
+
+func (op *recursiveOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	op.pos++
+	return op.rows[op.pos-1], nil
+}
+
+func (op *recursiveOp) Close() error          { op.rows = nil; return nil }
+func (op *recursiveOp) Columns() []PlanColumn { return op.node.Columns() }
+
+// workTableScanOp reads the rows a recursive query added in its previous
+// run.
+type workTableScanOp struct {
+	ctx     context.Context
+	name    string
+	work    *workTable
+	columns []PlanColumn
+	rows    []Tuple
+	pos     int
+}
+
+func (op *workTableScanOp) Open() error { op.rows, op.pos = op.work.rows, 0; return nil }
+
+func (op *workTableScanOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	if err := checkCanceled(op.ctx); err != nil {
+		return nil, err
+	}
+	op.pos++
+	return op.rows[op.pos-1], nil
+}
+
+func (op *workTableScanOp) Close() error          { op.rows = nil; return nil }
+func (op *workTableScanOp) Columns() []PlanColumn { return op.columns }
+
+// singleRowOp produces a single empty tuple.
+type singleRowOp struct {
+	done bool
+}
+
+func (op *singleRowOp) Open() error { op.done = false; return nil }
+
+func (op *singleRowOp) Next() (Tuple, error) {
+	if op.done {
+		return nil, nil
+	}
+	op.done = true
+	return Tuple{}, nil
+}
+
+func (op *singleRowOp) Close() error          { return nil }
+func (op *singleRowOp) Columns() []PlanColumn { return nil }
+
+// emptyOp produces no tuples.
+type emptyOp struct {
+	columns []PlanColumn
+}
+
+func (op *emptyOp) Open() error           { return nil }
+func (op *emptyOp) Next() (Tuple, error)  { return nil, nil }
+func (op *emptyOp) Close() error          { return nil }
+func (op *emptyOp) Columns() []PlanColumn { return op.columns }
+
+// filterOp passes on the tuples for which the condition is true.
+type filterOp struct {
+	input     Operator
+	expr      Expr
+	condition evalFunc
+}
+
+func (op *filterOp) Open() error { return op.input.Open() }
+
+func (op *filterOp) Next() (Tuple, error) {
+	for {
+		t, err := op.input.Next()
+		if t == nil || err != nil {
+			return nil, err
+		}
+		value, err := op.condition(t)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := isTrue(value); err != nil || ok {
+			return t, err
+		}
+	}
+}
+
+func (op *filterOp) Close() error          { return op.input.Close() }
+func (op *filterOp) Columns() []PlanColumn { return op.input.Columns() }
+
+// projectOp computes the output expressions of each tuple.
+type projectOp struct {
+	input   Operator
+	node    *ProjectNode
+	exprs   []evalFunc
+	columns []PlanColumn
+}
+
+func (op *projectOp) Open() error { return op.input.Open() }
+
+func (op *projectOp) Next() (Tuple, error) {
+	t, err := op.input.Next()
+	if t == nil || err != nil {
+		return nil, err
+	}
+	out := make(Tuple, len(op.exprs))
+	for i, expr := range op.exprs {
+		if out[i], err = expr(t); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (op *projectOp) Close() error          { return op.input.Close() }
+func (op *projectOp) Columns() []PlanColumn { return op.columns }
+
+// joinBase holds what the join operators share. The right input is read
+// in full at Open; the left input is streamed.
+type joinBase struct {
+	ctx       context.Context
+	node      *JoinNode
+	left      Operator
+	right     Operator
+	condition evalFunc // nil for CROSS joins
+	outer     bool     // LEFT join: keep unmatched left tuples
+	columns   []PlanColumn
+
+	current   Tuple   // left tuple being joined
+	matches   []Tuple // right tuples that may match current
+	pos       int
+	matched   bool
+	rightSize int
+}
+
+func (j *joinBase) open(onRight func(Tuple) error) error {
+	if err := j.left.Open(); err != nil {
+		return err
+	}
+	if err := j.right.Open(); err != nil {
+		return err
+	}
+	j.rightSize = len(j.right.Columns())
+	for {
+		t, err := j.right.Next()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			break
+		}
+		if err := onRight(t); err != nil {
+			return err
+		}
+	}
+	j.current = nil
+	return nil
+}
+
+// next joins the left tuples with their candidate right tuples; candidates
+// returns the right tuples that may match a left tuple.
+func (j *joinBase) next(candidates func(Tuple) ([]Tuple, error)) (Tuple, error) {
+	for {
+		if j.current == nil {
+			t, err := j.left.Next()
+			if t == nil || err != nil {
+				return nil, err
+			}
+			if j.matches, err = candidates(t); err != nil {
+				return nil, err
+			}
+			j.current, j.pos, j.matched = t, 0, false
+		}
+
+		for j.pos < len(j.matches) {
+			if err := checkCanceled(j.ctx); err != nil {
+				return nil, err
+			}
+			combined := append(append(Tuple{}, j.current...), j.matches[j.pos]...)
+			j.pos++
+			if j.condition != nil {
+				value, err := j.condition(combined)
+				if err != nil {
+					return nil, err
+				}
+				if ok, err := isTrue(value); err != nil || !ok {
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+			j.matched = true
+			return combined, nil
+		}
+
+		left := j.current
+		j.current = nil
+		if j.outer && !j.matched {
+			return append(append(Tuple{}, left...), make(Tuple, j.rightSize)...), nil
+		}
+	}
+}
+
+func (j *joinBase) Close() error {
+	j.matches = nil
+	err := j.left.Close()
+	if rightErr := j.right.Close(); err == nil {
+		err = rightErr
+	}
+	return err
+}
+
+func (j *joinBase) Columns() []PlanColumn { return j.columns }
+
+// nestedLoopJoinOp compares every left tuple with every right tuple.
+type nestedLoopJoinOp struct {
+	joinBase
+	rows []Tuple
+}
+
+func (op *nestedLoopJoinOp) Open() error {
+	op.rows = nil
+	return op.open(func(t Tuple) error {
+		op.rows = append(op.rows, t)
+		return nil
+	})
+}
+
+func (op *nestedLoopJoinOp) Next() (Tuple, error) {
+	return op.next(func(Tuple) ([]Tuple, error) { return op.rows, nil })
+}
+
+// hashJoinOp builds a hash table of the right input on the equality keys
+// and probes it with each left tuple.
+type hashJoinOp struct {
+	joinBase
+	leftKeys  []evalFunc
+	rightKeys []evalFunc
+	buckets   map[string][]Tuple
+}
+
+func (op *hashJoinOp) Open() error {
+	op.buckets = make(map[string][]Tuple)
+	return op.open(func(t Tuple) error {
+		key, ok, err := tupleKey(t, op.rightKeys)
+		if ok {
+			op.buckets[key] = append(op.buckets[key], t)
+		}
+		return err
+	})
+}
+
+func (op *hashJoinOp) Next() (Tuple, error) {
+	return op.next(func(t Tuple) ([]Tuple, error) {
+		key, ok, err := tupleKey(t, op.leftKeys)
+		if !ok || err != nil {
+			return nil, err
+		}
+		return op.buckets[key], nil
+	})
+}
+
+// hashAggregateOp groups its input on the GROUP BY keys and computes the
+// aggregates of each group. Groups come out in order of first appearance.
+type hashAggregateOp struct {
+	input   Operator
+	node    *AggregateNode
+	groupBy []evalFunc
+	calls   []*FuncCall
+	args    []evalFunc
+	columns []PlanColumn
+	results []Tuple
+	pos     int
+}
+
+func (op *hashAggregateOp) Open() error {
+	if err := op.input.Open(); err != nil {
+		return err
+	}
+
+	type group struct {
+		keys        Tuple
+		aggregators []aggregator
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	newGroup := func(keys Tuple) (*group, error) {
+		g := &group{keys: keys}
+		for _, call := range op.calls {
+			agg, err := newAggregator(call)
+			if err != nil {
+				return nil, err
+			}
+			g.aggregators = append(g.aggregators, agg)
+		}
+		groups = append(groups, g)
+		return g, nil
+	}
+
+	for {
+		t, err := op.input.Next()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			break
+		}
+		keys := make(Tuple, len(op.groupBy))
+		parts := make([]string, len(op.groupBy))
+		for i, expr := range op.groupBy {
+			if keys[i], err = expr(t); err != nil {
+				return err
+			}
+			parts[i] = valueKey(keys[i])
+		}
+		key := strings.Join(parts, "\x00")
+		g, exists := index[key]
+		if !exists {
+			if g, err = newGroup(keys); err != nil {
+				return err
+			}
+			index[key] = g
+		}
+		for i, arg := range op.args {
+			value, err := arg(t)
+			if err != nil {
+				return err
+			}
+			if err := g.aggregators[i].Step(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Without GROUP BY, an empty input still forms one group.
+	if len(groups) == 0 && len(op.groupBy) == 0 {
+		if _, err := newGroup(Tuple{}); err != nil {
+			return err
+		}
+	}
+
+	op.results, op.pos = nil, 0
+	for _, g := range groups {
+		t := append(Tuple{}, g.keys...)
+		for _, agg := range g.aggregators {
+			value, err := agg.Result()
+			if err != nil {
+				return err
+			}
+			t = append(t, value)
+		}
+		op.results = append(op.results, t)
+	}
+	return nil
+}
+
+func (op *hashAggregateOp) Next() (Tuple, error) {
+	if op.pos >= len(op.results) {
+		return nil, nil
+	}
+	op.pos++
+	return op.results[op.pos-1], nil
+}
+
+func (op *hashAggregateOp) Close() error          { op.results = nil; return op.input.Close() }
+func (op *hashAggregateOp) Columns() []PlanColumn { return op.columns }
+
+// sortOp reads its whole input and returns it ordered by the sort keys.
+// compareSortKeys orders two rows by their sort key values. NULLs sort
+// after other values, or first for descending keys.
+func compareSortKeys(x, y Tuple, desc []bool) int {
+	for i := range desc {
+		var c int
+		switch {
+		case x[i] == nil && y[i] == nil:
+			c = 0
+		case x[i] == nil:
+			c = 1
+		case y[i] == nil:
+			c = -1
+		default:
+			c = compareValues(x[i], y[i])
+		}
+		if desc[i] {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// NULLs sort last in ascending order and first in descending order.
+type sortOp struct {
+	input Operator
+	node  *SortNode
+	keys  []evalFunc
+	desc  []bool
+	rows  []Tuple
+	pos   int
+}
+
+func (op *sortOp) Open() error {
+	if err := op.input.Open(); err != nil {
+		return err
+	}
+
+	type sortRow struct {
+		tuple Tuple
+		keys  Tuple
+	}
+	var rows []sortRow
+	for {
+		t, err := op.input.Next()
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			break
+		}
+		keys := make(Tuple, len(op.keys))
+		for i, key := range op.keys {
+			if keys[i], err = key(t); err != nil {
+				return err
+			}
+		}
+		rows = append(rows, sortRow{tuple: t, keys: keys})
+	}
+
+	sort.SliceStable(rows, func(a, b int) bool {
+		return compareSortKeys(rows[a].keys, rows[b].keys, op.desc) < 0
+	})
+
+	op.rows, op.pos = make([]Tuple, len(rows)), 0
+	for i, row := range rows {
+		op.rows[i] = row.tuple
+	}
+	return nil
+}
+
+func (op *sortOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	op.pos++
+	return op.rows[op.pos-1], nil
+}
+
+func (op *sortOp) Close() error          { op.rows = nil; return op.input.Close() }
+func (op *sortOp) Columns() []PlanColumn { return op.input.Columns() }
+
+// limitOp skips the first offset tuples and stops after count tuples.
+// distinctOp passes on the first of each set of equal rows.
+type distinctOp struct {
+	input Operator
+	seen  map[string]bool
+}
+
+func (op *distinctOp) Open() error {
+	op.seen = make(map[string]bool)
+	return op.input.Open()
+}
+
+func (op *distinctOp) Next() (Tuple, error) {
+	for {
+		t, err := op.input.Next()
+		if t == nil || err != nil {
+			return nil, err
+		}
+		if key := rowKey(t); !op.seen[key] {
+			op.seen[key] = true
+			return t, nil
+		}
+	}
+}
+
+func (op *distinctOp) Close() error          { return op.input.Close() }
+func (op *distinctOp) Columns() []PlanColumn { return op.input.Columns() }
+
+type limitOp struct {
+	input    Operator
+	count    int64 // -1 for no limit
+	offset   int64
+	returned int64
+	skipped  int64
+}
+
+func (op *limitOp) Open() error {
+	op.returned, op.skipped = 0, 0
+	return op.input.Open()
+}
+
+func (op *limitOp) Next() (Tuple, error) {
+	for op.skipped < op.offset {
+		t, err := op.input.Next()
+		if t == nil || err != nil {
+			return nil, err
+		}
+		op.skipped++
+	}
+	if op.count >= 0 && op.returned >= op.count {
+		return nil, nil
+	}
+	t, err := op.input.Next()
+	if t != nil {
+		op.returned++
+	}
+	return t, err
+}
+
+func (op *limitOp) Close() error          { return op.input.Close() }
+func (op *limitOp) Columns() []PlanColumn { return op.input.Columns() }
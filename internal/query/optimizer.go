@@ -0,0 +1,373 @@
+package query
+
+import "strings"
+
+// optimize applies the rewrite rules to a logical plan. The rules run in
+// order: constant folding, predicate pushdown, removal of filters that are
+// always true or false, join ordering and projection pruning.
+func optimize(plan LogicalPlan) LogicalPlan {
+	plan = foldConstants(plan)
+	plan = pushDownFilters(plan)
+	plan = simplifyFilters(plan)
+	plan = reorderJoins(plan)
+	pruneColumns(plan, nil)
+	return plan
+}
+
+// mapChildren replaces the inputs of a node with fn applied to them.
+func mapChildren(plan LogicalPlan, fn func(LogicalPlan) LogicalPlan) LogicalPlan {
+	switch node := plan.(type) {
+	case *DerivedNode:
+		node.Input = fn(node.Input)
+	case *RecursiveNode:
+		node.Anchor, node.Recursive = fn(node.Anchor), fn(node.Recursive)
+	case *SetOpNode:
+		node.Left, node.Right = fn(node.Left), fn(node.Right)
+	case *WindowNode:
+		node.Input = fn(node.Input)
+	case *FilterNode:
+		node.Input = fn(node.Input)
+	case *ProjectNode:
+		node.Input = fn(node.Input)
+	case *JoinNode:
+		node.Left, node.Right = fn(node.Left), fn(node.Right)
+	case *AggregateNode:
+		node.Input = fn(node.Input)
+	case *SortNode:
+		node.Input = fn(node.Input)
+	case *DistinctNode:
+		node.Input = fn(node.Input)
+	case *LimitNode:
+		node.Input = fn(node.Input)
+	}
+	return plan
+}
+
+// foldConstants evaluates the parts of expressions that do not depend on
+// any row, such as 1 + 1 or 'a' = 'a', once at planning time.
+func foldConstants(plan LogicalPlan) LogicalPlan {
+	mapChildren(plan, foldConstants)
+	switch node := plan.(type) {
+	case *FilterNode:
+		node.Condition = foldExpr(node.Condition, node.Input.Columns())
+	case *JoinNode:
+		if node.Condition != nil {
+			node.Condition = foldExpr(node.Condition, node.Columns())
+		}
+	case *ProjectNode:
+		for i, expr := range node.Exprs {
+			node.Exprs[i] = foldExpr(expr, node.Input.Columns())
+		}
+	case *SortNode:
+		for i, key := range node.Keys {
+			node.Keys[i].Expr = foldExpr(key.Expr, node.Input.Columns())
+		}
+	}
+	return plan
+}
+
+// foldExpr folds the constant subexpressions of an expression. Inputs
+// computed below, such as aggregate results, are left alone, and so are
+// expressions whose evaluation fails, so the error surfaces at run time.
+func foldExpr(expr Expr, columns []PlanColumn) Expr {
+	key := expr.String()
+	for _, col := range columns {
+		if col.Expr != "" && col.Expr == key {
+			return expr
+		}
+	}
+
+	switch e := expr.(type) {
+	case *UnaryExpr:
+		folded := *e
+		folded.Operand = foldExpr(e.Operand, columns)
+		expr = &folded
+	case *CastExpr:
+		expr = &CastExpr{Expr: foldExpr(e.Expr, columns), Type: e.Type}
+	case *BinaryExpr:
+		folded := *e
+		folded.Left, folded.Right = foldExpr(e.Left, columns), foldExpr(e.Right, columns)
+		if simplified := simplifyLogic(&folded); simplified != nil {
+			return simplified
+		}
+		expr = &folded
+	case *FuncCall:
+		if e.isAggregate() {
+			return expr
+		}
+		folded := *e
+		folded.Args = make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			folded.Args[i] = foldExpr(arg, columns)
+		}
+		expr = &folded
+	default:
+		return expr
+	}
+
+	if !isConstant(expr) {
+		return expr
+	}
+	eval, err := compileExpr(expr, nil)
+	if err != nil {
+		return expr
+	}
+	value, err := eval(nil)
+	if err != nil {
+		return expr
+	}
+	return &Literal{Value: value}
+}
+
+// isConstant reports whether an expression reads no columns, aggregates or
+// registered functions.
+func isConstant(expr Expr) bool {
+	constant := true
+	walkExpr(expr, func(e Expr) {
+		switch n := e.(type) {
+		case *ColumnRef, *OuterRef, *SubqueryExpr, *ExistsExpr, *WindowExpr:
+			constant = false
+		case *InExpr:
+			if n.Select != nil {
+				constant = false
+			}
+		case *FuncCall:
+			// Registered functions may not be deterministic, so they
+			// are not evaluated while planning.
+			if n.user != nil || isAggregate(n.Name) {
+				constant = false
+			}
+		}
+	})
+	return constant
+}
+
+// simplifyLogic removes constant operands of AND and OR: x AND TRUE is x,
+// x AND FALSE is FALSE, x OR TRUE is TRUE and x OR FALSE is x. It returns
+// nil if nothing can be simplified.
+func simplifyLogic(e *BinaryExpr) Expr {
+	if e.Op != "AND" && e.Op != "OR" {
+		return nil
+	}
+	for _, pair := range [][2]Expr{{e.Left, e.Right}, {e.Right, e.Left}} {
+		lit, ok := pair[0].(*Literal)
+		if !ok {
+			continue
+		}
+		b, ok := lit.Value.(bool)
+		if !ok {
+			continue
+		}
+		if b == (e.Op == "OR") {
+			return &Literal{Value: b}
+		}
+		return pair[1]
+	}
+	return nil
+}
+
+// pushDownFilters moves filter conditions as close to the scans as
+// possible, so fewer rows reach joins and index scans can be used.
+func pushDownFilters(plan LogicalPlan) LogicalPlan {
+	if filter, ok := plan.(*FilterNode); ok {
+		return pushInto(filter.Input, conjuncts(filter.Condition))
+	}
+	if join, ok := plan.(*JoinNode); ok {
+		return pushInto(join, nil)
+	}
+	return mapChildren(plan, pushDownFilters)
+}
+
+// pushInto places the given conditions on plan or below it.
+func pushInto(plan LogicalPlan, conditions []Expr) LogicalPlan {
+	switch node := plan.(type) {
+	case *FilterNode:
+		return pushInto(node.Input, append(conditions, conjuncts(node.Condition)...))
+
+	case *JoinNode:
+		outer := node.Type == "LEFT"
+		var left, right, join, above []Expr
+
+		// Conditions from above a LEFT join may only filter its left side:
+		// the right side's columns are NULL for unmatched rows.
+		for _, condition := range conditions {
+			switch {
+			case compiles(condition, node.Left.Columns()):
+				left = append(left, condition)
+			case outer:
+				above = append(above, condition)
+			case compiles(condition, node.Right.Columns()):
+				right = append(right, condition)
+			default:
+				join = append(join, condition)
+			}
+		}
+
+		// Join conditions on one side filter that side, except that a
+		// LEFT join keeps every left row whatever its own condition says.
+		for _, condition := range conjuncts(node.Condition) {
+			switch {
+			case !outer && compiles(condition, node.Left.Columns()):
+				left = append(left, condition)
+			case compiles(condition, node.Right.Columns()):
+				right = append(right, condition)
+			default:
+				join = append(join, condition)
+			}
+		}
+
+		node.Left = pushInto(node.Left, left)
+		node.Right = pushInto(node.Right, right)
+		node.Condition = nil
+		if len(join) > 0 {
+			node.Condition = conjoin(join)
+		}
+		if !outer {
+			node.Type = "CROSS"
+			if node.Condition != nil {
+				node.Type = "INNER"
+			}
+		}
+		return withFilter(node, above)
+	}
+
+	return withFilter(mapChildren(plan, pushDownFilters), conditions)
+}
+
+func withFilter(plan LogicalPlan, conditions []Expr) LogicalPlan {
+	if len(conditions) == 0 {
+		return plan
+	}
+	return &FilterNode{Input: plan, Condition: conjoin(conditions)}
+}
+
+func compiles(expr Expr, columns []PlanColumn) bool {
+	_, err := compileExpr(expr, columns)
+	return err == nil
+}
+
+// simplifyFilters drops filters that are always true and replaces those
+// that are always false, or NULL, with an empty input.
+func simplifyFilters(plan LogicalPlan) LogicalPlan {
+	mapChildren(plan, simplifyFilters)
+	switch node := plan.(type) {
+	case *FilterNode:
+		if lit, ok := node.Condition.(*Literal); ok {
+			if pass, err := isTrue(lit.Value); err == nil {
+				if pass {
+					return node.Input
+				}
+				return &EmptyNode{columns: node.Columns()}
+			}
+		}
+	case *JoinNode:
+		if lit, ok := node.Condition.(*Literal); ok && lit.Value == true {
+			node.Condition = nil
+			if node.Type == "INNER" {
+				node.Type = "CROSS"
+			}
+		}
+	}
+	return plan
+}
+
+// reorderJoins lets the cost model order each chain of inner and cross
+// joins. LEFT joins keep their place.
+func reorderJoins(plan LogicalPlan) LogicalPlan {
+	join, ok := plan.(*JoinNode)
+	if !ok || join.Type == "LEFT" {
+		return mapChildren(plan, reorderJoins)
+	}
+
+	var inputs []LogicalPlan
+	var conditions []Expr
+	var flatten func(LogicalPlan)
+	flatten = func(p LogicalPlan) {
+		if j, ok := p.(*JoinNode); ok && j.Type != "LEFT" {
+			flatten(j.Left)
+			flatten(j.Right)
+			conditions = append(conditions, conjuncts(j.Condition)...)
+			return
+		}
+		inputs = append(inputs, reorderJoins(p))
+	}
+	flatten(join)
+	return orderJoins(inputs, conditions)
+}
+
+// pruneColumns narrows the scans to the columns the query uses, so the
+// values of other columns are never copied out of the rows. required holds
+// the column references made above plan.
+func pruneColumns(plan LogicalPlan, required []*ColumnRef) {
+	switch node := plan.(type) {
+	case *ScanNode:
+		node.columns = usedColumns(node.columns, required)
+	case *EmptyNode:
+		node.columns = usedColumns(node.columns, required)
+	case *DerivedNode:
+		// The subquery computes its own select list in full.
+		pruneColumns(node.Input, nil)
+	case *RecursiveNode:
+		pruneColumns(node.Anchor, nil)
+		pruneColumns(node.Recursive, nil)
+	case *SetOpNode:
+		// Duplicates are found on whole rows, so every column counts.
+		pruneColumns(node.Left, nil)
+		pruneColumns(node.Right, nil)
+	case *FilterNode:
+		pruneColumns(node.Input, append(required, exprColumnRefs(node.Condition)...))
+	case *ProjectNode:
+		var refs []*ColumnRef
+		for _, expr := range node.Exprs {
+			refs = append(refs, exprColumnRefs(expr)...)
+		}
+		pruneColumns(node.Input, refs)
+	case *JoinNode:
+		required = append(required, exprColumnRefs(node.Condition)...)
+		pruneColumns(node.Left, required)
+		pruneColumns(node.Right, required)
+	case *AggregateNode:
+		var refs []*ColumnRef
+		for _, expr := range node.GroupBy {
+			refs = append(refs, exprColumnRefs(expr)...)
+		}
+		for _, call := range node.Aggregates {
+			refs = append(refs, exprColumnRefs(call)...)
+		}
+		pruneColumns(node.Input, refs)
+	case *WindowNode:
+		for _, w := range node.Windows {
+			required = append(required, exprColumnRefs(w)...)
+		}
+		pruneColumns(node.Input, required)
+	case *SortNode:
+		for _, key := range node.Keys {
+			required = append(required, exprColumnRefs(key.Expr)...)
+		}
+		pruneColumns(node.Input, required)
+	case *DistinctNode:
+		pruneColumns(node.Input, nil)
+	case *LimitNode:
+		pruneColumns(node.Input, required)
+	}
+}
+
+// usedColumns keeps the columns that one of the references may refer to.
+// Computed columns, such as the aggregates of an empty input that replaced
+// a HAVING, are looked up by their expression, so they are always kept.
+func usedColumns(columns []PlanColumn, refs []*ColumnRef) []PlanColumn {
+	var used []PlanColumn
+	for _, col := range columns {
+		if col.Expr != "" {
+			used = append(used, col)
+			continue
+		}
+		for _, ref := range refs {
+			if strings.EqualFold(col.Name, ref.Name) && (ref.Table == "" || strings.EqualFold(col.Table, ref.Table)) {
+				used = append(used, col)
+				break
+			}
+		}
+	}
+	return used
+}
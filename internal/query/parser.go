@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-
-	"github.com/H3199/doggodb/internal/data"
 )
 
 //
@@ -28,10 +26,87 @@ const (
 	STRING      TokenType = "STRING"
 	IDENTIFIER  TokenType = "IDENTIFIER"
 	NUMBER      TokenType = "NUMBER"
+	PARAM       TokenType = "PARAM" // Placeholder, ? or $n; the literal is always $n
 	UPDATE      TokenType = "UPDATE"
 	EQUALS      TokenType = "EQUALS"
 	WHERE       TokenType = "WHERE"
 	SET         TokenType = "SET"
+	DELETE      TokenType = "DELETE"
+	CREATE      TokenType = "CREATE"
+	TABLE       TokenType = "TABLE"
+	RETURNING   TokenType = "RETURNING"
+	NULL        TokenType = "NULL"
+	PRIMARY     TokenType = "PRIMARY"
+	KEY         TokenType = "KEY"
+	UNIQUE      TokenType = "UNIQUE"
+	NOT         TokenType = "NOT"
+	INDEX       TokenType = "INDEX"
+	ON          TokenType = "ON"
+	CONFLICT    TokenType = "CONFLICT"
+	DO          TokenType = "DO"
+	NOTHING     TokenType = "NOTHING"
+	AND         TokenType = "AND"
+	OR          TokenType = "OR"
+	TRUE        TokenType = "TRUE"
+	FALSE       TokenType = "FALSE"
+	AS          TokenType = "AS"
+	JOIN        TokenType = "JOIN"
+	INNER       TokenType = "INNER"
+	LEFT        TokenType = "LEFT"
+	OUTER       TokenType = "OUTER"
+	CROSS       TokenType = "CROSS"
+	GROUP       TokenType = "GROUP"
+	BY          TokenType = "BY"
+	HAVING      TokenType = "HAVING"
+	ORDER       TokenType = "ORDER"
+	ASC         TokenType = "ASC"
+	DESC        TokenType = "DESC"
+	LIMIT       TokenType = "LIMIT"
+	OFFSET      TokenType = "OFFSET"
+	EXPLAIN     TokenType = "EXPLAIN"
+	ANALYZE     TokenType = "ANALYZE"
+	IN          TokenType = "IN"
+	EXISTS      TokenType = "EXISTS"
+	WITH        TokenType = "WITH"
+	RECURSIVE   TokenType = "RECURSIVE"
+	UNION       TokenType = "UNION"
+	INTERSECT   TokenType = "INTERSECT"
+	EXCEPT      TokenType = "EXCEPT"
+	OVER        TokenType = "OVER"
+	PARTITION   TokenType = "PARTITION"
+	ROWS        TokenType = "ROWS"
+	BETWEEN     TokenType = "BETWEEN"
+	UNBOUNDED   TokenType = "UNBOUNDED"
+	PRECEDING   TokenType = "PRECEDING"
+	FOLLOWING   TokenType = "FOLLOWING"
+	CURRENT     TokenType = "CURRENT"
+	ROW         TokenType = "ROW"
+	CAST        TokenType = "CAST"
+	IS          TokenType = "IS"
+	LIKE        TokenType = "LIKE"
+	ILIKE       TokenType = "ILIKE"
+	ESCAPE      TokenType = "ESCAPE"
+	CASE        TokenType = "CASE"
+	WHEN        TokenType = "WHEN"
+	THEN        TokenType = "THEN"
+	ELSE        TokenType = "ELSE"
+	END         TokenType = "END"
+	DISTINCT    TokenType = "DISTINCT"
+	ALL         TokenType = "ALL"
+	COPY        TokenType = "COPY"
+	BACKUP      TokenType = "BACKUP"
+
+	PLUS           TokenType = "PLUS"
+	MINUS          TokenType = "MINUS"
+	SLASH          TokenType = "SLASH"
+	PERCENT        TokenType = "PERCENT"
+	CONCAT         TokenType = "CONCAT"
+	DOUBLE_COLON   TokenType = "DOUBLE_COLON"
+	LESS           TokenType = "LESS"
+	GREATER        TokenType = "GREATER"
+	LESS_EQUALS    TokenType = "LESS_EQUALS"
+	GREATER_EQUALS TokenType = "GREATER_EQUALS"
+	NOT_EQUALS     TokenType = "NOT_EQUALS"
 )
 
 type Token struct {
@@ -46,82 +121,420 @@ func Parse(tokens []Token) (Statement, error) {
 	}
 
 	switch tokens[0].Type {
-	case SELECT:
+	case SELECT, WITH:
 		return parseSelect(tokens)
 	case INSERT:
 		return parseInsert(tokens)
 	case UPDATE:
 		return parseUpdate(tokens)
+	case DELETE:
+		return parseDelete(tokens)
+	case CREATE:
+		if len(tokens) > 1 && (tokens[1].Type == INDEX || tokens[1].Type == UNIQUE) {
+			return parseCreateIndex(tokens)
+		}
+		return parseCreateTable(tokens)
+	case EXPLAIN:
+		return parseExplain(tokens)
+	case ANALYZE:
+		return parseAnalyze(tokens)
+	case SET:
+		return parseSet(tokens)
+	case COPY:
+		return parseCopy(tokens)
+	case BACKUP:
+		return parseBackup(tokens)
 	default:
 		return nil, errors.New("unsupported query type")
 	}
 }
 
 func parseSelect(tokens []Token) (*SelectStatement, error) {
-	if len(tokens) < 4 {
+	if len(tokens) < 2 {
 		return nil, errors.New("invalid query: insufficient tokens")
 	}
 
+	stmt, i, err := parseSelectAt(tokens, 0)
+	if err != nil {
+		return nil, err
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in SELECT", tokens[i].Literal)
+	}
+	return stmt, nil
+}
+
+// setOperators are the tokens that combine SELECTs into a compound one.
+var setOperators = map[TokenType]bool{UNION: true, INTERSECT: true, EXCEPT: true}
+
+// parseSelectAt parses a SELECT, possibly a compound one, starting at
+// tokens[i] and returns the index of the first token after it.
+func parseSelectAt(tokens []Token, i int) (*SelectStatement, int, error) {
+	if i < len(tokens) && tokens[i].Type == WITH {
+		return parseWith(tokens, i)
+	}
+
+	stmt, i, err := parseSelectCore(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+
+	// Further SELECTs combined with UNION, INTERSECT or EXCEPT. A
+	// parenthesized one may have its own ORDER BY and LIMIT.
+	for i < len(tokens) && setOperators[tokens[i].Type] {
+		op := SetOperation{Op: string(tokens[i].Type)}
+		i++
+		if i < len(tokens) && tokens[i].Type == ALL {
+			op.All = true
+			i++
+		}
+		var next int
+		if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+			op.Select, next, err = parseSubquery(tokens, i)
+		} else {
+			op.Select, next, err = parseSelectCore(tokens, i)
+		}
+		if err != nil {
+			return nil, next, err
+		}
+		stmt.Compound, i = append(stmt.Compound, op), next
+	}
+
+	return parseSelectTail(tokens, i, stmt)
+}
+
+// parseSelectCore parses a single SELECT up to its HAVING clause.
+// parseSelectItem parses one item of a select list: *, table.* or an
+// expression, which is also returned parsed.
+func parseSelectItem(tokens []Token, i int) (string, Expr, int, error) {
+	if i < len(tokens) && tokens[i].Type == ASTERISK {
+		return "*", nil, i + 1, nil
+	}
+	if i+1 < len(tokens) && tokens[i].Type == IDENTIFIER && strings.HasSuffix(tokens[i].Literal, ".") && tokens[i+1].Type == ASTERISK {
+		return tokens[i].Literal + "*", nil, i + 2, nil
+	}
+	return parseExprText(tokens, i)
+}
+
+func parseSelectCore(tokens []Token, i int) (*SelectStatement, int, error) {
 	// Ensure the query starts with SELECT
-	if tokens[0].Type != SELECT {
-		return nil, errors.New("invalid SELECT query format: missing SELECT")
+	if i >= len(tokens) || tokens[i].Type != SELECT {
+		return nil, i, errors.New("invalid SELECT query format: missing SELECT")
 	}
+	i++
 
-	var columns []string
-	i := 1
+	stmt := &SelectStatement{}
 
-	// Parse columns
-	if tokens[i].Type == ASTERISK {
-		columns = append(columns, "*")
+	if i < len(tokens) && (tokens[i].Type == DISTINCT || tokens[i].Type == ALL) {
+		stmt.Distinct = tokens[i].Type == DISTINCT
 		i++
-	} else {
-		for i < len(tokens) && tokens[i].Type != FROM {
-			if tokens[i].Type == IDENTIFIER {
-				columns = append(columns, tokens[i].Literal)
-			} else if tokens[i].Type != COMMA {
-				return nil, errors.New("unexpected token in column list")
+	}
+
+	// Parse columns
+	for {
+		column, item, next, err := parseSelectItem(tokens, i)
+		if err != nil {
+			return nil, i, fmt.Errorf("invalid column list: %v", err)
+		}
+		stmt.Columns, stmt.items = append(stmt.Columns, column), append(stmt.items, item)
+		i = next
+
+		// An output name, with or without AS.
+		alias := ""
+		if i+1 < len(tokens) && tokens[i].Type == AS && tokens[i+1].Type == IDENTIFIER {
+			alias, i = tokens[i+1].Literal, i+2
+		} else if i < len(tokens) && tokens[i].Type == IDENTIFIER && !strings.HasSuffix(column, "*") {
+			alias, i = tokens[i].Literal, i+1
+		} else if i < len(tokens) && tokens[i].Type == AS {
+			return nil, i, errors.New("invalid column list: expected a name after AS")
+		}
+		if alias != "" {
+			for len(stmt.Aliases) < len(stmt.Columns)-1 {
+				stmt.Aliases = append(stmt.Aliases, "")
 			}
+			stmt.Aliases = append(stmt.Aliases, alias)
+		}
+
+		if i < len(tokens) && tokens[i].Type == COMMA {
 			i++
+			continue
 		}
-		if len(columns) == 0 {
-			return nil, errors.New("no columns specified in SELECT")
+		break
+	}
+	if stmt.Aliases != nil {
+		for len(stmt.Aliases) < len(stmt.Columns) {
+			stmt.Aliases = append(stmt.Aliases, "")
 		}
 	}
 
-	// Ensure FROM keyword
-	if i >= len(tokens) || tokens[i].Type != FROM {
-		return nil, errors.New("expected FROM after column list")
-	}
-	i++ // Skip 'FROM'
+	// FROM is optional: SELECT 1 + 1 evaluates a single row.
+	if i < len(tokens) && tokens[i].Type == FROM {
+		i++ // Skip 'FROM'
 
-	// Parse table name
-	if i >= len(tokens) || tokens[i].Type != IDENTIFIER {
-		return nil, errors.New("expected table name after FROM")
+		// Parse table name or derived table
+		source, next, err := parseTableSource(tokens, i)
+		if err != nil {
+			return nil, i, err
+		}
+		stmt.Table, stmt.Subquery, stmt.Alias, i = source.Table, source.Subquery, source.Alias, next
+
+		joins, next, err := parseJoins(tokens, i)
+		if err != nil {
+			return nil, i, err
+		}
+		stmt.Joins, i = joins, next
 	}
-	table := tokens[i].Literal
-	i++ // Skip table name
 
 	// Parse optional WHERE clause
-	var conditions string
 	if i < len(tokens) && tokens[i].Type == WHERE {
-		i++ // Skip 'WHERE'
-		var whereParts []string
-		for i < len(tokens) {
-			whereParts = append(whereParts, tokens[i].Literal)
+		conditions, where, next, err := parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, i, fmt.Errorf("invalid WHERE clause: %v", err)
+		}
+		stmt.Conditions, stmt.where, i = conditions, where, next
+	}
+
+	if i+1 < len(tokens) && tokens[i].Type == GROUP && tokens[i+1].Type == BY {
+		i += 2
+		for {
+			key, expr, next, err := parseExprText(tokens, i)
+			if err != nil {
+				return nil, i, fmt.Errorf("invalid GROUP BY clause: %v", err)
+			}
+			stmt.GroupBy, stmt.groupBy = append(stmt.GroupBy, key), append(stmt.groupBy, expr)
+			i = next
+			if i < len(tokens) && tokens[i].Type == COMMA {
+				i++
+				continue
+			}
+			break
+		}
+	}
+
+	if i < len(tokens) && tokens[i].Type == HAVING {
+		having, expr, next, err := parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, i, fmt.Errorf("invalid HAVING clause: %v", err)
+		}
+		stmt.Having, stmt.having, i = having, expr, next
+	}
+
+	return stmt, i, nil
+}
+
+// parseSelectTail parses the ORDER BY, LIMIT and OFFSET clauses of a
+// SELECT, which apply to the whole of a compound one.
+func parseSelectTail(tokens []Token, i int, stmt *SelectStatement) (*SelectStatement, int, error) {
+	if i+1 < len(tokens) && tokens[i].Type == ORDER && tokens[i+1].Type == BY {
+		i += 2
+		for {
+			key, expr, next, err := parseExprText(tokens, i)
+			if err != nil {
+				return nil, i, fmt.Errorf("invalid ORDER BY clause: %v", err)
+			}
+			item := OrderItem{Expr: key, parsed: expr}
+			i = next
+			if i < len(tokens) && (tokens[i].Type == ASC || tokens[i].Type == DESC) {
+				item.Desc = tokens[i].Type == DESC
+				i++
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if i < len(tokens) && tokens[i].Type == COMMA {
+				i++
+				continue
+			}
+			break
+		}
+	}
+
+	if i < len(tokens) && tokens[i].Type == LIMIT {
+		limit, expr, next, err := parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, i, fmt.Errorf("invalid LIMIT clause: %v", err)
+		}
+		stmt.Limit, stmt.limit, i = limit, expr, next
+	}
+
+	if i < len(tokens) && tokens[i].Type == OFFSET {
+		offset, expr, next, err := parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, i, fmt.Errorf("invalid OFFSET clause: %v", err)
+		}
+		stmt.Offset, stmt.offset, i = offset, expr, next
+	}
+
+	return stmt, i, nil
+}
+
+// parseTableName parses a table name at tokens[i] with an optional alias,
+// written either as "name AS alias" or "name alias".
+func parseTableName(tokens []Token, i int) (string, string, int) {
+	table := tokens[i].Literal
+	i++
+	if i+1 < len(tokens) && tokens[i].Type == AS && tokens[i+1].Type == IDENTIFIER {
+		return table, tokens[i+1].Literal, i + 2
+	}
+	if i < len(tokens) && tokens[i].Type == IDENTIFIER {
+		return table, tokens[i].Literal, i + 1
+	}
+	return table, "", i
+}
+
+// parseWith parses a WITH [RECURSIVE] clause and the SELECT it belongs to.
+func parseWith(tokens []Token, i int) (*SelectStatement, int, error) {
+	i++ // Skip 'WITH'
+	recursive := false
+	if i < len(tokens) && tokens[i].Type == RECURSIVE {
+		recursive = true
+		i++
+	}
+
+	var ctes []CommonTableExpr
+	for {
+		if i >= len(tokens) || tokens[i].Type != IDENTIFIER {
+			return nil, i, errors.New("expected name of common table expression")
+		}
+		cte := CommonTableExpr{Name: tokens[i].Literal}
+		i++
+
+		if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+			columns, next, err := parseIdentifierList(tokens, i)
+			if err != nil {
+				return nil, i, err
+			}
+			cte.Columns, i = columns, next
+		}
+		if i >= len(tokens) || tokens[i].Type != AS {
+			return nil, i, fmt.Errorf("expected AS after %s", cte.Name)
+		}
+		if i+1 >= len(tokens) || tokens[i+1].Type != LEFT_PAREN {
+			return nil, i, fmt.Errorf("expected '(' after %s AS", cte.Name)
+		}
+
+		sel, next, err := parseSelectAt(tokens, i+2)
+		if err != nil {
+			return nil, next, err
+		}
+		cte.Select, i = sel, next
+
+		// In a recursive query, the SELECT after the last UNION is the
+		// recursive term.
+		if last := len(sel.Compound) - 1; recursive && last >= 0 && sel.Compound[last].Op == "UNION" &&
+			len(sel.OrderBy) == 0 && sel.Limit == "" && sel.Offset == "" {
+			cte.Recursive, cte.UnionAll = sel.Compound[last].Select, sel.Compound[last].All
+			sel.Compound = sel.Compound[:last]
+			if last == 0 {
+				sel.Compound = nil
+			}
+		}
+		if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+			return nil, i, fmt.Errorf("expected ')' after query of %s", cte.Name)
+		}
+		i++
+		ctes = append(ctes, cte)
+
+		if i < len(tokens) && tokens[i].Type == COMMA {
 			i++
+			continue
 		}
-		conditions = strings.Join(whereParts, " ")
+		break
 	}
 
-	return &SelectStatement{
-		Table:      table,
-		Columns:    columns,
-		Conditions: conditions,
-	}, nil
+	stmt, i, err := parseSelectAt(tokens, i)
+	if err != nil {
+		return nil, i, err
+	}
+	if len(stmt.With) > 0 {
+		return nil, i, errors.New("unexpected second WITH clause")
+	}
+	stmt.With, stmt.Recursive = ctes, recursive
+	return stmt, i, nil
+}
+
+// parseTableSource parses a FROM item: a table name or a parenthesized
+// SELECT, each with an optional alias. Derived tables need an alias.
+func parseTableSource(tokens []Token, i int) (JoinClause, int, error) {
+	var source JoinClause
+	if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+		sub, next, err := parseSubquery(tokens, i)
+		if err != nil {
+			return source, i, err
+		}
+		source.Subquery, i = sub, next
+		if i < len(tokens) && tokens[i].Type == AS {
+			i++
+		}
+		if i >= len(tokens) || tokens[i].Type != IDENTIFIER {
+			return source, i, errors.New("subquery in FROM must have an alias")
+		}
+		source.Alias = tokens[i].Literal
+		return source, i + 1, nil
+	}
+
+	if i >= len(tokens) || tokens[i].Type != IDENTIFIER {
+		return source, i, errors.New("expected table name")
+	}
+	source.Table, source.Alias, i = parseTableName(tokens, i)
+	return source, i, nil
+}
+
+// parseJoins parses any number of JOIN clauses (or comma-separated tables)
+// following the first table of a FROM clause.
+func parseJoins(tokens []Token, i int) ([]JoinClause, int, error) {
+	var joins []JoinClause
+	for i < len(tokens) {
+		join := JoinClause{}
+		switch tokens[i].Type {
+		case COMMA:
+			join.Type = "CROSS"
+			i++
+		case JOIN:
+			join.Type = "INNER"
+			i++
+		case INNER, CROSS:
+			join.Type = strings.ToUpper(tokens[i].Literal)
+			i++
+			if i >= len(tokens) || tokens[i].Type != JOIN {
+				return nil, i, fmt.Errorf("expected JOIN after %s", join.Type)
+			}
+			i++
+		case LEFT:
+			join.Type = "LEFT"
+			i++
+			if i < len(tokens) && tokens[i].Type == OUTER {
+				i++
+			}
+			if i >= len(tokens) || tokens[i].Type != JOIN {
+				return nil, i, errors.New("expected JOIN after LEFT")
+			}
+			i++
+		default:
+			return joins, i, nil
+		}
+
+		source, next, err := parseTableSource(tokens, i)
+		if err != nil {
+			return nil, i, err
+		}
+		join.Table, join.Subquery, join.Alias, i = source.Table, source.Subquery, source.Alias, next
+
+		if join.Type != "CROSS" {
+			if i >= len(tokens) || tokens[i].Type != ON {
+				return nil, i, fmt.Errorf("expected ON after joined table %s", join.Table)
+			}
+			conditions, on, next, err := parseExprText(tokens, i+1)
+			if err != nil {
+				return nil, i, fmt.Errorf("invalid join condition: %v", err)
+			}
+			join.Conditions, join.on, i = conditions, on, next
+		}
+		joins = append(joins, join)
+	}
+	return joins, i, nil
 }
 
 func parseInsert(tokens []Token) (*InsertStatement, error) {
-	if len(tokens) < 6 {
+	if len(tokens) < 4 {
 		return nil, errors.New("invalid query: insufficient tokens for INSERT")
 	}
 
@@ -129,17 +542,16 @@ func parseInsert(tokens []Token) (*InsertStatement, error) {
 		return nil, errors.New("invalid INSERT query format")
 	}
 
-	table := tokens[2].Literal
-	var columns []string
-	var values []string
+	stmt := &InsertStatement{Table: tokens[2].Literal}
 
-	// Extract columns
+	// Extract columns. The column list is optional, in which case the
+	// values follow the table's schema order.
 	i := 3
 	if tokens[i].Type == LEFT_PAREN {
 		i++
 		for i < len(tokens) && tokens[i].Type != RIGHT_PAREN {
 			if tokens[i].Type == IDENTIFIER {
-				columns = append(columns, tokens[i].Literal)
+				stmt.Columns = append(stmt.Columns, tokens[i].Literal)
 			} else if tokens[i].Type != COMMA {
 				return nil, errors.New("unexpected token in column list")
 			}
@@ -149,42 +561,205 @@ func parseInsert(tokens []Token) (*InsertStatement, error) {
 			return nil, errors.New("expected ')' after column names")
 		}
 		i++ // Move past ')'
+		if len(stmt.Columns) == 0 {
+			return nil, errors.New("no columns or values found")
+		}
 	}
 
-	// Now expect VALUES
-	if i >= len(tokens) || tokens[i].Type != VALUES {
+	switch {
+	case i < len(tokens) && tokens[i].Type == SELECT:
+		// INSERT ... SELECT: the query runs until ON CONFLICT, RETURNING
+		// or the end.
+		end := indexOf(tokens, i, CONFLICT, RETURNING)
+		if end < len(tokens) && tokens[end].Type == CONFLICT {
+			end-- // Step back to ON
+		}
+		source, err := parseSelect(tokens[i:end])
+		if err != nil {
+			return nil, err
+		}
+		stmt.Select = source
+		i = end
+
+	case i < len(tokens) && tokens[i].Type == VALUES:
+		i++ // Move past 'VALUES'
+		for {
+			values, exprs, next, err := parseValueTuple(tokens, i)
+			if err != nil {
+				return nil, err
+			}
+			if len(stmt.Columns) > 0 && len(values) != len(stmt.Columns) {
+				return nil, fmt.Errorf("INSERT has %d columns but %d values", len(stmt.Columns), len(values))
+			}
+			if stmt.Values == nil {
+				stmt.Values = values
+			} else {
+				if len(values) != len(stmt.Values) {
+					return nil, errors.New("all VALUES lists must have the same length")
+				}
+				stmt.MoreValues = append(stmt.MoreValues, values)
+			}
+			stmt.values = append(stmt.values, exprs)
+			i = next
+
+			if i < len(tokens) && tokens[i].Type == COMMA {
+				i++ // Another tuple follows
+				continue
+			}
+			break
+		}
+
+	default:
 		return nil, errors.New("expected VALUES after columns")
 	}
-	i++ // Move past 'VALUES'
 
-	// Extract values
+	if i < len(tokens) && tokens[i].Type == ON {
+		onConflict, next, err := parseOnConflict(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+		stmt.OnConflict = onConflict
+		i = next
+	}
+
+	if i < len(tokens) && tokens[i].Type == RETURNING {
+		returning, next, err := parseReturning(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Returning = returning
+		i = next
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in INSERT", tokens[i].Literal)
+	}
+
+	return stmt, nil
+}
+
+// parseOnConflict parses an ON CONFLICT [(columns)] DO NOTHING | DO UPDATE
+// SET ... clause starting at tokens[i].
+func parseOnConflict(tokens []Token, i int) (*OnConflictClause, int, error) {
+	i++ // Skip 'ON'
+	if i >= len(tokens) || tokens[i].Type != CONFLICT {
+		return nil, i, errors.New("expected CONFLICT after ON")
+	}
+	i++
+
+	clause := &OnConflictClause{}
+	if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+		columns, next, err := parseIdentifierList(tokens, i)
+		if err != nil {
+			return nil, i, err
+		}
+		clause.Columns = columns
+		i = next
+	}
+
+	if i >= len(tokens) || tokens[i].Type != DO {
+		return nil, i, errors.New("expected DO in ON CONFLICT clause")
+	}
+	i++
+
+	switch {
+	case i < len(tokens) && tokens[i].Type == NOTHING:
+		clause.DoNothing = true
+		return clause, i + 1, nil
+	case i+1 < len(tokens) && tokens[i].Type == UPDATE && tokens[i+1].Type == SET:
+		if len(clause.Columns) == 0 {
+			return nil, i, errors.New("ON CONFLICT DO UPDATE requires a conflict target")
+		}
+		i += 2
+	default:
+		return nil, i, errors.New("expected NOTHING or UPDATE SET after DO")
+	}
+
+	// Parse assignments. Values are expressions over the existing row and
+	// excluded.<column> for the row proposed for insertion.
+	clause.Assignments, clause.values = make(map[string]string), make(map[string]Expr)
+	for i < len(tokens) && tokens[i].Type != RETURNING {
+		if tokens[i].Type != IDENTIFIER {
+			return nil, i, errors.New("invalid token in SET clause")
+		}
+		column := tokens[i].Literal
+		i++
+		if i >= len(tokens) || tokens[i].Type != EQUALS {
+			return nil, i, errors.New("expected '=' after column name in SET clause")
+		}
+		value, expr, next, err := parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, i, fmt.Errorf("expected value after '=' in SET clause: %v", err)
+		}
+		clause.Assignments[column], clause.values[column] = value, expr
+		i = next
+
+		if i < len(tokens) && tokens[i].Type == COMMA {
+			i++ // Skip comma
+		}
+	}
+	if len(clause.Assignments) == 0 {
+		return nil, i, errors.New("no assignments in ON CONFLICT DO UPDATE")
+	}
+	return clause, i, nil
+}
+
+// parseIdentifierList parses a parenthesized, comma-separated list of
+// names starting at tokens[i] and returns the index just past the ')'.
+func parseIdentifierList(tokens []Token, i int) ([]string, int, error) {
 	if i >= len(tokens) || tokens[i].Type != LEFT_PAREN {
-		return nil, errors.New("expected '(' after VALUES")
+		return nil, i, errors.New("expected '('")
 	}
-	i++ // Skip '(' token
+	i++
 
+	var names []string
 	for i < len(tokens) && tokens[i].Type != RIGHT_PAREN {
-		if tokens[i].Type == STRING || tokens[i].Type == NUMBER {
-			values = append(values, tokens[i].Literal)
+		if tokens[i].Type == IDENTIFIER {
+			names = append(names, tokens[i].Literal)
 		} else if tokens[i].Type != COMMA {
-			return nil, errors.New("unexpected token in values list")
+			return nil, i, fmt.Errorf("unexpected token '%s' in column list", tokens[i].Literal)
 		}
 		i++
 	}
-	if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
-		return nil, errors.New("expected ')' after values")
+	if i >= len(tokens) {
+		return nil, i, errors.New("expected ')' after column list")
 	}
-	i++ // Move past ')'
+	if len(names) == 0 {
+		return nil, i, errors.New("empty column list")
+	}
+	return names, i + 1, nil
+}
 
-	if len(columns) == 0 || len(values) == 0 {
-		return nil, errors.New("no columns or values found")
+// parseValueTuple parses a parenthesized list of expressions starting at
+// tokens[i] and returns their text, their trees and the index just past
+// the ')'.
+func parseValueTuple(tokens []Token, i int) ([]string, []Expr, int, error) {
+	if i >= len(tokens) || tokens[i].Type != LEFT_PAREN {
+		return nil, nil, i, errors.New("expected '(' after VALUES")
+	}
+	i++ // Skip '(' token
+	if i < len(tokens) && tokens[i].Type == RIGHT_PAREN {
+		return nil, nil, i, errors.New("no columns or values found")
 	}
 
-	return &InsertStatement{
-		Table:   table,
-		Columns: columns,
-		Values:  values,
-	}, nil
+	var values []string
+	var exprs []Expr
+	for {
+		value, expr, next, err := parseExprText(tokens, i)
+		if err != nil {
+			return nil, nil, i, fmt.Errorf("invalid value in values list: %v", err)
+		}
+		values, exprs = append(values, value), append(exprs, expr)
+		i = next
+		if i < len(tokens) && tokens[i].Type == COMMA {
+			i++
+			continue
+		}
+		break
+	}
+	if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+		return nil, nil, i, errors.New("expected ')' after values")
+	}
+	return values, exprs, i + 1, nil
 }
 
 func parseUpdate(tokens []Token) (*UpdateStatement, error) {
@@ -205,11 +780,11 @@ func parseUpdate(tokens []Token) (*UpdateStatement, error) {
 		return nil, errors.New("expected SET after table name in UPDATE")
 	}
 
-	assignments := make(map[string]string)
+	assignments, values := make(map[string]string), make(map[string]Expr)
 	i := 3
 
 	// Parse assignments (SET clause)
-	for i < len(tokens) && tokens[i].Type != WHERE {
+	for i < len(tokens) && tokens[i].Type != WHERE && tokens[i].Type != RETURNING {
 		if tokens[i].Type == IDENTIFIER {
 			column := tokens[i].Literal
 			i++
@@ -218,14 +793,14 @@ func parseUpdate(tokens []Token) (*UpdateStatement, error) {
 				return nil, errors.New("expected '=' after column name in SET clause")
 			}
 			i++
-			if i >= len(tokens) || (tokens[i].Type != STRING && tokens[i].Type != NUMBER) {
+			value, expr, next, err := parseExprText(tokens, i)
+			if err != nil {
 				//	fmt.Printf("DEBUG: tokens[%d]: %+v\n", i, tokens[i])
 				//	fmt.Println("DEBUG:expected '=' after column name in SET clause II")
-				return nil, errors.New("expected value after '=' in SET clause")
+				return nil, fmt.Errorf("expected value after '=' in SET clause: %v", err)
 			}
-			value := tokens[i].Literal
-			assignments[column] = value
-			i++
+			assignments[column], values[column] = value, expr
+			i = next
 
 			if i < len(tokens) && tokens[i].Type == COMMA {
 				i++ // Skip comma
@@ -238,14 +813,25 @@ func parseUpdate(tokens []Token) (*UpdateStatement, error) {
 
 	// Parse WHERE clause (optional)
 	var conditions string
+	var where Expr
 	if i < len(tokens) && tokens[i].Type == WHERE {
-		i++
-		var whereParts []string
-		for i < len(tokens) {
-			whereParts = append(whereParts, tokens[i].Literal)
-			i++
+		var err error
+		conditions, where, i, err = parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WHERE clause: %v", err)
 		}
-		conditions = strings.Join(whereParts, " ")
+	}
+
+	var returning []string
+	if i < len(tokens) && tokens[i].Type == RETURNING {
+		var err error
+		returning, i, err = parseReturning(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in UPDATE", tokens[i].Literal)
 	}
 
 	// Debug output to check the flow
@@ -255,56 +841,443 @@ func parseUpdate(tokens []Token) (*UpdateStatement, error) {
 		Table:       table,
 		Assignments: assignments,
 		Conditions:  conditions,
+		Returning:   returning,
+		values:      values,
+		where:       where,
 	}, nil
 }
 
-func parseCondition(condition string) (func(*data.Row) bool, error) {
-	// Example: "age > 30"
-	// Note: This is a basic implementation. For complex conditions, a full parser is needed.
-	parts := strings.Split(condition, " ")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid condition format")
+func parseDelete(tokens []Token) (*DeleteStatement, error) {
+	if len(tokens) < 3 || tokens[1].Type != FROM || tokens[2].Type != IDENTIFIER {
+		return nil, errors.New("invalid DELETE query format")
+	}
+
+	stmt := &DeleteStatement{Table: tokens[2].Literal}
+	i := 3
+
+	if i < len(tokens) && tokens[i].Type == WHERE {
+		var err error
+		stmt.Conditions, stmt.where, i, err = parseExprText(tokens, i+1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WHERE clause: %v", err)
+		}
+	}
+	if i < len(tokens) && tokens[i].Type == RETURNING {
+		var err error
+		stmt.Returning, i, err = parseReturning(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in DELETE", tokens[i].Literal)
 	}
 
-	column, operator, value := parts[0], parts[1], parts[2]
+	return stmt, nil
+}
 
-	// Convert the value from the condition to a float if needed
-	valNum, _ := toFloat(value)
+func parseCreateTable(tokens []Token) (*CreateTableStatement, error) {
+	if len(tokens) < 4 || tokens[1].Type != TABLE || tokens[2].Type != IDENTIFIER {
+		return nil, errors.New("invalid CREATE TABLE query format")
+	}
 
-	return func(row *data.Row) bool {
-		colValue, exists := row.Columns[column]
-		if !exists {
-			return false
+	stmt := &CreateTableStatement{Table: tokens[2].Literal}
+	i := 3
+	if tokens[i].Type != LEFT_PAREN {
+		return nil, errors.New("expected '(' after table name")
+	}
+	i++
+
+	setPrimaryKey := func(columns []string) error {
+		if stmt.PrimaryKey != nil {
+			return fmt.Errorf("multiple primary keys for table %s are not allowed", stmt.Table)
 		}
+		stmt.PrimaryKey = columns
+		return nil
+	}
 
-		switch operator {
-		case "=":
-			// Handle equality
-			return fmt.Sprintf("%v", colValue) == value
+	for i < len(tokens) && tokens[i].Type != RIGHT_PAREN {
+		switch tokens[i].Type {
+		case PRIMARY:
+			// Table constraint: PRIMARY KEY (a, b)
+			if i+1 >= len(tokens) || tokens[i+1].Type != KEY {
+				return nil, errors.New("expected KEY after PRIMARY")
+			}
+			columns, next, err := parseIdentifierList(tokens, i+2)
+			if err != nil {
+				return nil, err
+			}
+			if err := setPrimaryKey(columns); err != nil {
+				return nil, err
+			}
+			i = next
 
-		case ">", "<":
-			// Ensure colValue is numeric
-			colNum, err := toFloat(fmt.Sprintf("%v", colValue))
+		case UNIQUE:
+			// Table constraint: UNIQUE (a, b)
+			columns, next, err := parseIdentifierList(tokens, i+1)
 			if err != nil {
-				return false
+				return nil, err
+			}
+			stmt.Unique = append(stmt.Unique, columns)
+			i = next
+
+		case IDENTIFIER:
+			column := ColumnDefinition{Name: tokens[i].Literal}
+			i++
+
+			if i >= len(tokens) || tokens[i].Type != IDENTIFIER {
+				return nil, fmt.Errorf("expected type for column '%s'", column.Name)
+			}
+			column.Type = strings.ToUpper(tokens[i].Literal)
+			i++
+
+			// Skip a length specifier such as VARCHAR(255).
+			if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+				for i < len(tokens) && tokens[i].Type != RIGHT_PAREN {
+					i++
+				}
+				i++
 			}
 
-			// Perform the comparison
-			if operator == ">" {
-				return colNum > valNum
-			} else if operator == "<" {
-				return colNum < valNum
+			// Column constraints.
+		constraints:
+			for i < len(tokens) {
+				switch {
+				case tokens[i].Type == PRIMARY && i+1 < len(tokens) && tokens[i+1].Type == KEY:
+					if err := setPrimaryKey([]string{column.Name}); err != nil {
+						return nil, err
+					}
+					i += 2
+				case tokens[i].Type == UNIQUE:
+					stmt.Unique = append(stmt.Unique, []string{column.Name})
+					i++
+				case tokens[i].Type == NOT && i+1 < len(tokens) && tokens[i+1].Type == NULL:
+					column.NotNull = true
+					i += 2
+				case tokens[i].Type == NULL:
+					i++
+				default:
+					break constraints
+				}
 			}
 
+			stmt.Columns = append(stmt.Columns, column)
+
 		default:
-			// Unsupported operator
-			return false
+			return nil, fmt.Errorf("expected column name, got '%s'", tokens[i].Literal)
 		}
 
-		return false
-	}, nil
+		if i < len(tokens) && tokens[i].Type == COMMA {
+			i++
+		} else if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+			return nil, errors.New("expected ',' or ')' in column definitions")
+		}
+	}
+	if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+		return nil, errors.New("expected ')' after column definitions")
+	}
+	i++
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in CREATE TABLE", tokens[i].Literal)
+	}
+	// Without columns, as in CREATE TABLE t (), the table is schemaless.
+	return stmt, nil
+}
+
+func parseCreateIndex(tokens []Token) (*CreateIndexStatement, error) {
+	stmt := &CreateIndexStatement{}
+	i := 1
+	if tokens[i].Type == UNIQUE {
+		stmt.Unique = true
+		i++
+	}
+	if i >= len(tokens) || tokens[i].Type != INDEX {
+		return nil, errors.New("expected INDEX after CREATE UNIQUE")
+	}
+	i++
+
+	if i+2 >= len(tokens) || tokens[i].Type != IDENTIFIER || tokens[i+1].Type != ON || tokens[i+2].Type != IDENTIFIER {
+		return nil, errors.New("invalid CREATE INDEX query format")
+	}
+	stmt.Name = tokens[i].Literal
+	stmt.Table = tokens[i+2].Literal
+	i += 3
+
+	columns, i, err := parseIdentifierList(tokens, i)
+	if err != nil {
+		return nil, err
+	}
+	stmt.Columns = columns
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected token '%s' in CREATE INDEX", tokens[i].Literal)
+	}
+	return stmt, nil
+}
+
+// parseReturning parses a RETURNING clause starting at tokens[i]: either
+// '*' or a comma-separated list of column names.
+func parseReturning(tokens []Token, i int) ([]string, int, error) {
+	i++ // Skip 'RETURNING'
+	if i < len(tokens) && tokens[i].Type == ASTERISK {
+		return []string{"*"}, i + 1, nil
+	}
+
+	var columns []string
+	for i < len(tokens) {
+		if tokens[i].Type == IDENTIFIER {
+			columns = append(columns, tokens[i].Literal)
+		} else if tokens[i].Type != COMMA {
+			return nil, i, errors.New("unexpected token in RETURNING list")
+		}
+		i++
+	}
+	if len(columns) == 0 {
+		return nil, i, errors.New("no columns specified in RETURNING")
+	}
+	return columns, i, nil
+}
+
+// indexOf returns the index of the first token of one of the given types at
+// or after start that is not nested inside parentheses, or len(tokens) if
+// there is none.
+func indexOf(tokens []Token, start int, tokenTypes ...TokenType) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch tokens[i].Type {
+		case LEFT_PAREN:
+			depth++
+		case RIGHT_PAREN:
+			depth--
+		default:
+			if depth > 0 {
+				continue
+			}
+			for _, tokenType := range tokenTypes {
+				if tokens[i].Type == tokenType {
+					return i
+				}
+			}
+		}
+	}
+	return len(tokens)
+}
+
+func parseExplain(tokens []Token) (*ExplainStatement, error) {
+	stmt := &ExplainStatement{}
+	i := 1
+	if i < len(tokens) && tokens[i].Type == ANALYZE {
+		stmt.Analyze = true
+		i++
+	}
+	if i >= len(tokens) {
+		return nil, errors.New("expected a statement after EXPLAIN")
+	}
+	if tokens[i].Type == EXPLAIN {
+		return nil, errors.New("EXPLAIN cannot be nested")
+	}
+
+	inner, err := Parse(tokens[i:])
+	if err != nil {
+		return nil, err
+	}
+	stmt.Statement = inner
+	return stmt, nil
+}
+
+func parseAnalyze(tokens []Token) (*AnalyzeStatement, error) {
+	stmt := &AnalyzeStatement{}
+	if len(tokens) == 1 {
+		return stmt, nil
+	}
+	if len(tokens) > 2 || tokens[1].Type != IDENTIFIER {
+		return nil, errors.New("invalid ANALYZE query format")
+	}
+	stmt.Table = tokens[1].Literal
+	return stmt, nil
+}
+
+// parseBackup parses BACKUP TO 'file'.
+func parseBackup(tokens []Token) (*BackupStatement, error) {
+	if len(tokens) != 3 || !strings.EqualFold(tokens[1].Literal, "TO") || tokens[2].Type != STRING {
+		return nil, errors.New("invalid BACKUP query format, expected BACKUP TO 'file'")
+	}
+	return &BackupStatement{Path: literalValue(tokens[2].Literal).(string)}, nil
+}
+
+// parseSet parses SET name = value and SET name TO value.
+func parseSet(tokens []Token) (*SetStatement, error) {
+	if len(tokens) != 4 || tokens[1].Type != IDENTIFIER ||
+		(tokens[2].Type != EQUALS && !strings.EqualFold(tokens[2].Literal, "TO")) {
+		return nil, errors.New("invalid SET query format")
+	}
+	switch tokens[3].Type {
+	case STRING, NUMBER, IDENTIFIER:
+	default:
+		return nil, errors.New("invalid SET query format")
+	}
+	return &SetStatement{Name: strings.ToLower(tokens[1].Literal), Value: tokens[3].Literal}, nil
+}
+
+// parseCopy parses COPY table [(columns)] FROM 'file'|STDIN [WITH (options)],
+// COPY table [(columns)] TO 'file'|STDOUT [WITH (options)] and
+// COPY (query) TO 'file'|STDOUT [WITH (options)].
+func parseCopy(tokens []Token) (*CopyStatement, error) {
+	stmt := &CopyStatement{Options: DefaultCopyOptions()}
+	i := 1
+	if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+		query, next, err := parseSubquery(tokens, i)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Query, i = query, next
+	} else {
+		if i >= len(tokens) || tokens[i].Type != IDENTIFIER {
+			return nil, errors.New("expected table name after COPY")
+		}
+		stmt.Table = tokens[i].Literal
+		i++
+		if i < len(tokens) && tokens[i].Type == LEFT_PAREN {
+			columns, next, err := parseIdentifierList(tokens, i)
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns, i = columns, next
+		}
+	}
+
+	switch {
+	case i < len(tokens) && tokens[i].Type == FROM:
+		stmt.From = true
+	case i < len(tokens) && strings.EqualFold(tokens[i].Literal, "TO"):
+	default:
+		return nil, errors.New("expected FROM or TO in COPY")
+	}
+	if stmt.From && stmt.Query != nil {
+		return nil, errors.New("COPY FROM needs a table, not a query")
+	}
+	i++
+	stdio := "STDOUT"
+	if stmt.From {
+		stdio = "STDIN"
+	}
+	switch {
+	case i < len(tokens) && tokens[i].Type == STRING:
+		stmt.Path = literalValue(tokens[i].Literal).(string)
+	case i < len(tokens) && strings.EqualFold(tokens[i].Literal, stdio):
+		stmt.Stdio = true
+	default:
+		return nil, fmt.Errorf("expected a quoted file name or %s in COPY", stdio)
+	}
+	i++
+
+	if i < len(tokens) && tokens[i].Type == WITH {
+		i++
+	}
+	if i < len(tokens) {
+		next, err := parseCopyOptions(tokens, i, &stmt.Options)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s after COPY", tokens[i].Literal)
+	}
+	if err := stmt.Options.check(stmt.From); err != nil {
+		return nil, err
+	}
+	return stmt, nil
 }
 
-func toFloat(value string) (float64, error) {
-	return strconv.ParseFloat(value, 64)
+// parseCopyOptions parses a parenthesized list of COPY options, each a
+// name with an optional value.
+func parseCopyOptions(tokens []Token, i int, options *CopyOptions) (int, error) {
+	if tokens[i].Type != LEFT_PAREN {
+		return i, errors.New("expected '(' before COPY options")
+	}
+	for i++; ; i++ {
+		if i >= len(tokens) {
+			return i, errors.New("expected ')' after COPY options")
+		}
+		name := strings.ToUpper(tokens[i].Literal)
+		value := ""
+		if i+1 < len(tokens) && tokens[i+1].Type != COMMA && tokens[i+1].Type != RIGHT_PAREN {
+			i++
+			value = tokens[i].Literal
+		}
+		if err := setCopyOption(options, name, value); err != nil {
+			return i, err
+		}
+		i++
+		if i < len(tokens) && tokens[i].Type == RIGHT_PAREN {
+			return i + 1, nil
+		}
+		if i >= len(tokens) || tokens[i].Type != COMMA {
+			return i, errors.New("expected ',' or ')' in COPY options")
+		}
+	}
+}
+
+// setCopyOption sets the option with the given upper case name to the
+// literal text of a value, which is empty if the option has none.
+func setCopyOption(o *CopyOptions, name, value string) error {
+	text, _ := literalValue(value).(string)
+	switch name {
+	case "FORMAT":
+		format := strings.ToLower(text)
+		if format != "csv" && format != "json" && format != "ndjson" {
+			return fmt.Errorf("COPY format %q not recognized", text)
+		}
+		o.Format = format
+	case "HEADER":
+		if value == "" {
+			o.Header = true
+			return nil
+		}
+		header, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("HEADER requires a Boolean value")
+		}
+		o.Header = header
+	case "CREATE_TABLE":
+		if value == "" {
+			o.CreateTable = true
+			return nil
+		}
+		create, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("CREATE_TABLE requires a Boolean value")
+		}
+		o.CreateTable = create
+	case "SAMPLE":
+		sample, err := strconv.Atoi(value)
+		if err != nil || sample < 0 {
+			return fmt.Errorf("SAMPLE requires a number of rows")
+		}
+		o.Sample = sample
+	case "DELIMITER", "QUOTE":
+		runes := []rune(text)
+		if len(runes) != 1 || runes[0] == '\n' || runes[0] == '\r' {
+			return fmt.Errorf("COPY %s must be a single character", strings.ToLower(name))
+		}
+		if name == "DELIMITER" {
+			o.Delimiter = runes[0]
+		} else {
+			o.Quote = runes[0]
+		}
+	case "NULL":
+		o.Null = text
+	case "ON_ERROR":
+		switch strings.ToLower(text) {
+		case "stop":
+			o.SkipErrors = false
+		case "skip", "ignore":
+			o.SkipErrors = true
+		default:
+			return fmt.Errorf("COPY ON_ERROR %q not recognized", text)
+		}
+	default:
+		return fmt.Errorf("option %q not recognized", strings.ToLower(name))
+	}
+	return nil
 }
@@ -0,0 +1,261 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// PlanColumn describes one column of the rows produced by a plan node.
+type PlanColumn struct {
+	Table string    // Table name or alias the column comes from, if any
+	Name  string    // Column name, or the output name of a computed column
+	Type  data.Type // Declared or inferred type, TypeAny if unknown
+	Expr  string    // Expression text of computed columns such as aggregates
+
+	source *data.Table // Table a scanned column is read from, for statistics
+}
+
+// LogicalPlan is a node of the logical query plan built from the AST. Each
+// node describes what to compute; the physical operators decide how.
+type LogicalPlan interface {
+	Columns() []PlanColumn
+	Children() []LogicalPlan
+	String() string
+}
+
+// ScanNode reads every row of a table.
+type ScanNode struct {
+	Table   *data.Table
+	Alias   string
+	columns []PlanColumn
+}
+
+func (n *ScanNode) Columns() []PlanColumn   { return n.columns }
+func (n *ScanNode) Children() []LogicalPlan { return nil }
+
+func (n *ScanNode) String() string {
+	if n.Alias != "" && n.Alias != n.Table.Name {
+		return "Scan " + n.Table.Name + " AS " + n.Alias
+	}
+	return "Scan " + n.Table.Name
+}
+
+// DerivedNode is a subquery in FROM. It renames the columns of its input
+// to the alias of the derived table.
+type DerivedNode struct {
+	Input   LogicalPlan
+	Alias   string
+	columns []PlanColumn
+}
+
+func (n *DerivedNode) Columns() []PlanColumn   { return n.columns }
+func (n *DerivedNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+func (n *DerivedNode) String() string          { return "Derived " + n.Alias }
+
+// RecursiveNode computes a WITH RECURSIVE query: the rows of Anchor, then
+// the rows of Recursive run again and again over the rows the previous run
+// added, which it reads from the work table, until no new rows turn up.
+// UNION rather than UNION ALL drops rows seen before.
+type RecursiveNode struct {
+	Name      string
+	Anchor    LogicalPlan
+	Recursive LogicalPlan
+	UnionAll  bool
+	MaxDepth  int // Most runs of Recursive before the query fails
+	work      *workTable
+	columns   []PlanColumn
+}
+
+func (n *RecursiveNode) Columns() []PlanColumn   { return n.columns }
+func (n *RecursiveNode) Children() []LogicalPlan { return []LogicalPlan{n.Anchor, n.Recursive} }
+
+func (n *RecursiveNode) String() string {
+	if n.UnionAll {
+		return "Recursive Union All " + n.Name
+	}
+	return "Recursive Union " + n.Name
+}
+
+// WorkTableNode reads the rows a recursive query added in its previous run.
+type WorkTableNode struct {
+	Name    string
+	work    *workTable
+	columns []PlanColumn
+}
+
+func (n *WorkTableNode) Columns() []PlanColumn   { return n.columns }
+func (n *WorkTableNode) Children() []LogicalPlan { return nil }
+func (n *WorkTableNode) String() string          { return "WorkTable " + n.Name }
+
+// workTable passes rows from a recursive query to its recursive term.
+type workTable struct {
+	columns []PlanColumn
+	rows    []Tuple
+	used    bool // Whether the recursive term reads it
+}
+
+// SingleRowNode produces one empty row, the source of a SELECT without FROM.
+type SingleRowNode struct{}
+
+func (n *SingleRowNode) Columns() []PlanColumn   { return nil }
+func (n *SingleRowNode) Children() []LogicalPlan { return nil }
+func (n *SingleRowNode) String() string          { return "SingleRow" }
+
+// EmptyNode produces no rows. It replaces parts of a plan that can never
+// return anything, such as a filter on a condition that is always false.
+type EmptyNode struct {
+	columns []PlanColumn
+}
+
+func (n *EmptyNode) Columns() []PlanColumn   { return n.columns }
+func (n *EmptyNode) Children() []LogicalPlan { return nil }
+func (n *EmptyNode) String() string          { return "Empty" }
+
+// FilterNode keeps the input rows for which the condition is true.
+type FilterNode struct {
+	Input     LogicalPlan
+	Condition Expr
+}
+
+func (n *FilterNode) Columns() []PlanColumn   { return n.Input.Columns() }
+func (n *FilterNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+func (n *FilterNode) String() string          { return "Filter " + n.Condition.String() }
+
+// ProjectNode computes the output columns of a query.
+type ProjectNode struct {
+	Input   LogicalPlan
+	Exprs   []Expr
+	columns []PlanColumn
+}
+
+func (n *ProjectNode) Columns() []PlanColumn   { return n.columns }
+func (n *ProjectNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+
+func (n *ProjectNode) String() string {
+	exprs := make([]string, len(n.Exprs))
+	for i, expr := range n.Exprs {
+		exprs[i] = expr.String()
+	}
+	return "Project " + strings.Join(exprs, ", ")
+}
+
+// JoinNode combines the rows of two inputs. Type is INNER, LEFT or CROSS.
+type JoinNode struct {
+	Left      LogicalPlan
+	Right     LogicalPlan
+	Type      string
+	Condition Expr // nil for CROSS joins
+}
+
+func (n *JoinNode) Columns() []PlanColumn {
+	return append(append([]PlanColumn{}, n.Left.Columns()...), n.Right.Columns()...)
+}
+
+func (n *JoinNode) Children() []LogicalPlan { return []LogicalPlan{n.Left, n.Right} }
+
+func (n *JoinNode) String() string {
+	if n.Condition == nil {
+		return n.Type + " Join"
+	}
+	return n.Type + " Join ON " + n.Condition.String()
+}
+
+// AggregateNode groups its input and computes aggregate calls per group.
+// Its rows hold the GROUP BY values followed by the aggregate results.
+type AggregateNode struct {
+	Input      LogicalPlan
+	GroupBy    []Expr
+	Aggregates []*FuncCall
+	columns    []PlanColumn
+}
+
+func (n *AggregateNode) Columns() []PlanColumn   { return n.columns }
+func (n *AggregateNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+
+func (n *AggregateNode) String() string {
+	parts := []string{}
+	for _, call := range n.Aggregates {
+		parts = append(parts, call.String())
+	}
+	s := "Aggregate " + strings.Join(parts, ", ")
+	if len(n.GroupBy) > 0 {
+		keys := make([]string, len(n.GroupBy))
+		for i, expr := range n.GroupBy {
+			keys[i] = expr.String()
+		}
+		s += " GROUP BY " + strings.Join(keys, ", ")
+	}
+	return s
+}
+
+// SortKey is one ORDER BY key.
+type SortKey struct {
+	Expr Expr
+	Desc bool
+}
+
+// SortNode orders its input.
+type SortNode struct {
+	Input LogicalPlan
+	Keys  []SortKey
+}
+
+func (n *SortNode) Columns() []PlanColumn   { return n.Input.Columns() }
+func (n *SortNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+
+func (n *SortNode) String() string {
+	keys := make([]string, len(n.Keys))
+	for i, key := range n.Keys {
+		keys[i] = key.Expr.String()
+		if key.Desc {
+			keys[i] += " DESC"
+		}
+	}
+	return "Sort " + strings.Join(keys, ", ")
+}
+
+// DistinctNode removes duplicate rows, keeping the first of each.
+type DistinctNode struct {
+	Input LogicalPlan
+}
+
+func (n *DistinctNode) Columns() []PlanColumn   { return n.Input.Columns() }
+func (n *DistinctNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+func (n *DistinctNode) String() string          { return "Distinct" }
+
+// LimitNode skips Offset rows and returns at most Count rows (-1 for all).
+type LimitNode struct {
+	Input  LogicalPlan
+	Count  int64
+	Offset int64
+}
+
+func (n *LimitNode) Columns() []PlanColumn   { return n.Input.Columns() }
+func (n *LimitNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+
+func (n *LimitNode) String() string {
+	s := "Limit"
+	if n.Count >= 0 {
+		s += fmt.Sprintf(" %d", n.Count)
+	}
+	if n.Offset > 0 {
+		s += fmt.Sprintf(" OFFSET %d", n.Offset)
+	}
+	return s
+}
+
+// FormatPlan renders a plan tree with one indented line per node.
+func FormatPlan(plan LogicalPlan) string {
+	var sb strings.Builder
+	var format func(node LogicalPlan, depth int)
+	format = func(node LogicalPlan, depth int) {
+		sb.WriteString(strings.Repeat("  ", depth) + node.String() + "\n")
+		for _, child := range node.Children() {
+			format(child, depth+1)
+		}
+	}
+	format(plan, 0)
+	return sb.String()
+}
@@ -0,0 +1,667 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// selectExprs holds the parsed expressions of a SelectStatement.
+type selectExprs struct {
+	items   []Expr // * and table.* are starExprs
+	aliases []string
+	joins   []Expr
+	where   Expr
+	groupBy []Expr
+	having  Expr
+	orderBy []Expr
+	limit   Expr
+	offset  Expr
+}
+
+// starExpr is a * or table.* item of a select list, which the planner
+// expands into the columns of the FROM clause.
+type starExpr struct {
+	table string // "" for *
+}
+
+func (s *starExpr) exprNode() {}
+
+func (s *starExpr) String() string {
+	if s.table == "" {
+		return "*"
+	}
+	return s.table + ".*"
+}
+
+// parsedExpr returns the parsed tree of expression text: the one the
+// parser kept, or the text parsed now for statements built by hand. Empty
+// text is no expression.
+func parsedExpr(text string, parsed Expr) (Expr, error) {
+	if text == "" {
+		return nil, nil
+	}
+	if parsed != nil {
+		return parsed, nil
+	}
+	return ParseExpression(text)
+}
+
+// parseSelectExprs returns the expressions of a SELECT. The lists are new
+// for each call, so planning may change them, but the trees are shared
+// with the statement: anything that rewrites them must build new nodes, as
+// transformExpr does.
+func parseSelectExprs(stmt *SelectStatement) (*selectExprs, error) {
+	q := &selectExprs{}
+	var err error
+
+	if len(stmt.Columns) == 0 {
+		q.items = []Expr{&starExpr{}}
+	}
+	for i, column := range stmt.Columns {
+		alias := ""
+		if i < len(stmt.Aliases) {
+			alias = stmt.Aliases[i]
+		}
+		q.aliases = append(q.aliases, alias)
+		if column == "*" {
+			q.items = append(q.items, &starExpr{})
+			continue
+		}
+		if table := strings.TrimSuffix(column, ".*"); table != column {
+			q.items = append(q.items, &starExpr{table: table})
+			continue
+		}
+		var parsed Expr
+		if i < len(stmt.items) {
+			parsed = stmt.items[i]
+		}
+		expr, err := parsedExpr(column, parsed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid column '%s': %v", column, err)
+		}
+		q.items = append(q.items, expr)
+	}
+	for _, join := range stmt.Joins {
+		expr, err := parsedExpr(join.Conditions, join.on)
+		if err != nil {
+			return nil, fmt.Errorf("invalid join condition: %v", err)
+		}
+		q.joins = append(q.joins, expr)
+	}
+	if q.where, err = parsedExpr(stmt.Conditions, stmt.where); err != nil {
+		return nil, fmt.Errorf("invalid condition: %v", err)
+	}
+	for i, key := range stmt.GroupBy {
+		var parsed Expr
+		if i < len(stmt.groupBy) {
+			parsed = stmt.groupBy[i]
+		}
+		expr, err := parsedExpr(key, parsed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GROUP BY key: %v", err)
+		}
+		q.groupBy = append(q.groupBy, expr)
+	}
+	if q.having, err = parsedExpr(stmt.Having, stmt.having); err != nil {
+		return nil, fmt.Errorf("invalid HAVING clause: %v", err)
+	}
+	for _, item := range stmt.OrderBy {
+		expr, err := parsedExpr(item.Expr, item.parsed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ORDER BY key: %v", err)
+		}
+		q.orderBy = append(q.orderBy, expr)
+	}
+	if q.limit, err = parsedExpr(stmt.Limit, stmt.limit); err != nil {
+		return nil, fmt.Errorf("invalid LIMIT: %v", err)
+	}
+	if q.offset, err = parsedExpr(stmt.Offset, stmt.offset); err != nil {
+		return nil, fmt.Errorf("invalid OFFSET: %v", err)
+	}
+	return q, nil
+}
+
+// prepare binds the outer references and plans the subqueries of every
+// expression of the query.
+func (q *selectExprs) prepare(e *Executor, s *scope) error {
+	for _, list := range [][]Expr{q.items, q.joins, q.groupBy, q.orderBy} {
+		if err := e.prepareExprs(list, s); err != nil {
+			return err
+		}
+	}
+	var err error
+	if q.where, err = e.prepareExpr(q.where, s); err != nil {
+		return err
+	}
+	q.having, err = e.prepareExpr(q.having, s)
+	return err
+}
+
+// columnRefs lists every column referenced by the query.
+func (q *selectExprs) columnRefs() []*ColumnRef {
+	var refs []*ColumnRef
+	collect := func(expr Expr) {
+		walkExpr(expr, func(e Expr) {
+			if ref, ok := e.(*ColumnRef); ok {
+				refs = append(refs, ref)
+			}
+		})
+	}
+	for _, list := range [][]Expr{q.items, q.joins, q.groupBy, q.orderBy} {
+		for _, expr := range list {
+			collect(expr)
+		}
+	}
+	collect(q.where)
+	collect(q.having)
+	return refs
+}
+
+// planSelect turns a SELECT statement into a logical plan:
+// Scan/Join -> Filter -> Aggregate -> Filter (HAVING) -> Sort -> Project -> Limit,
+// which the rewrite rules then optimize.
+func (e *Executor) planSelect(stmt *SelectStatement) (LogicalPlan, error) {
+	return e.planQuery(stmt, &scope{})
+}
+
+// planQuery plans a SELECT within a scope. Subqueries are planned with the
+// scope of their enclosing query as parent, so they can read its columns.
+func (e *Executor) planQuery(stmt *SelectStatement, s *scope) (LogicalPlan, error) {
+	if len(stmt.Compound) > 0 {
+		return e.planCompound(stmt, s)
+	}
+	q, err := parseSelectExprs(stmt)
+	if err != nil {
+		return nil, err
+	}
+	refs := q.columnRefs()
+	if len(stmt.With) > 0 {
+		if err := e.planWith(stmt, s); err != nil {
+			return nil, err
+		}
+	}
+
+	// FROM and JOIN clauses.
+	var sources []LogicalPlan
+	if stmt.HasFrom() {
+		source, err := e.sourceNode(s, stmt.Table, stmt.Subquery, stmt.Alias, refs, len(stmt.Joins) == 0)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	for _, join := range stmt.Joins {
+		source, err := e.sourceNode(s, join.Table, join.Subquery, join.Alias, refs, false)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	for _, source := range sources {
+		s.columns = append(s.columns, source.Columns()...)
+	}
+	if err := q.prepare(e, s); err != nil {
+		return nil, err
+	}
+
+	var plan LogicalPlan = &SingleRowNode{}
+	if len(sources) > 0 {
+		plan = sources[0]
+	}
+	for i, join := range stmt.Joins {
+		joined := &JoinNode{Left: plan, Right: sources[i+1], Type: join.Type, Condition: q.joins[i]}
+		if joined.Condition != nil {
+			if err := checkExpr(joined.Condition, joined.Columns(), "JOIN conditions"); err != nil {
+				return nil, err
+			}
+		}
+		plan = joined
+	}
+
+	if q.where != nil {
+		if err := checkExpr(q.where, plan.Columns(), "WHERE"); err != nil {
+			return nil, err
+		}
+		plan = &FilterNode{Input: plan, Condition: q.where}
+	}
+
+	// Expand * and table.* into the columns of the FROM clause.
+	var items []Expr
+	var aliases []string
+	starred := false
+	for i, item := range q.items {
+		star, ok := item.(*starExpr)
+		if !ok {
+			items, aliases = append(items, item), append(aliases, q.aliases[i])
+			continue
+		}
+		if !stmt.HasFrom() {
+			return nil, fmt.Errorf("SELECT %s requires a FROM clause", star)
+		}
+		starred, ok = true, star.table == ""
+		for _, col := range plan.Columns() {
+			if star.table == "" || strings.EqualFold(col.Table, star.table) {
+				items, aliases = append(items, &ColumnRef{Table: col.Table, Name: col.Name}), append(aliases, "")
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("missing FROM-clause entry for table %s", star.table)
+		}
+	}
+
+	// ORDER BY may refer to select list items by position or output name.
+	orderBy := make([]Expr, len(q.orderBy))
+	for i, expr := range q.orderBy {
+		orderBy[i] = expr
+		if ref, ok := expr.(*ColumnRef); ok && ref.Table == "" {
+			for j, alias := range aliases {
+				if alias != "" && strings.EqualFold(alias, ref.Name) {
+					orderBy[i] = items[j]
+					break
+				}
+			}
+		}
+		if lit, ok := expr.(*Literal); ok {
+			n, isInt := lit.Value.(int64)
+			if !isInt || n < 1 || int(n) > len(items) {
+				return nil, fmt.Errorf("ORDER BY position %s is not in select list", lit)
+			}
+			orderBy[i] = items[n-1]
+		}
+	}
+
+	// Grouping and aggregates.
+	aggregated := len(q.groupBy) > 0 || q.having != nil
+	for _, expr := range append(append([]Expr{}, items...), orderBy...) {
+		aggregated = aggregated || containsAggregate(expr)
+	}
+	var grouped []PlanColumn // Columns before grouping
+	if aggregated {
+		if starred {
+			return nil, errors.New("SELECT * is not allowed in an aggregate query")
+		}
+		input := plan.Columns()
+		grouped = input
+		node := &AggregateNode{Input: plan, GroupBy: q.groupBy}
+
+		for _, key := range q.groupBy {
+			if containsAggregate(key) {
+				return nil, errors.New("aggregate functions are not allowed in GROUP BY")
+			}
+			if err := checkExpr(key, input, "GROUP BY"); err != nil {
+				return nil, err
+			}
+			col := PlanColumn{Type: inferType(key, input), Expr: key.String()}
+			if ref, ok := key.(*ColumnRef); ok {
+				slot, _ := resolveColumn(input, ref)
+				col.Table, col.Name = input[slot].Table, input[slot].Name
+			}
+			node.columns = append(node.columns, col)
+		}
+
+		var calls []*FuncCall
+		for _, expr := range append(append([]Expr{q.having}, items...), orderBy...) {
+			calls = collectAggregates(expr, calls)
+		}
+		for _, call := range calls {
+			if _, err := newAggregator(call); err != nil {
+				return nil, err
+			}
+			for _, arg := range call.Args {
+				if containsAggregate(arg) {
+					return nil, errors.New("aggregate function calls cannot be nested")
+				}
+				if err := checkExpr(arg, input, "aggregate arguments"); err != nil {
+					return nil, err
+				}
+			}
+			node.Aggregates = append(node.Aggregates, call)
+			node.columns = append(node.columns, PlanColumn{Type: inferType(call, input), Expr: call.String()})
+		}
+		plan = node
+
+		if q.having != nil {
+			if containsWindow(q.having) {
+				return nil, errors.New("window functions are not allowed in HAVING")
+			}
+			if err := checkGrouped(q.having, node.columns, input); err != nil {
+				return nil, err
+			}
+			plan = &FilterNode{Input: plan, Condition: q.having}
+		}
+	} else if q.having != nil {
+		return nil, errors.New("HAVING requires GROUP BY or aggregates")
+	}
+
+	// Window functions run over the groups, if any.
+	var windows []*WindowExpr
+	for _, expr := range append(append([]Expr{}, items...), orderBy...) {
+		windows = collectWindows(expr, windows)
+	}
+	if len(windows) > 0 {
+		node, err := windowNode(plan, windows, grouped)
+		if err != nil {
+			return nil, err
+		}
+		plan = node
+	}
+
+	// Everything above the aggregate may only use groups and aggregates.
+	if aggregated {
+		for _, expr := range append(append([]Expr{}, items...), orderBy...) {
+			if err := checkGrouped(expr, plan.Columns(), grouped); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(orderBy) > 0 {
+		keys := make([]SortKey, len(orderBy))
+		for i, expr := range orderBy {
+			if err := checkExpr(expr, plan.Columns(), "ORDER BY"); err != nil {
+				return nil, err
+			}
+			keys[i] = SortKey{Expr: expr, Desc: stmt.OrderBy[i].Desc}
+		}
+		plan = &SortNode{Input: plan, Keys: keys}
+	}
+
+	project := &ProjectNode{Input: plan, Exprs: items}
+	input := plan.Columns()
+	for i, item := range items {
+		if err := checkExpr(item, input, "the select list"); err != nil {
+			return nil, err
+		}
+		col := PlanColumn{Name: outputName(item), Type: inferType(item, input), Expr: item.String()}
+		if ref, ok := item.(*ColumnRef); ok {
+			slot, _ := resolveColumn(input, ref)
+			col.Table = input[slot].Table
+		}
+		if aliases[i] != "" {
+			col.Table, col.Name = "", aliases[i]
+		}
+		project.columns = append(project.columns, col)
+	}
+	plan = project
+
+	if stmt.Distinct {
+		for _, expr := range orderBy {
+			if !containsExpr(items, expr) {
+				return nil, errors.New("for SELECT DISTINCT, ORDER BY expressions must appear in select list")
+			}
+		}
+		plan = &DistinctNode{Input: plan}
+	}
+
+	if q.limit != nil || q.offset != nil {
+		limit := &LimitNode{Input: plan, Count: -1}
+		if q.limit != nil {
+			if limit.Count, err = e.constantInt(q.limit, "LIMIT"); err != nil {
+				return nil, err
+			}
+		}
+		if q.offset != nil {
+			if limit.Offset, err = e.constantInt(q.offset, "OFFSET"); err != nil {
+				return nil, err
+			}
+		}
+		plan = limit
+	}
+
+	return optimize(plan), nil
+}
+
+// containsExpr reports whether a list holds an expression.
+func containsExpr(exprs []Expr, expr Expr) bool {
+	for _, e := range exprs {
+		if e.String() == expr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// scanNode builds the scan of a table. Schemaless tables have no declared
+// columns, so they expose the columns found in their rows plus any the
+// query refers to; unqualified references count only when the table is the
+// only one in the query.
+func (e *Executor) scanNode(name, alias string, refs []*ColumnRef, only bool) (*ScanNode, error) {
+	table, err := e.storage.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	qualifier := name
+	if alias != "" {
+		qualifier = alias
+	}
+
+	return &ScanNode{Table: table, Alias: alias, columns: tableColumns(table, qualifier, refs, only)}, nil
+}
+
+// sourceNode builds the plan of a FROM item: a table scan, a common table
+// expression, or the plan of a derived table. Derived tables cannot refer
+// to the enclosing query.
+func (e *Executor) sourceNode(s *scope, table string, sub *SelectStatement, alias string, refs []*ColumnRef, only bool) (LogicalPlan, error) {
+	if sub == nil {
+		if def := s.with.lookup(table); def != nil {
+			if alias == "" {
+				alias = table
+			}
+			return e.cteNode(def, alias)
+		}
+		return e.scanNode(table, alias, refs, only)
+	}
+	input, err := e.planQuery(sub, &scope{with: s.with})
+	if err != nil {
+		return nil, err
+	}
+	node := &DerivedNode{Input: input, Alias: alias}
+	for _, col := range input.Columns() {
+		node.columns = append(node.columns, PlanColumn{Table: alias, Name: col.Name, Type: col.Type})
+	}
+	return node, nil
+}
+
+// tableColumns lists the columns of a table as seen by a query.
+func tableColumns(table *data.Table, qualifier string, refs []*ColumnRef, only bool) []PlanColumn {
+	var columns []PlanColumn
+	if len(table.Schema) > 0 {
+		for _, col := range table.Schema {
+			columns = append(columns, PlanColumn{Table: qualifier, Name: col.Name, Type: col.Type, source: table})
+		}
+		return columns
+	}
+
+	names := make(map[string]bool)
+	for _, row := range table.Snapshot() {
+		for name := range row {
+			names[name] = true
+		}
+	}
+	for _, ref := range refs {
+		if (ref.Table == "" && only) || strings.EqualFold(ref.Table, qualifier) {
+			names[ref.Name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		columns = append(columns, PlanColumn{Table: qualifier, Name: name, Type: data.TypeAny, source: table})
+	}
+	return columns
+}
+
+// checkExpr makes sure an expression can be evaluated against the given
+// columns, so that mistakes surface when planning rather than mid-query.
+func checkExpr(expr Expr, columns []PlanColumn, clause string) error {
+	if containsAggregate(expr) && clause != "the select list" && clause != "ORDER BY" {
+		return fmt.Errorf("aggregate functions are not allowed in %s", clause)
+	}
+	if containsWindow(expr) && clause != "the select list" && clause != "ORDER BY" {
+		return fmt.Errorf("window functions are not allowed in %s", clause)
+	}
+	_, err := compileExpr(expr, columns)
+	return err
+}
+
+// checkGrouped makes sure an expression evaluates against the columns
+// of a grouped query. grouped holds the columns before grouping, if any, to
+// tell ungrouped columns from missing ones.
+func checkGrouped(expr Expr, columns, grouped []PlanColumn) error {
+	_, err := compileExpr(expr, columns)
+	if err != nil && grouped != nil {
+		if _, inputErr := compileExpr(expr, grouped); inputErr == nil {
+			return fmt.Errorf("%s must appear in the GROUP BY clause or be used in an aggregate function", expr)
+		}
+	}
+	return err
+}
+
+// constantInt evaluates a constant, non-negative integer such as a LIMIT.
+func (e *Executor) constantInt(expr Expr, clause string) (int64, error) {
+	if param, ok := expr.(*Param); ok {
+		e.noteParamType(param.Index, data.TypeInt)
+	}
+	expr, err := e.bindParams(expr)
+	if err != nil {
+		return 0, err
+	}
+	eval, err := compileExpr(expr, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a constant: %v", clause, err)
+	}
+	value, err := eval(nil)
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		// As in PostgreSQL, LIMIT NULL is no limit and OFFSET NULL is none.
+		if clause == "LIMIT" {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	n, ok := value.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", clause)
+	}
+	return n, nil
+}
+
+// outputName is the result column name of a select list item.
+func outputName(expr Expr) string {
+	switch e := expr.(type) {
+	case *ColumnRef:
+		return e.Name
+	case *FuncCall:
+		return strings.ToLower(e.Name)
+	case *WindowExpr:
+		return strings.ToLower(e.Func.Name)
+	case *CastExpr:
+		return outputName(e.Expr)
+	case *CaseExpr:
+		return "case"
+	case *SubqueryExpr:
+		// As in PostgreSQL, a scalar subquery is named after its column.
+		if e.query != nil {
+			return e.query.plan.Columns()[0].Name
+		}
+	}
+	return "?column?"
+}
+
+// inferType works out the type of an expression's values where possible.
+func inferType(expr Expr, columns []PlanColumn) data.Type {
+	key := expr.String()
+	for _, col := range columns {
+		if col.Expr != "" && col.Expr == key {
+			return col.Type
+		}
+	}
+
+	switch e := expr.(type) {
+	case *Literal:
+		switch e.Value.(type) {
+		case int64:
+			return data.TypeInt
+		case float64:
+			return data.TypeFloat
+		case string:
+			return data.TypeText
+		case bool:
+			return data.TypeBool
+		}
+	case *ColumnRef:
+		if slot, err := resolveColumn(columns, e); err == nil {
+			return columns[slot].Type
+		}
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return data.TypeBool
+		}
+		return inferType(e.Operand, columns)
+	case *BinaryExpr:
+		if precedence(e.Op) <= 4 {
+			return data.TypeBool
+		}
+		if e.Op == "||" {
+			return data.TypeText
+		}
+		left, right := inferType(e.Left, columns), inferType(e.Right, columns)
+		if left == data.TypeInt && right == data.TypeInt {
+			return data.TypeInt
+		}
+		if (left == data.TypeInt || left == data.TypeFloat) && (right == data.TypeInt || right == data.TypeFloat) {
+			return data.TypeFloat
+		}
+	case *WindowExpr:
+		return windowType(e, columns)
+	case *InExpr, *LikeExpr, *BetweenExpr, *IsNullExpr:
+		return data.TypeBool
+	case *CaseExpr:
+		types := []data.Type{}
+		for _, w := range e.Whens {
+			types = append(types, inferType(w.Then, columns))
+		}
+		if e.Else != nil {
+			types = append(types, inferType(e.Else, columns))
+		}
+		return returnsArg(types)
+	case *CastExpr:
+		return e.Type
+	case *SubqueryExpr:
+		if e.query != nil {
+			return e.query.plan.Columns()[0].Type
+		}
+	case *FuncCall:
+		if e.user != nil {
+			return e.user.returnType
+		}
+		if f, ok := builtinFunctions[e.Name]; ok {
+			types := make([]data.Type, len(e.Args))
+			for i, arg := range e.Args {
+				types[i] = inferType(arg, columns)
+			}
+			return f.returns(types)
+		}
+		switch e.Name {
+		case "COUNT":
+			return data.TypeInt
+		case "AVG":
+			return data.TypeFloat
+		case "SUM", "MIN", "MAX":
+			if len(e.Args) == 1 {
+				return inferType(e.Args[0], columns)
+			}
+		}
+	}
+	return data.TypeAny
+}
@@ -0,0 +1,446 @@
+package query
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// statementCacheSize is how many prepared statements an Executor keeps.
+const statementCacheSize = 256
+
+// PreparedStatement is a parsed statement that can be run any number of
+// times. Values for its placeholders, ? or $n, are supplied on each run and
+// never become part of the query text.
+type PreparedStatement struct {
+	executor *Executor
+	text     string
+	stmt     Statement
+	params   int
+}
+
+// Prepare parses a query for repeated use. Statements are cached by their
+// text, so preparing the same query again skips the parser.
+func (e *Executor) Prepare(text string) (*PreparedStatement, error) {
+	if p := e.statements.get(text); p != nil {
+		return p, nil
+	}
+
+	tokens, err := Tokenize(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	stmt, err := Parse(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	p := &PreparedStatement{executor: e, text: text, stmt: stmt}
+	for _, token := range tokens {
+		if token.Type == PARAM {
+			if n, _ := strconv.Atoi(token.Literal[1:]); n > p.params {
+				p.params = n
+			}
+		}
+	}
+
+	e.statements.put(text, p)
+	return p, nil
+}
+
+// Exec prepares a query, using the statement cache, and runs it with the
+// given parameter values.
+func (e *Executor) Exec(text string, args ...interface{}) (*ResultSet, error) {
+	p, err := e.Prepare(text)
+	if err != nil {
+		return nil, err
+	}
+	return p.Exec(args...)
+}
+
+// Query is Exec for statements that return rows.
+func (e *Executor) Query(text string, args ...interface{}) (*ResultSet, error) {
+	p, err := e.Prepare(text)
+	if err != nil {
+		return nil, err
+	}
+	return p.Query(args...)
+}
+
+// Statement returns the parsed statement.
+func (p *PreparedStatement) Statement() Statement {
+	return p.stmt
+}
+
+// NumParams returns the number of parameter values a run needs: the
+// highest placeholder number.
+func (p *PreparedStatement) NumParams() int {
+	return p.params
+}
+
+// String returns the query text the statement was prepared from.
+func (p *PreparedStatement) String() string {
+	return p.text
+}
+
+// Describe returns the types of the placeholders and the columns of the
+// rows the statement returns, without running it. Columns is nil for
+// statements that return no rows. Placeholders take the type they are cast
+// to or of what they are compared with or assigned to, INT in LIMIT and
+// OFFSET and TEXT as LIKE patterns; TypeAny where nothing tells. They are
+// planned as NULL, so result columns that depend on them have type
+// TypeAny.
+func (p *PreparedStatement) Describe() (params []data.Type, columns []Column, err error) {
+	bound := *p.executor
+	bound.params = make([]interface{}, p.params)
+	bound.paramTypes = make([]data.Type, p.params)
+	for i := range bound.paramTypes {
+		bound.paramTypes[i] = data.TypeAny
+	}
+	if columns, err = bound.describe(p.stmt); err != nil {
+		return nil, nil, err
+	}
+	return bound.paramTypes, columns, nil
+}
+
+// describe plans a statement as far as needed to find its result columns,
+// noting the types of its placeholders on the way.
+func (e *Executor) describe(stmt Statement) ([]Column, error) {
+	switch s := stmt.(type) {
+	case *SelectStatement:
+		plan, err := e.planSelect(s)
+		if err != nil {
+			return nil, err
+		}
+		return planResult(plan.Columns(), nil).Columns(), nil
+
+	case *ExplainStatement:
+		if _, err := e.describe(s.Statement); err != nil {
+			return nil, err
+		}
+		return []Column{{Name: "QUERY PLAN", Type: data.TypeText}}, nil
+
+	case *InsertStatement:
+		table, err := e.storage.GetTable(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		if s.Select != nil {
+			if _, err := e.planSelect(s.Select); err != nil {
+				return nil, err
+			}
+		}
+		names := s.Columns
+		if len(names) == 0 {
+			names = table.ColumnNames()
+		}
+		for _, values := range s.values {
+			for i, expr := range values {
+				if param, ok := expr.(*Param); ok && i < len(names) {
+					if col, ok := table.Column(names[i]); ok {
+						e.noteParamType(param.Index, col.Type)
+					}
+				}
+				if _, err := e.prepareExpr(expr, &scope{}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return returningColumns(table, s.Returning), nil
+
+	case *UpdateStatement:
+		table, err := e.storage.GetTable(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		scope := &scope{columns: tableColumns(table, s.Table, nil, true)}
+		for column, value := range s.Assignments {
+			expr, err := parsedExpr(value, s.values[column])
+			if err != nil {
+				return nil, err
+			}
+			if param, ok := expr.(*Param); ok {
+				if col, ok := table.Column(column); ok {
+					e.noteParamType(param.Index, col.Type)
+				}
+			}
+			if _, err := e.prepareExpr(expr, scope); err != nil {
+				return nil, err
+			}
+		}
+		if err := e.describeCondition(s.Conditions, s.where, scope); err != nil {
+			return nil, err
+		}
+		return returningColumns(table, s.Returning), nil
+
+	case *DeleteStatement:
+		table, err := e.storage.GetTable(s.Table)
+		if err != nil {
+			return nil, err
+		}
+		scope := &scope{columns: tableColumns(table, s.Table, nil, true)}
+		if err := e.describeCondition(s.Conditions, s.where, scope); err != nil {
+			return nil, err
+		}
+		return returningColumns(table, s.Returning), nil
+	}
+	return nil, nil
+}
+
+func (e *Executor) describeCondition(text string, parsed Expr, s *scope) error {
+	where, err := parsedExpr(text, parsed)
+	if err != nil {
+		return err
+	}
+	_, err = e.prepareExpr(where, s)
+	return err
+}
+
+// returningColumns describes the rows of a RETURNING clause, nil if there
+// is none.
+func returningColumns(table *data.Table, returning []string) []Column {
+	if len(returning) == 0 {
+		return nil
+	}
+	return changeResult(table, nil, returning).Columns()
+}
+
+// noteParamType records the type of placeholder $index while describing
+// a statement. The first type found wins.
+func (e *Executor) noteParamType(index int, t data.Type) {
+	if index < 1 || index > len(e.paramTypes) || t == data.TypeAny || e.paramTypes[index-1] != data.TypeAny {
+		return
+	}
+	e.paramTypes[index-1] = t
+}
+
+// inferParamTypes notes the types of the placeholders of an expression
+// from the operands they meet.
+func (e *Executor) inferParamTypes(expr Expr, columns []PlanColumn) {
+	if e.paramTypes == nil {
+		return
+	}
+	infer := func(operand, other Expr) {
+		if param, ok := operand.(*Param); ok {
+			e.noteParamType(param.Index, inferType(other, columns))
+		}
+	}
+	walkExpr(expr, func(node Expr) {
+		switch n := node.(type) {
+		case *BinaryExpr:
+			if n.Op == "||" {
+				infer(n.Left, &Literal{Value: ""})
+				infer(n.Right, &Literal{Value: ""})
+				break
+			}
+			infer(n.Left, n.Right)
+			infer(n.Right, n.Left)
+		case *BetweenExpr:
+			infer(n.Expr, n.Low)
+			infer(n.Low, n.Expr)
+			infer(n.High, n.Expr)
+		case *InExpr:
+			for _, item := range n.List {
+				infer(item, n.Expr)
+				infer(n.Expr, item)
+			}
+		case *LikeExpr:
+			for _, operand := range []Expr{n.Expr, n.Pattern, n.Escape} {
+				infer(operand, &Literal{Value: ""})
+			}
+		case *CastExpr:
+			if param, ok := n.Expr.(*Param); ok {
+				e.noteParamType(param.Index, n.Type)
+			}
+		}
+	})
+}
+
+// Exec runs the statement with values for its placeholders. Go integers,
+// floats, strings, byte slices, bools, nil and driver.Valuer
+// implementations are accepted. There is no time type, so time.Time values
+// are refused; bind them formatted as text.
+func (p *PreparedStatement) Exec(args ...interface{}) (*ResultSet, error) {
+	return p.ExecContext(context.Background(), args...)
+}
+
+// ExecContext is like Exec, but stops the statement with a *CanceledError
+// once the context is canceled, as Executor.RunContext does.
+func (p *PreparedStatement) ExecContext(ctx context.Context, args ...interface{}) (*ResultSet, error) {
+	bound, err := p.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	// SET changes the executor itself.
+	if _, ok := p.stmt.(*SetStatement); ok {
+		return p.executor.RunContext(ctx, p.stmt)
+	}
+	return bound.RunContext(ctx, p.stmt)
+}
+
+// bind returns a copy of the executor that runs the statement with values
+// for its placeholders. Runs share the executor, so the values go to the
+// copy.
+func (p *PreparedStatement) bind(args []interface{}) (*Executor, error) {
+	if len(args) != p.params {
+		return nil, fmt.Errorf("statement needs %d parameters, got %d", p.params, len(args))
+	}
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
+		value, err := BindValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for parameter $%d: %v", i+1, err)
+		}
+		params[i] = value
+	}
+	bound := *p.executor
+	bound.params = params
+	return &bound, nil
+}
+
+// Query runs the statement like Exec but fails for statements that do not
+// return rows.
+func (p *PreparedStatement) Query(args ...interface{}) (*ResultSet, error) {
+	return p.QueryContext(context.Background(), args...)
+}
+
+// QueryContext is Query with a context, like ExecContext.
+func (p *PreparedStatement) QueryContext(ctx context.Context, args ...interface{}) (*ResultSet, error) {
+	result, err := p.ExecContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	if !result.HasRows() {
+		return nil, errors.New("statement does not return rows")
+	}
+	return result, nil
+}
+
+// BindValue converts a Go value to the value a placeholder takes, the
+// representation used for literals.
+func BindValue(value interface{}) (interface{}, error) {
+	if valuer, ok := value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return nil, err
+		}
+		value = v
+	}
+
+	switch v := value.(type) {
+	case nil, int64, float64, string, bool:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint:
+		return BindValue(uint64(v))
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, fmt.Errorf("%d is out of range for INT", v)
+		}
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		// Stored as text, the value would not scan back into a time.Time.
+		return nil, errors.New("time.Time is not supported, format it as text")
+	}
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+// param returns the value bound to placeholder $index.
+func (e *Executor) param(index int) (interface{}, error) {
+	if index < 1 || index > len(e.params) {
+		return nil, fmt.Errorf("no value supplied for parameter $%d", index)
+	}
+	return e.params[index-1], nil
+}
+
+// bindParams replaces the placeholders of an expression with the values
+// the statement runs with.
+func (e *Executor) bindParams(expr Expr) (Expr, error) {
+	if expr == nil {
+		return nil, nil
+	}
+	var err error
+	expr = transformExpr(expr, func(node Expr) Expr {
+		p, ok := node.(*Param)
+		if !ok {
+			return node
+		}
+		value, bindErr := e.param(p.Index)
+		if bindErr != nil {
+			if err == nil {
+				err = bindErr
+			}
+			return node
+		}
+		return &Literal{Value: value}
+	})
+	return expr, err
+}
+
+// statementCache keeps prepared statements by query text and evicts the
+// least recently used one when full. A nil cache keeps nothing.
+type statementCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *statementCache) get(text string) *PreparedStatement {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[text]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*PreparedStatement)
+}
+
+func (c *statementCache) put(text string, p *PreparedStatement) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[text]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[text] = c.order.PushFront(p)
+	if c.order.Len() > statementCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*PreparedStatement).text)
+	}
+}
@@ -0,0 +1,290 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// Column describes a column of a ResultSet.
+type Column struct {
+	Name string
+	Type data.Type // TypeAny where the type is not known
+}
+
+// ResultSet is the result of a statement. Queries, EXPLAIN and statements
+// with a RETURNING clause produce rows; INSERT, UPDATE and DELETE report
+// how many rows they changed. A ResultSet holds all of its rows; to read
+// the rows of a large query as they are produced, use
+// PreparedStatement.StreamContext.
+//
+//	rs, err := executor.Run(stmt)
+//	for rs.Next() {
+//		var id int64
+//		var name string
+//		if err := rs.Scan(&id, &name); err != nil { ... }
+//	}
+type ResultSet struct {
+	columns      []Column // nil for statements without rows
+	rows         [][]interface{}
+	pos          int // Position of the current row plus one
+	rowsAffected int64
+	lastInsertID int64
+	notices      []string
+}
+
+// newResultSet creates a result set with rows, even if there are none.
+func newResultSet(columns []Column, rows [][]interface{}) *ResultSet {
+	if columns == nil {
+		columns = []Column{}
+	}
+	return &ResultSet{columns: columns, rows: rows}
+}
+
+// planResult creates the result set of a plan's output tuples.
+func planResult(columns []PlanColumn, tuples []Tuple) *ResultSet {
+	names := resultNames(columns)
+	result := make([]Column, len(columns))
+	for i, col := range columns {
+		result[i] = Column{Name: names[i], Type: col.Type}
+	}
+	rows := make([][]interface{}, len(tuples))
+	for i, t := range tuples {
+		rows[i] = t
+	}
+	return newResultSet(result, rows)
+}
+
+// HasRows reports whether the statement produced rows, possibly none, as
+// opposed to only changing data or the schema.
+func (r *ResultSet) HasRows() bool {
+	return r.columns != nil
+}
+
+// Columns describes the result columns in order.
+func (r *ResultSet) Columns() []Column {
+	return r.columns
+}
+
+// Len returns the number of rows.
+func (r *ResultSet) Len() int {
+	return len(r.rows)
+}
+
+// Next advances to the next row, returning false after the last one.
+func (r *ResultSet) Next() bool {
+	if r.pos < len(r.rows) {
+		r.pos++
+		return true
+	}
+	r.pos = len(r.rows) + 1
+	return false
+}
+
+// Values returns the values of the current row.
+func (r *ResultSet) Values() []interface{} {
+	if r.pos == 0 || r.pos > len(r.rows) {
+		return nil
+	}
+	return r.rows[r.pos-1]
+}
+
+// Scan copies the values of the current row into dest, converting them to
+// the types pointed to. Supported are *interface{}, *string, *[]byte,
+// *int64, *int, *float64, *bool and types with a Scan(src interface{})
+// error method, such as sql.NullString; only the last two accept NULL.
+func (r *ResultSet) Scan(dest ...interface{}) error {
+	row := r.Values()
+	if row == nil {
+		return errors.New("Scan called without a current row")
+	}
+	if len(dest) != len(row) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(row), len(dest))
+	}
+	for i, d := range dest {
+		if err := scanValue(row[i], d); err != nil {
+			return fmt.Errorf("cannot scan column %s: %v", r.columns[i].Name, err)
+		}
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(src interface{}) error
+}
+
+func scanValue(value interface{}, dest interface{}) error {
+	switch d := dest.(type) {
+	case scanner:
+		return d.Scan(value)
+	case *interface{}:
+		*d = value
+		return nil
+	}
+	if value == nil {
+		return fmt.Errorf("NULL cannot be stored in %T", dest)
+	}
+
+	convert := func(t data.Type) (interface{}, error) {
+		return data.ConvertValue(value, t)
+	}
+	switch d := dest.(type) {
+	case *string:
+		*d = textValue(value)
+	case *[]byte:
+		*d = []byte(textValue(value))
+	case *int64:
+		v, err := convert(data.TypeInt)
+		if err != nil {
+			return err
+		}
+		*d = v.(int64)
+	case *int:
+		v, err := convert(data.TypeInt)
+		if err != nil {
+			return err
+		}
+		*d = int(v.(int64))
+	case *float64:
+		v, err := convert(data.TypeFloat)
+		if err != nil {
+			return err
+		}
+		*d = v.(float64)
+	case *bool:
+		v, err := convert(data.TypeBool)
+		if err != nil {
+			return err
+		}
+		*d = v.(bool)
+	default:
+		return fmt.Errorf("unsupported destination type %T", dest)
+	}
+	return nil
+}
+
+// RowsAffected returns the number of rows inserted, updated or deleted.
+func (r *ResultSet) RowsAffected() int64 {
+	return r.rowsAffected
+}
+
+// LastInsertID returns, after an INSERT into a table whose primary key is
+// a single INT column, the key of the last row inserted or updated;
+// otherwise 0.
+func (r *ResultSet) LastInsertID() int64 {
+	return r.lastInsertID
+}
+
+// Notices returns messages about the run of the statement that are not
+// errors, such as the rows a COPY skipped.
+func (r *ResultSet) Notices() []string {
+	return r.notices
+}
+
+// Rows returns the rows as data.Rows keyed by column name, remembering the
+// column order. Names that several columns share, such as ?column?, get a
+// suffix from the second on: ?column?, ?column?_2.
+func (r *ResultSet) Rows() []*data.Row {
+	names := uniqueNames(r.columnNames())
+	rows := make([]*data.Row, len(r.rows))
+	for i, row := range r.rows {
+		rows[i] = data.CreateOrderedRow(names, row)
+	}
+	return rows
+}
+
+// uniqueNames returns the names with a suffix added to repeated ones, so
+// that every name keys one column.
+func uniqueNames(names []string) []string {
+	taken := make(map[string]bool, len(names))
+	for _, name := range names {
+		taken[name] = true
+	}
+	unique := make([]string, len(names))
+	used := make(map[string]bool, len(names))
+	for i, name := range names {
+		for n := 2; used[name]; n++ {
+			if candidate := fmt.Sprintf("%s_%d", names[i], n); !taken[candidate] {
+				name = candidate
+			}
+		}
+		unique[i] = name
+		used[name] = true
+	}
+	return unique
+}
+
+func (r *ResultSet) columnNames() []string {
+	names := make([]string, len(r.columns))
+	for i, col := range r.columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// changeResult creates the result of an INSERT, UPDATE or DELETE that
+// changed the given rows, projected onto its RETURNING columns, if any.
+func changeResult(table *data.Table, rows []*data.Row, returning []string) *ResultSet {
+	var result *ResultSet
+	if len(returning) == 0 {
+		result = &ResultSet{}
+	} else {
+		names := returning
+		if isSelectAll(returning) {
+			names = rowColumnNames(table, rows)
+		}
+		columns := make([]Column, len(names))
+		for i, name := range names {
+			columns[i] = Column{Name: name, Type: data.TypeAny}
+			if col, ok := table.Column(name); ok {
+				columns[i].Type = col.Type
+			}
+		}
+		values := make([][]interface{}, len(rows))
+		for i, row := range rows {
+			values[i] = make([]interface{}, len(names))
+			for j, name := range names {
+				values[i][j] = row.Columns[name]
+			}
+		}
+		result = newResultSet(columns, values)
+	}
+	result.rowsAffected = int64(len(rows))
+	return result
+}
+
+// rowColumnNames lists the columns of a table in schema order. Schemaless
+// tables list the columns found in the rows, sorted by name.
+func rowColumnNames(table *data.Table, rows []*data.Row) []string {
+	if len(table.Schema) > 0 {
+		return table.ColumnNames()
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, row := range rows {
+		for name := range row.Columns {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// insertID returns the single INT primary key of the last of the rows, or
+// 0 if the table has no such key.
+func insertID(table *data.Table, rows []*data.Row) int64 {
+	key := table.PrimaryKey()
+	if len(key) != 1 || len(rows) == 0 {
+		return 0
+	}
+	if col, ok := table.Column(key[0]); !ok || col.Type != data.TypeInt {
+		return 0
+	}
+	id, _ := rows[len(rows)-1].Columns[key[0]].(int64)
+	return id
+}
@@ -0,0 +1,103 @@
+package query
+
+import (
+	"context"
+	"fmt"
+)
+
+// Rows is a cursor over the rows of a query. Each call to Next pulls the
+// next row from the physical operators, so only the operators that need
+// all of their input, such as sorts and aggregates, hold rows in memory.
+// A Rows is only valid in the function it is passed to.
+//
+//	_, err := p.StreamContext(ctx, func(rows *query.Rows) error {
+//		for rows.Next() {
+//			fmt.Println(rows.Values()...)
+//		}
+//		return rows.Err()
+//	})
+type Rows struct {
+	columns []Column
+	op      Operator
+	tuple   Tuple
+	done    bool
+	err     error
+}
+
+// Columns describes the columns of the rows in order.
+func (r *Rows) Columns() []Column {
+	return r.columns
+}
+
+// Next advances to the next row. It returns false after the last one or
+// once producing a row failed; Err tells which.
+func (r *Rows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.tuple, r.err = r.op.Next()
+	if r.err != nil {
+		r.tuple, r.err = nil, fmt.Errorf("failed to execute SELECT: %v", r.err)
+	}
+	r.done = r.tuple == nil
+	return !r.done
+}
+
+// Values returns the values of the current row.
+func (r *Rows) Values() []interface{} {
+	return r.tuple
+}
+
+// Err returns the error that ended the rows, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// StreamContext runs the statement like ExecContext, but passes the rows
+// of a SELECT to fn as they are produced instead of collecting them. The
+// returned result describes the columns and holds no rows; the error is
+// fn's, or that of the rows if fn leaves it unchecked. Other statements
+// run as with ExecContext, without calling fn.
+func (p *PreparedStatement) StreamContext(ctx context.Context, fn func(*Rows) error, args ...interface{}) (*ResultSet, error) {
+	stmt, ok := p.stmt.(*SelectStatement)
+	if !ok {
+		return p.ExecContext(ctx, args...)
+	}
+	bound, err := p.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	return bound.withContext(ctx, func(running *Executor) (*ResultSet, error) {
+		return running.streamSelect(stmt, fn)
+	})
+}
+
+// streamSelect plans a query and passes its rows to fn.
+func (e *Executor) streamSelect(stmt *SelectStatement, fn func(*Rows) error) (*ResultSet, error) {
+	plan, err := e.planSelect(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute SELECT: %v", err)
+	}
+	op, err := buildOperator(e.context(), plan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute SELECT: %v", err)
+	}
+	if err := op.Open(); err != nil {
+		op.Close()
+		return nil, fmt.Errorf("failed to execute SELECT: %v", err)
+	}
+
+	result := planResult(plan.Columns(), nil)
+	rows := &Rows{columns: result.columns, op: op}
+	err = fn(rows)
+	if err == nil {
+		err = rows.err
+	}
+	if closeErr := op.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SplitStatements splits SQL text into statements at semicolons outside
+// string literals. Comments running from -- to the end of the line and
+// empty statements are dropped.
+func SplitStatements(text string) []string {
+	var statements []string
+	var current strings.Builder
+	add := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == ';':
+			add()
+			continue
+		case c == '-' && strings.HasPrefix(text[i:], "--"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			current.WriteByte('\n')
+			continue
+		}
+		current.WriteByte(text[i])
+	}
+	add()
+	return statements
+}
+
+// ExecScript runs the statements of a script, such as a dump, in order.
+// It stops at the first statement that fails, naming it in the error; the
+// statements before it stay done.
+func (e *Executor) ExecScript(ctx context.Context, text string) error {
+	for i, text := range SplitStatements(text) {
+		// Statements are parsed here rather than prepared, so that a long
+		// script does not flush the statement cache.
+		tokens, err := Tokenize(text)
+		var stmt Statement
+		if err == nil {
+			stmt, err = Parse(tokens)
+		}
+		if err == nil {
+			_, err = e.RunContext(ctx, stmt)
+		}
+		if err != nil {
+			return fmt.Errorf("statement %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
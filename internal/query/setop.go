@@ -0,0 +1,235 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// SetOpNode combines the rows of two inputs with UNION, INTERSECT or
+// EXCEPT. Without All, the result has no duplicate rows.
+type SetOpNode struct {
+	Op      string
+	All     bool
+	Left    LogicalPlan
+	Right   LogicalPlan
+	columns []PlanColumn
+}
+
+func (n *SetOpNode) Columns() []PlanColumn   { return n.columns }
+func (n *SetOpNode) Children() []LogicalPlan { return []LogicalPlan{n.Left, n.Right} }
+
+func (n *SetOpNode) String() string {
+	s := map[string]string{"UNION": "Union", "INTERSECT": "Intersect", "EXCEPT": "Except"}[n.Op]
+	if n.All {
+		s += " All"
+	}
+	return s
+}
+
+// planCompound plans a compound SELECT. INTERSECT binds more tightly than
+// UNION and EXCEPT, which apply from left to right; ORDER BY and LIMIT
+// apply to the combined result.
+func (e *Executor) planCompound(stmt *SelectStatement, s *scope) (LogicalPlan, error) {
+	if len(stmt.With) > 0 {
+		if err := e.planWith(stmt, s); err != nil {
+			return nil, err
+		}
+	}
+
+	// Each SELECT has columns of its own but shares the enclosing query.
+	operand := func(sel *SelectStatement) (LogicalPlan, error) {
+		child := &scope{parent: s.parent, with: s.with}
+		plan, err := e.planQuery(sel, child)
+		s.outer = append(s.outer, child.outer...)
+		return plan, err
+	}
+	first := *stmt
+	first.With, first.Recursive, first.Compound = nil, false, nil
+	first.OrderBy, first.Limit, first.Offset = nil, "", ""
+	first.limit, first.offset = nil, nil
+	left, err := operand(&first)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := []LogicalPlan{left}
+	var ops []SetOperation
+	for _, op := range stmt.Compound {
+		right, err := operand(op.Select)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op != "INTERSECT" {
+			terms, ops = append(terms, right), append(ops, op)
+			continue
+		}
+		last := len(terms) - 1
+		if terms[last], err = newSetOp(op.Op, op.All, terms[last], right); err != nil {
+			return nil, err
+		}
+	}
+	plan := terms[0]
+	for i, op := range ops {
+		if plan, err = newSetOp(op.Op, op.All, plan, terms[i+1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(stmt.OrderBy) > 0 {
+		columns := plan.Columns()
+		keys := make([]SortKey, len(stmt.OrderBy))
+		for i, item := range stmt.OrderBy {
+			expr, err := parsedExpr(item.Expr, item.parsed)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ORDER BY key: %v", err)
+			}
+			if lit, ok := expr.(*Literal); ok {
+				n, isInt := lit.Value.(int64)
+				if !isInt || n < 1 || int(n) > len(columns) {
+					return nil, fmt.Errorf("ORDER BY position %s is not in select list", lit)
+				}
+				expr = &ColumnRef{Name: columns[n-1].Name}
+			}
+			if _, err := compileExpr(expr, columns); err != nil {
+				return nil, fmt.Errorf("ORDER BY on a %s result must be on one of the result columns", stmt.Compound[0].Op)
+			}
+			keys[i] = SortKey{Expr: expr, Desc: item.Desc}
+		}
+		plan = &SortNode{Input: plan, Keys: keys}
+	}
+
+	if stmt.Limit != "" || stmt.Offset != "" {
+		limit := &LimitNode{Input: plan, Count: -1}
+		for _, clause := range []struct {
+			name, text string
+			parsed     Expr
+			target     *int64
+		}{{"LIMIT", stmt.Limit, stmt.limit, &limit.Count}, {"OFFSET", stmt.Offset, stmt.offset, &limit.Offset}} {
+			if clause.text == "" {
+				continue
+			}
+			expr, err := parsedExpr(clause.text, clause.parsed)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", clause.name, err)
+			}
+			if *clause.target, err = e.constantInt(expr, clause.name); err != nil {
+				return nil, err
+			}
+		}
+		plan = limit
+	}
+
+	return optimize(plan), nil
+}
+
+// newSetOp combines two inputs, which must have the same number of columns
+// with matching types. The result columns take the names of the left input.
+func newSetOp(op string, all bool, left, right LogicalPlan) (*SetOpNode, error) {
+	l, r := left.Columns(), right.Columns()
+	if len(l) != len(r) {
+		return nil, fmt.Errorf("each %s query must have the same number of columns", op)
+	}
+	node := &SetOpNode{Op: op, All: all, Left: left, Right: right}
+	for i := range l {
+		columnType, ok := unifyTypes(l[i].Type, r[i].Type)
+		if !ok {
+			return nil, fmt.Errorf("%s types %s and %s cannot be matched", op, l[i].Type, r[i].Type)
+		}
+		node.columns = append(node.columns, PlanColumn{Name: l[i].Name, Type: columnType})
+	}
+	return node, nil
+}
+
+// unifyTypes finds the type of a result column fed by columns of two
+// types. Integers and floats mix as floats; untyped columns mix with any.
+func unifyTypes(a, b data.Type) (data.Type, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case a == data.TypeAny || b == data.TypeAny:
+		return data.TypeAny, true
+	case (a == data.TypeInt || a == data.TypeFloat) && (b == data.TypeInt || b == data.TypeFloat):
+		return data.TypeFloat, true
+	}
+	return "", false
+}
+
+// setOpOp computes a set operation when opened and then returns its rows.
+type setOpOp struct {
+	node  *SetOpNode
+	left  Operator
+	right Operator
+	rows  []Tuple
+	pos   int
+}
+
+func (op *setOpOp) Open() error {
+	left, err := runOperator(op.left)
+	if err != nil {
+		return err
+	}
+	right, err := runOperator(op.right)
+	if err != nil {
+		return err
+	}
+
+	op.rows, op.pos = nil, 0
+	if op.node.Op == "UNION" {
+		op.rows = append(left, right...)
+		if !op.node.All {
+			op.rows = distinctRows(op.rows)
+		}
+		return nil
+	}
+
+	// INTERSECT keeps left rows that the right input has, EXCEPT those it
+	// has not. With All, each right row cancels out one left row.
+	counts := make(map[string]int)
+	for _, row := range right {
+		counts[rowKey(row)]++
+	}
+	seen := make(map[string]bool)
+	for _, row := range left {
+		key := rowKey(row)
+		if !op.node.All {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		matched := counts[key] > 0
+		if matched && op.node.All {
+			counts[key]--
+		}
+		if matched == (op.node.Op == "INTERSECT") {
+			op.rows = append(op.rows, row)
+		}
+	}
+	return nil
+}
+
+func (op *setOpOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	op.pos++
+	return op.rows[op.pos-1], nil
+}
+
+func (op *setOpOp) Close() error          { op.rows = nil; return nil }
+func (op *setOpOp) Columns() []PlanColumn { return op.node.Columns() }
+
+// distinctRows drops repeated rows, keeping the first of each.
+func distinctRows(rows []Tuple) []Tuple {
+	seen := make(map[string]bool)
+	var kept []Tuple
+	for _, row := range rows {
+		key := rowKey(row)
+		if !seen[key] {
+			seen[key] = true
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
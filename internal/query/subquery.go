@@ -0,0 +1,335 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// scope holds the columns of a query's FROM clause while it is planned, so
+// that subqueries inside it can refer to them.
+type scope struct {
+	columns []PlanColumn
+	parent  *scope
+	outer   []*OuterRef // Columns of enclosing queries this query reads
+	with    *withScope  // Common table expressions visible to the query
+}
+
+// resolves reports whether the scope or one of its parents has a column.
+func (s *scope) resolves(ref *ColumnRef) bool {
+	for ; s != nil; s = s.parent {
+		if _, err := resolveColumn(s.columns, ref); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// outerRef returns the query's reference to a column of an enclosing
+// query. If the column belongs to a query further out, the enclosing query
+// gets a reference of its own that it passes on.
+func (s *scope) outerRef(ref *ColumnRef) *OuterRef {
+	for _, o := range s.outer {
+		if strings.EqualFold(o.Ref.String(), ref.String()) {
+			return o
+		}
+	}
+	o := &OuterRef{Ref: ref}
+	if p := s.parent; p != nil {
+		if _, err := resolveColumn(p.columns, ref); err != nil {
+			o.parent = p.outerRef(ref)
+		}
+	}
+	s.outer = append(s.outer, o)
+	return o
+}
+
+// subquery is a planned nested SELECT.
+type subquery struct {
+	plan  LogicalPlan
+	outer []*OuterRef     // Columns of the enclosing queries it reads
+	ctx   context.Context // Context of the statement it belongs to
+}
+
+// prepareExpr readies an expression of a query for compilation: placeholders
+// take their values, columns that only enclosing queries have become outer
+// references, and nested subqueries are planned with this query as their
+// enclosing scope.
+func (e *Executor) prepareExpr(expr Expr, s *scope) (Expr, error) {
+	e.inferParamTypes(expr, s.columns)
+	expr, err := e.bindParams(expr)
+	if expr == nil || err != nil {
+		return nil, err
+	}
+	plan := func(stmt *SelectStatement, columns int) *subquery {
+		child := &scope{parent: s, with: s.with}
+		p, planErr := e.planQuery(stmt, child)
+		if planErr == nil && columns > 0 && len(p.Columns()) != columns {
+			planErr = errors.New("subquery must return only one column")
+		}
+		if planErr != nil {
+			if err == nil {
+				err = planErr
+			}
+			return nil
+		}
+		return &subquery{plan: p, outer: child.outer, ctx: e.context()}
+	}
+
+	expr = transformExpr(e.bindFunctions(expr), func(node Expr) Expr {
+		switch n := node.(type) {
+		case *ColumnRef:
+			if _, resolveErr := resolveColumn(s.columns, n); resolveErr != nil && s.parent.resolves(n) {
+				return s.outerRef(n)
+			}
+		case *SubqueryExpr:
+			return &SubqueryExpr{Select: n.Select, query: plan(n.Select, 1)}
+		case *ExistsExpr:
+			return &ExistsExpr{Select: n.Select, query: plan(n.Select, 0)}
+		case *InExpr:
+			if n.Select == nil {
+				break
+			}
+			in := *n
+			in.query = plan(n.Select, 1)
+			return &in
+		}
+		return node
+	})
+	return expr, err
+}
+
+// hasSubquery reports whether an expression contains a subquery.
+func hasSubquery(expr Expr) bool {
+	found := false
+	walkExpr(expr, func(e Expr) {
+		switch n := e.(type) {
+		case *SubqueryExpr, *ExistsExpr:
+			found = true
+		case *InExpr:
+			found = found || n.Select != nil
+		}
+	})
+	return found
+}
+
+// prepareExprs prepares a list of expressions in place.
+func (e *Executor) prepareExprs(exprs []Expr, s *scope) error {
+	for i, expr := range exprs {
+		prepared, err := e.prepareExpr(expr, s)
+		if err != nil {
+			return err
+		}
+		exprs[i] = prepared
+	}
+	return nil
+}
+
+// compile compiles a subquery for evaluation against rows of the given
+// columns. The returned function runs the subquery for a row of the
+// enclosing query and passes each result tuple to fn until it returns false.
+func (q *subquery) compile(columns []PlanColumn) (func(Tuple, func(Tuple) bool) error, error) {
+	if q == nil {
+		return nil, errors.New("subquery has not been planned")
+	}
+	sources := make([]evalFunc, len(q.outer))
+	for i, o := range q.outer {
+		if parent := o.parent; parent != nil {
+			sources[i] = func(Tuple) (interface{}, error) { return parent.value, nil }
+			continue
+		}
+		source, err := compileExpr(o.Ref, columns)
+		if err != nil {
+			return nil, err
+		}
+		sources[i] = source
+	}
+	op, err := buildOperator(q.ctx, q.plan)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(t Tuple, fn func(Tuple) bool) error {
+		for i, source := range sources {
+			value, err := source(t)
+			if err != nil {
+				return err
+			}
+			q.outer[i].value = value
+		}
+		if err := op.Open(); err != nil {
+			op.Close()
+			return err
+		}
+		for {
+			row, err := op.Next()
+			if err != nil {
+				op.Close()
+				return err
+			}
+			if row == nil || !fn(row) {
+				break
+			}
+		}
+		return op.Close()
+	}, nil
+}
+
+// compileScalarSubquery evaluates to the single value the subquery
+// returns, or NULL if it returns no rows.
+func compileScalarSubquery(e *SubqueryExpr, columns []PlanColumn) (evalFunc, error) {
+	run, err := e.query.compile(columns)
+	if err != nil {
+		return nil, err
+	}
+	return cacheUncorrelated(e.query, func(t Tuple) (interface{}, error) {
+		var rows []Tuple
+		err := run(t, func(row Tuple) bool {
+			rows = append(rows, row)
+			return len(rows) < 2
+		})
+		switch {
+		case err != nil:
+			return nil, err
+		case len(rows) > 1:
+			return nil, errors.New("more than one row returned by a subquery used as an expression")
+		case len(rows) == 0:
+			return nil, nil
+		}
+		return rows[0][0], nil
+	}), nil
+}
+
+// compileExists evaluates to whether the subquery returns any row.
+func compileExists(e *ExistsExpr, columns []PlanColumn) (evalFunc, error) {
+	run, err := e.query.compile(columns)
+	if err != nil {
+		return nil, err
+	}
+	return cacheUncorrelated(e.query, func(t Tuple) (interface{}, error) {
+		found := false
+		err := run(t, func(Tuple) bool {
+			found = true
+			return false
+		})
+		return found, err
+	}), nil
+}
+
+// compileIn evaluates x IN (subquery): true if a row equals x, NULL if
+// none does but x or some row is NULL, and false otherwise.
+func compileIn(e *InExpr, columns []PlanColumn) (evalFunc, error) {
+	left, err := compileExpr(e.Expr, columns)
+	if err != nil {
+		return nil, err
+	}
+	run, err := e.query.compile(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	// The values of an uncorrelated subquery are read once.
+	var cached []interface{}
+	values := func(t Tuple) ([]interface{}, error) {
+		if cached != nil {
+			return cached, nil
+		}
+		result := []interface{}{}
+		err := run(t, func(row Tuple) bool {
+			result = append(result, row[0])
+			return true
+		})
+		if err == nil && len(e.query.outer) == 0 {
+			cached = result
+		}
+		return result, err
+	}
+
+	return func(t Tuple) (interface{}, error) {
+		x, err := left(t)
+		if err != nil {
+			return nil, err
+		}
+		list, err := values(t)
+		if err != nil {
+			return nil, err
+		}
+		result := inList(x, list)
+		if e.Not && result != nil {
+			return !result.(bool), nil
+		}
+		return result, nil
+	}, nil
+}
+
+// compileInList compiles x IN (list of values).
+func compileInList(e *InExpr, columns []PlanColumn) (evalFunc, error) {
+	left, err := compileExpr(e.Expr, columns)
+	if err != nil {
+		return nil, err
+	}
+	items, err := compileExprs(e.List, columns)
+	if err != nil {
+		return nil, err
+	}
+	return func(t Tuple) (interface{}, error) {
+		x, err := left(t)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			if list[i], err = item(t); err != nil {
+				return nil, err
+			}
+		}
+		result := inList(x, list)
+		if e.Not && result != nil {
+			return !result.(bool), nil
+		}
+		return result, nil
+	}, nil
+}
+
+// inList applies the IN semantics for a value and a list of values.
+func inList(x interface{}, list []interface{}) interface{} {
+	if len(list) == 0 {
+		return false
+	}
+	if x == nil {
+		return nil
+	}
+	sawNull := false
+	for _, value := range list {
+		if value == nil {
+			sawNull = true
+		} else if compareValues(x, value) == 0 {
+			return true
+		}
+	}
+	if sawNull {
+		return nil
+	}
+	return false
+}
+
+// cacheUncorrelated evaluates a subquery that does not depend on the
+// enclosing row only once.
+func cacheUncorrelated(q *subquery, eval evalFunc) evalFunc {
+	if len(q.outer) > 0 {
+		return eval
+	}
+	done := false
+	var value interface{}
+	return func(t Tuple) (interface{}, error) {
+		if done {
+			return value, nil
+		}
+		v, err := eval(t)
+		if err != nil {
+			return nil, err
+		}
+		value, done = v, true
+		return value, nil
+	}
+}
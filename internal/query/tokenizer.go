@@ -6,9 +6,87 @@ import (
 	"strings"
 )
 
-// Tokenize splits a query into tokens.
+// keywords maps reserved words (in upper case) to their token types.
+var keywords = map[string]TokenType{
+	"SELECT":    SELECT,
+	"INSERT":    INSERT,
+	"INTO":      INTO,
+	"VALUES":    VALUES,
+	"FROM":      FROM,
+	"UPDATE":    UPDATE,
+	"SET":       SET,
+	"WHERE":     WHERE,
+	"DELETE":    DELETE,
+	"CREATE":    CREATE,
+	"TABLE":     TABLE,
+	"RETURNING": RETURNING,
+	"NULL":      NULL,
+	"PRIMARY":   PRIMARY,
+	"KEY":       KEY,
+	"UNIQUE":    UNIQUE,
+	"NOT":       NOT,
+	"INDEX":     INDEX,
+	"ON":        ON,
+	"CONFLICT":  CONFLICT,
+	"DO":        DO,
+	"NOTHING":   NOTHING,
+	"AND":       AND,
+	"OR":        OR,
+	"TRUE":      TRUE,
+	"FALSE":     FALSE,
+	"AS":        AS,
+	"JOIN":      JOIN,
+	"INNER":     INNER,
+	"LEFT":      LEFT,
+	"OUTER":     OUTER,
+	"CROSS":     CROSS,
+	"GROUP":     GROUP,
+	"BY":        BY,
+	"HAVING":    HAVING,
+	"ORDER":     ORDER,
+	"ASC":       ASC,
+	"DESC":      DESC,
+	"LIMIT":     LIMIT,
+	"OFFSET":    OFFSET,
+	"EXPLAIN":   EXPLAIN,
+	"ANALYZE":   ANALYZE,
+	"IN":        IN,
+	"EXISTS":    EXISTS,
+	"WITH":      WITH,
+	"RECURSIVE": RECURSIVE,
+	"UNION":     UNION,
+	"INTERSECT": INTERSECT,
+	"EXCEPT":    EXCEPT,
+	"OVER":      OVER,
+	"PARTITION": PARTITION,
+	"ROWS":      ROWS,
+	"BETWEEN":   BETWEEN,
+	"UNBOUNDED": UNBOUNDED,
+	"PRECEDING": PRECEDING,
+	"FOLLOWING": FOLLOWING,
+	"CURRENT":   CURRENT,
+	"ROW":       ROW,
+	"CAST":      CAST,
+	"IS":        IS,
+	"LIKE":      LIKE,
+	"ILIKE":     ILIKE,
+	"ESCAPE":    ESCAPE,
+	"CASE":      CASE,
+	"WHEN":      WHEN,
+	"THEN":      THEN,
+	"ELSE":      ELSE,
+	"END":       END,
+	"DISTINCT":  DISTINCT,
+	"ALL":       ALL,
+	"COPY":      COPY,
+	"BACKUP":    BACKUP,
+}
+
+// Tokenize splits a query into tokens. Placeholders are numbered: the n-th
+// ? becomes $n, so ? and $n cannot be mixed in one query.
 func Tokenize(query string) ([]Token, error) {
 	var tokens []Token
+	positional, numbered := 0, false
 	//valuesMode := false // Track whether we are inside the VALUES clause
 	var current string // Accumulator for building tokens
 
@@ -18,23 +96,8 @@ func Tokenize(query string) ([]Token, error) {
 		}
 		upperCurrent := strings.ToUpper(current)
 		switch {
-		case upperCurrent == "SELECT":
-			tokens = append(tokens, Token{Type: SELECT, Literal: current})
-		case upperCurrent == "INSERT":
-			tokens = append(tokens, Token{Type: INSERT, Literal: current})
-		case upperCurrent == "INTO":
-			tokens = append(tokens, Token{Type: INTO, Literal: current})
-		case upperCurrent == "VALUES":
-			tokens = append(tokens, Token{Type: VALUES, Literal: current})
-			//valuesMode = true // Enter VALUES mode
-		case upperCurrent == "FROM":
-			tokens = append(tokens, Token{Type: FROM, Literal: current})
-		case upperCurrent == "UPDATE":
-			tokens = append(tokens, Token{Type: UPDATE, Literal: current})
-		case upperCurrent == "SET":
-			tokens = append(tokens, Token{Type: SET, Literal: current})
-		case upperCurrent == "WHERE":
-			tokens = append(tokens, Token{Type: WHERE, Literal: current})
+		case keywords[upperCurrent] != "":
+			tokens = append(tokens, Token{Type: keywords[upperCurrent], Literal: current})
 		case upperCurrent == "=":
 			tokens = append(tokens, Token{Type: EQUALS, Literal: current})
 		case upperCurrent == "*":
@@ -52,7 +115,10 @@ func Tokenize(query string) ([]Token, error) {
 					}
 				}
 			*/
-			if _, err := strconv.Atoi(current); err == nil {
+			if isParam(current) {
+				tokens = append(tokens, Token{Type: PARAM, Literal: current})
+				numbered = true
+			} else if isNumber(current) {
 				tokens = append(tokens, Token{Type: NUMBER, Literal: current})
 			} else if strings.HasPrefix(current, "'") && strings.HasSuffix(current, "'") {
 				tokens = append(tokens, Token{Type: STRING, Literal: current})
@@ -64,9 +130,11 @@ func Tokenize(query string) ([]Token, error) {
 		current = ""
 	}
 
-	for _, char := range query {
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
 		switch char {
-		case ' ', '\t', '\n': // Handle whitespace as token separators
+		case ' ', '\t', '\n', '\r': // Handle whitespace as token separators
 			flushCurrent()
 		case '(':
 			flushCurrent()
@@ -80,15 +148,86 @@ func Tokenize(query string) ([]Token, error) {
 		case '=':
 			flushCurrent()
 			tokens = append(tokens, Token{Type: EQUALS, Literal: string(char)})
+		case '*':
+			flushCurrent()
+			tokens = append(tokens, Token{Type: ASTERISK, Literal: string(char)})
+		case '+':
+			flushCurrent()
+			tokens = append(tokens, Token{Type: PLUS, Literal: string(char)})
+		case '-':
+			flushCurrent()
+			tokens = append(tokens, Token{Type: MINUS, Literal: string(char)})
+		case '/':
+			flushCurrent()
+			tokens = append(tokens, Token{Type: SLASH, Literal: string(char)})
+		case '%':
+			flushCurrent()
+			tokens = append(tokens, Token{Type: PERCENT, Literal: string(char)})
+		case '?':
+			flushCurrent()
+			positional++
+			tokens = append(tokens, Token{Type: PARAM, Literal: "$" + strconv.Itoa(positional)})
+		case '|':
+			flushCurrent()
+			if i+1 >= len(runes) || runes[i+1] != '|' {
+				return nil, errors.New("unexpected character '|'")
+			}
+			tokens = append(tokens, Token{Type: CONCAT, Literal: "||"})
+			i++
+		case ':':
+			// A :: cast. A single colon is part of a word.
+			if i+1 >= len(runes) || runes[i+1] != ':' {
+				current += string(char)
+				break
+			}
+			flushCurrent()
+			tokens = append(tokens, Token{Type: DOUBLE_COLON, Literal: "::"})
+			i++
+		case '<', '>', '!':
+			// Comparison operators, possibly two characters long.
+			flushCurrent()
+			operator := string(char)
+			if i+1 < len(runes) && (runes[i+1] == '=' || (char == '<' && runes[i+1] == '>')) {
+				operator += string(runes[i+1])
+				i++
+			}
+			switch operator {
+			case "<":
+				tokens = append(tokens, Token{Type: LESS, Literal: operator})
+			case ">":
+				tokens = append(tokens, Token{Type: GREATER, Literal: operator})
+			case "<=":
+				tokens = append(tokens, Token{Type: LESS_EQUALS, Literal: operator})
+			case ">=":
+				tokens = append(tokens, Token{Type: GREATER_EQUALS, Literal: operator})
+			case "<>", "!=":
+				tokens = append(tokens, Token{Type: NOT_EQUALS, Literal: operator})
+			default:
+				return nil, errors.New("unexpected character '!'")
+			}
 		case '\'':
-			// Handle quoted strings
-			if strings.HasPrefix(current, "'") {
-				current += string(char) // Closing quote
-				flushCurrent()
-			} else {
-				flushCurrent()
-				current = "'" // Start a new quoted string
+			// Handle quoted strings. Everything up to the closing quote,
+			// including whitespace and punctuation, belongs to the literal;
+			// a doubled quote ('') is an escaped quote.
+			flushCurrent()
+			current = "'"
+			closed := false
+			for i++; i < len(runes); i++ {
+				current += string(runes[i])
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						current += "'"
+						i++
+						continue
+					}
+					closed = true
+					break
+				}
 			}
+			if !closed {
+				return nil, errors.New("unterminated string literal")
+			}
+			flushCurrent()
 		default:
 			current += string(char)
 		}
@@ -96,9 +235,35 @@ func Tokenize(query string) ([]Token, error) {
 
 	flushCurrent() // Add any remaining token
 
+	if positional > 0 && numbered {
+		return nil, errors.New("cannot mix ? and $n placeholders")
+	}
+
 	if len(tokens) == 0 {
 		return nil, errors.New("query is empty or could not be tokenized")
 	}
 
 	return tokens, nil
 }
+
+// isNumber reports whether a word is a numeric literal such as 42, -7 or 1.5.
+func isNumber(word string) bool {
+	if _, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return true
+	}
+	digits := strings.TrimPrefix(word, "-")
+	if digits == "" || !(digits[0] >= '0' && digits[0] <= '9' || digits[0] == '.') {
+		return false
+	}
+	_, err := strconv.ParseFloat(word, 64)
+	return err == nil
+}
+
+// isParam reports whether a word is a numbered placeholder such as $1.
+func isParam(word string) bool {
+	if len(word) < 2 || word[0] != '$' || word[1] < '1' || word[1] > '9' {
+		return false
+	}
+	_, err := strconv.Atoi(word[1:])
+	return err == nil
+}
@@ -0,0 +1,203 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// Value is a SQL value as user-defined functions see it: nil for NULL, or
+// an int64, float64, string or bool.
+type Value = interface{}
+
+// Aggregate holds the callbacks of a user-defined aggregate function. Each
+// group starts with the state returned by Init, or nil if Init is nil. Step
+// folds the arguments of one row into the state, and Final turns the state
+// into the result; without Final the result is the state itself.
+type Aggregate struct {
+	Init  func() Value
+	Step  func(state Value, args []Value) (Value, error)
+	Final func(state Value) (Value, error)
+}
+
+// userFunction is a function registered on an Executor.
+type userFunction struct {
+	name       string
+	argTypes   []data.Type
+	returnType data.Type
+	fn         func(args []Value) (Value, error)
+	aggregate  *Aggregate // Set for aggregate functions
+}
+
+// RegisterFunc registers a scalar function callable from SQL like the
+// built-in functions. Arguments are converted to argTypes before fn is
+// called, and its result to returnType; NULL arguments are passed as nil.
+// Registering a name again replaces the function. Functions should be
+// registered before statements are executed concurrently.
+func (e *Executor) RegisterFunc(name string, argTypes []data.Type, returnType data.Type, fn func(args []Value) (Value, error)) error {
+	if fn == nil {
+		return errors.New("failed to register function: no implementation given")
+	}
+	return e.registerFunction(&userFunction{name: name, argTypes: argTypes, returnType: returnType, fn: fn})
+}
+
+// RegisterAggregate registers an aggregate function, usable with GROUP BY
+// and OVER like the built-in aggregates. Rows whose arguments are all NULL
+// are passed to Step too.
+func (e *Executor) RegisterAggregate(name string, argTypes []data.Type, returnType data.Type, agg Aggregate) error {
+	if agg.Step == nil {
+		return errors.New("failed to register aggregate: no Step function given")
+	}
+	return e.registerFunction(&userFunction{name: name, argTypes: argTypes, returnType: returnType, aggregate: &agg})
+}
+
+func (e *Executor) registerFunction(f *userFunction) error {
+	f.name = strings.ToUpper(f.name)
+	if !isIdentifier(f.name) {
+		return fmt.Errorf("failed to register function: invalid name '%s'", f.name)
+	}
+	if _, ok := builtinFunctions[f.name]; ok || isAggregate(f.name) || isWindowFunction(f.name) {
+		return fmt.Errorf("failed to register function: %s is a built-in function", f.name)
+	}
+	if _, ok := keywords[f.name]; ok {
+		return fmt.Errorf("failed to register function: %s is a keyword", f.name)
+	}
+	if e.functions == nil {
+		e.functions = make(map[string]*userFunction)
+	}
+	e.functions[f.name] = f
+	return nil
+}
+
+func isIdentifier(name string) bool {
+	for i, r := range name {
+		if r != '_' && !(r >= 'A' && r <= 'Z') && !(i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// bindFunction resolves a call of a registered function, returning the
+// call unchanged if it is not one.
+func (e *Executor) bindFunction(call *FuncCall) *FuncCall {
+	f, ok := e.functions[call.Name]
+	if !ok {
+		return call
+	}
+	bound := *call
+	bound.user = f
+	return &bound
+}
+
+// bindFunctions resolves the calls of registered functions in an
+// expression.
+func (e *Executor) bindFunctions(expr Expr) Expr {
+	return transformExpr(expr, func(node Expr) Expr {
+		switch n := node.(type) {
+		case *FuncCall:
+			return e.bindFunction(n)
+		case *WindowExpr:
+			w := *n
+			w.Func = e.bindFunction(n.Func)
+			return &w
+		}
+		return node
+	})
+}
+
+// checkArgs checks the number of arguments of a call.
+func (f *userFunction) checkArgs(call *FuncCall) error {
+	if call.Star {
+		return fmt.Errorf("%s(*) is not allowed", call.Name)
+	}
+	if len(call.Args) != len(f.argTypes) {
+		return fmt.Errorf("%s takes %d arguments, got %d", call.Name, len(f.argTypes), len(call.Args))
+	}
+	return nil
+}
+
+// convertArgs converts argument values to the declared types.
+func (f *userFunction) convertArgs(values []Value) error {
+	for i, value := range values {
+		converted, err := data.ConvertValue(value, f.argTypes[i])
+		if err != nil {
+			return fmt.Errorf("argument %d of %s: %v", i+1, f.name, err)
+		}
+		values[i] = converted
+	}
+	return nil
+}
+
+func (f *userFunction) convertResult(value Value) (Value, error) {
+	converted, err := data.ConvertValue(value, f.returnType)
+	if err != nil {
+		return nil, fmt.Errorf("result of %s: %v", f.name, err)
+	}
+	return converted, nil
+}
+
+// compileUserCall compiles a call of a registered scalar function.
+func compileUserCall(call *FuncCall, columns []PlanColumn) (evalFunc, error) {
+	f := call.user
+	if err := f.checkArgs(call); err != nil {
+		return nil, err
+	}
+	args, err := compileExprs(call.Args, columns)
+	if err != nil {
+		return nil, err
+	}
+	return func(t Tuple) (interface{}, error) {
+		var err error
+		values := make([]Value, len(args))
+		for i, arg := range args {
+			if values[i], err = arg(t); err != nil {
+				return nil, err
+			}
+		}
+		if err := f.convertArgs(values); err != nil {
+			return nil, err
+		}
+		value, err := f.fn(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		return f.convertResult(value)
+	}, nil
+}
+
+// userAggregator runs a registered aggregate function. With several
+// arguments, Step receives them as one []Value; see compileAggregateArg.
+type userAggregator struct {
+	f     *userFunction
+	state Value
+}
+
+func (a *userAggregator) Step(value interface{}) error {
+	args, ok := value.([]Value)
+	if !ok || len(a.f.argTypes) == 1 {
+		args = []Value{value}
+	}
+	if err := a.f.convertArgs(args); err != nil {
+		return err
+	}
+	state, err := a.f.aggregate.Step(a.state, args)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.f.name, err)
+	}
+	a.state = state
+	return nil
+}
+
+func (a *userAggregator) Result() (interface{}, error) {
+	value := a.state
+	if final := a.f.aggregate.Final; final != nil {
+		var err error
+		if value, err = final(a.state); err != nil {
+			return nil, fmt.Errorf("%s: %v", a.f.name, err)
+		}
+	}
+	return a.f.convertResult(value)
+}
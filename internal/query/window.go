@@ -0,0 +1,576 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/H3199/doggodb/internal/data"
+)
+
+// WindowExpr is a function evaluated over a window of rows:
+// f(...) OVER (PARTITION BY ... ORDER BY ... ROWS BETWEEN ... AND ...).
+type WindowExpr struct {
+	Func        *FuncCall
+	PartitionBy []Expr
+	OrderBy     []SortKey
+	Frame       *WindowFrame // nil for the default frame
+}
+
+func (w *WindowExpr) exprNode() {}
+
+// String returns the window function call with its OVER clause.
+func (w *WindowExpr) String() string {
+	var parts []string
+	if len(w.PartitionBy) > 0 {
+		keys := make([]string, len(w.PartitionBy))
+		for i, expr := range w.PartitionBy {
+			keys[i] = expr.String()
+		}
+		parts = append(parts, "PARTITION BY "+strings.Join(keys, ", "))
+	}
+	if len(w.OrderBy) > 0 {
+		keys := make([]string, len(w.OrderBy))
+		for i, key := range w.OrderBy {
+			keys[i] = key.Expr.String()
+			if key.Desc {
+				keys[i] += " DESC"
+			}
+		}
+		parts = append(parts, "ORDER BY "+strings.Join(keys, ", "))
+	}
+	if w.Frame != nil {
+		parts = append(parts, w.Frame.String())
+	}
+	return w.Func.String() + " OVER (" + strings.Join(parts, " ") + ")"
+}
+
+// WindowFrame is a ROWS BETWEEN Start AND End frame.
+type WindowFrame struct {
+	Start FrameBound
+	End   FrameBound
+}
+
+// String returns the frame clause.
+func (f *WindowFrame) String() string {
+	return "ROWS BETWEEN " + f.Start.String() + " AND " + f.End.String()
+}
+
+// FrameBound is one end of a window frame. Type is UNBOUNDED PRECEDING,
+// PRECEDING, CURRENT ROW, FOLLOWING or UNBOUNDED FOLLOWING; Offset counts
+// the rows of PRECEDING and FOLLOWING.
+type FrameBound struct {
+	Type   string
+	Offset int64
+}
+
+// String returns the bound as written in a frame clause.
+func (b FrameBound) String() string {
+	if b.Type == "PRECEDING" || b.Type == "FOLLOWING" {
+		return strconv.FormatInt(b.Offset, 10) + " " + b.Type
+	}
+	return b.Type
+}
+
+// frameOrder ranks bound types from the start of a partition to its end.
+var frameOrder = map[string]int{"UNBOUNDED PRECEDING": 0, "PRECEDING": 1, "CURRENT ROW": 2, "FOLLOWING": 3, "UNBOUNDED FOLLOWING": 4}
+
+// isWindowFunction reports whether a function can only be used with OVER.
+func isWindowFunction(name string) bool {
+	switch name {
+	case "ROW_NUMBER", "RANK", "DENSE_RANK", "LAG", "LEAD", "FIRST_VALUE":
+		return true
+	}
+	return false
+}
+
+// parseOver parses the OVER clause following a function call at tokens[i].
+func parseOver(tokens []Token, i int, call *FuncCall) (Expr, int, error) {
+	w := &WindowExpr{Func: call}
+	i++ // Skip 'OVER'
+	if i >= len(tokens) || tokens[i].Type != LEFT_PAREN {
+		return nil, i, errors.New("expected '(' after OVER")
+	}
+	i++
+
+	if i+1 < len(tokens) && tokens[i].Type == PARTITION && tokens[i+1].Type == BY {
+		i += 2
+		for {
+			expr, next, err := parseExpr(tokens, i)
+			if err != nil {
+				return nil, next, err
+			}
+			w.PartitionBy, i = append(w.PartitionBy, expr), next
+			if i < len(tokens) && tokens[i].Type == COMMA {
+				i++
+				continue
+			}
+			break
+		}
+	}
+
+	if i+1 < len(tokens) && tokens[i].Type == ORDER && tokens[i+1].Type == BY {
+		i += 2
+		for {
+			expr, next, err := parseExpr(tokens, i)
+			if err != nil {
+				return nil, next, err
+			}
+			key := SortKey{Expr: expr}
+			i = next
+			if i < len(tokens) && (tokens[i].Type == ASC || tokens[i].Type == DESC) {
+				key.Desc = tokens[i].Type == DESC
+				i++
+			}
+			w.OrderBy = append(w.OrderBy, key)
+			if i < len(tokens) && tokens[i].Type == COMMA {
+				i++
+				continue
+			}
+			break
+		}
+	}
+
+	if i < len(tokens) && tokens[i].Type == ROWS {
+		frame, next, err := parseFrame(tokens, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+		w.Frame, i = frame, next
+	}
+
+	if i >= len(tokens) || tokens[i].Type != RIGHT_PAREN {
+		return nil, i, errors.New("expected ')' after window definition")
+	}
+	return w, i + 1, nil
+}
+
+// parseFrame parses the frame after ROWS: BETWEEN start AND end, or just a
+// start, which then ends at the current row.
+func parseFrame(tokens []Token, i int) (*WindowFrame, int, error) {
+	frame := &WindowFrame{End: FrameBound{Type: "CURRENT ROW"}}
+	between := i < len(tokens) && tokens[i].Type == BETWEEN
+	if between {
+		i++
+	}
+	var err error
+	if frame.Start, i, err = parseFrameBound(tokens, i); err != nil {
+		return nil, i, err
+	}
+	if between {
+		if i >= len(tokens) || tokens[i].Type != AND {
+			return nil, i, errors.New("expected AND in frame clause")
+		}
+		if frame.End, i, err = parseFrameBound(tokens, i+1); err != nil {
+			return nil, i, err
+		}
+	}
+
+	switch {
+	case frame.Start.Type == "UNBOUNDED FOLLOWING":
+		return nil, i, errors.New("frame start cannot be UNBOUNDED FOLLOWING")
+	case frame.End.Type == "UNBOUNDED PRECEDING":
+		return nil, i, errors.New("frame end cannot be UNBOUNDED PRECEDING")
+	case frameOrder[frame.Start.Type] > frameOrder[frame.End.Type]:
+		return nil, i, errors.New("frame starts after it ends")
+	}
+	return frame, i, nil
+}
+
+func parseFrameBound(tokens []Token, i int) (FrameBound, int, error) {
+	if i+1 >= len(tokens) {
+		return FrameBound{}, i, errors.New("incomplete frame clause")
+	}
+	first, second := tokens[i], tokens[i+1]
+	switch {
+	case first.Type == UNBOUNDED && second.Type == PRECEDING:
+		return FrameBound{Type: "UNBOUNDED PRECEDING"}, i + 2, nil
+	case first.Type == UNBOUNDED && second.Type == FOLLOWING:
+		return FrameBound{Type: "UNBOUNDED FOLLOWING"}, i + 2, nil
+	case first.Type == CURRENT && second.Type == ROW:
+		return FrameBound{Type: "CURRENT ROW"}, i + 2, nil
+	case first.Type == NUMBER && (second.Type == PRECEDING || second.Type == FOLLOWING):
+		offset, err := strconv.ParseInt(first.Literal, 10, 64)
+		if err != nil || offset < 0 {
+			return FrameBound{}, i, fmt.Errorf("frame offset must be a non-negative integer, got %s", first.Literal)
+		}
+		return FrameBound{Type: string(second.Type), Offset: offset}, i + 2, nil
+	}
+	return FrameBound{}, i, fmt.Errorf("invalid frame bound at '%s'", first.Literal)
+}
+
+// containsWindow reports whether an expression calls a window function.
+func containsWindow(expr Expr) bool {
+	found := false
+	walkExpr(expr, func(e Expr) {
+		if _, ok := e.(*WindowExpr); ok {
+			found = true
+		}
+	})
+	return found
+}
+
+// collectWindows appends the distinct window function calls of an
+// expression.
+func collectWindows(expr Expr, windows []*WindowExpr) []*WindowExpr {
+	walkExpr(expr, func(e Expr) {
+		w, ok := e.(*WindowExpr)
+		if !ok {
+			return
+		}
+		for _, existing := range windows {
+			if existing.String() == w.String() {
+				return
+			}
+		}
+		windows = append(windows, w)
+	})
+	return windows
+}
+
+// WindowNode computes window functions over its input. Its rows hold the
+// input columns followed by one column per window function.
+type WindowNode struct {
+	Input   LogicalPlan
+	Windows []*WindowExpr
+	outputs []PlanColumn // Columns of the window function results
+}
+
+func (n *WindowNode) Columns() []PlanColumn {
+	return append(append([]PlanColumn{}, n.Input.Columns()...), n.outputs...)
+}
+
+func (n *WindowNode) Children() []LogicalPlan { return []LogicalPlan{n.Input} }
+
+func (n *WindowNode) String() string {
+	parts := make([]string, len(n.Windows))
+	for i, w := range n.Windows {
+		parts[i] = w.String()
+	}
+	return "Window " + strings.Join(parts, ", ")
+}
+
+// windowNode adds the window functions of a query on top of its plan. If
+// the query is grouped, grouped holds the columns before grouping, so that
+// ungrouped columns are reported as such.
+func windowNode(plan LogicalPlan, windows []*WindowExpr, grouped []PlanColumn) (*WindowNode, error) {
+	input := plan.Columns()
+	node := &WindowNode{Input: plan, Windows: windows}
+	for _, w := range windows {
+		if err := checkWindowCall(w.Func); err != nil {
+			return nil, err
+		}
+		parts := append(append([]Expr{}, w.Func.Args...), w.PartitionBy...)
+		for _, key := range w.OrderBy {
+			parts = append(parts, key.Expr)
+		}
+		for _, part := range parts {
+			if containsWindow(part) {
+				return nil, errors.New("window function calls cannot be nested")
+			}
+			if err := checkGrouped(part, input, grouped); err != nil {
+				return nil, err
+			}
+		}
+		node.outputs = append(node.outputs, PlanColumn{Name: strings.ToLower(w.Func.Name), Type: windowType(w, input), Expr: w.String()})
+	}
+	return node, nil
+}
+
+// checkWindowCall checks the arguments of a function used with OVER.
+func checkWindowCall(call *FuncCall) error {
+	if call.Distinct {
+		return fmt.Errorf("DISTINCT is not supported for window functions")
+	}
+	if call.isAggregate() {
+		_, err := newAggregator(call)
+		return err
+	}
+	if call.Star {
+		return fmt.Errorf("%s(*) is not allowed", call.Name)
+	}
+	switch call.Name {
+	case "ROW_NUMBER", "RANK", "DENSE_RANK":
+		if len(call.Args) != 0 {
+			return fmt.Errorf("%s takes no arguments", call.Name)
+		}
+	case "LAG", "LEAD":
+		if len(call.Args) < 1 || len(call.Args) > 3 {
+			return fmt.Errorf("%s takes one to three arguments", call.Name)
+		}
+	case "FIRST_VALUE":
+		if len(call.Args) != 1 {
+			return fmt.Errorf("%s takes exactly one argument", call.Name)
+		}
+	default:
+		return fmt.Errorf("function %s is not a window function", call.Name)
+	}
+	return nil
+}
+
+// windowType infers the type of a window function's values.
+func windowType(w *WindowExpr, columns []PlanColumn) data.Type {
+	if w.Func.user != nil {
+		return w.Func.user.returnType
+	}
+	switch w.Func.Name {
+	case "ROW_NUMBER", "RANK", "DENSE_RANK":
+		return data.TypeInt
+	case "LAG", "LEAD", "FIRST_VALUE":
+		return inferType(w.Func.Args[0], columns)
+	}
+	return inferType(w.Func, columns)
+}
+
+// windowFunc is a window function compiled against the input columns.
+type windowFunc struct {
+	expr      *WindowExpr
+	partition []evalFunc
+	order     []evalFunc
+	desc      []bool
+	args      []evalFunc
+	typ       data.Type // Type of the values, which LAG and LEAD defaults take
+}
+
+// windowOp computes the window functions of every input row when opened.
+// Rows keep their input order; each window function sorts a copy.
+type windowOp struct {
+	input   Operator
+	node    *WindowNode
+	funcs   []windowFunc
+	columns []PlanColumn
+	rows    []Tuple
+	pos     int
+}
+
+func newWindowOp(input Operator, node *WindowNode) (*windowOp, error) {
+	op := &windowOp{input: input, node: node, columns: node.Columns()}
+	columns := node.Input.Columns()
+	for _, w := range node.Windows {
+		f := windowFunc{expr: w, typ: windowType(w, columns)}
+		var err error
+		if f.partition, err = compileExprs(w.PartitionBy, columns); err != nil {
+			return nil, err
+		}
+		for _, key := range w.OrderBy {
+			eval, err := compileExpr(key.Expr, columns)
+			if err != nil {
+				return nil, err
+			}
+			f.order = append(f.order, eval)
+			f.desc = append(f.desc, key.Desc)
+		}
+		if w.Func.isAggregate() {
+			arg, err := compileAggregateArg(w.Func, columns)
+			if err != nil {
+				return nil, err
+			}
+			f.args = []evalFunc{arg}
+		} else if f.args, err = compileExprs(w.Func.Args, columns); err != nil {
+			return nil, err
+		}
+		op.funcs = append(op.funcs, f)
+	}
+	return op, nil
+}
+
+func (op *windowOp) Open() error {
+	input, err := runOperator(op.input)
+	if err != nil {
+		return err
+	}
+	width := len(op.node.Input.Columns())
+	op.rows, op.pos = make([]Tuple, len(input)), 0
+	for i, t := range input {
+		op.rows[i] = append(append(make(Tuple, 0, width+len(op.funcs)), t...), make(Tuple, len(op.funcs))...)
+	}
+	for slot, f := range op.funcs {
+		if err := f.compute(input, op.rows, width+slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *windowOp) Next() (Tuple, error) {
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	op.pos++
+	return op.rows[op.pos-1], nil
+}
+
+func (op *windowOp) Close() error          { op.rows = nil; return nil }
+func (op *windowOp) Columns() []PlanColumn { return op.columns }
+
+// compute stores the function's value for each input row at slot of the
+// matching output row.
+func (f *windowFunc) compute(input, output []Tuple, slot int) error {
+	// Split the rows into partitions, in order of first appearance.
+	var order []string
+	partitions := make(map[string][]int)
+	for i, t := range input {
+		values := make(Tuple, len(f.partition))
+		for k, eval := range f.partition {
+			var err error
+			if values[k], err = eval(t); err != nil {
+				return err
+			}
+		}
+		key := rowKey(values)
+		if _, ok := partitions[key]; !ok {
+			order = append(order, key)
+		}
+		partitions[key] = append(partitions[key], i)
+	}
+
+	for _, key := range order {
+		rows := partitions[key]
+		keys := make([]Tuple, len(input))
+		for _, i := range rows {
+			keys[i] = make(Tuple, len(f.order))
+			for k, eval := range f.order {
+				var err error
+				if keys[i][k], err = eval(input[i]); err != nil {
+					return err
+				}
+			}
+		}
+		sort.SliceStable(rows, func(a, b int) bool {
+			return compareSortKeys(keys[rows[a]], keys[rows[b]], f.desc) < 0
+		})
+
+		// Peers share their ORDER BY values; without ORDER BY, all rows
+		// of the partition are peers.
+		peerStart := make([]int, len(rows))
+		peerEnd := make([]int, len(rows))
+		for pos := range rows {
+			if pos > 0 && compareSortKeys(keys[rows[pos-1]], keys[rows[pos]], f.desc) == 0 {
+				peerStart[pos] = peerStart[pos-1]
+			} else {
+				peerStart[pos] = pos
+			}
+		}
+		for pos := len(rows) - 1; pos >= 0; pos-- {
+			if pos < len(rows)-1 && peerStart[pos+1] == peerStart[pos] {
+				peerEnd[pos] = peerEnd[pos+1]
+			} else {
+				peerEnd[pos] = pos
+			}
+		}
+
+		dense := int64(0)
+		for pos, i := range rows {
+			if peerStart[pos] == pos {
+				dense++
+			}
+			value, err := f.value(input, rows, pos, peerStart[pos], peerEnd[pos], dense)
+			if err != nil {
+				return err
+			}
+			output[i][slot] = value
+		}
+	}
+	return nil
+}
+
+// value computes the function for the row at pos of a sorted partition.
+func (f *windowFunc) value(input []Tuple, rows []int, pos, peerStart, peerEnd int, dense int64) (interface{}, error) {
+	call := f.expr.Func
+	current := input[rows[pos]]
+	switch call.Name {
+	case "ROW_NUMBER":
+		return int64(pos + 1), nil
+	case "RANK":
+		return int64(peerStart + 1), nil
+	case "DENSE_RANK":
+		return dense, nil
+
+	case "LAG", "LEAD":
+		offset := int64(1)
+		if len(f.args) > 1 {
+			value, err := f.args[1](current)
+			if err != nil {
+				return nil, err
+			}
+			n, ok := value.(int64)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("%s offset must be a non-negative integer", call.Name)
+			}
+			offset = n
+		}
+		target := int64(pos) - offset
+		if call.Name == "LEAD" {
+			target = int64(pos) + offset
+		}
+		if target < 0 || target >= int64(len(rows)) {
+			if len(f.args) > 2 {
+				value, err := f.args[2](current)
+				if err != nil {
+					return nil, err
+				}
+				if value, err = data.ConvertValue(value, f.typ); err != nil {
+					return nil, fmt.Errorf("invalid %s default: %v", call.Name, err)
+				}
+				return value, nil
+			}
+			return nil, nil
+		}
+		return f.args[0](input[rows[target]])
+	}
+
+	// FIRST_VALUE and aggregates read the rows of the frame. By default
+	// the frame runs from the start of the partition to the last peer of
+	// the current row.
+	lo, hi := 0, peerEnd
+	if frame := f.expr.Frame; frame != nil {
+		lo, hi = frameBound(frame.Start, pos, len(rows)), frameBound(frame.End, pos, len(rows))
+	}
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(rows)-1 {
+		hi = len(rows) - 1
+	}
+
+	if call.Name == "FIRST_VALUE" {
+		if lo > hi {
+			return nil, nil
+		}
+		return f.args[0](input[rows[lo]])
+	}
+
+	agg, err := newAggregator(call)
+	if err != nil {
+		return nil, err
+	}
+	for k := lo; k <= hi; k++ {
+		var value interface{}
+		if !call.Star {
+			if value, err = f.args[0](input[rows[k]]); err != nil {
+				return nil, err
+			}
+		}
+		if err := agg.Step(value); err != nil {
+			return nil, err
+		}
+	}
+	return agg.Result()
+}
+
+// frameBound turns a frame bound into a position in a partition of n rows.
+func frameBound(bound FrameBound, pos, n int) int {
+	switch bound.Type {
+	case "UNBOUNDED PRECEDING":
+		return 0
+	case "PRECEDING":
+		return pos - int(bound.Offset)
+	case "FOLLOWING":
+		return pos + int(bound.Offset)
+	case "UNBOUNDED FOLLOWING":
+		return n - 1
+	}
+	return pos
+}
@@ -0,0 +1,221 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+func TestBackup(t *testing.T) {
+	db := engine.NewDatabase()
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	session := db.Session()
+	defer session.Close()
+	exec := func(s *engine.Session, sql string, args ...interface{}) (*query.ResultSet, error) {
+		p, err := s.Prepare(sql)
+		if err != nil {
+			return nil, err
+		}
+		return s.Run(ctx, p, args...)
+	}
+	for _, sql := range []string{
+		"CREATE TABLE orders (id INT PRIMARY KEY, total FLOAT)",
+		"CREATE TABLE lines (order_id INT, item TEXT)",
+		"CREATE INDEX lines_order ON lines (order_id)",
+	} {
+		if _, err := exec(session, sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+
+	// Writers add an order and its line in one transaction while backups
+	// are taken; every backup must have as many orders as lines.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		writer := db.Session()
+		defer writer.Close()
+		for i := 0; i < 200; i++ {
+			if err := writer.Begin(ctx, false); err != nil {
+				t.Errorf("Begin failed: %v", err)
+				return
+			}
+			_, err := exec(writer, "INSERT INTO orders VALUES (?, ?)", i, float64(i)/2)
+			if err == nil {
+				_, err = exec(writer, "INSERT INTO lines VALUES (?, 'item')", i)
+			}
+			if err != nil {
+				t.Errorf("INSERT failed: %v", err)
+				writer.Rollback()
+				return
+			}
+			writer.Commit()
+		}
+	}()
+	var paths []string
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, "backup"+string(rune('a'+i))+".sql")
+		if _, err := exec(session, "BACKUP TO '"+path+"'"); err != nil {
+			t.Fatalf("BACKUP failed: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	wg.Wait()
+	if err := db.Backup(filepath.Join(dir, "final.sql")); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	paths = append(paths, filepath.Join(dir, "final.sql"))
+
+	count := func(db *engine.Database, table string) int64 {
+		t.Helper()
+		rs, err := db.Executor().Query("SELECT COUNT(*) FROM " + table)
+		if err != nil || !rs.Next() {
+			t.Fatalf("COUNT failed: %v", err)
+		}
+		return rs.Values()[0].(int64)
+	}
+	for _, path := range paths {
+		backup, err := engine.OpenBackup(ctx, path)
+		if err != nil {
+			t.Fatalf("OpenBackup %s failed: %v", path, err)
+		}
+		if orders, lines := count(backup, "orders"), count(backup, "lines"); orders != lines {
+			t.Errorf("Backup %s is inconsistent: %d orders and %d lines", filepath.Base(path), orders, lines)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != len(paths) {
+		t.Errorf("Expected only the backup files, got %d files", len(entries))
+	}
+
+	// A backup opens read-only.
+	backup, err := engine.OpenBackup(ctx, filepath.Join(dir, "final.sql"))
+	if err != nil {
+		t.Fatalf("OpenBackup failed: %v", err)
+	}
+	if !backup.ReadOnly() || count(backup, "orders") != 200 {
+		t.Errorf("Expected a read-only backup with 200 orders")
+	}
+	if info, _ := backup.DescribeTable("lines"); len(info.Indexes) != 1 || info.Indexes[0].Name != "lines_order" {
+		t.Errorf("Expected the index to be restored, got %+v", info.Indexes)
+	}
+	reader := backup.Session()
+	defer reader.Close()
+	if rs, err := exec(reader, "SELECT total FROM orders WHERE id = 9"); err != nil || !rs.Next() || rs.Values()[0] != 4.5 {
+		t.Errorf("Expected to read the backup, got %v", err)
+	}
+	if _, err := exec(reader, "INSERT INTO orders VALUES (1000, 1)"); err != engine.ErrReadOnlyDatabase {
+		t.Errorf("Expected ErrReadOnlyDatabase, got %v", err)
+	}
+	if err := reader.Begin(ctx, false); err != engine.ErrReadOnlyDatabase {
+		t.Errorf("Expected ErrReadOnlyDatabase from Begin, got %v", err)
+	}
+	if _, err := exec(reader, "BACKUP TO '"+filepath.Join(dir, "copy.sql")+"'"); err != nil {
+		t.Errorf("Expected a read-only database to back up, got %v", err)
+	}
+
+	// In a transaction, the backup leaves out its uncommitted changes.
+	if err := session.Begin(ctx, false); err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if _, err := exec(session, "INSERT INTO orders VALUES (1000, 1)"); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	if _, err := exec(session, "BACKUP TO '"+filepath.Join(dir, "tx.sql")+"'"); err != nil {
+		t.Fatalf("BACKUP in a transaction failed: %v", err)
+	}
+	session.Rollback()
+	if backup, err := engine.OpenBackup(ctx, filepath.Join(dir, "tx.sql")); err != nil || count(backup, "orders") != 200 {
+		t.Errorf("Expected the backup to hold the 200 committed orders, got %v", err)
+	}
+
+	// The executor runs BACKUP itself too.
+	if _, err := db.Executor().Exec("BACKUP TO '" + filepath.Join(dir, "executor.sql") + "'"); err != nil {
+		t.Errorf("BACKUP on the executor failed: %v", err)
+	}
+	if _, err := exec(session, "BACKUP TO '"+filepath.Join(dir, "missing", "x.sql")+"'"); err == nil {
+		t.Errorf("Expected BACKUP into a missing directory to fail")
+	}
+	if _, err := db.Executor().Exec("BACKUP 'x.sql'"); err == nil {
+		t.Errorf("Expected BACKUP without TO to fail")
+	}
+}
+
+func TestRestrictFiles(t *testing.T) {
+	db := engine.NewDatabase()
+	ctx := context.Background()
+	dir, outside := t.TempDir(), t.TempDir()
+	os.Symlink(filepath.Join(outside, "x.csv"), filepath.Join(dir, "link.csv"))
+
+	session := db.Session()
+	defer session.Close()
+	exec := func(sql string) error {
+		p, err := session.Prepare(sql)
+		if err == nil {
+			_, err = session.Run(ctx, p)
+		}
+		return err
+	}
+	if err := exec("CREATE TABLE pets (id INT, name TEXT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	exec("INSERT INTO pets VALUES (1, 'Rex')")
+
+	session.RestrictFiles("")
+	for _, sql := range []string{
+		"COPY pets TO '" + filepath.Join(dir, "pets.csv") + "'",
+		"BACKUP TO '" + filepath.Join(dir, "pets.sql") + "'",
+	} {
+		if err := exec(sql); !errors.Is(err, engine.ErrFileAccess) {
+			t.Errorf("Expected %q to be denied, got %v", sql, err)
+		}
+	}
+
+	session.RestrictFiles(dir)
+	for _, path := range []string{"pets.csv", "pets.sql"} {
+		sql := "COPY pets TO '" + filepath.Join(dir, path) + "'"
+		if path == "pets.sql" {
+			sql = "BACKUP TO '" + filepath.Join(dir, path) + "'"
+		}
+		if err := exec(sql); err != nil {
+			t.Errorf("Expected %q inside the directory to run, got %v", sql, err)
+		}
+	}
+	for _, path := range []string{
+		filepath.Join(outside, "x.csv"),
+		filepath.Join(dir, "..", filepath.Base(outside), "x.csv"),
+		filepath.Join(dir, "link.csv"),
+		"/etc/passwd",
+	} {
+		if err := exec("COPY pets FROM '" + path + "'"); !errors.Is(err, engine.ErrFileAccess) {
+			t.Errorf("Expected %s to be denied, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x.csv")); err == nil {
+		t.Errorf("Expected nothing to be written outside the directory")
+	}
+
+	// Data still goes through the client.
+	p, _ := session.Prepare("COPY pets FROM STDIN")
+	if rs, err := session.RunCopy(ctx, p, strings.NewReader("2,Bo\n"), nil); err != nil || rs.RowsAffected() != 1 {
+		t.Errorf("COPY FROM STDIN failed: %v", err)
+	}
+	var out strings.Builder
+	p, _ = session.Prepare("COPY pets TO STDOUT")
+	if _, err := session.RunCopy(ctx, p, nil, &out); err != nil || out.String() != "1,Rex\n2,Bo\n" {
+		t.Errorf("Expected the rows on STDOUT, got %q %v", out.String(), err)
+	}
+	if err := exec("COPY pets TO STDOUT"); err == nil {
+		t.Errorf("Expected COPY TO STDOUT without a client to fail")
+	}
+}
@@ -0,0 +1,312 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/H3199/doggodb/internal/data"
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+func TestExecutorCopy(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+	dir := t.TempDir()
+
+	exec := func(sql string) *query.ResultSet {
+		t.Helper()
+		result, err := executor.Exec(sql)
+		if err != nil {
+			t.Fatalf("Exec %q failed: %v", sql, err)
+		}
+		return result
+	}
+	path := func(name string) string {
+		return filepath.ToSlash(filepath.Join(dir, name))
+	}
+	readFile := func(name string) string {
+		t.Helper()
+		content, err := os.ReadFile(path(name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		return string(content)
+	}
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(path(name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	rows := func(sql string) [][]interface{} {
+		t.Helper()
+		var result [][]interface{}
+		rs := exec(sql)
+		for rs.Next() {
+			result = append(result, rs.Values())
+		}
+		return result
+	}
+
+	exec("CREATE TABLE pets (id INT PRIMARY KEY, name TEXT, weight FLOAT, good BOOLEAN)")
+	exec(`INSERT INTO pets VALUES (1, 'Rex', 12.5, TRUE), (2, 'Bob, Jr.', NULL, FALSE), (3, 'say "hi"', 3, NULL), (4, '', 1, TRUE)`)
+
+	// Export, quoting what needs it and leaving NULL empty.
+	result := exec("COPY pets TO '" + path("pets.csv") + "' WITH (HEADER)")
+	if result.RowsAffected() != 4 {
+		t.Errorf("Expected 4 rows copied, got %d", result.RowsAffected())
+	}
+	expected := "id,name,weight,good\n1,Rex,12.5,true\n2,\"Bob, Jr.\",,false\n3,\"say \"\"hi\"\"\",3,\n4,\"\",1,true\n"
+	if content := readFile("pets.csv"); content != expected {
+		t.Errorf("Expected file:\n%s\ngot:\n%s", expected, content)
+	}
+	exec("COPY (SELECT name, id * 10 AS tens FROM pets WHERE id < 3 ORDER BY id DESC) TO '" + path("query.csv") + "' WITH (HEADER true, DELIMITER '|', NULL 'NA')")
+	if content := readFile("query.csv"); content != "name|tens\nBob, Jr.|20\nRex|10\n" {
+		t.Errorf("Unexpected query export:\n%s", content)
+	}
+
+	// Import it back: fields take the column types, and only an unquoted
+	// empty field is NULL.
+	exec("CREATE TABLE copies (id INT PRIMARY KEY, name TEXT, weight FLOAT, good BOOLEAN)")
+	result = exec("COPY copies FROM '" + path("pets.csv") + "' WITH (HEADER)")
+	if result.RowsAffected() != 4 || len(result.Notices()) != 0 {
+		t.Errorf("Expected 4 rows copied without notices, got %d and %v", result.RowsAffected(), result.Notices())
+	}
+	if got, want := rows("SELECT * FROM copies ORDER BY id"), rows("SELECT * FROM pets ORDER BY id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v after the round trip, got %v", want, got)
+	}
+
+	// A column list, another delimiter and NULL marker, CRLF line ends and a
+	// quoted line break.
+	exec("CREATE TABLE notes (id INT, body TEXT, score INT)")
+	writeFile("notes.txt", "7;NA\r\n8;\"two\nlines\"\r\n\r\n9;\"NA\"\r\n")
+	exec("COPY notes (id, body) FROM '" + path("notes.txt") + "' WITH (DELIMITER ';', NULL 'NA', HEADER false)")
+	expectedRows := [][]interface{}{{int64(7), nil, nil}, {int64(8), "two\nlines", nil}, {int64(9), "NA", nil}}
+	if got := rows("SELECT id, body, score FROM notes ORDER BY id"); !reflect.DeepEqual(got, expectedRows) {
+		t.Errorf("Expected %v, got %v", expectedRows, got)
+	}
+
+	// A bad row fails the COPY with its line, and nothing is inserted.
+	exec("CREATE TABLE scores (id INT PRIMARY KEY, score INT)")
+	writeFile("scores.csv", "id,score\n1,10\n2,ten\n3,30\n1,40\n4\n")
+	_, err := executor.Exec("COPY scores FROM '" + path("scores.csv") + "' WITH (HEADER)")
+	if err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "column 'score'") {
+		t.Errorf("Expected an error on line 3, got %v", err)
+	}
+	if got := rows("SELECT COUNT(*) FROM scores"); got[0][0] != int64(0) {
+		t.Errorf("Expected no rows after the failed COPY, got %v", got[0][0])
+	}
+
+	// With ON_ERROR skip the bad rows are reported and the rest inserted,
+	// including rows that break a unique key.
+	result = exec("COPY scores FROM '" + path("scores.csv") + "' WITH (HEADER, ON_ERROR skip)")
+	if result.RowsAffected() != 2 {
+		t.Errorf("Expected 2 rows copied, got %d", result.RowsAffected())
+	}
+	notices := result.Notices()
+	if len(notices) != 4 || !strings.HasPrefix(notices[0], "skipped line 3:") || !strings.HasPrefix(notices[1], "skipped line 6:") ||
+		!strings.HasPrefix(notices[2], "skipped line 5:") || notices[3] != "3 rows were skipped" {
+		t.Errorf("Unexpected notices %q", notices)
+	}
+	if got := rows("SELECT id, score FROM scores ORDER BY id"); !reflect.DeepEqual(got, [][]interface{}{{int64(1), int64(10)}, {int64(3), int64(30)}}) {
+		t.Errorf("Unexpected rows %v", got)
+	}
+
+	// Rows that clash with existing ones fail the COPY too.
+	writeFile("more.csv", "5,50\n3,31\n")
+	if _, err := executor.Exec("COPY scores FROM '" + path("more.csv") + "'"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected a duplicate key error on line 2, got %v", err)
+	}
+
+	writeFile("broken.csv", "1,\"open\n")
+	if _, err := executor.Exec("COPY scores FROM '" + path("broken.csv") + "'"); err == nil || !strings.Contains(err.Error(), "unterminated quoted field") {
+		t.Errorf("Expected an unterminated quote error, got %v", err)
+	}
+	if _, err := executor.Exec("COPY scores FROM '" + path("missing.csv") + "'"); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+	if _, err := executor.Exec("COPY scores (id, nope) FROM '" + path("more.csv") + "'"); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("Expected an unknown column error, got %v", err)
+	}
+
+	for _, sql := range []string{
+		"COPY scores FROM 'x.csv' WITH (DELIMITER ',,')",
+		"COPY scores FROM 'x.csv' WITH (FORMAT binary)",
+		"COPY scores FROM 'x.csv' WITH (ON_ERROR maybe)",
+		"COPY scores FROM 'x.csv' WITH (COLOR 'red')",
+		"COPY (SELECT * FROM scores) FROM 'x.csv'",
+		"COPY scores FROM x.csv",
+	} {
+		if _, err := executor.Exec(sql); err == nil {
+			t.Errorf("Expected %q to fail", sql)
+		}
+	}
+}
+
+func TestExecutorCopyJSON(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+	dir := t.TempDir()
+
+	exec := func(sql string) *query.ResultSet {
+		t.Helper()
+		result, err := executor.Exec(sql)
+		if err != nil {
+			t.Fatalf("Exec %q failed: %v", sql, err)
+		}
+		return result
+	}
+	path := func(name string) string {
+		return filepath.ToSlash(filepath.Join(dir, name))
+	}
+	readFile := func(name string) string {
+		t.Helper()
+		content, err := os.ReadFile(path(name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		return string(content)
+	}
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(path(name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	// The table is created with columns inferred from the first objects;
+	// a later object with another key is rejected.
+	writeFile("events.ndjson", `{"id": 1, "kind": "click", "ms": 12, "tags": ["a"], "ok": true}
+{"id": 2, "kind": "view", "ms": 3.5, "ok": false, "extra": null}
+
+{"id": 3, "kind": "click", "ms": null, "user": {"name": "x<y"}}
+not json
+[1, 2]
+{"id": 4, "color": "red"}
+`)
+	result := exec("COPY events FROM '" + path("events.ndjson") + "' WITH (FORMAT ndjson, CREATE_TABLE, SAMPLE 2, ON_ERROR skip)")
+	if result.RowsAffected() != 2 {
+		t.Errorf("Expected 2 rows copied, got %d", result.RowsAffected())
+	}
+	notices := result.Notices()
+	if len(notices) != 5 || !strings.HasPrefix(notices[0], "skipped line 5: invalid JSON") ||
+		notices[1] != "skipped line 6: expected a JSON object, got an array" ||
+		!strings.HasPrefix(notices[2], "skipped line 4: column 'user' not found") ||
+		!strings.HasPrefix(notices[3], "skipped line 7: column 'color' not found") {
+		t.Errorf("Unexpected notices %q", notices)
+	}
+	columns := exec("SELECT * FROM events").Columns()
+	expectedColumns := []query.Column{
+		{Name: "id", Type: data.TypeInt}, {Name: "kind", Type: data.TypeText}, {Name: "ms", Type: data.TypeFloat},
+		{Name: "tags", Type: data.TypeText}, {Name: "ok", Type: data.TypeBool}, {Name: "extra", Type: data.TypeText},
+	}
+	if !reflect.DeepEqual(columns, expectedColumns) {
+		t.Errorf("Expected inferred columns %v, got %v", expectedColumns, columns)
+	}
+
+	// Export a query as a JSON array and as NDJSON.
+	exec("COPY (SELECT id, kind, ms, tags, ok FROM events ORDER BY id) TO '" + path("events.json") + "' WITH (FORMAT json)")
+	expected := `[
+{"id":1,"kind":"click","ms":12,"tags":"[\"a\"]","ok":true},
+{"id":2,"kind":"view","ms":3.5,"tags":null,"ok":false}
+]
+`
+	if content := readFile("events.json"); content != expected {
+		t.Errorf("Expected file:\n%s\ngot:\n%s", expected, content)
+	}
+	exec("COPY events (id, kind) TO '" + path("kinds.ndjson") + "' WITH (FORMAT ndjson)")
+	if content := readFile("kinds.ndjson"); content != "{\"id\":1,\"kind\":\"click\"}\n{\"id\":2,\"kind\":\"view\"}\n" {
+		t.Errorf("Unexpected NDJSON export:\n%s", content)
+	}
+
+	// A JSON array loads into an existing table; a column list picks keys
+	// and ignores the others.
+	exec("CREATE TABLE copies (id INT PRIMARY KEY, kind TEXT, ms FLOAT, tags TEXT, ok BOOLEAN)")
+	if result := exec("COPY copies FROM '" + path("events.json") + "' WITH (FORMAT json)"); result.RowsAffected() != 2 {
+		t.Errorf("Expected 2 rows copied, got %d", result.RowsAffected())
+	}
+	exec("CREATE TABLE kinds (kind TEXT)")
+	exec("COPY kinds (kind) FROM '" + path("events.json") + "' WITH (FORMAT json)")
+	if result := exec("SELECT COUNT(*) FROM kinds WHERE kind = 'view'"); !result.Next() || result.Values()[0] != int64(1) {
+		t.Errorf("Expected the kinds to be copied")
+	}
+
+	// Without ON_ERROR skip a bad object fails the COPY, and a created
+	// table is not left behind.
+	_, err := executor.Exec("COPY broken FROM '" + path("events.ndjson") + "' WITH (FORMAT ndjson, CREATE_TABLE)")
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Errorf("Expected an error on line 5, got %v", err)
+	}
+	if _, err := executor.Exec("SELECT * FROM broken"); err == nil {
+		t.Errorf("Expected the table not to be created")
+	}
+	writeFile("bad.json", `{"id": 1}`)
+	if _, err := executor.Exec("COPY copies FROM '" + path("bad.json") + "' WITH (FORMAT json)"); err == nil || !strings.Contains(err.Error(), "expected a JSON array") {
+		t.Errorf("Expected an error for an object instead of an array, got %v", err)
+	}
+
+	// The Go API: load from a reader and write results.
+	_, err = executor.CopyFrom(context.Background(), "copies", strings.NewReader(`{"id": 5, "kind": "tap", "ms": 1}`), query.CopyOptions{Format: "ndjson"})
+	if err != nil {
+		t.Fatalf("CopyFrom failed: %v", err)
+	}
+	rs := exec("SELECT id, kind FROM copies WHERE id > 1 ORDER BY id")
+	var buf bytes.Buffer
+	if err := rs.WriteJSON(&buf); err != nil || buf.String() != "[\n{\"id\":2,\"kind\":\"view\"},\n{\"id\":5,\"kind\":\"tap\"}\n]\n" {
+		t.Errorf("Unexpected WriteJSON output %q (%v)", buf.String(), err)
+	}
+	buf.Reset()
+	if err := rs.WriteNDJSON(&buf); err != nil || buf.String() != "{\"id\":2,\"kind\":\"view\"}\n{\"id\":5,\"kind\":\"tap\"}\n" {
+		t.Errorf("Unexpected WriteNDJSON output %q (%v)", buf.String(), err)
+	}
+	buf.Reset()
+	if err := exec("SELECT id FROM copies WHERE id > 10").WriteJSON(&buf); err != nil || buf.String() != "[]\n" {
+		t.Errorf("Unexpected WriteJSON output for no rows %q (%v)", buf.String(), err)
+	}
+
+	db := engine.NewDatabase()
+	session := db.Session()
+	defer session.Close()
+	result, err = session.CopyFrom(context.Background(), "logs", strings.NewReader("{\"level\": \"info\"}\n{\"level\": \"warn\"}\n"), query.CopyOptions{Format: "ndjson", CreateTable: true})
+	if err != nil || result.RowsAffected() != 2 {
+		t.Fatalf("Session.CopyFrom failed: %v", err)
+	}
+	if info, err := db.DescribeTable("logs"); err != nil || info.Rows != 2 || info.Columns[0].Type != data.TypeText {
+		t.Errorf("Unexpected table %+v (%v)", info, err)
+	}
+	// Columns keep the order of the keys, not their alphabetical one.
+	_, err = session.CopyFrom(context.Background(), "people", strings.NewReader(`[{"name": "ann", "id": 1}, {"id": 2, "name": "bo", "age": 30}]`), query.CopyOptions{Format: "json", CreateTable: true})
+	if err != nil {
+		t.Fatalf("Session.CopyFrom failed: %v", err)
+	}
+	p, _ := session.Prepare("SELECT * FROM people ORDER BY id")
+	rs, err = session.Run(context.Background(), p)
+	if err != nil {
+		t.Fatalf("SELECT failed: %v", err)
+	}
+	if names := rs.Columns(); len(names) != 3 || names[0].Name != "name" || names[1].Name != "id" || names[2].Name != "age" {
+		t.Errorf("Expected columns name, id, age, got %v", names)
+	}
+	if !rs.Next() || rs.Values()[0] != "ann" {
+		t.Errorf("Expected ann first, got %v", rs.Values())
+	}
+
+	for _, sql := range []string{
+		"COPY events FROM 'x.json' WITH (FORMAT json, HEADER)",
+		"COPY events FROM 'x.json' WITH (FORMAT ndjson, DELIMITER ';')",
+		"COPY events FROM 'x.csv' WITH (CREATE_TABLE)",
+		"COPY events TO 'x.json' WITH (FORMAT json, CREATE_TABLE)",
+		"COPY events FROM 'x.json' WITH (FORMAT xml)",
+		"COPY events FROM 'x.json' WITH (FORMAT ndjson, SAMPLE -1)",
+	} {
+		if _, err := executor.Exec(sql); err == nil {
+			t.Errorf("Expected %q to fail", sql)
+		}
+	}
+}
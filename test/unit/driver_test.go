@@ -0,0 +1,203 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/H3199/doggodb/driver"
+)
+
+// databases counts the named databases the tests open.
+var databases int64
+
+// databaseName returns a data source name no other test uses.
+func databaseName(t *testing.T) string {
+	return fmt.Sprintf("%s_%d", t.Name(), atomic.AddInt64(&databases, 1))
+}
+
+func TestDriver(t *testing.T) {
+	name := databaseName(t)
+	db, err := sql.Open("doggodb", name)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE accounts (id INT PRIMARY KEY, owner TEXT, balance FLOAT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	result, err := db.Exec("INSERT INTO accounts VALUES (1, 'ann', 100), (2, 'bob', 50.5)")
+	if err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n != 2 {
+		t.Errorf("Expected 2 rows affected, got %d", n)
+	}
+	if id, _ := result.LastInsertId(); id != 2 {
+		t.Errorf("Expected last insert id 2, got %d", id)
+	}
+
+	rows, err := db.Query("SELECT owner, balance FROM accounts ORDER BY id")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	columns, _ := rows.Columns()
+	types, _ := rows.ColumnTypes()
+	if len(columns) != 2 || columns[0] != "owner" || types[1].DatabaseTypeName() != "FLOAT" {
+		t.Errorf("Unexpected columns %v", columns)
+	}
+	var owners []string
+	var total float64
+	for rows.Next() {
+		var owner string
+		var balance float64
+		if err := rows.Scan(&owner, &balance); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		owners = append(owners, owner)
+		total += balance
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Rows failed: %v", err)
+	}
+	rows.Close()
+	if len(owners) != 2 || owners[0] != "ann" || total != 150.5 {
+		t.Errorf("Unexpected rows %v, total %v", owners, total)
+	}
+
+	// A rolled back transaction leaves no trace; a committed one stays.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE accounts SET balance = 0"); err != nil {
+		t.Fatalf("UPDATE failed: %v", err)
+	}
+	if _, err := tx.Exec("CREATE TABLE scratch (id INT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	var balance float64
+	if err := tx.QueryRow("SELECT balance FROM accounts WHERE id = 1").Scan(&balance); err != nil || balance != 0 {
+		t.Errorf("Expected the transaction to see its update, got %v, %v", balance, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if err := db.QueryRow("SELECT balance FROM accounts WHERE id = 1").Scan(&balance); err != nil || balance != 100 {
+		t.Errorf("Expected the update to be rolled back, got %v, %v", balance, err)
+	}
+	if _, err := db.Exec("SELECT * FROM scratch"); err == nil {
+		t.Errorf("Expected the created table to be rolled back")
+	}
+
+	tx, _ = db.BeginTx(context.Background(), nil)
+	tx.Exec("DELETE FROM accounts WHERE id = 2")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Errorf("Expected an error committing twice")
+	}
+
+	// Other handles on the same name share the database.
+	other, _ := sql.Open("doggodb", name)
+	defer other.Close()
+	var count int
+	if err := other.QueryRow("SELECT COUNT(*) FROM accounts").Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected 1 account, got %d, %v", count, err)
+	}
+	private, _ := sql.Open("doggodb", "")
+	defer private.Close()
+	if _, err := private.Exec("SELECT * FROM accounts"); err == nil {
+		t.Errorf("Expected an unnamed database to start empty")
+	}
+
+	ro, _ := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if _, err := ro.Exec("DELETE FROM accounts"); err == nil {
+		t.Errorf("Expected an error writing in a read-only transaction")
+	}
+	ro.Rollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.QueryContext(ctx, "SELECT * FROM accounts"); err == nil {
+		t.Errorf("Expected an error for a cancelled context")
+	}
+
+	// Waiting for another connection's transaction ends at the deadline.
+	tx, _ = db.Begin()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = other.QueryContext(ctx, "SELECT * FROM accounts")
+	if !errors.Is(err, context.DeadlineExceeded) || err.Error() != "canceling statement due to deadline" || time.Since(start) > time.Second {
+		t.Errorf("Expected the query to stop waiting at its deadline, got %v after %v", err, time.Since(start))
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := other.BeginTx(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected BEGIN to stop waiting at its deadline, got %v", err)
+	}
+	tx.Rollback()
+	if _, err := db.Exec("SELEC 1"); err == nil {
+		t.Errorf("Expected a syntax error")
+	}
+}
+
+func TestDriverParameters(t *testing.T) {
+	db, err := sql.Open("doggodb", "")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	db.Exec("CREATE TABLE notes (id INT PRIMARY KEY, body TEXT)")
+	insert, err := db.Prepare("INSERT INTO notes VALUES ($1, $2)")
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	defer insert.Close()
+	for i, body := range []string{"first", "it's second"} {
+		if _, err := insert.Exec(i+1, body); err != nil {
+			t.Fatalf("Exec failed: %v", err)
+		}
+	}
+	var body string
+	if err := db.QueryRow("SELECT body FROM notes WHERE id = ?", 2).Scan(&body); err != nil || body != "it's second" {
+		t.Errorf("Expected it's second, got %q, %v", body, err)
+	}
+	if _, err := insert.Exec(3); err == nil {
+		t.Errorf("Expected an error for a missing argument")
+	}
+	// There is no time type to bring a time.Time back as.
+	if _, err := insert.Exec(3, time.Now()); err == nil || !strings.Contains(err.Error(), "time.Time is not supported") {
+		t.Errorf("Expected time.Time to be refused, got %v", err)
+	}
+}
+
+func TestDriverRelease(t *testing.T) {
+	name := databaseName(t)
+	first, _ := sql.Open("doggodb", name)
+	second, _ := sql.Open("doggodb", name)
+	if _, err := first.Exec("CREATE TABLE pets (id INT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+
+	// The database lives while a handle on its name is open.
+	first.Close()
+	if _, err := second.Exec("INSERT INTO pets VALUES (1)"); err != nil {
+		t.Errorf("Expected the database to outlive the first handle: %v", err)
+	}
+	second.Close()
+	again, _ := sql.Open("doggodb", name)
+	defer again.Close()
+	if _, err := again.Exec("SELECT * FROM pets"); err == nil {
+		t.Errorf("Expected the database to be dropped with its last handle")
+	}
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+func TestDumpRestore(t *testing.T) {
+	db := engine.NewDatabase()
+	executor := db.Executor()
+	for _, sql := range []string{
+		"CREATE TABLE pets (id INT PRIMARY KEY, name TEXT NOT NULL, weight FLOAT, good BOOLEAN, tag ANY)",
+		"CREATE UNIQUE INDEX pets_name ON pets (name)",
+		"CREATE INDEX pets_weight_good ON pets (weight, good)",
+		"CREATE TABLE owners (pet INT, name TEXT, PRIMARY KEY (pet, name))",
+		"CREATE TABLE notes ()",
+		`INSERT INTO pets VALUES (1, 'Rex', 12, TRUE, 3.0), (2, 'it''s; -- not a comment', -0.5, NULL, 'x'), (3, 'Bob', 1e21, FALSE, NULL)`,
+		"INSERT INTO owners VALUES (1, 'Ann'), (1, 'Bo'), (3, 'Cy')",
+		"INSERT INTO notes (a, b) VALUES (1, 'one')",
+		"INSERT INTO notes (a) VALUES (2.5)",
+	} {
+		if _, err := executor.Exec(sql); err != nil {
+			t.Fatalf("Exec %q failed: %v", sql, err)
+		}
+	}
+
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	expected := `-- doggodb dump
+
+CREATE TABLE notes ();
+CREATE TABLE owners (pet INT NOT NULL, name TEXT NOT NULL, PRIMARY KEY (pet, name));
+CREATE TABLE pets (id INT NOT NULL, name TEXT NOT NULL, weight FLOAT, good BOOL, tag ANY, PRIMARY KEY (id));
+
+INSERT INTO notes (a, b) VALUES (1, 'one');
+INSERT INTO notes (a) VALUES (2.5);
+INSERT INTO owners (pet, name) VALUES (1, 'Ann'), (1, 'Bo'), (3, 'Cy');
+INSERT INTO pets (id, name, weight, good, tag) VALUES (1, 'Rex', 12.0, TRUE, 3.0), (2, 'it''s; -- not a comment', -0.5, NULL, 'x'), (3, 'Bob', 1000000000000000000000.0, FALSE, NULL);
+
+CREATE UNIQUE INDEX pets_name ON pets (name);
+CREATE INDEX pets_weight_good ON pets (weight, good);
+`
+	if dump.String() != expected {
+		t.Errorf("Expected dump:\n%s\ngot:\n%s", expected, dump.String())
+	}
+
+	// Restoring into an empty database gives the same dump back.
+	restored := engine.NewDatabase()
+	if err := restored.Restore(context.Background(), strings.NewReader(dump.String())); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	var again bytes.Buffer
+	if err := restored.Dump(&again); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	if again.String() != dump.String() {
+		t.Errorf("Expected the restored database to dump the same, got:\n%s", again.String())
+	}
+	rows := func(db *engine.Database, sql string) [][]interface{} {
+		t.Helper()
+		rs, err := db.Executor().Query(sql)
+		if err != nil {
+			t.Fatalf("Query %q failed: %v", sql, err)
+		}
+		var result [][]interface{}
+		for rs.Next() {
+			result = append(result, rs.Values())
+		}
+		return result
+	}
+	for _, sql := range []string{"SELECT * FROM pets ORDER BY id", "SELECT a, b FROM notes ORDER BY a"} {
+		if got, want := rows(restored, sql), rows(db, sql); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v for %q, got %v", want, sql, got)
+		}
+	}
+	info, _ := restored.DescribeTable("pets")
+	if len(info.Indexes) != 3 || info.Indexes[1].Name != "pets_name" || !info.Indexes[1].Unique {
+		t.Errorf("Unexpected indexes %+v", info.Indexes)
+	}
+
+	// A failing restore changes nothing.
+	err := restored.Restore(context.Background(), strings.NewReader("CREATE TABLE extra (id INT);\nINSERT INTO pets VALUES (1, 'Dup', 1, TRUE, NULL);"))
+	if err == nil || !strings.Contains(err.Error(), "statement 2") {
+		t.Errorf("Expected the second statement to fail, got %v", err)
+	}
+	if names := restored.TableNames(); len(names) != 3 {
+		t.Errorf("Expected the failed restore to be rolled back, got tables %v", names)
+	}
+
+	// Untyped values keep their types through a dump and a restore.
+	untyped := engine.NewDatabase()
+	for _, sql := range []string{
+		"CREATE TABLE mixed (id INT PRIMARY KEY, v ANY)",
+		"INSERT INTO mixed VALUES (1, 3.0), (2, -9223372036854775808), (3, TRUE), (4, 9223372036854775807), (5, -2.5), (6, '3')",
+	} {
+		if _, err := untyped.Executor().Exec(sql); err != nil {
+			t.Fatalf("Exec %q failed: %v", sql, err)
+		}
+	}
+	var first, second bytes.Buffer
+	untyped.Dump(&first)
+	reloaded := engine.NewDatabase()
+	if err := reloaded.Restore(context.Background(), strings.NewReader(first.String())); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	reloaded.Dump(&second)
+	if second.String() != first.String() {
+		t.Errorf("Expected the same dump after a restore, got:\n%s\nthen:\n%s", first.String(), second.String())
+	}
+	want := [][]interface{}{{int64(1), 3.0}, {int64(2), int64(math.MinInt64)}, {int64(3), true}, {int64(4), int64(math.MaxInt64)}, {int64(5), -2.5}, {int64(6), "3"}}
+	if got := rows(reloaded, "SELECT * FROM mixed ORDER BY id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	statements := query.SplitStatements("SELECT 'a;b' -- one; two\n; ;\nSELECT 2;")
+	if !reflect.DeepEqual(statements, []string{"SELECT 'a;b'", "SELECT 2"}) {
+		t.Errorf("Unexpected statements %q", statements)
+	}
+}
@@ -1,7 +1,16 @@
 package test
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/H3199/doggodb/internal/data"
 	"github.com/H3199/doggodb/internal/query"
@@ -142,3 +151,1473 @@ func TestExecutorSelect(t *testing.T) {
 		}
 	}
 }
+
+// run tokenizes, parses and executes a query, failing the test on error.
+func run(t *testing.T, executor *query.Executor, sql string) interface{} {
+	t.Helper()
+	tokens, err := query.Tokenize(sql)
+	if err != nil {
+		t.Fatalf("Tokenize %q failed: %v", sql, err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parse %q failed: %v", sql, err)
+	}
+	result, err := executor.Execute(stmt)
+	if err != nil {
+		t.Fatalf("Execute %q failed: %v", sql, err)
+	}
+	return result
+}
+
+func TestExecutorBulkInsert(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT, name TEXT)")
+	result := run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (2, 'Bob'), (3, NULL) RETURNING id, name")
+
+	returned, ok := result.([]*data.Row)
+	if !ok {
+		t.Fatalf("Expected result to be []*data.Row, got %T", result)
+	}
+	if len(returned) != 3 {
+		t.Fatalf("Expected 3 returned rows, got %d", len(returned))
+	}
+	if id, _ := returned[1].GetValue("id"); id != int64(2) {
+		t.Errorf("Expected id 2 converted to INT, got %v (%T)", id, id)
+	}
+	if name, _ := returned[2].GetValue("name"); name != nil {
+		t.Errorf("Expected NULL name, got %v", name)
+	}
+
+	// A bad row rejects the whole statement.
+	tokens, _ := query.Tokenize("INSERT INTO users VALUES (4, 'Dan'), ('five', 'Eve')")
+	stmt, _ := query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Fatalf("Expected error inserting a non-integer id")
+	}
+	table, _ := storage.GetTable("users")
+	if len(table.Rows) != 3 {
+		t.Errorf("Expected 3 rows after failed insert, got %d", len(table.Rows))
+	}
+
+	// Values are expressions, and numbers and booleans keep their type in
+	// untyped columns.
+	run(t, executor, "CREATE TABLE things (id INT, label TEXT, tag ANY)")
+	run(t, executor, "INSERT INTO things VALUES (1 + 1, 'x' || 'y', LOWER('X')), ((SELECT MAX(id) FROM users) * 10, CAST(7 AS TEXT), TRUE), (-3, NULL, 3), (4, NULL, -9223372036854775808), (5, NULL, 2.5)")
+	result = run(t, executor, "SELECT id, label, tag FROM things ORDER BY id")
+	var got []string
+	for _, row := range result.([]*data.Row) {
+		id, _ := row.GetValue("id")
+		label, _ := row.GetValue("label")
+		tag, _ := row.GetValue("tag")
+		got = append(got, fmt.Sprintf("%v %v %v %T", id, label, tag, tag))
+	}
+	expected := []string{"-3 <nil> 3 int64", "2 xy x string", "4 <nil> -9223372036854775808 int64", "5 <nil> 2.5 float64", "30 7 true bool"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	// Untyped values compare as numbers, not as text.
+	result = run(t, executor, "SELECT id FROM things WHERE tag > 2 AND tag < 9")
+	if rows := result.([]*data.Row); len(rows) != 2 {
+		t.Errorf("Expected 2 tags between 2 and 9, got %d", len(rows))
+	}
+	tokens, _ = query.Tokenize("INSERT INTO things VALUES (id, 'x', 1)")
+	stmt, _ = query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Errorf("Expected an error for a column in VALUES")
+	}
+}
+
+func TestExecutorInsertSelect(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT, name TEXT)")
+	run(t, executor, "CREATE TABLE archive (id INT, name TEXT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (20, 'Bob'), (30, 'Carol')")
+
+	result := run(t, executor, "INSERT INTO archive SELECT * FROM users WHERE id > 10 RETURNING name")
+	if returned := result.([]*data.Row); len(returned) != 2 {
+		t.Fatalf("Expected 2 returned rows, got %d", len(returned))
+	}
+
+	archive, _ := storage.GetTable("archive")
+	if len(archive.Rows) != 2 {
+		t.Fatalf("Expected 2 archived rows, got %d", len(archive.Rows))
+	}
+	if name, _ := archive.Rows[0].GetValue("name"); name != "Bob" {
+		t.Errorf("Expected 'Bob', got %v", name)
+	}
+}
+
+func TestExecutorUpdateDeleteReturning(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT, name TEXT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (2, 'Bob')")
+
+	result := run(t, executor, "UPDATE users SET name = 'Bobby' WHERE id = 2 RETURNING *")
+	updated := result.([]*data.Row)
+	if len(updated) != 1 {
+		t.Fatalf("Expected 1 updated row, got %d", len(updated))
+	}
+	if name, _ := updated[0].GetValue("name"); name != "Bobby" {
+		t.Errorf("Expected 'Bobby', got %v", name)
+	}
+
+	if result := run(t, executor, "DELETE FROM users WHERE id = 1"); result != nil {
+		t.Errorf("Expected nil result without RETURNING, got %v", result)
+	}
+
+	result = run(t, executor, "DELETE FROM users RETURNING id")
+	deleted := result.([]*data.Row)
+	if len(deleted) != 1 {
+		t.Fatalf("Expected 1 deleted row, got %d", len(deleted))
+	}
+	if id, _ := deleted[0].GetValue("id"); id != int64(2) {
+		t.Errorf("Expected id 2, got %v", id)
+	}
+}
+
+func TestExecutorUpsert(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT PRIMARY KEY, email TEXT UNIQUE, visits INT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'alice@example.com', 1), (2, 'bob@example.com', 1)")
+
+	// Plain inserts may not break the primary key.
+	tokens, _ := query.Tokenize("INSERT INTO users VALUES (1, 'other@example.com', 1)")
+	stmt, _ := query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Fatalf("Expected duplicate key error")
+	}
+
+	// DO NOTHING skips the conflicting row but inserts the other one.
+	result := run(t, executor, "INSERT INTO users VALUES (1, 'alice@example.com', 5), (3, 'carol@example.com', 1) ON CONFLICT DO NOTHING RETURNING id")
+	if affected := result.([]*data.Row); len(affected) != 1 {
+		t.Fatalf("Expected 1 affected row, got %d", len(affected))
+	}
+
+	// DO UPDATE rewrites the existing row with values from excluded.
+	run(t, executor, "INSERT INTO users VALUES (2, 'bobby@example.com', 7) ON CONFLICT (id) DO UPDATE SET email = excluded.email, visits = excluded.visits")
+
+	table, _ := storage.GetTable("users")
+	if len(table.Rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(table.Rows))
+	}
+	result = run(t, executor, "SELECT email, visits FROM users WHERE id = 2")
+	rows := result.([]*data.Row)
+	if email, _ := rows[0].GetValue("email"); email != "bobby@example.com" {
+		t.Errorf("Expected updated email, got %v", email)
+	}
+	if visits, _ := rows[0].GetValue("visits"); visits != int64(7) {
+		t.Errorf("Expected 7 visits, got %v", visits)
+	}
+
+	// An update that collides with another unique key fails as a whole.
+	tokens, _ = query.Tokenize("INSERT INTO users VALUES (3, 'alice@example.com', 1) ON CONFLICT (id) DO UPDATE SET email = excluded.email")
+	stmt, _ = query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Fatalf("Expected unique violation on email")
+	}
+
+	// A row may not be changed twice by one statement, whether it was
+	// inserted or updated first; the statement is undone as a whole.
+	for _, sql := range []string{
+		"INSERT INTO users VALUES (4, 'dan@example.com', 1), (4, 'dan@example.org', 2) ON CONFLICT (id) DO UPDATE SET visits = users.visits + excluded.visits",
+		"INSERT INTO users VALUES (1, 'alice@example.com', 1), (1, 'alice@example.com', 1) ON CONFLICT (id) DO UPDATE SET visits = users.visits + 1",
+	} {
+		tokens, _ = query.Tokenize(sql)
+		stmt, _ = query.Parse(tokens)
+		_, err := executor.Execute(stmt)
+		if err == nil || !strings.Contains(err.Error(), "cannot affect row a second time") {
+			t.Errorf("Expected an error for a row changed twice, got %v", err)
+		}
+	}
+	result = run(t, executor, "SELECT id, visits FROM users WHERE id IN (1, 4)")
+	if rows := result.([]*data.Row); len(rows) != 1 {
+		t.Errorf("Expected the failed statements to leave 1 row, got %d", len(rows))
+	} else if visits, _ := rows[0].GetValue("visits"); visits != int64(1) {
+		t.Errorf("Expected alice to keep 1 visit, got %v", visits)
+	}
+	// DO NOTHING skips the second copy instead.
+	result = run(t, executor, "INSERT INTO users VALUES (4, 'dan@example.com', 1), (4, 'dan@example.org', 2) ON CONFLICT DO NOTHING RETURNING id")
+	if affected := result.([]*data.Row); len(affected) != 1 {
+		t.Errorf("Expected 1 row inserted, got %d", len(affected))
+	}
+
+	// The conflict target has to match a unique constraint.
+	tokens, _ = query.Tokenize("INSERT INTO users VALUES (5, 'dan@example.com', 1) ON CONFLICT (visits) DO NOTHING")
+	stmt, _ = query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Fatalf("Expected error for conflict target without unique index")
+	}
+}
+
+func TestExecutorJoins(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT PRIMARY KEY, name TEXT)")
+	run(t, executor, "CREATE TABLE orders (id INT, user_id INT, total INT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (2, 'Bob'), (3, 'Carol')")
+	run(t, executor, "INSERT INTO orders VALUES (10, 1, 5), (11, 1, 7), (12, 2, 3)")
+
+	result := run(t, executor, "SELECT u.name, o.total FROM users u JOIN orders o ON o.user_id = u.id WHERE o.total > 4 ORDER BY o.total DESC")
+	rows := result.([]*data.Row)
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	if total, _ := rows[0].GetValue("total"); total != int64(7) {
+		t.Errorf("Expected largest total first, got %v", total)
+	}
+
+	// LEFT JOIN keeps users without orders, padded with NULLs.
+	result = run(t, executor, "SELECT users.name, orders.id FROM users LEFT JOIN orders ON users.id = orders.user_id ORDER BY users.name")
+	rows = result.([]*data.Row)
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 rows, got %d", len(rows))
+	}
+	if name, _ := rows[3].GetValue("name"); name != "Carol" {
+		t.Errorf("Expected Carol last, got %v", name)
+	}
+	if id, _ := rows[3].GetValue("id"); id != nil {
+		t.Errorf("Expected NULL order id for Carol, got %v", id)
+	}
+
+	// Columns sharing a name are qualified with their table.
+	result = run(t, executor, "SELECT * FROM users CROSS JOIN orders")
+	rows = result.([]*data.Row)
+	if len(rows) != 9 {
+		t.Fatalf("Expected 9 rows, got %d", len(rows))
+	}
+	if _, err := rows[0].GetValue("orders.id"); err != nil {
+		t.Errorf("Expected qualified column orders.id: %v", err)
+	}
+}
+
+func TestExecutorAggregates(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE orders (id INT, customer TEXT, total INT)")
+	run(t, executor, "INSERT INTO orders VALUES (1, 'alice', 5), (2, 'bob', 3), (3, 'alice', 7), (4, 'carol', NULL)")
+
+	result := run(t, executor, "SELECT customer, COUNT(*), SUM(total) FROM orders GROUP BY customer HAVING COUNT(*) > 1")
+	rows := result.([]*data.Row)
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 group, got %d", len(rows))
+	}
+	if count, _ := rows[0].GetValue("count"); count != int64(2) {
+		t.Errorf("Expected count 2, got %v", count)
+	}
+	if sum, _ := rows[0].GetValue("sum"); sum != int64(12) {
+		t.Errorf("Expected sum 12, got %v", sum)
+	}
+
+	// Aggregates without GROUP BY form a single group, even over no rows.
+	result = run(t, executor, "SELECT COUNT(total), MAX(total) FROM orders WHERE id > 10")
+	rows = result.([]*data.Row)
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 row, got %d", len(rows))
+	}
+	if count, _ := rows[0].GetValue("count"); count != int64(0) {
+		t.Errorf("Expected count 0, got %v", count)
+	}
+	if max, _ := rows[0].GetValue("max"); max != nil {
+		t.Errorf("Expected NULL max, got %v", max)
+	}
+
+	// Ungrouped columns are rejected.
+	tokens, _ := query.Tokenize("SELECT id, COUNT(*) FROM orders GROUP BY customer")
+	stmt, _ := query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Fatalf("Expected grouping error")
+	}
+}
+
+func TestExecutorOrderLimit(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE items (id INT PRIMARY KEY, price FLOAT)")
+	run(t, executor, "INSERT INTO items VALUES (1, 9.5), (2, 1.25), (3, NULL), (4, 4)")
+
+	result := run(t, executor, "SELECT id, price * 2 FROM items ORDER BY price LIMIT 2 OFFSET 1")
+	rows := result.([]*data.Row)
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	if id, _ := rows[0].GetValue("id"); id != int64(4) {
+		t.Errorf("Expected id 4 first, got %v", id)
+	}
+	if doubled, _ := rows[1].GetValue("?column?"); doubled != 19.0 {
+		t.Errorf("Expected 19, got %v", doubled)
+	}
+
+	// Equality on the primary key reads through the index.
+	result = run(t, executor, "SELECT price FROM items WHERE id = 2")
+	rows = result.([]*data.Row)
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 row, got %d", len(rows))
+	}
+	if price, _ := rows[0].GetValue("price"); price != 1.25 {
+		t.Errorf("Expected 1.25, got %v", price)
+	}
+}
+
+// explain runs an EXPLAIN statement and returns its plan lines.
+func explain(t *testing.T, executor *query.Executor, sql string) []string {
+	t.Helper()
+	var lines []string
+	for _, row := range run(t, executor, sql).([]*data.Row) {
+		line, _ := row.GetValue("QUERY PLAN")
+		lines = append(lines, line.(string))
+	}
+	return lines
+}
+
+func TestExecutorExplain(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT PRIMARY KEY, name TEXT)")
+	run(t, executor, "CREATE TABLE orders (id INT, user_id INT, total INT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (2, 'Bob'), (3, 'Carol')")
+	run(t, executor, "INSERT INTO orders VALUES (10, 1, 5), (11, 1, 7), (12, 2, 3)")
+
+	lines := explain(t, executor, "EXPLAIN SELECT name FROM users WHERE id = 2")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 plan lines, got %v", lines)
+	}
+	if !strings.Contains(lines[2], "Index Scan using users_pkey on users") || !strings.Contains(lines[2], "(rows=1)") {
+		t.Errorf("Expected index scan with 1 estimated row, got %q", lines[2])
+	}
+
+	lines = explain(t, executor, "EXPLAIN SELECT u.name, o.total FROM users u JOIN orders o ON o.user_id = u.id")
+	if !strings.Contains(lines[1], "Hash INNER Join") {
+		t.Errorf("Expected a hash join, got %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "Seq Scan on users AS u  (rows=3)") {
+		t.Errorf("Expected sequential scan of users, got %q", lines[2])
+	}
+
+	// EXPLAIN ANALYZE runs the query and reports what actually happened.
+	lines = explain(t, executor, "EXPLAIN ANALYZE SELECT u.name FROM users u LEFT JOIN orders o ON o.user_id = u.id")
+	if !strings.Contains(lines[1], "actual rows=4 loops=1") {
+		t.Errorf("Expected 4 actual rows from the join, got %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "Execution Time: ") {
+		t.Errorf("Expected execution time last, got %q", lines[len(lines)-1])
+	}
+}
+
+func TestExecutorCostBasedPlans(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT PRIMARY KEY, active BOOL)")
+	run(t, executor, "CREATE INDEX users_active ON users (active)")
+	run(t, executor, "CREATE TABLE orders (id INT, user_id INT)")
+	for i := 1; i <= 40; i++ {
+		run(t, executor, fmt.Sprintf("INSERT INTO users VALUES (%d, %t)", i, i%2 == 0))
+		run(t, executor, fmt.Sprintf("INSERT INTO orders VALUES (%d, %d), (%d, %d)", 2*i, i, 2*i+1, i))
+	}
+	run(t, executor, "CREATE TABLE countries (code TEXT)")
+	run(t, executor, "INSERT INTO countries VALUES ('fi'), ('se')")
+
+	// Without statistics an equality on an indexed column looks selective.
+	lines := explain(t, executor, "EXPLAIN SELECT id FROM users WHERE active = TRUE")
+	if !strings.Contains(lines[2], "Index Scan using users_active") {
+		t.Errorf("Expected index scan before ANALYZE, got %q", lines[2])
+	}
+
+	// ANALYZE shows that half of the rows match, so a full scan is cheaper.
+	run(t, executor, "ANALYZE")
+	lines = explain(t, executor, "EXPLAIN SELECT id FROM users WHERE active = TRUE")
+	if !strings.Contains(lines[2], "Seq Scan on users  (rows=40)") || !strings.Contains(lines[1], "(rows=20)") {
+		t.Errorf("Expected sequential scan estimating 20 rows after ANALYZE, got %v", lines)
+	}
+
+	// Joins start from the connected pair and keep the smaller input on
+	// the build side; the cross join with countries comes last.
+	lines = explain(t, executor, "EXPLAIN SELECT * FROM countries CROSS JOIN users JOIN orders ON orders.user_id = users.id")
+	if !strings.Contains(lines[1], "CROSS Join") || !strings.Contains(lines[2], "Hash INNER Join on orders.user_id = users.id  (rows=80)") {
+		t.Fatalf("Unexpected join order: %v", lines)
+	}
+	if !strings.Contains(lines[3], "Seq Scan on orders") || !strings.Contains(lines[4], "Seq Scan on users") {
+		t.Errorf("Expected orders to probe a hash table of users, got %v", lines)
+	}
+
+	// Reordering does not change the result columns.
+	rows := run(t, executor, "SELECT * FROM countries CROSS JOIN users JOIN orders ON orders.user_id = users.id").([]*data.Row)
+	if len(rows) != 160 {
+		t.Fatalf("Expected 160 rows, got %d", len(rows))
+	}
+	if _, err := rows[0].GetValue("code"); err != nil {
+		t.Errorf("Expected column code: %v", err)
+	}
+}
+
+func TestExecutorRewriteRules(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT PRIMARY KEY, name TEXT)")
+	run(t, executor, "CREATE TABLE orders (id INT, user_id INT, total INT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (2, 'Bob'), (3, 'Carol')")
+	run(t, executor, "INSERT INTO orders VALUES (10, 1, 5), (11, 1, 7), (12, 2, 3)")
+
+	// Constants are folded, the always-true conjunct disappears and each
+	// filter moves below the join to the table it reads.
+	lines := explain(t, executor, "EXPLAIN SELECT u.name, o.total FROM users u JOIN orders o ON o.user_id = u.id WHERE u.id = 1 + 0 AND o.total > 2 * 2 AND 'a' = 'a'")
+	expected := []string{
+		"Project: u.name, o.total",
+		"-> Hash INNER Join on o.user_id = u.id",
+		"  -> Filter: o.total > 4",
+		"    -> Seq Scan on orders AS o",
+		"  -> Filter: u.id = 1",
+		"    -> Index Scan using users_pkey on users AS u",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d plan lines, got %v", len(expected), lines)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("Line %d: expected %q, got %q", i, prefix, lines[i])
+		}
+	}
+
+	// Conditions on the right side of a LEFT join stay above it.
+	lines = explain(t, executor, "EXPLAIN SELECT u.name FROM users u LEFT JOIN orders o ON o.user_id = u.id WHERE o.total > 4 AND u.name <> 'x'")
+	if !strings.HasPrefix(lines[1], "-> Filter: o.total > 4") || !strings.HasPrefix(lines[3], "    -> Filter: u.name <> 'x'") {
+		t.Errorf("Unexpected LEFT join plan: %v", lines)
+	}
+
+	// A filter that is always false leaves nothing to scan.
+	lines = explain(t, executor, "EXPLAIN SELECT COUNT(*) FROM users WHERE 1 = 0")
+	if !strings.HasPrefix(lines[2], "  -> Empty Result") {
+		t.Errorf("Expected an empty input, got %v", lines)
+	}
+	rows := run(t, executor, "SELECT COUNT(*) FROM users WHERE 1 = 0").([]*data.Row)
+	if count, _ := rows[0].GetValue("count"); count != int64(0) {
+		t.Errorf("Expected count 0, got %v", count)
+	}
+
+	// A HAVING that is always false leaves no groups, and the aggregates
+	// above it still resolve.
+	for _, sql := range []string{
+		"SELECT user_id, COUNT(*) FROM orders GROUP BY user_id HAVING FALSE",
+		"SELECT user_id, COUNT(*) FROM orders GROUP BY user_id HAVING COUNT(*) > 1 AND 1 = 0",
+		"SELECT COUNT(*) FROM orders HAVING 1 = 0",
+	} {
+		if rows := run(t, executor, sql).([]*data.Row); len(rows) != 0 {
+			t.Errorf("Expected no rows for %q, got %d", sql, len(rows))
+		}
+		if lines := explain(t, executor, "EXPLAIN "+sql); !strings.HasPrefix(lines[len(lines)-1], "-> Empty Result") {
+			t.Errorf("Expected an empty input for %q, got %v", sql, lines)
+		}
+	}
+
+	// Rewritten LEFT joins still return the unmatched rows.
+	rows = run(t, executor, "SELECT u.name, o.total FROM users u LEFT JOIN orders o ON o.user_id = u.id AND o.total > 4 ORDER BY u.name, o.total").([]*data.Row)
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 rows, got %d", len(rows))
+	}
+	if total, _ := rows[2].GetValue("total"); total != nil {
+		t.Errorf("Expected Bob without orders over 4, got %v", total)
+	}
+}
+
+func TestExecutorSubqueries(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE users (id INT PRIMARY KEY, name TEXT)")
+	run(t, executor, "CREATE TABLE orders (id INT, user_id INT, total INT)")
+	run(t, executor, "INSERT INTO users VALUES (1, 'Alice'), (2, 'Bob'), (3, 'Carol')")
+	run(t, executor, "INSERT INTO orders VALUES (10, 1, 5), (11, 1, 7), (12, 2, 3)")
+
+	names := func(sql string) []string {
+		var result []string
+		for _, row := range run(t, executor, sql).([]*data.Row) {
+			name, _ := row.GetValue("name")
+			result = append(result, fmt.Sprint(name))
+		}
+		return result
+	}
+	for sql, expected := range map[string]string{
+		"SELECT name FROM users WHERE id IN (SELECT user_id FROM orders) ORDER BY name":                                 "[Alice Bob]",
+		"SELECT name FROM users WHERE id NOT IN (SELECT user_id FROM orders) ORDER BY name":                             "[Carol]",
+		"SELECT name FROM users u WHERE EXISTS (SELECT 1 FROM orders o WHERE o.user_id = u.id AND o.total > 4)":         "[Alice]",
+		"SELECT name FROM users u WHERE NOT EXISTS (SELECT 1 FROM orders WHERE user_id = u.id) ORDER BY name":           "[Carol]",
+		"SELECT name FROM users WHERE id = (SELECT user_id FROM orders WHERE total = 3)":                                "[Bob]",
+		"SELECT name FROM (SELECT name, id FROM users WHERE id > 1) AS big WHERE big.id < 3":                            "[Bob]",
+		"SELECT name FROM users WHERE id IN (SELECT user_id FROM orders WHERE total > (SELECT MIN(total) FROM orders))": "[Alice]",
+	} {
+		if got := fmt.Sprint(names(sql)); got != expected {
+			t.Errorf("%s: expected %s, got %s", sql, expected, got)
+		}
+	}
+
+	lines := explain(t, executor, "EXPLAIN SELECT name FROM (SELECT name FROM users) AS u")
+	if !strings.HasPrefix(lines[1], "-> Subquery Scan on u") || !strings.HasPrefix(lines[3], "    -> Seq Scan on users") {
+		t.Errorf("Unexpected derived table plan: %v", lines)
+	}
+
+	// A correlated scalar subquery in the select list runs per row and is
+	// NULL when it finds nothing.
+	rows := run(t, executor, "SELECT name, (SELECT SUM(total) FROM orders WHERE user_id = users.id) FROM users ORDER BY id").([]*data.Row)
+	for i, expected := range []interface{}{int64(12), int64(3), nil} {
+		if got, _ := rows[i].GetValue("sum"); got != expected {
+			t.Errorf("Row %d: expected total %v, got %v", i, expected, got)
+		}
+	}
+
+	// The column is named and typed after the subquery's own column.
+	rs, err := executor.Exec("SELECT id, (SELECT name FROM users WHERE id = 1), (SELECT MAX(total) AS top FROM orders) FROM users WHERE id = 2")
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	expectedColumns := []query.Column{{Name: "id", Type: data.TypeInt}, {Name: "name", Type: data.TypeText}, {Name: "top", Type: data.TypeInt}}
+	if !reflect.DeepEqual(rs.Columns(), expectedColumns) {
+		t.Errorf("Expected columns %v, got %v", expectedColumns, rs.Columns())
+	}
+
+	// NOT IN is NULL rather than true when the subquery returns a NULL.
+	run(t, executor, "INSERT INTO orders VALUES (13, NULL, 1)")
+	if got := names("SELECT name FROM users WHERE id NOT IN (SELECT user_id FROM orders)"); len(got) != 0 {
+		t.Errorf("Expected no rows, got %v", got)
+	}
+
+	for _, sql := range []string{
+		"SELECT name FROM users WHERE id = (SELECT user_id FROM orders)",
+		"SELECT name FROM users WHERE id IN (SELECT id, user_id FROM orders)",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+
+	// Subqueries in DELETE and UPDATE may read the table being changed.
+	run(t, executor, "DELETE FROM orders WHERE user_id IN (SELECT id FROM users WHERE name = 'Bob')")
+	run(t, executor, "UPDATE orders SET total = (SELECT MAX(total) FROM orders) WHERE id = 13")
+	rows = run(t, executor, "SELECT id, total FROM orders ORDER BY id").([]*data.Row)
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 orders left, got %d", len(rows))
+	}
+	if total, _ := rows[2].GetValue("total"); total != int64(7) {
+		t.Errorf("Expected updated total 7, got %v", total)
+	}
+}
+
+func TestExecutorCommonTableExpressions(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE employees (id INT PRIMARY KEY, name TEXT, manager_id INT)")
+	run(t, executor, "INSERT INTO employees VALUES (1, 'Ada', NULL), (2, 'Ben', 1), (3, 'Cy', 1), (4, 'Di', 2), (5, 'Ed', 4), (6, 'Flo', 3)")
+
+	// A plain CTE, read twice and by a later CTE.
+	rows := run(t, executor, "WITH reports AS (SELECT id, manager_id FROM employees WHERE manager_id = 1), pairs AS (SELECT a.id FROM reports a JOIN reports b ON a.id < b.id) SELECT id FROM pairs").([]*data.Row)
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 row, got %d", len(rows))
+	}
+	if id, _ := rows[0].GetValue("id"); id != int64(2) {
+		t.Errorf("Expected id 2, got %v", id)
+	}
+
+	// Everyone below Ben, with their depth.
+	rows = run(t, executor, "WITH RECURSIVE chain (id, name, depth) AS (SELECT id, name, 0 FROM employees WHERE id = 2 UNION ALL SELECT e.id, e.name, c.depth + 1 FROM employees e JOIN chain c ON e.manager_id = c.id) SELECT name, depth FROM chain ORDER BY depth").([]*data.Row)
+	var got []string
+	for _, row := range rows {
+		name, _ := row.GetValue("name")
+		depth, _ := row.GetValue("depth")
+		got = append(got, fmt.Sprintf("%v:%v", name, depth))
+	}
+	if fmt.Sprint(got) != "[Ben:0 Di:1 Ed:2]" {
+		t.Errorf("Unexpected chain %v", got)
+	}
+
+	// UNION stops at the fixed point even when the data has a cycle.
+	run(t, executor, "UPDATE employees SET manager_id = 5 WHERE id = 1")
+	rows = run(t, executor, "WITH RECURSIVE reach (id) AS (SELECT 1 UNION SELECT e.id FROM employees e JOIN reach r ON e.manager_id = r.id) SELECT COUNT(*) FROM reach").([]*data.Row)
+	if count, _ := rows[0].GetValue("count"); count != int64(6) {
+		t.Errorf("Expected 6 reachable employees, got %v", count)
+	}
+
+	// UNION ALL over the cycle runs into the depth guard.
+	executor.SetMaxRecursionDepth(50)
+	tokens, _ := query.Tokenize("WITH RECURSIVE reach (id) AS (SELECT 1 UNION ALL SELECT e.id FROM employees e JOIN reach r ON e.manager_id = r.id) SELECT COUNT(*) FROM reach")
+	stmt, _ := query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil || !strings.Contains(err.Error(), "maximum recursion depth of 50") {
+		t.Errorf("Expected the depth guard to stop the query, got %v", err)
+	}
+
+	lines := explain(t, executor, "EXPLAIN WITH RECURSIVE n (x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n WHERE x < 3) SELECT x FROM n")
+	if !strings.Contains(lines[2], "Recursive Union All on n") || !strings.Contains(strings.Join(lines, "\n"), "WorkTable Scan on n") {
+		t.Errorf("Unexpected recursive plan: %v", lines)
+	}
+}
+
+func TestExecutorSetOperations(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE a (x INT, label TEXT)")
+	run(t, executor, "CREATE TABLE b (y FLOAT, name TEXT)")
+	run(t, executor, "INSERT INTO a VALUES (1, 'one'), (2, 'two'), (2, 'two'), (3, 'three')")
+	run(t, executor, "INSERT INTO b VALUES (2, 'two'), (3, 'three'), (4, 'four')")
+
+	values := func(sql string) string {
+		var result []string
+		for _, row := range run(t, executor, sql).([]*data.Row) {
+			x, _ := row.GetValue("x")
+			result = append(result, fmt.Sprint(x))
+		}
+		return strings.Join(result, " ")
+	}
+	for sql, expected := range map[string]string{
+		"SELECT x FROM a UNION SELECT y FROM b ORDER BY x":                                "1 2 3 4",
+		"SELECT x FROM a UNION ALL SELECT y FROM b ORDER BY 1 DESC LIMIT 3":               "4 3 3",
+		"SELECT x FROM a INTERSECT SELECT y FROM b ORDER BY x":                            "2 3",
+		"SELECT x FROM a EXCEPT SELECT y FROM b":                                          "1",
+		"SELECT x FROM a EXCEPT ALL SELECT y FROM b ORDER BY x":                           "1 2",
+		"SELECT x FROM a INTERSECT ALL SELECT x FROM a ORDER BY x":                        "1 2 2 3",
+		"SELECT x FROM a WHERE x = 1 UNION SELECT y FROM b INTERSECT SELECT 4 ORDER BY x": "1 4",
+		"SELECT x FROM a UNION SELECT y FROM b ORDER BY x LIMIT 2 OFFSET 1":               "2 3",
+	} {
+		if got := values(sql); got != expected {
+			t.Errorf("%s: expected %s, got %s", sql, expected, got)
+		}
+	}
+
+	// Set operations work in subqueries too.
+	rows := run(t, executor, "SELECT COUNT(*) FROM a WHERE x IN (SELECT y FROM b EXCEPT SELECT 3)").([]*data.Row)
+	if count, _ := rows[0].GetValue("count"); count != int64(2) {
+		t.Errorf("Expected 2 rows, got %v", count)
+	}
+
+	for _, sql := range []string{
+		"SELECT x, label FROM a UNION SELECT y FROM b",
+		"SELECT x FROM a UNION SELECT name FROM b",
+		"SELECT x FROM a UNION SELECT y FROM b ORDER BY label",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestExecutorWindowFunctions(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE sales (id INT, region TEXT, amount INT)")
+	run(t, executor, "INSERT INTO sales VALUES (1, 'east', 10), (2, 'east', 30), (3, 'east', 30), (4, 'east', 40), (5, 'west', 5), (6, 'west', 15)")
+
+	column := func(sql, name string) string {
+		var values []string
+		for _, row := range run(t, executor, sql).([]*data.Row) {
+			value, _ := row.GetValue(name)
+			values = append(values, fmt.Sprint(value))
+		}
+		return strings.Join(values, " ")
+	}
+	for _, c := range []struct{ sql, column, expected string }{
+		{"SELECT id, ROW_NUMBER() OVER (PARTITION BY region ORDER BY amount DESC) FROM sales ORDER BY id", "row_number", "4 2 3 1 2 1"},
+		{"SELECT id, RANK() OVER (ORDER BY amount) FROM sales ORDER BY id", "rank", "2 4 4 6 1 3"},
+		{"SELECT id, DENSE_RANK() OVER (ORDER BY amount) FROM sales ORDER BY id", "dense_rank", "2 4 4 5 1 3"},
+		{"SELECT id, LAG(amount) OVER (PARTITION BY region ORDER BY id) FROM sales ORDER BY id", "lag", "<nil> 10 30 30 <nil> 5"},
+		{"SELECT id, LEAD(amount, 2, 0) OVER (PARTITION BY region ORDER BY id) FROM sales ORDER BY id", "lead", "30 40 0 0 0 0"},
+		// Defaults take the type of the values.
+		{"SELECT id, LAG(amount, 1, '0') OVER (PARTITION BY region ORDER BY id) FROM sales ORDER BY id", "lag", "0 10 30 30 0 5"},
+		{"SELECT id, FIRST_VALUE(id) OVER (PARTITION BY region ORDER BY amount DESC) FROM sales ORDER BY id", "first_value", "4 4 4 4 6 6"},
+		// Running totals include the peers of the current row by default.
+		{"SELECT id, SUM(amount) OVER (ORDER BY amount) FROM sales ORDER BY id", "sum", "15 90 90 130 5 30"},
+		{"SELECT id, SUM(amount) OVER (PARTITION BY region ORDER BY id ROWS BETWEEN 1 PRECEDING AND CURRENT ROW) FROM sales ORDER BY id", "sum", "10 40 60 70 5 20"},
+		{"SELECT id, COUNT(*) OVER (PARTITION BY region) FROM sales ORDER BY id", "count", "4 4 4 4 2 2"},
+		{"SELECT id, AVG(amount) OVER (ORDER BY id ROWS BETWEEN 1 FOLLOWING AND UNBOUNDED FOLLOWING) FROM sales ORDER BY id", "avg", "24 22.5 20 10 15 <nil>"},
+		// Windows run after grouping and may rank aggregates.
+		{"SELECT region, RANK() OVER (ORDER BY SUM(amount) DESC) FROM sales GROUP BY region ORDER BY region", "rank", "1 2"},
+		// ORDER BY may sort on a window function.
+		{"SELECT id FROM sales ORDER BY ROW_NUMBER() OVER (ORDER BY amount DESC, id) LIMIT 3", "id", "4 2 3"},
+	} {
+		if got := column(c.sql, c.column); got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.sql, c.expected, got)
+		}
+	}
+
+	rows := run(t, executor, "SELECT LAG(id, 1, '0') OVER (ORDER BY id) FROM sales LIMIT 1").([]*data.Row)
+	if value, _ := rows[0].GetValue("lag"); value != int64(0) {
+		t.Errorf("Expected the default as int64 0, got %#v", value)
+	}
+
+	lines := explain(t, executor, "EXPLAIN SELECT id, ROW_NUMBER() OVER (ORDER BY id) FROM sales")
+	if !strings.HasPrefix(lines[1], "-> Window: ROW_NUMBER() OVER (ORDER BY id)") {
+		t.Errorf("Unexpected window plan: %v", lines)
+	}
+
+	for _, sql := range []string{
+		"SELECT id FROM sales WHERE ROW_NUMBER() OVER (ORDER BY id) = 1",
+		"SELECT ROW_NUMBER() FROM sales",
+		"SELECT id, SUM(amount) OVER () FROM sales GROUP BY region",
+		"SELECT UPPER(region) OVER () FROM sales",
+		"SELECT LAG(id, 1, 'x') OVER (ORDER BY id) FROM sales",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestExecutorScalarFunctions(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE people (id INT, first TEXT, last TEXT, nick TEXT, score FLOAT)")
+	run(t, executor, "INSERT INTO people VALUES (1, 'Ada', 'Lovelace', NULL, 91.456), (2, 'alan', 'Turing', 'Al', -7.5)")
+
+	value := func(sql, name string) interface{} {
+		rows := run(t, executor, sql).([]*data.Row)
+		if len(rows) != 1 {
+			t.Fatalf("%s: expected 1 row, got %d", sql, len(rows))
+		}
+		v, _ := rows[0].GetValue(name)
+		return v
+	}
+	for _, c := range []struct {
+		sql, column string
+		expected    interface{}
+	}{
+		{"SELECT LOWER(first) FROM people WHERE id = 1", "lower", "ada"},
+		{"SELECT UPPER(first) FROM people WHERE id = 2", "upper", "ALAN"},
+		{"SELECT LENGTH('héllo')", "length", int64(5)},
+		{"SELECT SUBSTR(last, 2, 3) FROM people WHERE id = 1", "substr", "ove"},
+		{"SELECT SUBSTR('doggo', 3)", "substr", "ggo"},
+		{"SELECT TRIM('  padded  ')", "trim", "padded"},
+		{"SELECT TRIM('xxhixx', 'x')", "trim", "hi"},
+		{"SELECT REPLACE('a-b-c', '-', '+')", "replace", "a+b+c"},
+		{"SELECT first || ' ' || last FROM people WHERE id = 2", "?column?", "alan Turing"},
+		{"SELECT 'n' || 1", "?column?", "n1"},
+		{"SELECT ABS(score) FROM people WHERE id = 2", "abs", 7.5},
+		{"SELECT ABS(-3)", "abs", int64(3)},
+		{"SELECT ROUND(score, 1) FROM people WHERE id = 1", "round", 91.5},
+		{"SELECT ROUND(score) FROM people WHERE id = 2", "round", -8.0},
+		{"SELECT ROUND(1234, -2)", "round", int64(1200)},
+		{"SELECT FLOOR(score) FROM people WHERE id = 2", "floor", -8.0},
+		{"SELECT CEIL(score) FROM people WHERE id = 2", "ceil", -7.0},
+		{"SELECT MOD(17, 5)", "mod", int64(2)},
+		{"SELECT COALESCE(nick, first) FROM people WHERE id = 1", "coalesce", "Ada"},
+		{"SELECT IFNULL(nick, 'none') FROM people WHERE id = 2", "ifnull", "Al"},
+		{"SELECT NULLIF(first, 'Ada') FROM people WHERE id = 1", "nullif", nil},
+		{"SELECT NULLIF(first, 'Ada') FROM people WHERE id = 2", "nullif", "alan"},
+		// Strict functions return NULL for NULL arguments.
+		{"SELECT UPPER(nick) FROM people WHERE id = 1", "upper", nil},
+		{"SELECT nick || 'x' FROM people WHERE id = 1", "?column?", nil},
+		{"SELECT CAST(score AS INT) FROM people WHERE id = 1", "score", int64(91)},
+		{"SELECT CAST('42' AS INT)", "?column?", int64(42)},
+		{"SELECT CAST(id AS TEXT) FROM people WHERE id = 2", "id", "2"},
+		{"SELECT '41'::int + 1", "?column?", int64(42)},
+		{"SELECT id::text || '!' FROM people WHERE id = 2", "?column?", "2!"},
+		// Functions work in WHERE, ORDER BY and GROUP BY too.
+		{"SELECT id FROM people WHERE LOWER(first) = 'alan'", "id", int64(2)},
+		{"SELECT id FROM people ORDER BY LENGTH(last) LIMIT 1", "id", int64(2)},
+		{"SELECT COUNT(*) FROM people GROUP BY UPPER(SUBSTR(first, 1, 1)) HAVING UPPER(SUBSTR(first, 1, 1)) = 'A'", "count", int64(2)},
+	} {
+		if got := value(c.sql, c.column); got != c.expected {
+			t.Errorf("%s: expected %v (%T), got %v (%T)", c.sql, c.expected, c.expected, got, got)
+		}
+	}
+
+	run(t, executor, "UPDATE people SET nick = UPPER(SUBSTR(last, 1, 3)) WHERE COALESCE(nick, '') = ''")
+	if got := value("SELECT nick FROM people WHERE id = 1", "nick"); got != "LOV" {
+		t.Errorf("Expected nick LOV, got %v", got)
+	}
+
+	lines := explain(t, executor, "EXPLAIN SELECT id FROM people WHERE id = ABS(-1) + LENGTH('x')")
+	if !strings.Contains(strings.Join(lines, "\n"), "id = 2") {
+		t.Errorf("Expected constant functions to be folded: %v", lines)
+	}
+
+	for _, sql := range []string{
+		"SELECT NO_SUCH_FUNCTION(id) FROM people",
+		"SELECT LOWER() FROM people",
+		"SELECT SUBSTR(first, 1, 2, 3) FROM people",
+		"SELECT MOD(id, 0) FROM people",
+		"SELECT ABS(first) FROM people",
+		"SELECT CAST(first AS INT) FROM people",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestExecutorUserDefinedFunctions(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	distance := func(args []query.Value) (query.Value, error) {
+		dx, dy := args[2].(float64)-args[0].(float64), args[3].(float64)-args[1].(float64)
+		return math.Sqrt(dx*dx + dy*dy), nil
+	}
+	float := data.TypeFloat
+	if err := executor.RegisterFunc("distance", []data.Type{float, float, float, float}, float, distance); err != nil {
+		t.Fatalf("RegisterFunc failed: %v", err)
+	}
+	err := executor.RegisterFunc("shout", []data.Type{data.TypeText}, data.TypeText, func(args []query.Value) (query.Value, error) {
+		if args[0] == nil {
+			return "NOTHING!", nil
+		}
+		if args[0] == "" {
+			return nil, errors.New("nothing to shout")
+		}
+		return strings.ToUpper(args[0].(string)) + "!", nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterFunc failed: %v", err)
+	}
+	err = executor.RegisterAggregate("product", []data.Type{data.TypeInt}, data.TypeInt, query.Aggregate{
+		Init: func() query.Value { return int64(1) },
+		Step: func(state query.Value, args []query.Value) (query.Value, error) {
+			if args[0] == nil {
+				return state, nil
+			}
+			return state.(int64) * args[0].(int64), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterAggregate failed: %v", err)
+	}
+	type weighted struct{ sum, weight float64 }
+	err = executor.RegisterAggregate("weighted_avg", []data.Type{float, float}, float, query.Aggregate{
+		Init: func() query.Value { return &weighted{} },
+		Step: func(state query.Value, args []query.Value) (query.Value, error) {
+			w := state.(*weighted)
+			w.sum += args[0].(float64) * args[1].(float64)
+			w.weight += args[1].(float64)
+			return w, nil
+		},
+		Final: func(state query.Value) (query.Value, error) {
+			w := state.(*weighted)
+			if w.weight == 0 {
+				return nil, errors.New("total weight is zero")
+			}
+			return w.sum / w.weight, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("RegisterAggregate failed: %v", err)
+	}
+
+	run(t, executor, "CREATE TABLE places (id INT, name TEXT, x INT, y INT, kind TEXT)")
+	run(t, executor, "INSERT INTO places VALUES (1, 'home', 0, 0, 'a'), (2, 'park', 3, 4, 'a'), (3, 'shop', 6, 8, 'b'), (4, 'pier', 1, 1, 'b')")
+
+	column := func(sql, name string) string {
+		var values []string
+		for _, row := range run(t, executor, sql).([]*data.Row) {
+			value, _ := row.GetValue(name)
+			values = append(values, fmt.Sprint(value))
+		}
+		return strings.Join(values, " ")
+	}
+	for _, c := range []struct{ sql, column, expected string }{
+		// Integer arguments are converted to the declared FLOAT type.
+		{"SELECT distance(0, 0, x, y) FROM places ORDER BY id", "distance", "0 5 10 1.4142135623730951"},
+		{"SELECT id FROM places WHERE DISTANCE(x, y, 3, 4) < 2 ORDER BY id", "id", "2"},
+		{"SELECT name FROM places ORDER BY distance(x, y, 6, 8) LIMIT 1", "name", "shop"},
+		{"SELECT shout(name) FROM places WHERE id = 1", "shout", "HOME!"},
+		{"SELECT shout(NULL)", "shout", "NOTHING!"},
+		{"SELECT kind, product(x) FROM places GROUP BY kind ORDER BY kind", "product", "0 6"},
+		{"SELECT product(id) FROM places", "product", "24"},
+		{"SELECT kind FROM places GROUP BY kind HAVING product(y) > 0", "kind", "b"},
+		{"SELECT weighted_avg(x, y) FROM places WHERE id > 1", "weighted_avg", "4.6923076923076925"},
+		{"SELECT id, product(id) OVER (ORDER BY id) FROM places ORDER BY id", "product", "1 2 6 24"},
+	} {
+		if got := column(c.sql, c.column); got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.sql, c.expected, got)
+		}
+	}
+
+	run(t, executor, "UPDATE places SET name = shout(name) WHERE distance(0, 0, x, y) > 5")
+	if got := column("SELECT name FROM places WHERE id = 3", "name"); got != "SHOP!" {
+		t.Errorf("Expected SHOP!, got %s", got)
+	}
+
+	// Registered functions are not evaluated while planning.
+	lines := explain(t, executor, "EXPLAIN SELECT id FROM places WHERE x < distance(0, 0, 3, 4)")
+	if !strings.Contains(strings.Join(lines, "\n"), "x < DISTANCE(0, 0, 3, 4)") {
+		t.Errorf("Unexpected plan: %v", lines)
+	}
+
+	for _, name := range []string{"upper", "count", "row_number", "select", "bad-name"} {
+		if err := executor.RegisterFunc(name, nil, data.TypeInt, func([]query.Value) (query.Value, error) { return nil, nil }); err == nil {
+			t.Errorf("Expected an error registering %s", name)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT distance(x, y) FROM places",
+		"SELECT shout('')",
+		"SELECT distance(name, 0, 0, 0) FROM places",
+		"SELECT weighted_avg(x, y) FROM places WHERE id = 1",
+		"SELECT shout(name) OVER () FROM places",
+		"SELECT product(*) FROM places",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestExecutorConditionExpressions(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE files (id INT, name TEXT, size INT, owner TEXT)")
+	run(t, executor, "INSERT INTO files VALUES (1, 'Report.txt', 120, 'ann'), (2, 'notes.TXT', 5, NULL), (3, '100%_done.md', 40, 'bob'), (4, 'image.png', 900, 'ann'), (5, 'a_b.txt', NULL, 'cy')")
+
+	ids := func(sql string) string {
+		var values []string
+		for _, row := range run(t, executor, sql).([]*data.Row) {
+			value, _ := row.GetValue("id")
+			values = append(values, fmt.Sprint(value))
+		}
+		return strings.Join(values, " ")
+	}
+	for _, c := range []struct{ where, expected string }{
+		{"name LIKE '%.txt'", "1 5"},
+		{"name ILIKE '%.txt'", "1 2 5"},
+		{"name NOT LIKE '%.txt'", "2 3 4"},
+		{"name LIKE '_____.png'", "4"},
+		{"name LIKE 'a\\_b%'", "5"},
+		{"name LIKE '100!%!_%' ESCAPE '!'", "3"},
+		{"name LIKE '%o%t%'", "1 2"},
+		{"owner LIKE '%'", "1 3 4 5"},
+		{"id IN (2, 4, 9)", "2 4"},
+		{"id NOT IN (2, 4)", "1 3 5"},
+		{"owner IN ('bob', NULL)", "3"},
+		{"owner NOT IN ('bob', NULL)", ""},
+		{"size BETWEEN 5 AND 120", "1 2 3"},
+		{"size NOT BETWEEN 5 AND 120", "4"},
+		{"owner IS NULL", "2"},
+		{"owner IS NOT NULL AND size IS NULL", "5"},
+		{"CASE WHEN size > 100 THEN owner = 'ann' ELSE FALSE END", "1 4"},
+	} {
+		if got := ids("SELECT id FROM files WHERE " + c.where + " ORDER BY id"); got != c.expected {
+			t.Errorf("WHERE %s: expected %q, got %q", c.where, c.expected, got)
+		}
+	}
+
+	column := func(sql, name string) string {
+		var values []string
+		for _, row := range run(t, executor, sql).([]*data.Row) {
+			value, _ := row.GetValue(name)
+			values = append(values, fmt.Sprint(value))
+		}
+		return strings.Join(values, " ")
+	}
+	sizes := column("SELECT CASE WHEN size IS NULL THEN 'unknown' WHEN size < 50 THEN 'small' ELSE 'large' END FROM files ORDER BY id", "case")
+	if sizes != "large small small large unknown" {
+		t.Errorf("Unexpected searched CASE results: %s", sizes)
+	}
+	owners := column("SELECT CASE owner WHEN 'ann' THEN 1 WHEN 'bob' THEN 2 END FROM files ORDER BY id", "case")
+	if owners != "1 <nil> 2 1 <nil>" {
+		t.Errorf("Unexpected simple CASE results: %s", owners)
+	}
+	// Branches that are not taken are not evaluated.
+	safe := column("SELECT CASE WHEN size = 0 OR size IS NULL THEN 0 ELSE 1000 / size END FROM files ORDER BY id", "case")
+	if safe != "8 200 25 1 0" {
+		t.Errorf("Unexpected CASE results: %s", safe)
+	}
+	flags := column("SELECT id IN (1, 2) FROM files ORDER BY id", "?column?")
+	if flags != "true true false false false" {
+		t.Errorf("Unexpected IN results: %s", flags)
+	}
+
+	run(t, executor, "UPDATE files SET owner = 'nobody' WHERE owner IS NULL")
+	run(t, executor, "DELETE FROM files WHERE name ILIKE '%.PNG'")
+	if got := ids("SELECT id FROM files WHERE owner IN ('nobody', 'cy') ORDER BY id"); got != "2 5" {
+		t.Errorf("Expected 2 5, got %s", got)
+	}
+	if got := ids("SELECT id FROM files ORDER BY id"); got != "1 2 3 5" {
+		t.Errorf("Expected 1 2 3 5, got %s", got)
+	}
+
+	for _, sql := range []string{
+		"SELECT id FROM files WHERE name LIKE 'x!' ESCAPE '!'",
+		"SELECT id FROM files WHERE name LIKE 'x' ESCAPE 'ab'",
+		"SELECT id FROM files WHERE missing IS NULL",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestExecutorSelectList(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	run(t, executor, "CREATE TABLE pets (id INT, name TEXT, kind TEXT, owner INT)")
+	run(t, executor, "CREATE TABLE owners (id INT, name TEXT)")
+	run(t, executor, "INSERT INTO pets VALUES (1, 'Rex', 'dog', 1), (2, 'Tom', 'cat', 1), (3, 'Fido', 'dog', 2), (4, 'Rex', 'dog', 2), (5, 'Kit', 'cat', NULL)")
+	run(t, executor, "INSERT INTO owners VALUES (1, 'Ann'), (2, 'Bob')")
+
+	rows := func(sql string) []*data.Row {
+		return run(t, executor, sql).([]*data.Row)
+	}
+	format := func(result []*data.Row) string {
+		var lines []string
+		for _, row := range result {
+			lines = append(lines, fmt.Sprint(row.Values()))
+		}
+		return strings.Join(lines, " ")
+	}
+
+	// Result columns keep select-list order and take their aliases.
+	result := rows("SELECT kind AS species, id * 10 AS tenfold, name FROM pets WHERE id = 2")
+	if got := result[0].ColumnNames(); !reflect.DeepEqual(got, []string{"species", "tenfold", "name"}) {
+		t.Errorf("Unexpected columns %v", got)
+	}
+	if got := format(result); got != "[cat 20 Tom]" {
+		t.Errorf("Unexpected values %s", got)
+	}
+
+	for _, c := range []struct{ sql, expected string }{
+		{"SELECT DISTINCT kind FROM pets ORDER BY kind", "[cat] [dog]"},
+		{"SELECT DISTINCT name, kind FROM pets ORDER BY name DESC", "[Tom cat] [Rex dog] [Kit cat] [Fido dog]"},
+		{"SELECT DISTINCT owner FROM pets ORDER BY owner", "[1] [2] [<nil>]"},
+		{"SELECT DISTINCT kind FROM pets ORDER BY kind LIMIT 1", "[cat]"},
+		{"SELECT COUNT(DISTINCT name) AS names, COUNT(name) AS pets, COUNT(DISTINCT owner) AS owners FROM pets", "[4 5 2]"},
+		{"SELECT kind, COUNT(DISTINCT owner) AS owners FROM pets GROUP BY kind ORDER BY owners", "[cat 1] [dog 2]"},
+		{"SELECT SUM(DISTINCT owner) FROM pets", "[3]"},
+		{"SELECT name AS n FROM pets ORDER BY n LIMIT 2", "[Fido] [Kit]"},
+		{"SELECT o.*, p.name FROM owners o JOIN pets p ON p.owner = o.id WHERE p.kind = 'cat'", "[1 Ann Tom]"},
+		{"SELECT p.id, o.* FROM pets p JOIN owners o ON p.owner = o.id ORDER BY p.id LIMIT 1", "[1 1 Ann]"},
+		{"SELECT *, id + 100 AS big FROM owners ORDER BY id", "[1 Ann 101] [2 Bob 102]"},
+		{"SELECT t.total FROM (SELECT COUNT(*) AS total FROM pets) t", "[5]"},
+	} {
+		if got := format(rows(c.sql)); got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.sql, c.expected, got)
+		}
+	}
+
+	result = rows("SELECT o.*, p.name FROM owners o JOIN pets p ON p.owner = o.id WHERE p.id = 1")
+	if got := result[0].ColumnNames(); !reflect.DeepEqual(got, []string{"id", "o.name", "p.name"}) {
+		t.Errorf("Unexpected columns %v", got)
+	}
+
+	// Columns that share a name are told apart by a suffix.
+	result = rows("SELECT id + 1, id * 10, LOWER(name), LOWER(kind) FROM pets WHERE id = 2")
+	if got := result[0].ColumnNames(); !reflect.DeepEqual(got, []string{"?column?", "?column?_2", "lower", "lower_2"}) {
+		t.Errorf("Unexpected columns %v", got)
+	}
+	if got := format(result); got != "[3 20 tom cat]" {
+		t.Errorf("Unexpected values %s", got)
+	}
+
+	lines := explain(t, executor, "EXPLAIN SELECT DISTINCT kind FROM pets")
+	if !strings.HasPrefix(lines[0], "Hash Distinct") {
+		t.Errorf("Unexpected plan: %v", lines)
+	}
+
+	for _, sql := range []string{
+		"SELECT DISTINCT kind FROM pets ORDER BY id",
+		"SELECT x.* FROM pets",
+		"SELECT LOWER(DISTINCT name) FROM pets",
+		"SELECT COUNT(DISTINCT id) OVER () FROM pets",
+		"SELECT *, COUNT(*) FROM pets",
+	} {
+		tokens, _ := query.Tokenize(sql)
+		stmt, _ := query.Parse(tokens)
+		if _, err := executor.Execute(stmt); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestExecutorResultSet(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	exec := func(sql string) *query.ResultSet {
+		t.Helper()
+		tokens, err := query.Tokenize(sql)
+		if err != nil {
+			t.Fatalf("Tokenize %q failed: %v", sql, err)
+		}
+		stmt, err := query.Parse(tokens)
+		if err != nil {
+			t.Fatalf("Parse %q failed: %v", sql, err)
+		}
+		result, err := executor.Run(stmt)
+		if err != nil {
+			t.Fatalf("Run %q failed: %v", sql, err)
+		}
+		return result
+	}
+
+	if result := exec("CREATE TABLE items (id INT PRIMARY KEY, name TEXT, price FLOAT)"); result.HasRows() || result.RowsAffected() != 0 {
+		t.Errorf("Expected no rows from CREATE TABLE")
+	}
+	result := exec("INSERT INTO items VALUES (1, 'pen', 1.5), (2, 'ink', NULL), (7, 'pad', 3)")
+	if result.HasRows() || result.RowsAffected() != 3 || result.LastInsertID() != 7 {
+		t.Errorf("Expected 3 rows affected and last insert id 7, got %d and %d", result.RowsAffected(), result.LastInsertID())
+	}
+
+	result = exec("SELECT price, name, id FROM items ORDER BY id")
+	expected := []query.Column{{Name: "price", Type: data.TypeFloat}, {Name: "name", Type: data.TypeText}, {Name: "id", Type: data.TypeInt}}
+	if !reflect.DeepEqual(result.Columns(), expected) {
+		t.Errorf("Expected columns %v, got %v", expected, result.Columns())
+	}
+	var names []string
+	var total float64
+	for result.Next() {
+		var price sql.NullFloat64
+		var name string
+		var id int
+		if err := result.Scan(&price, &name, &id); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		names = append(names, fmt.Sprintf("%d:%s", id, name))
+		total += price.Float64
+	}
+	if strings.Join(names, " ") != "1:pen 2:ink 7:pad" || total != 4.5 {
+		t.Errorf("Unexpected rows %v with total %v", names, total)
+	}
+	if result.Next() {
+		t.Errorf("Expected no more rows")
+	}
+
+	result = exec("SELECT name, price FROM items WHERE id = 2")
+	result.Next()
+	var name, price string
+	if err := result.Scan(&name, &price); err == nil {
+		t.Errorf("Expected an error scanning NULL into a string")
+	}
+	if err := result.Scan(&name); err == nil {
+		t.Errorf("Expected an error scanning too few values")
+	}
+	var anything interface{}
+	if err := result.Scan(&name, &anything); err != nil || anything != nil {
+		t.Errorf("Expected NULL in an interface{}, got %v, %v", anything, err)
+	}
+
+	if result = exec("SELECT id FROM items WHERE id > 100"); !result.HasRows() || result.Len() != 0 || result.Next() {
+		t.Errorf("Expected an empty result with rows")
+	}
+
+	result = exec("UPDATE items SET price = 2 WHERE price IS NOT NULL RETURNING id, price")
+	if result.RowsAffected() != 2 || result.Len() != 2 {
+		t.Errorf("Expected 2 updated rows, got %d", result.RowsAffected())
+	}
+	result = exec("DELETE FROM items WHERE id = 1 RETURNING *")
+	if result.RowsAffected() != 1 || len(result.Columns()) != 3 || result.Columns()[1].Name != "name" {
+		t.Errorf("Unexpected DELETE result %v", result.Columns())
+	}
+	result.Next()
+	if got := fmt.Sprint(result.Values()); got != "[1 pen 2]" {
+		t.Errorf("Expected [1 pen 2], got %s", got)
+	}
+	result = exec("INSERT INTO items VALUES (2, 'ink', 9) ON CONFLICT (id) DO UPDATE SET price = excluded.price")
+	if result.RowsAffected() != 1 || result.LastInsertID() != 2 {
+		t.Errorf("Expected an upsert of id 2, got %d rows and id %d", result.RowsAffected(), result.LastInsertID())
+	}
+
+	if result = exec("EXPLAIN SELECT * FROM items"); result.Columns()[0].Name != "QUERY PLAN" || result.Len() == 0 {
+		t.Errorf("Unexpected EXPLAIN result %v", result.Columns())
+	}
+}
+
+func TestExecutorStreaming(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+	ctx := context.Background()
+
+	executor.Exec("CREATE TABLE numbers (n INT)")
+	insert, _ := executor.Prepare("INSERT INTO numbers VALUES (?)")
+	for i := 1; i <= 1000; i++ {
+		insert.Exec(i)
+	}
+	calls := 0
+	executor.RegisterFunc("probe", []data.Type{data.TypeInt}, data.TypeInt, func(args []query.Value) (query.Value, error) {
+		calls++
+		return args[0], nil
+	})
+
+	// Rows are produced as they are read.
+	p, _ := executor.Prepare("SELECT probe(n) AS n FROM numbers WHERE n > ?")
+	var got []interface{}
+	result, err := p.StreamContext(ctx, func(rows *query.Rows) error {
+		if columns := rows.Columns(); len(columns) != 1 || columns[0].Name != "n" {
+			t.Errorf("Unexpected columns %v", columns)
+		}
+		for len(got) < 3 && rows.Next() {
+			got = append(got, rows.Values()[0])
+		}
+		return nil
+	}, 10)
+	if err != nil || !result.HasRows() || result.Len() != 0 {
+		t.Fatalf("StreamContext failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, []interface{}{int64(11), int64(12), int64(13)}) || calls > 10 {
+		t.Errorf("Expected 3 rows from a few calls, got %v from %d calls", got, calls)
+	}
+
+	// Errors of the rows and of the function end the statement.
+	p, _ = executor.Prepare("SELECT 1 / (n - 500) FROM numbers")
+	count := 0
+	_, err = p.StreamContext(ctx, func(rows *query.Rows) error {
+		for rows.Next() {
+			count++
+		}
+		return rows.Err()
+	})
+	if err == nil || !strings.Contains(err.Error(), "division by zero") || count != 499 {
+		t.Errorf("Expected division by zero after 499 rows, got %d rows and %v", count, err)
+	}
+	stop := errors.New("stop")
+	if _, err := p.StreamContext(ctx, func(*query.Rows) error { return stop }); err != stop {
+		t.Errorf("Expected the function's error, got %v", err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	_, err = p.StreamContext(canceled, func(rows *query.Rows) error {
+		cancel()
+		for rows.Next() {
+		}
+		return rows.Err()
+	})
+	var canceledErr *query.CanceledError
+	if !errors.As(err, &canceledErr) {
+		t.Errorf("Expected a CanceledError, got %v", err)
+	}
+
+	// Other statements run as usual.
+	p, _ = executor.Prepare("DELETE FROM numbers WHERE n > 10")
+	result, err = p.StreamContext(ctx, func(*query.Rows) error {
+		t.Errorf("Expected no rows to stream for DELETE")
+		return nil
+	})
+	if err != nil || result.RowsAffected() != 990 {
+		t.Errorf("DELETE failed: %v", err)
+	}
+}
+
+func TestExecutorPreparedStatements(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	if _, err := executor.Exec("CREATE TABLE users (id INT PRIMARY KEY, name TEXT, score FLOAT, active BOOL)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	insert, err := executor.Prepare("INSERT INTO users VALUES (?, ?, ?, ?)")
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if insert.NumParams() != 4 {
+		t.Errorf("Expected 4 parameters, got %d", insert.NumParams())
+	}
+	for i, name := range []string{"ann", "bob", "o'brien; DROP TABLE users"} {
+		if _, err := insert.Exec(i+1, name, float32(i)+0.5, i%2 == 0); err != nil {
+			t.Fatalf("Exec failed: %v", err)
+		}
+	}
+	if again, _ := executor.Prepare("INSERT INTO users VALUES (?, ?, ?, ?)"); again != insert {
+		t.Errorf("Expected the statement cache to return the prepared statement")
+	}
+
+	result, err := executor.Query("SELECT id, name FROM users WHERE name = $1", "o'brien; DROP TABLE users")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var id int64
+	var name string
+	if !result.Next() || result.Scan(&id, &name) != nil || id != 3 || result.Next() {
+		t.Errorf("Expected only user 3, got %d %q", id, name)
+	}
+
+	// Placeholders work in expressions, subqueries, LIMIT and UPDATE.
+	result, err = executor.Query("SELECT name FROM users WHERE score > $1 * 2 AND id IN (SELECT id FROM users WHERE active = $2) ORDER BY id LIMIT $3", 0.2, true, int8(1))
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if !result.Next() || result.Scan(&name) != nil || name != "ann" || result.Next() {
+		t.Errorf("Expected ann, got %q", name)
+	}
+	update, err := executor.Exec("UPDATE users SET name = name || $1 WHERE id = $2", "!", uint(2))
+	if err != nil || update.RowsAffected() != 1 {
+		t.Fatalf("UPDATE failed: %v", err)
+	}
+	result, _ = executor.Query("SELECT name FROM users WHERE id = ?", []byte("2"))
+	if !result.Next() || result.Scan(&name) != nil || name != "bob!" {
+		t.Errorf("Expected bob!, got %q", name)
+	}
+	result, _ = executor.Query("SELECT COUNT(*) FROM users WHERE score = ?", nil)
+	var count int64
+	if !result.Next() || result.Scan(&count) != nil || count != 0 {
+		t.Errorf("Expected a NULL parameter to match nothing, got %d", count)
+	}
+
+	for _, args := range [][]interface{}{{}, {1, 2}, {struct{}{}}} {
+		if _, err := insert.Exec(args...); err == nil {
+			t.Errorf("Expected an error for arguments %v", args)
+		}
+	}
+	if _, err := executor.Query("DELETE FROM users WHERE id = ?", 1); err == nil {
+		t.Errorf("Expected an error querying a statement without rows")
+	}
+	tokens, _ := query.Tokenize("SELECT * FROM users WHERE id = ?")
+	stmt, _ := query.Parse(tokens)
+	if _, err := executor.Execute(stmt); err == nil {
+		t.Errorf("Expected an error running a placeholder without a value")
+	}
+
+	// A statement is parsed once and its runs bind their values to copies,
+	// so runs at the same time do not see each other's values.
+	lookup, err := executor.Prepare("SELECT u.name, COUNT(*) FROM users u JOIN users o ON o.id <= u.id + $1 * 0 WHERE u.id = $1 GROUP BY u.name HAVING COUNT(*) >= $1 - 1 ORDER BY u.name LIMIT $1")
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	expected := map[int]string{2: "bob!", 3: "o'brien; DROP TABLE users"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				result, err := lookup.Query(id)
+				var name string
+				var count int64
+				if err != nil || !result.Next() || result.Scan(&name, &count) != nil || name != expected[id] || count != int64(id-1) {
+					t.Errorf("Expected %q with %d rows, got %q with %d (%v)", expected[id], id-1, name, count, err)
+					return
+				}
+			}
+		}(i%2 + 2)
+	}
+	wg.Wait()
+}
+
+func TestExecutorCancellation(t *testing.T) {
+	storage := data.NewInMemoryStorage()
+	executor := query.NewExecutor(*storage)
+
+	if _, err := executor.Exec("CREATE TABLE numbers (n INT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	insert, _ := executor.Prepare("INSERT INTO numbers VALUES (?)")
+	for i := 0; i < 500; i++ {
+		if _, err := insert.Exec(i); err != nil {
+			t.Fatalf("INSERT failed: %v", err)
+		}
+	}
+	// Far too slow to finish: 125 million combinations.
+	slow, err := executor.Prepare("SELECT COUNT(*) FROM numbers a CROSS JOIN numbers b CROSS JOIN numbers c WHERE a.n + b.n + c.n < 0")
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	// run fails the test unless the statement stops soon after it is
+	// canceled.
+	run := func(ctx context.Context, p *query.PreparedStatement) error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := p.ExecContext(ctx)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Statement was not canceled")
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err = run(ctx, slow)
+	var canceled *query.CanceledError
+	if !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) || err.Error() != "canceling statement due to user request" {
+		t.Errorf("Expected a cancellation error, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = run(ctx, slow); !errors.Is(err, context.DeadlineExceeded) || err.Error() != "canceling statement due to deadline" {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	executor.SetStatementTimeout(20 * time.Millisecond)
+	if err = run(context.Background(), slow); !errors.Is(err, context.DeadlineExceeded) || err.Error() != "canceling statement due to statement timeout" {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+	executor.SetStatementTimeout(0)
+
+	// UPDATE and DELETE stop as well, changing nothing.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := executor.ExecuteContext(ctx, mustParse(t, "DELETE FROM numbers")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected DELETE to be canceled, got %v", err)
+	}
+	update, _ := executor.Prepare("UPDATE numbers SET n = n + 1 WHERE n IN (SELECT a.n FROM numbers a CROSS JOIN numbers b CROSS JOIN numbers c WHERE a.n + b.n + c.n < 0)")
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := run(ctx, update); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected UPDATE to time out, got %v", err)
+	}
+	if result, _ := executor.Query("SELECT COUNT(*) FROM numbers WHERE n = 0"); result.Rows()[0].Columns["count"] != int64(1) {
+		t.Errorf("Expected the table to be unchanged")
+	}
+
+	// SET statement_timeout applies to later statements.
+	for _, sql := range []string{"SET statement_timeout = '20ms'", "SET statement_timeout TO 20"} {
+		if _, err := executor.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+		if err := run(context.Background(), slow); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %s to time out the query, got %v", sql, err)
+		}
+	}
+	if _, err := executor.Exec("SET statement_timeout = DEFAULT"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if _, err := executor.Exec("SELECT COUNT(*) FROM numbers a CROSS JOIN numbers b"); err != nil {
+		t.Errorf("Expected the timeout to be off, got %v", err)
+	}
+	for _, sql := range []string{"SET statement_timeout = 'soon'", "SET work_mem = '4MB'", "SET statement_timeout"} {
+		if _, err := executor.Exec(sql); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func mustParse(t *testing.T, sql string) query.Statement {
+	t.Helper()
+	tokens, err := query.Tokenize(sql)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return stmt
+}
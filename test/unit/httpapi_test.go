@@ -0,0 +1,203 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/httpapi"
+)
+
+func postQuery(t *testing.T, url, body string, header http.Header) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	if resp.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Decoding the response failed: %v", err)
+		}
+	}
+	return resp, result
+}
+
+func getJSON(t *testing.T, url string) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Decoding the response failed: %v", err)
+	}
+	return resp.StatusCode, result
+}
+
+func TestHTTPAPI(t *testing.T) {
+	server := httptest.NewServer(httpapi.NewHandler(engine.NewDatabase(), time.Minute))
+	defer server.Close()
+
+	for _, sql := range []string{
+		"CREATE TABLE pets (id INT PRIMARY KEY, name TEXT NOT NULL, weight FLOAT)",
+		"CREATE INDEX pets_name ON pets (name)",
+	} {
+		body, _ := json.Marshal(map[string]string{"sql": sql})
+		if resp, result := postQuery(t, server.URL+"/query", string(body), nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s failed: %v", sql, result["error"])
+		}
+	}
+
+	// Parameters and affected row counts.
+	resp, result := postQuery(t, server.URL+"/query", `{"sql": "INSERT INTO pets VALUES (?, ?, ?), (?, ?, ?)", "params": [1, "rex", 30.5, 2, "tom", null]}`, nil)
+	if resp.StatusCode != http.StatusOK || result["rows_affected"] != 2.0 || result["last_insert_id"] != 2.0 {
+		t.Fatalf("Unexpected INSERT response %d %v", resp.StatusCode, result)
+	}
+	resp, result = postQuery(t, server.URL+"/query", `{"sql": "SELECT id, name, weight FROM pets WHERE id >= $1 ORDER BY id", "params": [1]}`, nil)
+	columns := []interface{}{
+		map[string]interface{}{"name": "id", "type": "INT"},
+		map[string]interface{}{"name": "name", "type": "TEXT"},
+		map[string]interface{}{"name": "weight", "type": "FLOAT"},
+	}
+	rows := []interface{}{[]interface{}{1.0, "rex", 30.5}, []interface{}{2.0, "tom", nil}}
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(result["columns"], columns) || !reflect.DeepEqual(result["rows"], rows) {
+		t.Errorf("Unexpected SELECT response %d %v", resp.StatusCode, result)
+	}
+	resp, result = postQuery(t, server.URL+"/query", `{"sql": "SELECT name FROM pets WHERE id = 3"}`, nil)
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(result["rows"], []interface{}{}) {
+		t.Errorf("Expected no rows, got %v", result)
+	}
+
+	// Streaming with NDJSON.
+	resp, _ = postQuery(t, server.URL+"/query?format=ndjson", `{"sql": "SELECT name FROM pets ORDER BY id"}`, nil)
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Expected NDJSON, got %s", resp.Header.Get("Content-Type"))
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/query", strings.NewReader(`{"sql": "SELECT name FROM pets ORDER BY id"}`))
+	req.Header.Set("Accept", "application/x-ndjson")
+	streamed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(streamed.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	streamed.Body.Close()
+	expected := []string{
+		`{"columns":[{"name":"name","type":"TEXT"}]}`,
+		`["rex"]`,
+		`["tom"]`,
+		`{"row_count":2,"rows_affected":0}`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+
+	// A row that fails after others were sent ends the stream.
+	resp, err = http.Post(server.URL+"/query?format=ndjson", "application/json", strings.NewReader(`{"sql": "SELECT 10 / (id - 2) AS q FROM pets ORDER BY id"}`))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	lines = strings.Split(strings.TrimSpace(string(body)), "\n")
+	if resp.StatusCode != http.StatusOK || len(lines) != 3 || lines[1] != "[-10]" || !strings.Contains(lines[2], `"error"`) {
+		t.Errorf("Expected a row and an error line, got %d %q", resp.StatusCode, lines)
+	}
+	resp, _ = postQuery(t, server.URL+"/query?format=ndjson", `{"sql": "SELECT * FROM nowhere"}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a query that fails before streaming, got %d", resp.StatusCode)
+	}
+
+	// Errors.
+	for body, status := range map[string]int{
+		`{"sql": "SELECT * FROM nowhere"}`:                      http.StatusBadRequest,
+		`{"sql": "SELEC 1"}`:                                    http.StatusBadRequest,
+		`{"sql": "SELECT ?", "params": [[1]]}`:                  http.StatusBadRequest,
+		`{"sql": "SELECT ?"}`:                                   http.StatusBadRequest,
+		`{"sql": ""}`:                                           http.StatusBadRequest,
+		`not json`:                                              http.StatusBadRequest,
+		`{"sql": "SELECT 1", "timeout": "soon"}`:                http.StatusBadRequest,
+		`{"sql": "SELECT * FROM pets", "timeout": "1ns"}`:       http.StatusGatewayTimeout,
+		`{"sql": "SELECT COUNT(*) FROM pets", "timeout": "5s"}`: http.StatusOK,
+	} {
+		resp, result := postQuery(t, server.URL+"/query", body, nil)
+		if resp.StatusCode != status {
+			t.Errorf("Expected %d for %s, got %d", status, body, resp.StatusCode)
+		}
+		if status != http.StatusOK && result["error"] == nil {
+			t.Errorf("Expected an error message for %s", body)
+		}
+	}
+
+	// Tables and schemas.
+	if status, result := getJSON(t, server.URL+"/tables"); status != http.StatusOK || !reflect.DeepEqual(result["tables"], []interface{}{"pets"}) {
+		t.Errorf("Unexpected tables %d %v", status, result)
+	}
+	status, result := getJSON(t, server.URL+"/tables/pets/schema")
+	if status != http.StatusOK || result["rows"] != 2.0 || !reflect.DeepEqual(result["primary_key"], []interface{}{"id"}) {
+		t.Errorf("Unexpected schema %d %v", status, result)
+	}
+	if indexes, _ := result["indexes"].([]interface{}); len(indexes) != 2 || indexes[1].(map[string]interface{})["name"] != "pets_name" {
+		t.Errorf("Unexpected indexes %v", result["indexes"])
+	}
+	if status, _ := getJSON(t, server.URL+"/tables/nowhere/schema"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown table, got %d", status)
+	}
+	if status, _ := getJSON(t, server.URL+"/nowhere"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown path, got %d", status)
+	}
+	if status, _ := getJSON(t, server.URL+"/query"); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET /query, got %d", status)
+	}
+
+	// Clients may not back up to or copy with the server's files.
+	path := filepath.Join(t.TempDir(), "pets.sql")
+	for _, sql := range []string{"BACKUP TO '" + path + "'", "COPY pets TO '" + path + "'"} {
+		body, _ := json.Marshal(map[string]string{"sql": sql})
+		if resp, _ := postQuery(t, server.URL+"/query", string(body), nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected 403 for %q, got %d", sql, resp.StatusCode)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected no file to be written")
+	}
+
+	// The dump is a script that restores the database.
+	resp, err = http.Get(server.URL + "/dump")
+	if err != nil {
+		t.Fatalf("GET /dump failed: %v", err)
+	}
+	dump, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(dump), "CREATE TABLE pets") {
+		t.Errorf("Unexpected dump %d %s", resp.StatusCode, dump)
+	}
+	restored := engine.NewDatabase()
+	if err := restored.Restore(context.Background(), bytes.NewReader(dump)); err != nil {
+		t.Errorf("Restore failed: %v", err)
+	} else if info, _ := restored.DescribeTable("pets"); info == nil || info.Rows != 2 {
+		t.Errorf("Unexpected restored table %+v", info)
+	}
+}
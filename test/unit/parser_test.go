@@ -123,7 +123,14 @@ func TestInsert(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Parse failed: %v", err)
 	}
-	if !reflect.DeepEqual(ast, expectedAST) {
+	// The parsed statement also holds the trees of the values.
+	insert, ok := ast.(*query.InsertStatement)
+	if !ok {
+		t.Fatalf("Expected an INSERT, got %T", ast)
+	}
+	got := &query.InsertStatement{Table: insert.Table, Columns: insert.Columns, Values: insert.Values, MoreValues: insert.MoreValues,
+		Select: insert.Select, OnConflict: insert.OnConflict, Returning: insert.Returning}
+	if !reflect.DeepEqual(got, expectedAST) {
 		t.Errorf("AST does not match. Expected %v, got %v", expectedAST, ast)
 	}
 }
@@ -159,3 +166,431 @@ func TestUpdateParsing(t *testing.T) {
 		t.Errorf("Expected condition 'id = 1', got %s", updateStmt.Conditions)
 	}
 }
+
+func TestMultiRowInsertParsing(t *testing.T) {
+	queryString := "INSERT INTO users VALUES (1, 'Alice Smith'), (2, 'Bob') RETURNING id"
+	tokens, err := query.Tokenize(queryString)
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+
+	insertStmt, ok := stmt.(*query.InsertStatement)
+	if !ok {
+		t.Fatalf("Expected InsertStatement, got %T", stmt)
+	}
+
+	if len(insertStmt.Columns) != 0 {
+		t.Errorf("Expected no columns, got %v", insertStmt.Columns)
+	}
+
+	expectedTuples := [][]string{{"1", "'Alice Smith'"}, {"2", "'Bob'"}}
+	if !reflect.DeepEqual(insertStmt.Tuples(), expectedTuples) {
+		t.Errorf("Expected tuples %v, got %v", expectedTuples, insertStmt.Tuples())
+	}
+
+	if !reflect.DeepEqual(insertStmt.Returning, []string{"id"}) {
+		t.Errorf("Expected RETURNING [id], got %v", insertStmt.Returning)
+	}
+}
+
+func TestInsertSelectParsing(t *testing.T) {
+	queryString := "INSERT INTO archive (id, name) SELECT id, name FROM users WHERE id > 10 RETURNING *"
+	tokens, err := query.Tokenize(queryString)
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+
+	insertStmt, ok := stmt.(*query.InsertStatement)
+	if !ok {
+		t.Fatalf("Expected InsertStatement, got %T", stmt)
+	}
+	if insertStmt.Select == nil {
+		t.Fatalf("Expected a source SELECT")
+	}
+	if insertStmt.Select.Table != "users" || insertStmt.Select.Conditions != "id > 10" {
+		t.Errorf("Unexpected source SELECT: %s", insertStmt.Select)
+	}
+	if !reflect.DeepEqual(insertStmt.Returning, []string{"*"}) {
+		t.Errorf("Expected RETURNING *, got %v", insertStmt.Returning)
+	}
+}
+
+func TestDeleteParsing(t *testing.T) {
+	tokens, err := query.Tokenize("DELETE FROM users WHERE id = 1 RETURNING name")
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+
+	deleteStmt, ok := stmt.(*query.DeleteStatement)
+	if !ok {
+		t.Fatalf("Expected DeleteStatement, got %T", stmt)
+	}
+	if deleteStmt.Table != "users" {
+		t.Errorf("Expected table 'users', got %s", deleteStmt.Table)
+	}
+	if deleteStmt.Conditions != "id = 1" {
+		t.Errorf("Expected condition 'id = 1', got %s", deleteStmt.Conditions)
+	}
+	if !reflect.DeepEqual(deleteStmt.Returning, []string{"name"}) {
+		t.Errorf("Expected RETURNING [name], got %v", deleteStmt.Returning)
+	}
+}
+
+func TestOnConflictParsing(t *testing.T) {
+	queryString := "INSERT INTO users (id, name) VALUES (1, 'Alice') ON CONFLICT (id) DO UPDATE SET name = excluded.name RETURNING *"
+	tokens, err := query.Tokenize(queryString)
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+
+	insertStmt := stmt.(*query.InsertStatement)
+	if insertStmt.OnConflict == nil {
+		t.Fatalf("Expected ON CONFLICT clause")
+	}
+	if !reflect.DeepEqual(insertStmt.OnConflict.Columns, []string{"id"}) {
+		t.Errorf("Expected conflict target [id], got %v", insertStmt.OnConflict.Columns)
+	}
+	if insertStmt.OnConflict.Assignments["name"] != "excluded.name" {
+		t.Errorf("Expected name = excluded.name, got %v", insertStmt.OnConflict.Assignments)
+	}
+	if !reflect.DeepEqual(insertStmt.Returning, []string{"*"}) {
+		t.Errorf("Expected RETURNING *, got %v", insertStmt.Returning)
+	}
+
+	// DO UPDATE needs to know which constraint it is resolving.
+	tokens, _ = query.Tokenize("INSERT INTO users VALUES (1) ON CONFLICT DO UPDATE SET id = 2")
+	if _, err := query.Parse(tokens); err == nil {
+		t.Errorf("Expected error for DO UPDATE without conflict target")
+	}
+}
+
+func TestExplainParsing(t *testing.T) {
+	tokens, err := query.Tokenize("EXPLAIN ANALYZE SELECT name FROM users WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+
+	explainStmt, ok := stmt.(*query.ExplainStatement)
+	if !ok {
+		t.Fatalf("Expected ExplainStatement, got %T", stmt)
+	}
+	if !explainStmt.Analyze {
+		t.Errorf("Expected ANALYZE to be set")
+	}
+	selectStmt, ok := explainStmt.Statement.(*query.SelectStatement)
+	if !ok {
+		t.Fatalf("Expected explained SelectStatement, got %T", explainStmt.Statement)
+	}
+	if selectStmt.Conditions != "id = 1" {
+		t.Errorf("Expected condition 'id = 1', got %s", selectStmt.Conditions)
+	}
+}
+
+func TestAnalyzeParsing(t *testing.T) {
+	for sql, table := range map[string]string{"ANALYZE": "", "ANALYZE users": "users"} {
+		tokens, err := query.Tokenize(sql)
+		if err != nil {
+			t.Fatalf("Tokenization failed: %v", err)
+		}
+		stmt, err := query.Parse(tokens)
+		if err != nil {
+			t.Fatalf("Parsing %q failed: %v", sql, err)
+		}
+		analyzeStmt, ok := stmt.(*query.AnalyzeStatement)
+		if !ok {
+			t.Fatalf("Expected AnalyzeStatement, got %T", stmt)
+		}
+		if analyzeStmt.Table != table {
+			t.Errorf("Expected table %q, got %q", table, analyzeStmt.Table)
+		}
+	}
+}
+
+func TestSubqueryParsing(t *testing.T) {
+	tokens, err := query.Tokenize("SELECT name FROM (SELECT name, id FROM users) AS u WHERE id IN (SELECT user_id FROM orders) AND EXISTS (SELECT 1 FROM admins)")
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	selectStmt, ok := stmt.(*query.SelectStatement)
+	if !ok {
+		t.Fatalf("Expected SelectStatement, got %T", stmt)
+	}
+	if selectStmt.Subquery == nil || selectStmt.Subquery.Table != "users" || selectStmt.Alias != "u" {
+		t.Fatalf("Expected derived table u over users, got %v", selectStmt)
+	}
+
+	condition, err := query.ParseExpression(selectStmt.Conditions)
+	if err != nil {
+		t.Fatalf("Parsing the condition failed: %v", err)
+	}
+	if condition.String() != "id IN (SELECT user_id FROM orders) AND EXISTS (SELECT 1 FROM admins)" {
+		t.Errorf("Unexpected condition %s", condition)
+	}
+
+	tokens, _ = query.Tokenize("SELECT * FROM (SELECT id FROM users)")
+	if _, err := query.Parse(tokens); err == nil {
+		t.Errorf("Expected an error for a derived table without alias")
+	}
+}
+
+func TestWithParsing(t *testing.T) {
+	sql := "WITH RECURSIVE chain (id, depth) AS (SELECT id, 0 FROM employees WHERE manager_id = 1 UNION ALL SELECT e.id, depth + 1 FROM employees e JOIN chain ON e.manager_id = chain.id) SELECT id FROM chain"
+	tokens, err := query.Tokenize(sql)
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	selectStmt, ok := stmt.(*query.SelectStatement)
+	if !ok {
+		t.Fatalf("Expected SelectStatement, got %T", stmt)
+	}
+	if !selectStmt.Recursive || len(selectStmt.With) != 1 || selectStmt.Table != "chain" {
+		t.Fatalf("Unexpected statement %v", selectStmt)
+	}
+	cte := selectStmt.With[0]
+	if cte.Name != "chain" || !reflect.DeepEqual(cte.Columns, []string{"id", "depth"}) || !cte.UnionAll {
+		t.Errorf("Unexpected common table expression %v", cte.String())
+	}
+	if cte.Select.Table != "employees" || cte.Recursive == nil || len(cte.Recursive.Joins) != 1 {
+		t.Errorf("Unexpected terms %v", cte.String())
+	}
+
+	// Without RECURSIVE, a UNION is an ordinary compound query.
+	tokens, _ = query.Tokenize("WITH a AS (SELECT 1 UNION SELECT 2) SELECT * FROM a")
+	stmt, err = query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	if cte := stmt.(*query.SelectStatement).With[0]; cte.Recursive != nil || len(cte.Select.Compound) != 1 {
+		t.Errorf("Expected a compound query, got %v", cte.String())
+	}
+}
+
+func TestCompoundSelectParsing(t *testing.T) {
+	tokens, err := query.Tokenize("SELECT id FROM a UNION ALL SELECT id FROM b INTERSECT (SELECT id FROM c ORDER BY id LIMIT 2) ORDER BY id DESC LIMIT 3")
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	selectStmt := stmt.(*query.SelectStatement)
+	if len(selectStmt.Compound) != 2 || selectStmt.Compound[0].Op != "UNION" || !selectStmt.Compound[0].All || selectStmt.Compound[1].Op != "INTERSECT" {
+		t.Fatalf("Unexpected set operations %v", selectStmt.Compound)
+	}
+	if selectStmt.Limit != "3" || len(selectStmt.OrderBy) != 1 || !selectStmt.OrderBy[0].Desc {
+		t.Errorf("Expected ORDER BY and LIMIT on the compound query, got %v", selectStmt)
+	}
+	if inner := selectStmt.Compound[1].Select; inner.Limit != "2" || inner.Table != "c" {
+		t.Errorf("Expected the parenthesized SELECT to keep its LIMIT, got %v", inner)
+	}
+	expected := "SELECT id FROM a UNION ALL SELECT id FROM b INTERSECT (SELECT id FROM c ORDER BY id LIMIT 2) ORDER BY id DESC LIMIT 3"
+	if selectStmt.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, selectStmt.String())
+	}
+}
+
+func TestWindowParsing(t *testing.T) {
+	expr, err := query.ParseExpression("SUM(amount) OVER (PARTITION BY region ORDER BY day DESC ROWS BETWEEN 2 PRECEDING AND CURRENT ROW)")
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	window, ok := expr.(*query.WindowExpr)
+	if !ok {
+		t.Fatalf("Expected WindowExpr, got %T", expr)
+	}
+	if window.Func.Name != "SUM" || len(window.PartitionBy) != 1 || !window.OrderBy[0].Desc {
+		t.Errorf("Unexpected window %s", window)
+	}
+	if window.Frame == nil || window.Frame.Start.Type != "PRECEDING" || window.Frame.Start.Offset != 2 || window.Frame.End.Type != "CURRENT ROW" {
+		t.Errorf("Unexpected frame %v", window.Frame)
+	}
+	expected := "SUM(amount) OVER (PARTITION BY region ORDER BY day DESC ROWS BETWEEN 2 PRECEDING AND CURRENT ROW)"
+	if window.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, window.String())
+	}
+
+	if _, err := query.ParseExpression("SUM(x) OVER (ROWS BETWEEN CURRENT ROW AND 1 PRECEDING)"); err == nil {
+		t.Errorf("Expected an error for a frame that ends before it starts")
+	}
+}
+
+func TestFunctionExpressionParsing(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"CAST(price * 2 AS INTEGER)": "CAST(price * 2 AS INT)",
+		"first || ' ' || last":       "first || ' ' || last",
+		"a + b || c":                 "a + b || c",
+		"UPPER(TRIM(name))":          "UPPER(TRIM(name))",
+		"-price::int * 2":            "-CAST(price AS INT) * 2",
+		"$1::text::integer":          "CAST(CAST($1 AS TEXT) AS INT)",
+	} {
+		expr, err := query.ParseExpression(sql)
+		if err != nil {
+			t.Errorf("Parsing %s failed: %v", sql, err)
+			continue
+		}
+		if expr.String() != expected {
+			t.Errorf("Expected %q, got %q", expected, expr.String())
+		}
+	}
+
+	for _, sql := range []string{"CAST(x AS BLOB)", "CAST(x INT)", "a | b", "x::", "x::blob"} {
+		if _, err := query.ParseExpression(sql); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestConditionExpressionParsing(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"name LIKE 'a%'":                                    "name LIKE 'a%'",
+		"name NOT ILIKE '%x!%%' ESCAPE '!'":                 "name NOT ILIKE '%x!%%' ESCAPE '!'",
+		"id IN (1, 2, 3)":                                   "id IN (1, 2, 3)",
+		"id NOT IN (1)":                                     "id NOT IN (1)",
+		"price BETWEEN 1 AND 10 AND id > 2":                 "price BETWEEN 1 AND 10 AND id > 2",
+		"a + 1 NOT BETWEEN b AND c * 2":                     "a + 1 NOT BETWEEN b AND c * 2",
+		"x IS NULL OR y IS NOT NULL":                        "x IS NULL OR y IS NOT NULL",
+		"NOT x IS NULL":                                     "NOT x IS NULL",
+		"CASE WHEN a > 1 THEN 'big' ELSE 'small' END":       "CASE WHEN a > 1 THEN 'big' ELSE 'small' END",
+		"CASE kind WHEN 1 THEN 'one' WHEN 2 THEN 'two' END": "CASE kind WHEN 1 THEN 'one' WHEN 2 THEN 'two' END",
+	} {
+		expr, err := query.ParseExpression(sql)
+		if err != nil {
+			t.Errorf("Parsing %s failed: %v", sql, err)
+			continue
+		}
+		if expr.String() != expected {
+			t.Errorf("Expected %q, got %q", expected, expr.String())
+		}
+	}
+
+	between, err := query.ParseExpression("x BETWEEN 1 AND 5")
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	if b, ok := between.(*query.BetweenExpr); !ok || b.Not {
+		t.Errorf("Expected BetweenExpr, got %#v", between)
+	}
+
+	for _, sql := range []string{
+		"x IS 1",
+		"x BETWEEN 1",
+		"x IN ()",
+		"x IN (1, 2",
+		"CASE END",
+		"CASE WHEN a THEN b",
+		"CASE WHEN a b END",
+	} {
+		if _, err := query.ParseExpression(sql); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestSelectListParsing(t *testing.T) {
+	tokens, err := query.Tokenize("SELECT DISTINCT u.*, price * 2 AS double, name label, COUNT(DISTINCT kind) FROM users u")
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	sel := stmt.(*query.SelectStatement)
+	if !sel.Distinct {
+		t.Errorf("Expected DISTINCT")
+	}
+	if !reflect.DeepEqual(sel.Columns, []string{"u.*", "price * 2", "name", "COUNT(DISTINCT kind)"}) {
+		t.Errorf("Unexpected columns %q", sel.Columns)
+	}
+	if !reflect.DeepEqual(sel.Aliases, []string{"", "double", "label", ""}) {
+		t.Errorf("Unexpected aliases %q", sel.Aliases)
+	}
+	expected := "SELECT DISTINCT u.*, price * 2 AS double, name AS label, COUNT(DISTINCT kind) FROM users AS u"
+	if sel.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, sel.String())
+	}
+
+	tokens, _ = query.Tokenize("SELECT id FROM users")
+	stmt, _ = query.Parse(tokens)
+	if sel := stmt.(*query.SelectStatement); sel.Aliases != nil || sel.Distinct {
+		t.Errorf("Expected no aliases and no DISTINCT, got %q %v", sel.Aliases, sel.Distinct)
+	}
+
+	for _, sql := range []string{"SELECT id AS FROM users", "SELECT COUNT(DISTINCT) FROM users", "SELECT COUNT(DISTINCT *) FROM users"} {
+		tokens, _ := query.Tokenize(sql)
+		if _, err := query.Parse(tokens); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
+
+func TestPlaceholderParsing(t *testing.T) {
+	tokens, err := query.Tokenize("SELECT name FROM users WHERE id = ? AND name <> '?' AND age > ?")
+	if err != nil {
+		t.Fatalf("Tokenization failed: %v", err)
+	}
+	stmt, err := query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	if where := stmt.(*query.SelectStatement).Conditions; where != "id = $1 AND name <> '?' AND age > $2" {
+		t.Errorf("Unexpected condition %q", where)
+	}
+
+	tokens, _ = query.Tokenize("INSERT INTO users (id, name) VALUES ($2, $1)")
+	stmt, err = query.Parse(tokens)
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	if values := stmt.(*query.InsertStatement).Values; !reflect.DeepEqual(values, []string{"$2", "$1"}) {
+		t.Errorf("Unexpected values %q", values)
+	}
+
+	expr, err := query.ParseExpression("$3 + 1")
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	if param := expr.(*query.BinaryExpr).Left.(*query.Param); param.Index != 3 {
+		t.Errorf("Expected parameter 3, got %d", param.Index)
+	}
+
+	for _, sql := range []string{"SELECT * FROM users WHERE id = ? OR id = $1"} {
+		if _, err := query.Tokenize(sql); err == nil {
+			t.Errorf("Expected an error for %s", sql)
+		}
+	}
+}
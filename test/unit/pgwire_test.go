@@ -0,0 +1,392 @@
+package test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/pgwire"
+)
+
+// pgClient speaks just enough of the PostgreSQL protocol to test the
+// server.
+type pgClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	pid    int32 // From BackendKeyData, for CancelRequest
+	secret int32
+}
+
+// pgResult collects the replies to a query up to ReadyForQuery, or up to
+// CopyInResponse when the server waits for COPY data.
+type pgResult struct {
+	kinds   string   // Message types in order
+	columns []string // Column names of the last RowDescription
+	oids    []uint32
+	rows    [][][]byte
+	tags    []string
+	code    string // SQLSTATE of an ErrorResponse
+	status  byte   // Transaction status of ReadyForQuery
+	pid     int32  // BackendKeyData
+	secret  int32
+	copied  []byte // CopyData sent by COPY TO STDOUT
+}
+
+func dialPG(t *testing.T, addr string) *pgClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c := &pgClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	// SSL is declined before the startup message.
+	c.write(0, binary.BigEndian.AppendUint32(nil, 80877103))
+	if b, _ := c.r.ReadByte(); b != 'N' {
+		t.Fatalf("Expected SSL to be declined, got %q", b)
+	}
+	startup := binary.BigEndian.AppendUint32(nil, 3<<16)
+	startup = append(startup, "user\x00doggo\x00database\x00doggodb\x00\x00"...)
+	c.write(0, startup)
+	result := c.readResult()
+	if result.kinds[0] != 'R' || result.status != 'I' {
+		t.Fatalf("Unexpected startup replies %q", result.kinds)
+	}
+	c.pid, c.secret = result.pid, result.secret
+	return c
+}
+
+func (c *pgClient) write(kind byte, body []byte) {
+	var msg []byte
+	if kind != 0 {
+		msg = append(msg, kind)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(body)+4))
+	if _, err := c.conn.Write(append(msg, body...)); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func (c *pgClient) readResult() *pgResult {
+	c.t.Helper()
+	result := &pgResult{}
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			c.t.Fatalf("Read failed: %v", err)
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			c.t.Fatalf("Read failed: %v", err)
+		}
+		result.kinds += string(header[0])
+		switch header[0] {
+		case 'T':
+			result.columns, result.oids = nil, nil
+			n := int(binary.BigEndian.Uint16(body))
+			pos := 2
+			for i := 0; i < n; i++ {
+				end := pos
+				for body[end] != 0 {
+					end++
+				}
+				result.columns = append(result.columns, string(body[pos:end]))
+				pos = end + 1 + 6
+				result.oids = append(result.oids, binary.BigEndian.Uint32(body[pos:]))
+				pos += 12
+			}
+		case 'D':
+			n := int(binary.BigEndian.Uint16(body))
+			pos := 2
+			row := make([][]byte, n)
+			for i := range row {
+				size := int32(binary.BigEndian.Uint32(body[pos:]))
+				pos += 4
+				if size >= 0 {
+					row[i] = body[pos : pos+int(size)]
+					pos += int(size)
+				}
+			}
+			result.rows = append(result.rows, row)
+		case 'C':
+			result.tags = append(result.tags, string(body[:len(body)-1]))
+		case 'E':
+			for pos := 0; body[pos] != 0; {
+				field := body[pos]
+				end := pos + 1
+				for body[end] != 0 {
+					end++
+				}
+				if field == 'C' {
+					result.code = string(body[pos+1 : end])
+				}
+				pos = end + 1
+			}
+		case 'K':
+			result.pid = int32(binary.BigEndian.Uint32(body))
+			result.secret = int32(binary.BigEndian.Uint32(body[4:]))
+		case 'd':
+			result.copied = append(result.copied, body...)
+		case 'G':
+			return result
+		case 'Z':
+			result.status = body[0]
+			return result
+		}
+	}
+}
+
+func (c *pgClient) query(sql string) *pgResult {
+	c.t.Helper()
+	c.write('Q', append([]byte(sql), 0))
+	return c.readResult()
+}
+
+func textRows(rows [][][]byte) [][]string {
+	result := [][]string{}
+	for _, row := range rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			if v == nil {
+				values[i] = "NULL"
+			} else {
+				values[i] = string(v)
+			}
+		}
+		result = append(result, values)
+	}
+	return result
+}
+
+func TestPGWireServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := pgwire.NewServer(engine.NewDatabase())
+	done := make(chan error)
+	go func() { done <- server.Serve(listener) }()
+	defer func() {
+		server.Close()
+		if err := <-done; err != pgwire.ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	}()
+
+	c := dialPG(t, listener.Addr().String())
+	defer c.conn.Close()
+
+	// Simple query protocol, several statements in one message.
+	result := c.query("CREATE TABLE pets (id INT PRIMARY KEY, name TEXT, weight FLOAT, good BOOL); INSERT INTO pets VALUES (1, 'rex', 30.5, TRUE), (2, 'tom', NULL, FALSE)")
+	if !reflect.DeepEqual(result.tags, []string{"CREATE TABLE", "INSERT 0 2"}) || result.code != "" {
+		t.Fatalf("Unexpected tags %q, error %s", result.tags, result.code)
+	}
+	result = c.query("SELECT id, name, weight, good FROM pets ORDER BY id")
+	if !reflect.DeepEqual(result.columns, []string{"id", "name", "weight", "good"}) || !reflect.DeepEqual(result.oids, []uint32{20, 25, 701, 16}) {
+		t.Errorf("Unexpected row description %q %v", result.columns, result.oids)
+	}
+	expected := [][]string{{"1", "rex", "30.5", "t"}, {"2", "tom", "NULL", "f"}}
+	if rows := textRows(result.rows); !reflect.DeepEqual(rows, expected) || result.tags[0] != "SELECT 2" {
+		t.Errorf("Expected %q, got %q with tag %q", expected, rows, result.tags)
+	}
+	if result = c.query(""); result.kinds != "IZ" {
+		t.Errorf("Expected an empty query response, got %q", result.kinds)
+	}
+
+	// Errors carry a SQLSTATE and stop the rest of the query.
+	for sql, code := range map[string]string{
+		"SELEC 1":               "42601",
+		"SELECT * FROM nowhere": "42P01",
+		"INSERT INTO pets VALUES (1, 'dup', 1, TRUE)": "23505",
+		"SELECT 1 / 0; DELETE FROM pets":              "22012",
+	} {
+		if result := c.query(sql); result.code != code || result.status != 'I' {
+			t.Errorf("Expected SQLSTATE %s for %s, got %q", code, sql, result.code)
+		}
+	}
+
+	// Extended query protocol: Parse, Bind with a binary parameter,
+	// Describe, Execute and Sync.
+	parse := append([]byte("byweight\x00SELECT name, weight FROM pets WHERE weight > $1\x00"), 0, 0)
+	c.write('P', parse)
+	c.write('D', []byte("Sbyweight\x00"))
+	bind := []byte("\x00byweight\x00")
+	bind = binary.BigEndian.AppendUint16(bind, 1)
+	bind = binary.BigEndian.AppendUint16(bind, 1) // Binary parameter
+	bind = binary.BigEndian.AppendUint16(bind, 1)
+	bind = binary.BigEndian.AppendUint32(bind, 8)
+	bind = binary.BigEndian.AppendUint64(bind, 0x4024000000000000) // 10.0
+	bind = binary.BigEndian.AppendUint16(bind, 0)                  // Text results
+	c.write('B', bind)
+	c.write('E', []byte("\x00\x00\x00\x00\x00"))
+	c.write('S', nil)
+	result = c.readResult()
+	if result.kinds != "1tT2DCZ" || !reflect.DeepEqual(result.oids, []uint32{25, 701}) {
+		t.Errorf("Unexpected replies %q with types %v", result.kinds, result.oids)
+	}
+	if rows := textRows(result.rows); !reflect.DeepEqual(rows, [][]string{{"rex", "30.5"}}) || result.tags[0] != "SELECT 1" {
+		t.Errorf("Unexpected rows %q", rows)
+	}
+
+	// A placeholder takes the type it is cast to.
+	c.write('P', append([]byte("\x00SELECT $1::int + 1 AS n\x00"), 0, 0))
+	bind = []byte("\x00\x00\x00\x00\x00\x01")
+	bind = binary.BigEndian.AppendUint32(bind, 2)
+	bind = append(bind, "41"...)
+	c.write('B', binary.BigEndian.AppendUint16(bind, 0))
+	c.write('D', []byte("P\x00"))
+	c.write('E', []byte("\x00\x00\x00\x00\x00"))
+	c.write('S', nil)
+	result = c.readResult()
+	if rows := textRows(result.rows); !reflect.DeepEqual(rows, [][]string{{"42"}}) || !reflect.DeepEqual(result.oids, []uint32{20}) {
+		t.Errorf("Expected 42 as an INT, got %q %v %s", rows, result.oids, result.code)
+	}
+
+	// An error in the extended protocol skips messages up to Sync.
+	c.write('P', append([]byte("\x00SELEC 1\x00"), 0, 0))
+	c.write('B', []byte("\x00\x00\x00\x00\x00\x00\x00\x00"))
+	c.write('E', []byte("\x00\x00\x00\x00\x00"))
+	c.write('S', nil)
+	if result = c.readResult(); result.kinds != "EZ" || result.code != "42601" {
+		t.Errorf("Expected one error, got %q", result.kinds)
+	}
+
+	// Malformed list lengths and format counts are protocol violations,
+	// and the connection goes on.
+	threeColumns := []byte("\x00\x00")
+	threeColumns = binary.BigEndian.AppendUint16(threeColumns, 0) // Parameter formats
+	threeColumns = binary.BigEndian.AppendUint16(threeColumns, 0) // Parameters
+	threeColumns = binary.BigEndian.AppendUint16(threeColumns, 2) // Result formats
+	threeColumns = binary.BigEndian.AppendUint32(threeColumns, 0)
+	for name, messages := range map[string][][]byte{
+		"negative Parse count": {[]byte("P\x00SELECT 1\x00\xff\xff")},
+		"long Parse count":     {[]byte("P\x00SELECT 1\x00\x7f\xff")},
+		"long Bind count":      {[]byte("P\x00SELECT 1\x00\x00\x00"), []byte("B\x00\x00\x00\x00\x7f\xff")},
+		"parameter formats":    {[]byte("P\x00SELECT $1::int\x00\x00\x00"), []byte("B\x00\x00\x00\x02\x00\x00\x00\x00\x00\x01\x00\x00\x00\x01\x31\x00\x00")},
+		"result formats":       {[]byte("P\x00SELECT id, name, weight FROM pets\x00\x00\x00"), append([]byte("B"), threeColumns...)},
+	} {
+		for _, msg := range messages {
+			c.write(msg[0], msg[1:])
+		}
+		c.write('E', []byte("\x00\x00\x00\x00\x00"))
+		c.write('S', nil)
+		if result = c.readResult(); result.code != "08P01" || result.status != 'I' {
+			t.Errorf("%s: expected a protocol violation, got %q %s", name, result.kinds, result.code)
+		}
+	}
+	if result = c.query("SELECT 1"); !reflect.DeepEqual(textRows(result.rows), [][]string{{"1"}}) {
+		t.Errorf("Expected the connection to go on, got %q %s", result.kinds, result.code)
+	}
+
+	// Transaction blocks roll back and abort on errors.
+	if result = c.query("BEGIN; DELETE FROM pets"); result.status != 'T' || result.tags[1] != "DELETE 2" {
+		t.Errorf("Expected an open transaction, got %q", result.tags)
+	}
+	if result = c.query("SELECT nope FROM pets"); result.status != 'E' {
+		t.Errorf("Expected a failed transaction, got status %q", result.status)
+	}
+	if result = c.query("SELECT 1"); result.code != "25P02" {
+		t.Errorf("Expected commands to be rejected, got %q", result.code)
+	}
+	if result = c.query("COMMIT"); result.tags[0] != "ROLLBACK" || result.status != 'I' {
+		t.Errorf("Expected COMMIT to roll back, got %q", result.tags)
+	}
+	if result = c.query("SELECT COUNT(*) FROM pets"); textRows(result.rows)[0][0] != "2" {
+		t.Errorf("Expected the deletion to be rolled back, got %q", textRows(result.rows))
+	}
+
+	// A second client sees committed changes.
+	c.query("BEGIN; UPDATE pets SET name = 'max' WHERE id = 2; COMMIT")
+	other := dialPG(t, listener.Addr().String())
+	defer other.conn.Close()
+	if result = other.query("SELECT name FROM pets WHERE id = 2"); textRows(result.rows)[0][0] != "max" {
+		t.Errorf("Expected max, got %q", textRows(result.rows))
+	}
+
+	// Statements stop on the statement timeout and on cancel requests.
+	values := make([]string, 300)
+	for i := range values {
+		values[i] = fmt.Sprintf("(%d)", i)
+	}
+	c.query("CREATE TABLE numbers (n INT); INSERT INTO numbers VALUES " + strings.Join(values, ", "))
+	slow := "SELECT COUNT(*) FROM numbers a CROSS JOIN numbers b CROSS JOIN numbers c WHERE a.n + b.n + c.n < 0"
+	if result = c.query("SET statement_timeout = '20ms'"); result.tags[0] != "SET" {
+		t.Errorf("Unexpected SET reply %q %s", result.tags, result.code)
+	}
+	if result = c.query(slow); result.code != "57014" {
+		t.Errorf("Expected the statement timeout, got %q", result.code)
+	}
+	if result = c.query("SET statement_timeout = 0; SET client_encoding = 'UTF8'"); result.code != "" {
+		t.Errorf("Unexpected SET error %s", result.code)
+	}
+	if result = c.query("SET statement_timeout = 'soon'"); result.code == "" {
+		t.Errorf("Expected an invalid timeout to fail")
+	}
+	c.write('Q', append([]byte(slow), 0))
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			cancel, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return
+			}
+			request := binary.BigEndian.AppendUint32(nil, 80877102)
+			request = binary.BigEndian.AppendUint32(request, uint32(c.pid))
+			request = binary.BigEndian.AppendUint32(request, uint32(c.secret))
+			cancel.Write(append(binary.BigEndian.AppendUint32(nil, 16), request...))
+			cancel.Close()
+		}
+	}()
+	result = c.readResult()
+	close(stop)
+	if result.code != "57014" {
+		t.Errorf("Expected the query to be canceled, got %q", result.code)
+	}
+
+	other.write('X', nil)
+
+	// Clients may not use the server's files, but copy data through the
+	// connection.
+	path := filepath.Join(t.TempDir(), "pets.csv")
+	for _, sql := range []string{"COPY pets TO '" + path + "'", "COPY pets FROM '/etc/passwd'", "BACKUP TO '" + path + "'"} {
+		if result = c.query(sql); result.code != "42501" {
+			t.Errorf("Expected %q to be refused, got %q", sql, result.code)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected no file to be written")
+	}
+	if result = c.query("COPY pets (id, name) FROM STDIN"); result.kinds != "G" {
+		t.Fatalf("Expected CopyInResponse, got %q %s", result.kinds, result.code)
+	}
+	c.write('d', []byte("7,ann\n8,"))
+	c.write('d', []byte("bo\n"))
+	c.write('c', nil)
+	if result = c.readResult(); !reflect.DeepEqual(result.tags, []string{"COPY 2"}) {
+		t.Errorf("Expected COPY 2, got %q %s", result.tags, result.code)
+	}
+	c.query("COPY pets FROM STDIN")
+	c.write('f', append([]byte("client gave up"), 0))
+	if result = c.readResult(); result.code != "57014" {
+		t.Errorf("Expected the failed copy to be reported, got %q", result.code)
+	}
+	result = c.query("COPY (SELECT id, name FROM pets WHERE id > 6 ORDER BY id) TO STDOUT WITH (HEADER)")
+	if string(result.copied) != "id,name\n7,ann\n8,bo\n" || !strings.HasPrefix(result.kinds, "Hdddc") || result.tags[0] != "COPY 2" {
+		t.Errorf("Unexpected COPY TO STDOUT replies %q %q %q", result.kinds, result.copied, result.tags)
+	}
+}
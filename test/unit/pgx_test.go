@@ -0,0 +1,104 @@
+//go:build pgx
+
+// These tests talk to the server with pgx, over loopback. They need
+// github.com/jackc/pgx/v5 in the module, so they only build with the pgx
+// tag: go test -tags pgx ./test/unit
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/pgwire"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestPGX(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := pgwire.NewServer(engine.NewDatabase())
+	go server.Serve(listener)
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, "postgres://doggo@"+listener.Addr().String()+"/doggo?sslmode=disable")
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "CREATE TABLE pets (id INT PRIMARY KEY, name TEXT, weight FLOAT, good BOOL)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	for i, name := range []string{"rex", "tom", "o'brien"} {
+		tag, err := conn.Exec(ctx, "INSERT INTO pets VALUES ($1, $2, $3, $4)", i+1, name, float64(i)+0.5, i%2 == 0)
+		if err != nil || tag.String() != "INSERT 0 1" {
+			t.Fatalf("INSERT failed: %v %q", err, tag)
+		}
+	}
+
+	// Extended protocol, with the statement cached after the first run.
+	for i := 0; i < 2; i++ {
+		var name string
+		var weight float64
+		var good bool
+		if err := conn.QueryRow(ctx, "SELECT name, weight, good FROM pets WHERE id = $1", 3).Scan(&name, &weight, &good); err != nil || name != "o'brien" || weight != 2.5 || !good {
+			t.Errorf("Unexpected row %q %v %v (%v)", name, weight, good, err)
+		}
+	}
+	var n int64
+	if err := conn.QueryRow(ctx, "SELECT $1::int + 1", 41).Scan(&n); err != nil || n != 42 {
+		t.Errorf("Expected 42 from a cast placeholder, got %d (%v)", n, err)
+	}
+	rows, _ := conn.Query(ctx, "SELECT name FROM pets WHERE weight > $1 ORDER BY id", 1.0)
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil || strings.Join(names, ",") != "tom,o'brien" {
+		t.Errorf("Unexpected names %q (%v)", names, err)
+	}
+
+	// The simple protocol substitutes the values into the query text.
+	var name string
+	if err := conn.QueryRow(ctx, "SELECT name FROM pets WHERE id = $1", pgx.QueryExecModeSimpleProtocol, 1).Scan(&name); err != nil || name != "rex" {
+		t.Errorf("Expected rex with the simple protocol, got %q (%v)", name, err)
+	}
+
+	// Errors carry their SQLSTATE.
+	var pgErr *pgconn.PgError
+	if _, err := conn.Exec(ctx, "INSERT INTO pets VALUES ($1, 'dup', 1, TRUE)", 1); !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		t.Errorf("Expected a unique violation, got %v", err)
+	}
+
+	// Transactions.
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM pets"); err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if err := conn.QueryRow(ctx, "SELECT COUNT(*) FROM pets").Scan(&n); err != nil || n != 3 {
+		t.Errorf("Expected the rollback to keep 3 pets, got %d (%v)", n, err)
+	}
+
+	// COPY FROM STDIN and TO STDOUT.
+	tag, err := conn.PgConn().CopyFrom(ctx, strings.NewReader("4,bo,1.5,true\n5,cy,,false\n"), "COPY pets FROM STDIN")
+	if err != nil || tag.RowsAffected() != 2 {
+		t.Errorf("COPY FROM STDIN failed: %v %q", err, tag)
+	}
+	var out bytes.Buffer
+	if _, err := conn.PgConn().CopyTo(ctx, &out, "COPY (SELECT id, name FROM pets WHERE id > 3 ORDER BY id) TO STDOUT"); err != nil || out.String() != "4,bo\n5,cy\n" {
+		t.Errorf("Unexpected COPY TO STDOUT output %q (%v)", out.String(), err)
+	}
+}
@@ -1,6 +1,7 @@
 package test_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/H3199/doggodb/internal/data"
@@ -27,3 +28,18 @@ func TestRow(t *testing.T) {
 		t.Fatalf("expected false, got %v", value)
 	}
 }
+
+func TestOrderedRow(t *testing.T) {
+	row := data.CreateOrderedRow([]string{"name", "id"}, []interface{}{"Aliisa", 1})
+	if !reflect.DeepEqual(row.ColumnNames(), []string{"name", "id"}) {
+		t.Fatalf("expected columns [name id], got %v", row.ColumnNames())
+	}
+	if !reflect.DeepEqual(row.Values(), []interface{}{"Aliisa", 1}) {
+		t.Fatalf("expected values [Aliisa 1], got %v", row.Values())
+	}
+
+	unordered := data.CreateRow(map[string]interface{}{"name": "Aliisa", "id": 1})
+	if !reflect.DeepEqual(unordered.ColumnNames(), []string{"id", "name"}) {
+		t.Fatalf("expected columns sorted by name, got %v", unordered.ColumnNames())
+	}
+}
@@ -72,3 +72,40 @@ func TestTableOperations(t *testing.T) {
 		t.Errorf("Expected name 'Bob', got %s", name)
 	}
 }
+
+func TestTableAnalyze(t *testing.T) {
+	table := data.NewTable("scores", data.Column{Name: "id", Type: data.TypeInt}, data.Column{Name: "score", Type: data.TypeInt})
+	for i := 1; i <= 100; i++ {
+		values := map[string]interface{}{"id": i, "score": i % 10}
+		if i%4 == 0 {
+			values["score"] = nil
+		}
+		if err := table.Insert(data.CreateRow(values)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	if table.Stats() != nil {
+		t.Fatalf("Expected no statistics before Analyze")
+	}
+	stats := table.Analyze()
+	if stats.RowCount != 100 || table.Stats() != stats {
+		t.Fatalf("Expected stored statistics over 100 rows, got %+v", stats)
+	}
+
+	id := stats.Columns["id"]
+	if id.Distinct != 100 || id.NullFraction != 0 {
+		t.Errorf("Unexpected id statistics: %+v", id)
+	}
+	if len(id.Histogram) != data.HistogramBuckets+1 || id.Histogram[0] != int64(1) || id.Histogram[data.HistogramBuckets] != int64(100) {
+		t.Errorf("Unexpected id histogram: %v", id.Histogram)
+	}
+
+	score := stats.Columns["score"]
+	if score.NullFraction != 0.25 {
+		t.Errorf("Expected null fraction 0.25, got %v", score.NullFraction)
+	}
+	if score.Distinct != 10 {
+		t.Errorf("Expected 10 distinct scores, got %d", score.Distinct)
+	}
+}
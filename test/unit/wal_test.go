@@ -0,0 +1,205 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/H3199/doggodb/internal/engine"
+	"github.com/H3199/doggodb/internal/query"
+)
+
+func TestArchiveRecovery(t *testing.T) {
+	db := engine.NewDatabase()
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "wal")
+	ctx := context.Background()
+	if err := db.EnableArchive(archive); err != nil {
+		t.Fatalf("EnableArchive failed: %v", err)
+	}
+
+	session := db.Session()
+	defer session.Close()
+	exec := func(sql string, args ...interface{}) {
+		t.Helper()
+		p, err := session.Prepare(sql)
+		if err == nil {
+			_, err = session.Run(ctx, p, args...)
+		}
+		if err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	exec("CREATE TABLE pets (id INT PRIMARY KEY, name TEXT, weight FLOAT, tag ANY)")
+	exec("INSERT INTO pets VALUES (?, ?, ?, ?)", 1, "Rex", 12.0, "a")
+	exec("INSERT INTO pets VALUES (?, ?, ?, ?)", 2, []byte("Bo"), float32(0.5), "b")
+	exec("SELECT * FROM pets")
+	if lsn := db.LSN(); lsn != 3 {
+		t.Errorf("Expected WAL position 3, got %d", lsn)
+	}
+	backup := filepath.Join(dir, "base.sql")
+	exec("BACKUP TO '" + backup + "'")
+
+	// A transaction is one record and a rolled back one is not archived.
+	if err := session.Begin(ctx, false); err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	exec("UPDATE pets SET weight = weight * ? WHERE id = ?", 2.0, int8(1))
+	exec("DELETE FROM pets WHERE id = 2")
+	exec("INSERT INTO pets VALUES (?, ?, ?, ?)", 6, "Fay", float32(0.25), 2.0)
+	if err := session.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	session.Begin(ctx, false)
+	exec("INSERT INTO pets VALUES (99, 'Gone', 1, NULL)")
+	session.Rollback()
+	csv := filepath.Join(dir, "pets.csv")
+	os.WriteFile(csv, []byte("3,Cy,1.5,x\n"), 0o644)
+	exec("COPY pets FROM '" + csv + "'")
+	os.Remove(csv)
+	if lsn := db.LSN(); lsn != 5 {
+		t.Errorf("Expected WAL position 5, got %d", lsn)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := session.CopyFrom(ctx, "pets", strings.NewReader(`{"id": 4, "name": "Dee"}`), query.CopyOptions{Format: "ndjson"}); err != nil {
+		t.Fatalf("CopyFrom failed: %v", err)
+	}
+	if err := db.Restore(ctx, strings.NewReader("INSERT INTO pets (id, name) VALUES (5, 'Eve');")); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	rows := func(db *engine.Database) [][]interface{} {
+		t.Helper()
+		rs, err := db.Executor().Query("SELECT * FROM pets ORDER BY id")
+		if err != nil {
+			t.Fatalf("SELECT failed: %v", err)
+		}
+		var result [][]interface{}
+		for rs.Next() {
+			result = append(result, rs.Values())
+		}
+		return result
+	}
+	recoverTo := func(target engine.RecoveryTarget) *engine.Database {
+		t.Helper()
+		recovered, err := engine.Recover(ctx, backup, archive, target)
+		if err != nil {
+			t.Fatalf("Recover to %+v failed: %v", target, err)
+		}
+		return recovered
+	}
+
+	// Replaying the whole archive gives the database back.
+	recovered := recoverTo(engine.RecoveryTarget{})
+	if got, want := rows(recovered), rows(db); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if recovered.LSN() != 7 || recovered.ReadOnly() {
+		t.Errorf("Expected a writable database at position 7, got %d", recovered.LSN())
+	}
+
+	recovered = recoverTo(engine.RecoveryTarget{LSN: 4})
+	expected := [][]interface{}{{int64(1), "Rex", 24.0, "a"}, {int64(6), "Fay", 0.25, 2.0}}
+	if got := rows(recovered); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v at position 4, got %v", expected, got)
+	}
+	recovered = recoverTo(engine.RecoveryTarget{Time: cutoff})
+	expected = [][]interface{}{expected[0], {int64(3), "Cy", 1.5, "x"}, expected[1]}
+	if got := rows(recovered); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v before the cutoff, got %v", expected, got)
+	}
+	recovered = recoverTo(engine.RecoveryTarget{LSN: 3})
+	if got := rows(recovered); len(got) != 2 || got[1][1] != "Bo" {
+		t.Errorf("Expected the backup as it was, got %v", got)
+	}
+
+	// The recovered database cannot archive into the old directory, which
+	// holds the changes it left out.
+	if err := recovered.EnableArchive(archive); err == nil {
+		t.Errorf("Expected EnableArchive on an archive past the database to fail")
+	}
+	if err := recovered.EnableArchive(filepath.Join(dir, "wal2")); err != nil {
+		t.Errorf("EnableArchive on a new directory failed: %v", err)
+	}
+
+	if _, err := engine.Recover(ctx, backup, archive, engine.RecoveryTarget{LSN: 8}); err == nil || !strings.Contains(err.Error(), "WAL record 8 is missing") {
+		t.Errorf("Expected a missing record error, got %v", err)
+	}
+	if _, err := engine.Recover(ctx, backup, archive, engine.RecoveryTarget{LSN: 2}); err == nil {
+		t.Errorf("Expected recovering to before the backup to fail")
+	}
+	var dump bytes.Buffer
+	db.Dump(&dump)
+	os.WriteFile(filepath.Join(dir, "dump.sql"), dump.Bytes(), 0o644)
+	if _, err := engine.Recover(ctx, filepath.Join(dir, "dump.sql"), archive, engine.RecoveryTarget{}); err == nil {
+		t.Errorf("Expected recovering from a dump to fail")
+	}
+
+	// A record cut short by a crash is left out.
+	segments, _ := filepath.Glob(filepath.Join(archive, "*.wal"))
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, got %v", segments)
+	}
+	f, _ := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"lsn": 8, "entr`)
+	f.Close()
+	recovered = recoverTo(engine.RecoveryTarget{})
+	if recovered.LSN() != 7 {
+		t.Errorf("Expected recovery to stop at position 7, got %d", recovered.LSN())
+	}
+
+	// Archiving again after the crash drops the cut record, so that later
+	// recoveries read past it.
+	if err := recovered.EnableArchive(archive); err != nil {
+		t.Fatalf("EnableArchive after a crash failed: %v", err)
+	}
+	session = recovered.Session()
+	defer session.Close()
+	exec("INSERT INTO pets (id, name) VALUES (7, 'Gus')")
+	recovered = recoverTo(engine.RecoveryTarget{})
+	if got := rows(recovered); recovered.LSN() != 8 || len(got) != 6 || got[5][1] != "Gus" {
+		t.Errorf("Expected Gus at position 8, got %v at %d", got, recovered.LSN())
+	}
+}
+
+func TestArchiveFailure(t *testing.T) {
+	db := engine.NewDatabase()
+	ctx := context.Background()
+	session := db.Session()
+	defer session.Close()
+	run := func(sql string) (*query.ResultSet, error) {
+		p, err := session.Prepare(sql)
+		if err != nil {
+			return nil, err
+		}
+		return session.Run(ctx, p)
+	}
+	if _, err := run("CREATE TABLE pets (id INT, name TEXT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+
+	// A change that cannot be archived is undone, as a transaction's is, so
+	// that the database and the archive agree.
+	archive := filepath.Join(t.TempDir(), "wal")
+	if err := db.EnableArchive(archive); err != nil {
+		t.Fatalf("EnableArchive failed: %v", err)
+	}
+	os.RemoveAll(archive)
+	if _, err := run("INSERT INTO pets VALUES (1, 'Rex')"); err == nil || !strings.Contains(err.Error(), "failed to archive WAL") {
+		t.Errorf("Expected the archive to fail, got %v", err)
+	}
+	rs, err := run("SELECT COUNT(*) FROM pets")
+	if err != nil || !rs.Next() || rs.Values()[0] != int64(0) {
+		t.Errorf("Expected the insert to be undone, got %v (%v)", rs.Values(), err)
+	}
+	if db.LSN() != 0 {
+		t.Errorf("Expected nothing archived, got position %d", db.LSN())
+	}
+}